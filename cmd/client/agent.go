@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+)
+
+// The agent is a long-running client that other client processes, the
+// shims, hand their jobs to over a Unix socket. A shim passes its stdin,
+// stdout and stderr as file descriptors, then sends an agentRequest. While
+// the job runs it may send an agentMessage to cancel it, and the agent
+// replies with one carrying the exit code when the job ends.
+
+var errAgentUnsupported = errors.New("the agent is not supported on this OS")
+
+// agentRequest is the job a shim hands to the agent.
+type agentRequest struct {
+	Program string   `json:"program"`
+	Args    []string `json:"args"`
+	Dir     string   `json:"dir"`
+	Env     []string `json:"env"`
+}
+
+// agentMessage is sent by either side while a job runs.
+type agentMessage struct {
+	Cancel   bool `json:"cancel,omitempty"`
+	ExitCode *int `json:"exitCode,omitempty"`
+}
+
+// runShim hands the job to the agent listening on cfg.AgentSocket and
+// returns its exit code. It returns false if no agent is running, and the
+// client runs the job itself.
+func runShim(cfg *config.ClientConfig, program string, args []string) (int, bool) {
+	if !agentSupported {
+		return 0, false
+	}
+	conn, err := net.Dial("unix", cfg.AgentSocket)
+	if err != nil {
+		log.Printf("agent not available, running the job directly: %v", err)
+		return 0, false
+	}
+	defer conn.Close()
+
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Printf("agent not used, running the job directly: %v", err)
+		return 0, false
+	}
+	if err := sendStdio(conn.(*net.UnixConn), os.Stdin, os.Stdout, os.Stderr); err != nil {
+		log.Printf("agent not used, running the job directly: %v", err)
+		return 0, false
+	}
+	enc := json.NewEncoder(conn)
+	req := &agentRequest{Program: program, Args: args, Dir: dir, Env: os.Environ()}
+	if err := enc.Encode(req); err != nil {
+		log.Printf("agent not used, running the job directly: %v", err)
+		return 0, false
+	}
+
+	// Signal handler (Ctrl-C)
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		enc.Encode(&agentMessage{Cancel: true})
+	}()
+
+	var result agentMessage
+	if err := json.NewDecoder(conn).Decode(&result); err != nil || result.ExitCode == nil {
+		log.Printf("lost the connection to the agent: %v", err)
+		fmt.Fprintf(os.Stderr, "ffmpeg-over-ip: lost the connection to the agent\n")
+		return 1, true
+	}
+	return *result.ExitCode, true
+}
+
+// runAgent runs the jobs that shims hand over on cfg.AgentSocket, until
+// interrupted.
+func runAgent(cfg *config.ClientConfig) {
+	if !agentSupported {
+		log.Fatal(errAgentUnsupported)
+	}
+	if cfg.AgentSocket == "" {
+		log.Fatal("config: agentSocket is required to run the agent")
+	}
+
+	// A socket left behind by an agent that did not shut down is replaced,
+	// but not one that an agent still listens on
+	if conn, err := net.Dial("unix", cfg.AgentSocket); err == nil {
+		conn.Close()
+		log.Fatalf("an agent is already listening on %s", cfg.AgentSocket)
+	}
+	os.Remove(cfg.AgentSocket)
+	ln, err := listenAgent(cfg.AgentSocket)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %v", cfg.AgentSocket, err)
+	}
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Printf("received %v, shutting down", sig)
+		ln.Close()
+	}()
+
+	p := newPool(cfg)
+	go p.warm()
+	log.Printf("agent listening on %s", cfg.AgentSocket)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// Closing the listener removes the socket
+				return
+			}
+			log.Printf("accept error: %v", err)
+			continue
+		}
+		go serveShim(cfg, p, conn.(*net.UnixConn))
+	}
+}
+
+// serveShim runs the job a shim hands over on conn.
+func serveShim(cfg *config.ClientConfig, p *pool, conn *net.UnixConn) {
+	defer conn.Close()
+
+	stdio, err := receiveStdio(conn)
+	if err != nil {
+		log.Printf("agent: failed to receive stdio: %v", err)
+		return
+	}
+	defer closeStdio(stdio)
+	dec := json.NewDecoder(conn)
+	var req agentRequest
+	if err := dec.Decode(&req); err != nil {
+		log.Printf("agent: failed to read job: %v", err)
+		return
+	}
+
+	j := newJob(cfg, req.Program, req.Args)
+	j.environ = req.Env
+	j.dir = req.Dir
+	j.stdin, j.stdout, j.stderr = stdio[0], stdio[1], stdio[2]
+	j.dial = p.dial
+
+	// The shim cancels the job on Ctrl-C, or by going away
+	go func() {
+		for {
+			var msg agentMessage
+			if err := dec.Decode(&msg); err != nil || msg.Cancel {
+				j.cancel()
+				return
+			}
+		}
+	}()
+
+	code := j.run()
+	json.NewEncoder(conn).Encode(&agentMessage{ExitCode: &code})
+}
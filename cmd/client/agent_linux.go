@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// reopenNonblock opens a new, non-blocking file description of what fd
+// refers to. Sockets cannot be reopened. A terminal does not become the
+// agent's controlling terminal.
+func reopenNonblock(fd int) (*os.File, error) {
+	return os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fd), os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOCTTY, 0)
+}
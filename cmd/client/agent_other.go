@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// Passing file descriptors between processes needs Unix sockets, so
+// there is no agent on this OS and the client always runs jobs itself.
+const agentSupported = false
+
+func listenAgent(path string) (net.Listener, error) {
+	return nil, errAgentUnsupported
+}
+
+func sendStdio(conn *net.UnixConn, stdin, stdout, stderr *os.File) error {
+	return errAgentUnsupported
+}
+
+func receiveStdio(conn *net.UnixConn) ([]*os.File, error) {
+	return nil, errAgentUnsupported
+}
+
+func closeStdio(files []*os.File) {}
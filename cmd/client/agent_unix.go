@@ -0,0 +1,87 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+const agentSupported = true
+
+// listenAgent listens on the agent's socket. Only this user may connect,
+// since whoever can runs jobs with the agent's secret and files.
+func listenAgent(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+// sendStdio passes the shim's stdin, stdout and stderr to the agent.
+func sendStdio(conn *net.UnixConn, stdin, stdout, stderr *os.File) error {
+	rights := syscall.UnixRights(int(stdin.Fd()), int(stdout.Fd()), int(stderr.Fd()))
+	_, _, err := conn.WriteMsgUnix([]byte{0}, rights, nil)
+	return err
+}
+
+// receiveStdio receives a shim's stdin, stdout and stderr.
+func receiveStdio(conn *net.UnixConn) ([]*os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(3*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, msg := range msgs {
+		if rights, err := syscall.ParseUnixRights(&msg); err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	for _, fd := range fds {
+		// Not inherited by the local programs of other jobs
+		syscall.CloseOnExec(fd)
+	}
+	if len(fds) != 3 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("expected 3 file descriptors, got %d", len(fds))
+	}
+
+	return []*os.File{
+		openStdin(fds[0]),
+		os.NewFile(uintptr(fds[1]), "stdout"),
+		os.NewFile(uintptr(fds[2]), "stderr"),
+	}, nil
+}
+
+// openStdin returns the shim's stdin. Its file description is shared with
+// the shim's caller, so its flags are left alone: a pipe or terminal is
+// reopened as a description of the agent's own, which is non-blocking so
+// that closing it ends a read once the job is over. Where that is not
+// possible, a read still waiting when the job ends takes what arrives next.
+func openStdin(fd int) *os.File {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err == nil && st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		// Reopening a regular file would start it over, and its reads do
+		// not wait anyway
+		if f, err := reopenNonblock(fd); err == nil {
+			syscall.Close(fd)
+			return f
+		}
+	}
+	return os.NewFile(uintptr(fd), "stdin")
+}
+
+// closeStdio closes what receiveStdio returned.
+func closeStdio(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
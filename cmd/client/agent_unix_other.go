@@ -0,0 +1,14 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reopenNonblock would open a new file description of what fd refers to,
+// but /dev/fd on these systems duplicates fd instead, sharing its flags.
+func reopenNonblock(fd int) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
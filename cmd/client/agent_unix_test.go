@@ -0,0 +1,236 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/pkg/server"
+)
+
+func TestMain(m *testing.M) {
+	// Jobs with resource limits re-execute the test binary as the launch helper
+	server.HelperMain()
+	os.Exit(m.Run())
+}
+
+// startServer serves jobs with /bin/sh as ffmpeg on a local port, and
+// returns the client config for it.
+func startServer(t *testing.T) *config.ClientConfig {
+	t.Helper()
+	srv, err := server.New(&server.Config{AuthSecret: "secret"}, server.Options{FFmpegPath: "/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.Serve(ctx, ln)
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+	})
+
+	// The failure cache stays out of the user's cache directory
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	return &config.ClientConfig{Address: ln.Addr().String(), AuthSecret: "secret"}
+}
+
+// testShim is the shim's side of a job handed to serveShim, with pipes for
+// the stdio it passes.
+type testShim struct {
+	conn   *net.UnixConn
+	stdin  *os.File // read end, as passed to the agent
+	input  *os.File // write end of stdin
+	stdout *bufio.Reader
+	stderr *bufio.Reader
+	done   chan struct{} // closed when serveShim returns
+}
+
+// startShim hands the job to serveShim as runShim does.
+func startShim(t *testing.T, cfg *config.ClientConfig, p *pool, args ...string) *testShim {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shimConn := unixConn(t, fds[0])
+	agentConn := unixConn(t, fds[1])
+
+	stdin, input := pipe(t)
+	stdout, stdoutW := pipe(t)
+	stderr, stderrW := pipe(t)
+	if err := sendStdio(shimConn, stdin, stdoutW, stderrW); err != nil {
+		t.Fatal(err)
+	}
+	// The agent has its own copies, so output ends when it closes them
+	stdoutW.Close()
+	stderrW.Close()
+	req := &agentRequest{Program: "ffmpeg", Args: args, Dir: t.TempDir()}
+	if err := json.NewEncoder(shimConn).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testShim{
+		conn:   shimConn,
+		stdin:  stdin,
+		input:  input,
+		stdout: bufio.NewReader(stdout),
+		stderr: bufio.NewReader(stderr),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		serveShim(cfg, p, agentConn)
+		close(s.done)
+	}()
+	t.Cleanup(func() {
+		shimConn.Close()
+		input.Close()
+		<-s.done
+	})
+	return s
+}
+
+func unixConn(t *testing.T, fd int) *net.UnixConn {
+	t.Helper()
+	f := os.NewFile(uintptr(fd), "socket")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*net.UnixConn)
+}
+
+func pipe(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	return r, w
+}
+
+// readLine reads a line of the job's output, failing the test if there is
+// none within a few seconds.
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line := make(chan string, 1)
+	go func() {
+		s, _ := r.ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		return s
+	case <-time.After(10 * time.Second):
+		t.Fatal("no output from the job")
+		return ""
+	}
+}
+
+// result reads the exit code the agent reports.
+func (s *testShim) result(t *testing.T) int {
+	t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var msg agentMessage
+	if err := json.NewDecoder(s.conn).Decode(&msg); err != nil {
+		t.Fatalf("failed to read the result: %v", err)
+	}
+	if msg.ExitCode == nil {
+		t.Fatalf("result %+v has no exit code", msg)
+	}
+	return *msg.ExitCode
+}
+
+func nonblocking(t *testing.T, f *os.File) bool {
+	t.Helper()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags uintptr
+	rc.Control(func(fd uintptr) {
+		flags, _, _ = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	})
+	return flags&syscall.O_NONBLOCK != 0
+}
+
+func TestAgentRunsJob(t *testing.T) {
+	cfg := startServer(t)
+	p := newPool(cfg)
+	s := startShim(t, cfg, p, "-c", `read line; echo "$line"; cat; echo "done" >&2; exit 3`)
+
+	s.input.WriteString("first\n")
+	if got := readLine(t, s.stdout); got != "first\n" {
+		t.Errorf("stdout = %q, want %q", got, "first\n")
+	}
+	// The agent reads the stdin it was passed without changing the flags
+	// it shares with the shim's caller
+	if nonblocking(t, s.stdin) {
+		t.Error("the shim's stdin was made non-blocking")
+	}
+	s.input.WriteString("second\n")
+	s.input.Close()
+	if got := readLine(t, s.stdout); got != "second\n" {
+		t.Errorf("stdout = %q, want %q", got, "second\n")
+	}
+	if got := readLine(t, s.stderr); got != "done\n" {
+		t.Errorf("stderr = %q, want %q", got, "done\n")
+	}
+	if code := s.result(t); code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+
+	// The job ran on a stream of the pool's connection
+	if p.servers[cfg.Address] == nil || p.servers[cfg.Address].conn == nil {
+		t.Error("the pool has no multiplexed connection to the server")
+	}
+}
+
+func TestAgentCancel(t *testing.T) {
+	cfg := startServer(t)
+	s := startShim(t, cfg, newPool(cfg), "-c", "echo started; exec sleep 30")
+	readLine(t, s.stdout)
+
+	if err := json.NewEncoder(s.conn).Encode(&agentMessage{Cancel: true}); err != nil {
+		t.Fatal(err)
+	}
+	if code := s.result(t); code == 0 {
+		t.Error("exit code = 0, want the cancelled job's")
+	}
+}
+
+func TestAgentCancelWhenShimLeaves(t *testing.T) {
+	cfg := startServer(t)
+	s := startShim(t, cfg, newPool(cfg), "-c", "echo started; exec sleep 30")
+	readLine(t, s.stdout)
+
+	s.conn.Close()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job still running after the shim went away")
+	}
+	// The program is gone, so its output has ended
+	if _, err := s.stdout.ReadString('\n'); err != io.EOF {
+		t.Errorf("stdout read error = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+)
+
+// openCapture creates the file to record the job's messages to, if the
+// client config or the invocation's environment asks for it. A target that
+// is a directory gets a new file for each job. Failing to record does not
+// fail the job.
+func (j *job) openCapture() *os.File {
+	target := j.cfg.Capture
+	if v, ok := j.lookupEnv("FFMPEG_OVER_IP_CLIENT_CAPTURE"); ok {
+		target = v
+	}
+	if target == "" {
+		return nil
+	}
+	if !filepath.IsAbs(target) && j.dir != "" {
+		target = filepath.Join(j.dir, target)
+	}
+
+	var f *os.File
+	var err error
+	if info, statErr := os.Stat(target); statErr == nil && info.IsDir() {
+		f, err = os.CreateTemp(target, j.program+"-*.ffcap")
+	} else {
+		f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		log.Printf("failed to create capture: %v", err)
+		return nil
+	}
+	log.Printf("recording the job to %s", f.Name())
+	return f
+}
+
+// inspect prints a readable trace of the capture file at path.
+func inspect(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return capture.Inspect(out, f)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/failover"
+	"github.com/steelbrain/ffmpeg-over-ip/pkg/client"
+)
+
+// job is one run of a program: what the client does for each invocation,
+// either itself or in the agent on behalf of a shim.
+type job struct {
+	cfg     *config.ClientConfig
+	program string
+	args    []string
+	environ []string // the invocation's environment; nil for this process's
+	dir     string   // working directory of the invocation; "" for this process's
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+
+	// dial connects to a server; a new TCP connection when nil
+	dial func(address string) (net.Conn, error)
+	// exec lets a local fallback replace this process
+	exec bool
+
+	ctx    context.Context
+	cancel context.CancelFunc // asks the program to stop, as Ctrl-C would
+}
+
+func newJob(cfg *config.ClientConfig, program string, args []string) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &job{
+		cfg:     cfg,
+		program: program,
+		args:    args,
+		stdin:   os.Stdin,
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// lookupEnv looks up an environment variable of the invocation.
+func (j *job) lookupEnv(name string) (string, bool) {
+	if j.environ == nil {
+		return os.LookupEnv(name)
+	}
+	for _, kv := range j.environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// forwardedEnv returns the configured environment variables that are set
+// for the invocation.
+func (j *job) forwardedEnv() []string {
+	var env []string
+	for _, name := range j.cfg.ForwardEnv {
+		if value, ok := j.lookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// fail reports an error that ends the job before it has started on
+// stderr, where the calling application shows it with ffmpeg's output, and
+// returns code.
+func (j *job) fail(code int, format string, args ...any) int {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	fmt.Fprintf(j.stderr, "ffmpeg-over-ip: %s\n", msg)
+	return code
+}
+
+// run runs the job and returns its exit code.
+func (j *job) run() int {
+	opts := client.Options{
+		AuthSecret:           j.cfg.AuthSecret,
+		Program:              j.program,
+		Args:                 j.args,
+		Env:                  j.forwardedEnv(),
+		Profile:              j.cfg.Profile,
+		Stdin:                j.stdin,
+		Stdout:               j.stdout,
+		Stderr:               j.stderr,
+		FS:                   client.LocalFS(j.dir),
+		ConnectTimeout:       time.Duration(j.cfg.ConnectTimeout),
+		HandshakeTimeout:     time.Duration(j.cfg.HandshakeTimeout),
+		FirstResponseTimeout: time.Duration(j.cfg.FirstResponseTimeout),
+		FailureCache:         failover.DefaultCachePath(),
+	}
+	for _, s := range j.cfg.ServerList() {
+		opts.Servers = append(opts.Servers, client.Server{Address: s.Address, Priority: s.Priority, Weight: s.Weight})
+	}
+	if j.dial != nil {
+		opts.Dial = func(ctx context.Context, address string) (net.Conn, error) {
+			return j.dial(address)
+		}
+	}
+	if path, ok := j.cfg.LocalFallback[j.program]; ok {
+		opts.Fallback = func(ctx context.Context, stdin io.Reader, err error) (int, error) {
+			log.Printf("%v, running %s locally", err, path)
+			return j.runLocal(path, stdin), nil
+		}
+	}
+
+	sink := j.progressSink()
+	defer sink.close()
+	if sink.target != "" {
+		opts.Progress = sink.write
+	}
+	if f := j.openCapture(); f != nil {
+		defer f.Close()
+		opts.Capture = f
+	}
+
+	code, err := client.Run(j.ctx, opts)
+	var serverErr *client.ServerError
+	var connErr *client.ConnectionError
+	switch {
+	case err == nil:
+	case errors.As(err, &serverErr):
+		// After the program's output, as the server sent it
+		fmt.Fprintln(j.stderr, err)
+	case errors.As(err, &connErr), errors.Is(err, context.Canceled):
+		log.Print(err)
+	default:
+		j.fail(code, "%v", err)
+	}
+	return code
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var errExecUnsupported = errors.New("exec is not supported")
+
+// runLocal runs the program's local fallback binary with the job's
+// arguments and output, and stdin, and returns its exit code. If stdin is
+// the job's own, not read from yet, and the job may replace the client,
+// the client replaces itself with the binary where the OS allows it;
+// otherwise the binary runs as a child.
+func (j *job) runLocal(path string, stdin io.Reader) int {
+	// Names without a separator are looked up in PATH, others are
+	// relative to the job's directory
+	if j.dir != "" && !filepath.IsAbs(path) && strings.ContainsAny(path, `/\`) {
+		path = filepath.Join(j.dir, path)
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return j.fail(1, "local fallback: %v", err)
+	}
+	if isSelf(resolved) {
+		return j.fail(1, "local fallback: %s is this client, not ffmpeg", resolved)
+	}
+
+	if j.exec && stdin == j.stdin {
+		err := execLocal(resolved, j.args)
+		if err != errExecUnsupported {
+			return j.fail(1, "local fallback: %v", err)
+		}
+	}
+
+	cmd := exec.Command(resolved, j.args...)
+	cmd.Dir = j.dir
+	cmd.Env = j.environ
+	cmd.Stdout = j.stdout
+	cmd.Stderr = j.stderr
+	var pipe io.WriteCloser
+	if stdin == j.stdin {
+		cmd.Stdin = j.stdin
+	} else if pipe, err = cmd.StdinPipe(); err != nil {
+		return j.fail(1, "local fallback: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return j.fail(1, "local fallback: %v", err)
+	}
+	if pipe != nil {
+		// Copied here rather than by cmd, whose Wait would wait for the
+		// copy, although stdin may not end when the child does
+		go func() {
+			io.Copy(pipe, stdin)
+			pipe.Close()
+		}()
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-j.ctx.Done():
+			if err := cmd.Process.Signal(os.Interrupt); err != nil {
+				cmd.Process.Kill()
+			}
+		case <-exited:
+		}
+	}()
+
+	cmd.Wait()
+	code := cmd.ProcessState.ExitCode()
+	if code < 0 {
+		// Killed by a signal, which a shell reports as 128+signal
+		code = 1
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+	}
+	return code
+}
+
+// isSelf reports whether path is the running client, as it is when the
+// client is installed as "ffmpeg" and the fallback is looked up in PATH.
+func isSelf(path string) bool {
+	exe, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	a, errA := filepath.EvalSymlinks(exe)
+	b, errB := filepath.EvalSymlinks(path)
+	return errA == nil && errB == nil && a == b
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// execLocal is not possible on this OS; the caller runs the binary as a
+// child instead.
+func execLocal(path string, args []string) error {
+	return errExecUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// execLocal replaces the client with the binary at path. It only returns
+// on error.
+func execLocal(path string, args []string) error {
+	return syscall.Exec(path, append([]string{path}, args...), os.Environ())
+}
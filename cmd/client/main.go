@@ -1,37 +1,24 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync/atomic"
 	"syscall"
-	"time"
 
-	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
-	"github.com/steelbrain/ffmpeg-over-ip/internal/filehandler"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
-	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
-)
-
-const (
-	keepaliveSendInterval = 30 * time.Second
-	keepaliveRecvTimeout  = 150 * time.Second
 )
 
 func main() {
-	// Detect program from argv[0]
-	program := protocol.ProgramFFmpeg
-	if strings.Contains(filepath.Base(os.Args[0]), "ffprobe") {
-		program = protocol.ProgramFFprobe
+	// The program to run is the name we were invoked as, so a symlink named
+	// after any program in the server's registry runs that program
+	program := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if len(program) > protocol.MaxProgramLength {
+		log.Fatalf("program name is longer than %d bytes: %s", protocol.MaxProgramLength, program)
 	}
 
 	// All args go to ffmpeg — no --config flag
@@ -46,6 +33,12 @@ func main() {
 			return
 		}
 	}
+	if len(args) == 2 && args[0] == "--inspect" {
+		if err := inspect(args[1]); err != nil {
+			log.Fatalf("failed to inspect %s: %v", args[1], err)
+		}
+		return
+	}
 
 	// Load config
 	cfg, err := config.LoadClientConfig("")
@@ -55,142 +48,29 @@ func main() {
 
 	config.SetupLogging(cfg.Log)
 
-	// Connect to server
-	network, addr := config.ParseAddress(cfg.Address)
-	conn, err := net.Dial(network, addr)
-	if err != nil {
-		log.Fatalf("failed to connect to %s: %v", addr, err)
+	// Run as the agent, which takes jobs from other client processes
+	if len(args) == 1 && args[0] == "--agent" {
+		runAgent(cfg)
+		return
 	}
-	defer conn.Close()
 
-	// Generate nonce
-	var nonce [protocol.NonceLength]byte
-	if _, err := rand.Read(nonce[:]); err != nil {
-		log.Fatalf("failed to generate nonce: %v", err)
-	}
-
-	// Sign and send command
-	sig := auth.Sign(cfg.AuthSecret, protocol.CurrentVersion, nonce, program, args)
-	cmd := &protocol.CommandMessage{
-		Nonce:     nonce,
-		Signature: sig,
-		Program:   program,
-		Args:      args,
-	}
-	if err := protocol.WriteMessageTo(conn, protocol.MsgCommand, cmd.Encode()); err != nil {
-		log.Fatalf("failed to send command: %v", err)
+	// Hand the job to the agent if one is running
+	if cfg.AgentSocket != "" {
+		if code, ok := runShim(cfg, program, args); ok {
+			os.Exit(code)
+		}
 	}
 
-	// Set up serialized writer for concurrent TCP writes
-	w := session.NewWriter(conn)
-
-	// Track last received message for keepalive
-	var lastRecv atomic.Int64
-	lastRecv.Store(time.Now().UnixNano())
-
-	// Exit code channel — set when MsgExitCode is received
-	exitCh := make(chan int, 1)
-
-	// Stdin forwarding
-	go func() {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := os.Stdin.Read(buf)
-			if n > 0 {
-				w.WriteMessage(protocol.MsgStdin, buf[:n])
-			}
-			if err != nil {
-				w.WriteMessage(protocol.MsgStdinClose, nil)
-				return
-			}
-		}
-	}()
+	j := newJob(cfg, program, args)
+	j.exec = true
 
 	// Signal handler (Ctrl-C)
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
-
-		w.WriteMessage(protocol.MsgCancel, nil)
-
-		// Wait for exit code with timeout
-		select {
-		case <-exitCh:
-		case <-time.After(5 * time.Second):
-		}
-		conn.Close()
-		os.Exit(1)
-	}()
-
-	// Keepalive
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			if time.Since(w.LastSendTime()) >= keepaliveSendInterval {
-				w.WriteMessage(protocol.MsgPing, nil)
-			}
-			lr := time.Unix(0, lastRecv.Load())
-			if time.Since(lr) >= keepaliveRecvTimeout {
-				log.Printf("server keepalive timeout")
-				conn.Close()
-				os.Exit(1)
-			}
-		}
+		j.cancel()
 	}()
 
-	// File handler for I/O requests
-	handler := filehandler.NewHandler()
-	defer handler.CloseAll()
-
-	// Message loop (main goroutine)
-	for {
-		msg, err := protocol.ReadMessageFrom(conn)
-		if err != nil {
-			if err == io.EOF {
-				log.Fatal("server closed connection")
-			}
-			log.Fatalf("read error: %v", err)
-		}
-
-		lastRecv.Store(time.Now().UnixNano())
-
-		switch {
-		case protocol.IsFileIORequest(msg.Type):
-			respType, respPayload, err := handler.HandleMessage(msg.Type, msg.Payload)
-			if err != nil {
-				log.Printf("file handler error: %v", err)
-				continue
-			}
-			w.WriteMessage(respType, respPayload)
-
-		case msg.Type == protocol.MsgStdout:
-			os.Stdout.Write(msg.Payload)
-
-		case msg.Type == protocol.MsgStderr:
-			os.Stderr.Write(msg.Payload)
-
-		case msg.Type == protocol.MsgExitCode:
-			code := int(binary.BigEndian.Uint32(msg.Payload))
-			select {
-			case exitCh <- code:
-			default:
-			}
-			os.Exit(code)
-
-		case msg.Type == protocol.MsgError:
-			fmt.Fprintf(os.Stderr, "server error: %s\n", string(msg.Payload))
-			os.Exit(1)
-
-		case msg.Type == protocol.MsgPing:
-			w.WriteMessage(protocol.MsgPong, msg.Payload)
-
-		case msg.Type == protocol.MsgPong:
-			// keepalive response, nothing to do (lastRecv already updated)
-
-		default:
-			log.Printf("unknown message type 0x%02x, ignoring", msg.Type)
-		}
-	}
+	os.Exit(j.run())
 }
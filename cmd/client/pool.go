@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/failover"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/mux"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/pkg/client"
+)
+
+// errNoMux is a server that does not support multiplexed connections.
+var errNoMux = errors.New("server does not support multiplexing")
+
+// pool keeps a multiplexed connection open to each server for the agent,
+// so that its jobs start without connecting and authenticating first.
+type pool struct {
+	cfg *config.ClientConfig
+
+	mu      sync.Mutex
+	servers map[string]*pooledServer
+}
+
+type pooledServer struct {
+	mu    sync.Mutex // held while connecting
+	conn  *mux.Conn
+	plain bool // the server does not multiplex, so each job connects itself
+}
+
+func newPool(cfg *config.ClientConfig) *pool {
+	return &pool{cfg: cfg, servers: make(map[string]*pooledServer)}
+}
+
+// warm connects to every server ahead of the first job.
+func (p *pool) warm() {
+	for _, s := range p.cfg.ServerList() {
+		go func() {
+			if _, err := p.get(s.Address); err != nil && !errors.Is(err, errNoMux) {
+				log.Printf("agent: cannot connect to %s yet: %v", s.Address, err)
+			}
+		}()
+	}
+}
+
+// dial opens a stream for a job on the connection to the server at
+// address, connecting first if there is no connection.
+func (p *pool) dial(address string) (net.Conn, error) {
+	// A connection that broke since its last job may only show when
+	// opening a stream fails, so that is tried once more on a new one
+	for attempt := 0; ; attempt++ {
+		m, err := p.get(address)
+		if errors.Is(err, errNoMux) {
+			return failover.Dial(context.Background(), address, time.Duration(p.cfg.ConnectTimeout))
+		}
+		if err != nil {
+			return nil, err
+		}
+		stream, err := m.Open()
+		if err == nil || attempt > 0 {
+			return stream, err
+		}
+	}
+}
+
+// get returns the open connection to the server at address, connecting if
+// there is none.
+func (p *pool) get(address string) (*mux.Conn, error) {
+	p.mu.Lock()
+	s := p.servers[address]
+	if s == nil {
+		s = &pooledServer{}
+		p.servers[address] = s
+	}
+	p.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.plain {
+		return nil, errNoMux
+	}
+	if s.conn != nil {
+		select {
+		case <-s.conn.Done():
+			log.Printf("agent: connection to %s closed: %v", address, s.conn.Err())
+			s.conn = nil
+		default:
+			return s.conn, nil
+		}
+	}
+	m, err := p.connect(address)
+	if errors.Is(err, errNoMux) {
+		log.Printf("agent: %s does not support multiplexing, jobs connect to it separately", address)
+		s.plain = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.conn = m
+	return m, nil
+}
+
+// connect opens an authenticated multiplexed connection to a server.
+func (p *pool) connect(address string) (*mux.Conn, error) {
+	conn, err := failover.Dial(context.Background(), address, time.Duration(p.cfg.ConnectTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &protocol.MuxMessage{}
+	if _, err := rand.Read(req.Nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Signature = auth.SignMux(p.cfg.AuthSecret, protocol.CurrentVersion, req.Nonce)
+
+	timeout := time.Duration(p.cfg.HandshakeTimeout)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	err = protocol.WriteMessageTo(conn, protocol.MsgMux, req.Encode())
+	var reply *protocol.Message
+	if err == nil {
+		reply, err = protocol.ReadMessageFrom(conn)
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = &client.TimeoutError{Step: "opening a multiplexed connection", Timeout: timeout, Code: client.ExitHandshakeTimeout}
+		}
+		return nil, err
+	}
+
+	switch reply.Type {
+	case protocol.MsgMuxOk:
+		m := mux.Client(conn)
+		go m.Keepalive(client.KeepaliveInterval, client.KeepaliveTimeout)
+		log.Printf("agent: connected to %s", address)
+		return m, nil
+	case protocol.MsgError:
+		conn.Close()
+		// Servers from before multiplexing speak an older protocol version,
+		// and run no jobs for this client either way
+		if string(reply.Payload) == protocol.ErrNoMux {
+			return nil, errNoMux
+		}
+		return nil, fmt.Errorf("server error: %s", reply.Payload)
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected reply 0x%02x", reply.Type)
+	}
+}
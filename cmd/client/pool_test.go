@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/mux"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// refusingServer answers multiplexed connections with the error reply,
+// and reports the type of the first message of every connection.
+func refusingServer(t *testing.T, reply string) (string, <-chan uint8) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	first := make(chan uint8, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				msg, err := protocol.ReadMessageFrom(conn)
+				if err != nil {
+					return
+				}
+				first <- msg.Type
+				if msg.Type == protocol.MsgMux {
+					protocol.WriteMessageTo(conn, protocol.MsgError, []byte(reply))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), first
+}
+
+func TestPoolWithoutMux(t *testing.T) {
+	address, first := refusingServer(t, protocol.ErrNoMux)
+	p := newPool(&config.ClientConfig{Address: address, AuthSecret: "secret"})
+
+	for i := range 2 {
+		conn, err := p.dial(address)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		if _, stream := conn.(*mux.Stream); stream {
+			t.Fatalf("dial %d: got a multiplexed stream", i)
+		}
+		protocol.WriteMessageTo(conn, protocol.MsgCommand, nil)
+		conn.Close()
+	}
+
+	// Only the first job asks for multiplexing; both connect themselves
+	want := []uint8{protocol.MsgMux, protocol.MsgCommand, protocol.MsgCommand}
+	for i, w := range want {
+		if got := <-first; got != w {
+			t.Errorf("connection %d: first message 0x%02x, want 0x%02x", i, got, w)
+		}
+	}
+}
+
+func TestPoolMuxRefused(t *testing.T) {
+	address, _ := refusingServer(t, "authentication failed")
+	p := newPool(&config.ClientConfig{Address: address, AuthSecret: "secret"})
+
+	_, err := p.dial(address)
+	if err == nil || errors.Is(err, errNoMux) || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("dial error = %v, want the server's", err)
+	}
+	if p.servers[address].plain {
+		t.Error("server marked as not multiplexing")
+	}
+}
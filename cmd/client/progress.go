@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// progressSink writes the progress reports a server sends for a job, one
+// JSON object per line, to the target set by the client config or the
+// invocation's environment. It is opened with the first report, and gives
+// up on the first error, since losing progress must not fail the job.
+type progressSink struct {
+	target string // "stderr", "unix:" and a socket path, a file path, or "" for none
+	stderr io.Writer
+	dir    string // for relative file paths; "" for this process's working directory
+
+	w      io.Writer
+	c      io.Closer
+	failed bool
+}
+
+func (j *job) progressSink() *progressSink {
+	target := j.cfg.Progress
+	if v, ok := j.lookupEnv("FFMPEG_OVER_IP_CLIENT_PROGRESS"); ok {
+		target = v
+	}
+	return &progressSink{target: target, stderr: j.stderr, dir: j.dir}
+}
+
+// write writes a report.
+func (s *progressSink) write(fields map[string]string) {
+	if s.failed {
+		return
+	}
+	if s.w == nil && !s.open() {
+		return
+	}
+	line, _ := json.Marshal(fields)
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		log.Printf("progress: %v", err)
+		s.failed = true
+	}
+}
+
+func (s *progressSink) open() bool {
+	switch {
+	case s.target == "stderr":
+		s.w = s.stderr
+		return true
+	case strings.HasPrefix(s.target, "unix:"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(s.target, "unix:"))
+		if err != nil {
+			log.Printf("progress: %v", err)
+			s.failed = true
+			return false
+		}
+		s.w, s.c = conn, conn
+		return true
+	default:
+		path := s.target
+		if s.dir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(s.dir, path)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Printf("progress: %v", err)
+			s.failed = true
+			return false
+		}
+		s.w, s.c = f, f
+		return true
+	}
+}
+
+func (s *progressSink) close() {
+	if s.c != nil {
+		s.c.Close()
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// captureMagic starts every capture file; anything else is read as raw
+// frames.
+const captureMagic = "FFOIPCAP"
+
+// dumper prints the frames of one or more inputs. File I/O requests are
+// remembered across inputs, so a response in one file is paired with its
+// request in another.
+type dumper struct {
+	out      io.Writer
+	hexBytes int
+	pending  map[requestKey]request
+	latency  map[uint8][]time.Duration
+}
+
+// requestKey identifies a file I/O request. Each multiplexed stream is a
+// session of its own, numbering its requests independently.
+type requestKey struct {
+	stream uint32
+	id     uint16
+}
+
+type request struct {
+	msgType uint8
+	where   string
+	at      time.Time // zero for raw streams, which have no timestamps
+}
+
+// input is the state of one capture or raw stream. Frames are keyed by
+// direction, which is empty for raw streams, and by stream, which is 0
+// outside a multiplexed stream.
+type input struct {
+	fragments map[fragmentKey][]byte
+	streams   map[streamKey]*bytes.Buffer
+}
+
+type fragmentKey struct {
+	dir     string
+	stream  uint32
+	msgType uint8
+}
+
+type streamKey struct {
+	dir    string
+	stream uint32
+}
+
+// frameInfo is where a frame was found.
+type frameInfo struct {
+	where  string // byte offset or time into the capture
+	at     time.Time
+	dir    string
+	stream uint32
+}
+
+func newDumper(out io.Writer, hexBytes int) *dumper {
+	return &dumper{
+		out:      out,
+		hexBytes: hexBytes,
+		pending:  make(map[requestKey]request),
+		latency:  make(map[uint8][]time.Duration),
+	}
+}
+
+// dump prints the frames in r, a capture file or a raw stream.
+func (d *dumper) dump(name string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	in := &input{fragments: make(map[fragmentKey][]byte), streams: make(map[streamKey]*bytes.Buffer)}
+	var err error
+	if head, _ := br.Peek(len(captureMagic)); string(head) == captureMagic {
+		err = d.dumpCapture(name, in, br)
+	} else {
+		err = d.dumpRaw(name, in, br)
+	}
+	d.leftovers(in)
+	return err
+}
+
+func (d *dumper) dumpCapture(name string, in *input, r io.Reader) error {
+	cr, err := capture.NewReader(r)
+	if err != nil {
+		return err
+	}
+	h := cr.Header()
+	fmt.Fprintf(d.out, "%s: capture taken on the %s, protocol 0x%02x, started %s\n",
+		name, h.Side, h.ProtocolVersion, h.Start.Format("2006-01-02 15:04:05.000 MST"))
+	if h.ProtocolVersion != protocol.CurrentVersion {
+		fmt.Fprintf(d.out, "  recorded by a release speaking protocol 0x%02x; this build speaks 0x%02x and may misread it\n",
+			h.ProtocolVersion, protocol.CurrentVersion)
+	}
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				fmt.Fprintf(d.out, "  (capture ends in the middle of a record)\n")
+				return nil
+			}
+			return err
+		}
+		dir := "S->C"
+		if h.Sender(rec.Direction) == capture.SideClient {
+			dir = "C->S"
+		}
+		f := frameInfo{
+			where: fmt.Sprintf("%+11.6fs", rec.Time.Sub(h.Start).Seconds()),
+			at:    rec.Time,
+			dir:   dir,
+		}
+		d.frame(in, f, &rec.Message)
+	}
+}
+
+func (d *dumper) dumpRaw(name string, in *input, r io.Reader) error {
+	fmt.Fprintf(d.out, "%s: raw frames\n", name)
+	cr := &countingReader{r: r}
+	for {
+		offset := cr.n
+		msg, err := protocol.ReadMessageFrom(cr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("at byte %d: %w", offset, err)
+		}
+		d.frame(in, frameInfo{where: fmt.Sprintf("@%-10d", offset)}, msg)
+	}
+}
+
+// frame prints a frame, and the frames inside it when it carries data of
+// a multiplexed stream.
+func (d *dumper) frame(in *input, f frameInfo, msg *protocol.Message) {
+	if msg.Type == protocol.MsgFragment {
+		d.line(f, msg, capture.Describe(msg))
+		if m, err := protocol.DecodeFragmentMessage(msg.Payload); err == nil {
+			k := fragmentKey{f.dir, f.stream, m.Type}
+			in.fragments[k] = append(in.fragments[k], m.Data...)
+		}
+		return
+	}
+
+	var note string
+	k := fragmentKey{f.dir, f.stream, msg.Type}
+	if head, ok := in.fragments[k]; ok {
+		delete(in.fragments, k)
+		msg = &protocol.Message{Type: msg.Type, Payload: append(head, msg.Payload...)}
+		note = " (reassembled)"
+	}
+	d.line(f, msg, capture.Describe(msg)+note+d.pair(f, msg))
+	d.versionNote(f, msg)
+	d.hexDump(f, msg.Payload)
+
+	switch msg.Type {
+	case protocol.MsgStreamData:
+		if m, err := protocol.DecodeStreamData(msg.Payload); err == nil {
+			d.streamData(in, f, m)
+		}
+	case protocol.MsgStreamClose:
+		if len(msg.Payload) == 4 {
+			delete(in.streams, streamKey{f.dir, binary.BigEndian.Uint32(msg.Payload)})
+		}
+	}
+}
+
+// streamData adds data to a multiplexed stream, and prints the frames it
+// completes.
+func (d *dumper) streamData(in *input, f frameInfo, m *protocol.StreamData) {
+	k := streamKey{f.dir, m.StreamID}
+	buf := in.streams[k]
+	if buf == nil {
+		buf = new(bytes.Buffer)
+		in.streams[k] = buf
+	}
+	buf.Write(m.Data)
+	inner := frameInfo{where: f.where, at: f.at, dir: f.dir, stream: m.StreamID}
+	for buf.Len() >= 5 {
+		n := binary.BigEndian.Uint32(buf.Bytes()[1:5])
+		if n > protocol.MaxPayload {
+			d.line(inner, nil, fmt.Sprintf("not a frame: payload length %d; ignoring the rest of the stream", n))
+			delete(in.streams, k)
+			return
+		}
+		if buf.Len() < 5+int(n) {
+			return
+		}
+		msg, err := protocol.ReadMessageFrom(buf)
+		if err != nil {
+			return
+		}
+		d.frame(in, inner, msg)
+	}
+}
+
+// pair remembers file I/O requests and matches responses to them.
+func (d *dumper) pair(f frameInfo, msg *protocol.Message) string {
+	isRequest := protocol.IsFileIORequest(msg.Type)
+	if (!isRequest && !protocol.IsFileIOResponse(msg.Type)) || len(msg.Payload) < 2 {
+		return ""
+	}
+	k := requestKey{f.stream, binary.BigEndian.Uint16(msg.Payload)}
+	if isRequest {
+		d.pending[k] = request{msgType: msg.Type, where: strings.TrimSpace(f.where), at: f.at}
+		return ""
+	}
+	req, ok := d.pending[k]
+	if !ok {
+		return "  [no request seen]"
+	}
+	delete(d.pending, k)
+	if req.at.IsZero() || f.at.IsZero() {
+		return fmt.Sprintf("  [answers %s at %s]", capture.Name(req.msgType), req.where)
+	}
+	rtt := f.at.Sub(req.at)
+	d.latency[req.msgType] = append(d.latency[req.msgType], rtt)
+	return fmt.Sprintf("  [answers %s at %s, %.3fms]", capture.Name(req.msgType), req.where, rtt.Seconds()*1000)
+}
+
+// versionNote points out messages that carry a protocol version other than
+// this build's, the usual cause of a peer rejecting a connection.
+func (d *dumper) versionNote(f frameInfo, msg *protocol.Message) {
+	switch msg.Type {
+	case protocol.MsgCommand, protocol.MsgResume, protocol.MsgMux:
+	default:
+		return
+	}
+	if len(msg.Payload) > 0 && msg.Payload[0] != protocol.CurrentVersion {
+		d.note(f, fmt.Sprintf("protocol version 0x%02x; this build speaks 0x%02x", msg.Payload[0], protocol.CurrentVersion))
+	}
+}
+
+func (d *dumper) hexDump(f frameInfo, payload []byte) {
+	if d.hexBytes <= 0 || len(payload) == 0 {
+		return
+	}
+	dump := hex.Dump(payload[:min(len(payload), d.hexBytes)])
+	for _, l := range strings.Split(strings.TrimRight(dump, "\n"), "\n") {
+		d.note(f, l)
+	}
+}
+
+func (d *dumper) line(f frameInfo, msg *protocol.Message, desc string) {
+	prefix := d.prefix(f)
+	if msg == nil {
+		fmt.Fprintf(d.out, "%s%s\n", prefix, desc)
+		return
+	}
+	fmt.Fprintln(d.out, strings.TrimRight(fmt.Sprintf("%s%-12s %s", prefix, capture.Name(msg.Type), desc), " "))
+}
+
+// note prints a line under the frame it is about.
+func (d *dumper) note(f frameInfo, s string) {
+	fmt.Fprintf(d.out, "%s    %s\n", strings.Repeat(" ", len(d.prefix(f))), s)
+}
+
+func (d *dumper) prefix(f frameInfo) string {
+	s := "  " + f.where + "  "
+	if f.dir != "" {
+		s += f.dir + "  "
+	}
+	if f.stream != 0 {
+		s += fmt.Sprintf("[%d] ", f.stream)
+	}
+	return s
+}
+
+// leftovers reports frames an input ended in the middle of.
+func (d *dumper) leftovers(in *input) {
+	for k, data := range in.fragments {
+		fmt.Fprintf(d.out, "  (ends with %d bytes of an unfinished %s%s)\n", len(data), capture.Name(k.msgType), inStream(k.stream))
+	}
+	for k, buf := range in.streams {
+		if buf.Len() > 0 {
+			fmt.Fprintf(d.out, "  (ends with %d bytes of an unfinished frame%s)\n", buf.Len(), inStream(k.stream))
+		}
+	}
+}
+
+func inStream(id uint32) string {
+	if id == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" in stream %d", id)
+}
+
+// finish prints the requests left unanswered and, when the inputs had
+// timestamps, the round-trip times of file I/O requests by type.
+func (d *dumper) finish() {
+	if len(d.pending) > 0 {
+		keys := make([]requestKey, 0, len(d.pending))
+		for k := range d.pending {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b requestKey) int {
+			if a.stream != b.stream {
+				return int(a.stream) - int(b.stream)
+			}
+			return int(a.id) - int(b.id)
+		})
+		fmt.Fprintf(d.out, "unanswered\n")
+		for _, k := range keys {
+			req := d.pending[k]
+			fmt.Fprintf(d.out, "  %-12s #%d%s at %s\n", capture.Name(req.msgType), k.id, inStream(k.stream), req.where)
+		}
+	}
+
+	if len(d.latency) == 0 {
+		return
+	}
+	types := make([]uint8, 0, len(d.latency))
+	for t := range d.latency {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	fmt.Fprintf(d.out, "round trips\n")
+	for _, t := range types {
+		rtts := d.latency[t]
+		slices.Sort(rtts)
+		var total time.Duration
+		for _, rtt := range rtts {
+			total += rtt
+		}
+		fmt.Fprintf(d.out, "  %-10s %6d  avg %.3fms  min %.3fms  max %.3fms\n", capture.Name(t), len(rtts),
+			(total/time.Duration(len(rtts))).Seconds()*1000, rtts[0].Seconds()*1000, rtts[len(rtts)-1].Seconds()*1000)
+	}
+}
+
+// countingReader counts the bytes read through it, for frame offsets.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
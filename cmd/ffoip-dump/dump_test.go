@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+func frames(t *testing.T, msgs ...protocol.Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		if err := protocol.WriteMessageTo(&buf, m.Type, m.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDumpRawPairsAcrossInputs(t *testing.T) {
+	toClient := frames(t,
+		protocol.Message{Type: protocol.MsgSession, Payload: (&protocol.SessionMessage{}).Encode()},
+		protocol.Message{Type: protocol.MsgRead, Payload: (&protocol.ReadRequest{RequestID: 4, FileID: 1, NBytes: 512}).Encode()},
+		protocol.Message{Type: protocol.MsgClose, Payload: (&protocol.CloseRequest{RequestID: 5, FileID: 1}).Encode()},
+	)
+	toServer := frames(t,
+		protocol.Message{Type: protocol.MsgReadOk, Payload: (&protocol.ReadOkResponse{RequestID: 4, Data: make([]byte, 512)}).Encode()},
+	)
+
+	var out strings.Builder
+	d := newDumper(&out, 0)
+	if err := d.dump("s2c", bytes.NewReader(toClient)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.dump("c2s", bytes.NewReader(toServer)); err != nil {
+		t.Fatal(err)
+	}
+	d.finish()
+
+	for _, want := range []string{
+		"s2c: raw frames",
+		"@0           Session      not resumable",
+		"@25          Read         #4 file 1, 512 bytes",
+		"@0           ReadOk       #4 512 bytes  [answers Read at @25]",
+		"unanswered\n  Close        #5 at @38",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dump is missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "round trips") {
+		t.Errorf("round trips reported without timestamps:\n%s", out.String())
+	}
+}
+
+func TestDumpCaptureWithStreams(t *testing.T) {
+	readOk := (&protocol.ReadOkResponse{RequestID: 1, Data: make([]byte, 100)}).Encode()
+	inner := frames(t,
+		protocol.Message{Type: protocol.MsgFragment, Payload: (&protocol.FragmentMessage{Type: protocol.MsgReadOk, Data: readOk[:40]}).Encode()},
+		protocol.Message{Type: protocol.MsgReadOk, Payload: readOk[40:]},
+	)
+
+	var buf bytes.Buffer
+	w, err := capture.NewWriter(&buf, capture.SideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(capture.Received, protocol.MsgStreamData, (&protocol.StreamData{StreamID: 2, Data: frames(t,
+		protocol.Message{Type: protocol.MsgRead, Payload: (&protocol.ReadRequest{RequestID: 1, FileID: 1, NBytes: 100}).Encode()},
+	)}).Encode())
+	// The response is split across two stream frames, and across fragments
+	w.Record(capture.Sent, protocol.MsgStreamData, (&protocol.StreamData{StreamID: 2, Data: inner[:30]}).Encode())
+	w.Record(capture.Sent, protocol.MsgStreamData, (&protocol.StreamData{StreamID: 2, Data: inner[30:]}).Encode())
+	w.Close()
+
+	var out strings.Builder
+	d := newDumper(&out, 0)
+	if err := d.dump("job.ffcap", &buf); err != nil {
+		t.Fatal(err)
+	}
+	d.finish()
+
+	for _, want := range []string{
+		"job.ffcap: capture taken on the client",
+		"S->C  StreamData   stream 2,",
+		"S->C  [2] Read         #1 file 1, 100 bytes",
+		"C->S  [2] Fragment     of ReadOk, 40 bytes",
+		"C->S  [2] ReadOk       #1 100 bytes (reassembled)  [answers Read at +",
+		"round trips\n  Read            1  avg",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dump is missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "unanswered") || strings.Contains(out.String(), "unfinished") {
+		t.Errorf("dump has leftovers:\n%s", out.String())
+	}
+}
+
+func TestDumpVersionMismatch(t *testing.T) {
+	payload := (&protocol.CommandMessage{Program: "ffmpeg", Args: []string{"-version"}}).Encode()
+	payload[0] = protocol.CurrentVersion - 1
+
+	var out strings.Builder
+	d := newDumper(&out, 0)
+	if err := d.dump("stdin", bytes.NewReader(frames(t, protocol.Message{Type: protocol.MsgCommand, Payload: payload}))); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Command      malformed"; !strings.Contains(out.String(), want) {
+		t.Errorf("dump is missing %q:\n%s", want, out.String())
+	}
+	if want := fmt.Sprintf("protocol version 0x%02x; this build speaks 0x%02x", payload[0], protocol.CurrentVersion); !strings.Contains(out.String(), want) {
+		t.Errorf("dump is missing %q:\n%s", want, out.String())
+	}
+}
+
+func TestDumpRawTruncated(t *testing.T) {
+	data := frames(t,
+		protocol.Message{Type: protocol.MsgPing},
+		protocol.Message{Type: protocol.MsgStdout, Payload: []byte("hello")},
+	)
+
+	var out strings.Builder
+	err := newDumper(&out, 0).dump("stdin", bytes.NewReader(data[:len(data)-2]))
+	if err == nil || !strings.Contains(err.Error(), "at byte 5") {
+		t.Fatalf("dump = %v, want an error at byte 5", err)
+	}
+	if !strings.Contains(out.String(), "@0           Ping") {
+		t.Errorf("frames before the error not dumped:\n%s", out.String())
+	}
+}
@@ -0,0 +1,66 @@
+// Command ffoip-dump prints the frames of ffmpeg-over-ip traffic, decoded:
+// message names and fields, which request each file I/O response answers,
+// and how long it took.
+//
+// It reads capture files recorded by the client or the server, and raw
+// streams of frames as they are on the wire, such as one direction of a
+// TCP connection saved with Wireshark's "Follow TCP Stream". Give "-" or
+// no file to read stdin. The two directions of a connection can be given
+// as two files to pair responses with requests across them.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	hexBytes := flag.Int("hex", 0, "also hex dump the first `n` bytes of each payload")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: ffoip-dump [-hex n] [file ...]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Decodes ffmpeg-over-ip capture files or raw frame streams; \"-\" or no file reads stdin.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	d := newDumper(out, *hexBytes)
+	failed := false
+	for _, name := range inputs {
+		if err := dumpFile(d, name); err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "ffoip-dump: %v\n", err)
+			failed = true
+		}
+	}
+	d.finish()
+	out.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func dumpFile(d *dumper, name string) error {
+	if name == "-" {
+		if err := d.dump("stdin", os.Stdin); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := d.dump(name, f); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -1,27 +1,33 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
+	"reflect"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
-	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
-	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
-	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+	"github.com/steelbrain/ffmpeg-over-ip/pkg/server"
 )
 
 func main() {
+	// Re-executed to apply resource limits or the sandbox before exec'ing ffmpeg
+	server.HelperMain()
+
 	configPath := flag.String("config", "", "path to server config file")
 	debugPaths := flag.Bool("debug-print-search-paths", false, "print config search paths and exit")
+	inspectPath := flag.String("inspect", "", "print a readable trace of a capture file and exit")
 	flag.Parse()
 
 	if *debugPaths {
@@ -30,6 +36,12 @@ func main() {
 		}
 		return
 	}
+	if *inspectPath != "" {
+		if err := inspect(*inspectPath); err != nil {
+			log.Fatalf("failed to inspect %s: %v", *inspectPath, err)
+		}
+		return
+	}
 
 	cfg, err := config.LoadServerConfig(*configPath)
 	if err != nil {
@@ -44,13 +56,31 @@ func main() {
 		log.Fatalf("failed to resolve executable path: %v", err)
 	}
 	exeDir := filepath.Dir(exePath)
-	ffmpegPath := filepath.Join(exeDir, "ffmpeg")
-	ffprobePath := filepath.Join(exeDir, "ffprobe")
+	srv, err := server.New(cfg, server.Options{
+		FFmpegPath:  filepath.Join(exeDir, "ffmpeg"),
+		FFprobePath: filepath.Join(exeDir, "ffprobe"),
+	})
+	if err != nil {
+		log.Fatalf("failed to create server: %v", err)
+	}
 
-	// Set up signal-aware context
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	// ctx is cancelled once shutdown, including any drain, has finished
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			if err := reload(srv, *configPath); err != nil {
+				log.Printf("config reload failed, keeping current config: %v", err)
+			}
+		}
+	}()
+
 	network, addr := config.ParseAddress(cfg.Address)
 	listener, err := net.Listen(network, addr)
 	if err != nil {
@@ -66,7 +96,36 @@ func main() {
 
 	log.Printf("listening on %s (%s)", addr, network)
 
-	// Stop accepting on context cancellation; clean up Unix socket
+	// The admin API asks for a drain; safe to ask more than once
+	drainRequested := make(chan struct{})
+	var drainOnce sync.Once
+	requestDrain := func() { drainOnce.Do(func() { close(drainRequested) }) }
+
+	if cfg.Admin != nil {
+		if err := serveAdmin(ctx, srv, cfg.Admin, requestDrain); err != nil {
+			log.Fatalf("failed to start admin API: %v", err)
+		}
+	}
+
+	// Drain on the first signal or admin request. A second signal
+	// terminates the remaining sessions without waiting for the deadline.
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Printf("received %v, draining", sig)
+		case <-drainRequested:
+			log.Printf("drain requested via admin API")
+		}
+		go func() {
+			sig := <-sigCh
+			log.Printf("received %v while draining, terminating sessions", sig)
+			srv.TerminateAll()
+		}()
+		srv.Drain(time.Duration(srv.Config().DrainTimeout))
+		cancel()
+	}()
+
+	// Stop accepting once shutdown completes; clean up Unix socket
 	go func() {
 		<-ctx.Done()
 		listener.Close()
@@ -75,100 +134,81 @@ func main() {
 		}
 	}()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if ctx.Err() != nil {
-				return // shutting down
-			}
-			log.Printf("accept error: %v", err)
-			continue
-		}
-
-		go handleConnection(ctx, conn, cfg, ffmpegPath, ffprobePath)
+	if err := srv.Serve(ctx, listener); err != nil {
+		log.Fatalf("failed to accept connections: %v", err)
 	}
 }
 
-func handleConnection(ctx context.Context, conn net.Conn, cfg *config.ServerConfig, ffmpegPath, ffprobePath string) {
-	defer conn.Close()
-
-	// Read command message
-	msg, err := protocol.ReadMessageFrom(conn)
+// reload re-reads the config and applies it to connections accepted from
+// now on. Settings bound at startup (the listen and admin addresses) keep
+// their current values and a restart is required to change them.
+func reload(srv *server.Server, configPath string) error {
+	next, err := config.LoadServerConfig(configPath)
 	if err != nil {
-		log.Printf("failed to read command: %v", err)
-		return
-	}
-	if msg.Type != protocol.MsgCommand {
-		sendError(conn, fmt.Sprintf("expected command message (0x%02x), got 0x%02x", protocol.MsgCommand, msg.Type))
-		return
+		return err
 	}
+	cur := srv.Config()
 
-	// Decode command
-	cmd, err := protocol.DecodeCommandMessage(msg.Payload)
-	if err != nil {
-		sendError(conn, fmt.Sprintf("invalid command: %v", err))
-		return
+	if next.Address != cur.Address {
+		log.Printf("config reload: address change to %s requires a restart, still listening on %s", next.Address, cur.Address)
+		next.Address = cur.Address
 	}
-
-	// Verify HMAC
-	if !auth.Verify(cfg.AuthSecret, protocol.CurrentVersion, cmd.Nonce, cmd.Signature, cmd.Program, cmd.Args) {
-		sendError(conn, "authentication failed")
-		log.Printf("auth failed from %s", conn.RemoteAddr())
-		return
+	if !reflect.DeepEqual(next.Admin, cur.Admin) {
+		log.Printf("config reload: admin API changes require a restart")
+		next.Admin = cur.Admin
 	}
-
-	// Determine binary path
-	var binaryPath string
-	switch cmd.Program {
-	case protocol.ProgramFFmpeg:
-		binaryPath = ffmpegPath
-	case protocol.ProgramFFprobe:
-		binaryPath = ffprobePath
-	default:
-		sendError(conn, fmt.Sprintf("unknown program: 0x%02x", cmd.Program))
-		return
+	if next.Log != cur.Log {
+		config.SetupLogging(next.Log)
 	}
 
-	// Apply rewrites
-	args := applyRewrites(cmd.Args, cfg.Rewrites)
+	srv.SetConfig(next)
+	log.Printf("config reloaded")
+	return nil
+}
 
-	if cfg.Debug {
-		log.Printf("[debug] original args: %v", cmd.Args)
-		log.Printf("[debug] rewritten args: %v", args)
+// serveAdmin starts the admin API in the background. It stops when ctx is
+// cancelled. A drain request calls drain.
+func serveAdmin(ctx context.Context, srv *server.Server, adminCfg *config.AdminConfig, drain func()) error {
+	network, addr := config.ParseAddress(adminCfg.Address)
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
-	log.Printf("running %s %v (from %s)", filepath.Base(binaryPath), args, conn.RemoteAddr())
-
-	// Start process
-	proc := process.NewProcess(binaryPath, args)
-	if err := proc.Start(ctx); err != nil {
-		sendError(conn, fmt.Sprintf("failed to start process: %v", err))
-		return
+	if network == "unix" {
+		if err := os.Chmod(addr, 0600); err != nil {
+			log.Printf("warning: failed to chmod admin socket: %v", err)
+		}
 	}
 
-	// Run session
-	sess := session.NewSession(conn, proc)
-	exitCode, err := sess.Run(ctx)
-	if err != nil {
-		log.Printf("session error: %v", err)
+	httpServer := &http.Server{
+		Handler:           srv.AdminHandler(adminCfg.AuthSecret, drain),
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+		if network == "unix" {
+			os.Remove(addr)
+		}
+	}()
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin API error: %v", err)
+		}
+	}()
 
-	log.Printf("process exited with code %d (from %s)", exitCode, conn.RemoteAddr())
+	log.Printf("admin API listening on %s (%s)", addr, network)
+	return nil
 }
 
-func applyRewrites(args []string, rewrites [][2]string) []string {
-	if len(rewrites) == 0 {
-		return args
-	}
-	result := make([]string, len(args))
-	for i, arg := range args {
-		result[i] = arg
-		for _, rw := range rewrites {
-			result[i] = strings.ReplaceAll(result[i], rw[0], rw[1])
-		}
+// inspect prints a readable trace of the capture file at path.
+func inspect(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	return result
-}
-
-func sendError(conn net.Conn, msg string) {
-	protocol.WriteMessageTo(conn, protocol.MsgError, []byte(msg))
+	defer f.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return capture.Inspect(out, f)
 }
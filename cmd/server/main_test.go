@@ -1,447 +1,120 @@
 package main
 
 import (
-	"context"
-	"encoding/binary"
-	"io"
-	"net"
-	"strings"
+	"os"
+	"path/filepath"
 	"testing"
-	"time"
 
-	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
-	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/pkg/server"
 )
 
-func TestApplyRewrites(t *testing.T) {
-	tests := []struct {
-		name     string
-		args     []string
-		rewrites [][2]string
-		want     []string
-		sameRef  bool // if true, expect returned slice is the same reference as input
-	}{
-		{
-			name:     "empty rewrites returns same slice",
-			args:     []string{"-c:v", "h264_nvenc", "-i", "input.mp4"},
-			rewrites: nil,
-			want:     []string{"-c:v", "h264_nvenc", "-i", "input.mp4"},
-			sameRef:  true,
-		},
-		{
-			name:     "empty rewrites with explicit empty slice returns same slice",
-			args:     []string{"-c:v", "h264_nvenc"},
-			rewrites: [][2]string{},
-			want:     []string{"-c:v", "h264_nvenc"},
-			sameRef:  true,
-		},
-		{
-			name:     "single rewrite replaces codec",
-			args:     []string{"-c:v", "h264_nvenc", "-i", "input.mp4"},
-			rewrites: [][2]string{{"h264_nvenc", "h264_qsv"}},
-			want:     []string{"-c:v", "h264_qsv", "-i", "input.mp4"},
-		},
-		{
-			name:     "multiple rewrites applied in order",
-			args:     []string{"-c:v", "h264_nvenc", "-preset", "fast"},
-			rewrites: [][2]string{
-				{"h264_nvenc", "h264_qsv"},
-				{"fast", "medium"},
-			},
-			want: []string{"-c:v", "h264_qsv", "-preset", "medium"},
-		},
-		{
-			name:     "rewrite that does not match leaves args unchanged",
-			args:     []string{"-c:v", "libx264", "-i", "input.mp4"},
-			rewrites: [][2]string{{"h264_nvenc", "h264_qsv"}},
-			want:     []string{"-c:v", "libx264", "-i", "input.mp4"},
-		},
-		{
-			name:     "rewrite applied to all args not just first match",
-			args:     []string{"h264_nvenc", "foo", "h264_nvenc"},
-			rewrites: [][2]string{{"h264_nvenc", "h264_qsv"}},
-			want:     []string{"h264_qsv", "foo", "h264_qsv"},
-		},
-		{
-			name:     "rewrite with empty replacement deletes pattern",
-			args:     []string{"-nostdin", "-c:v", "libx264"},
-			rewrites: [][2]string{{"-nostdin", ""}},
-			want:     []string{"", "-c:v", "libx264"},
-		},
-		{
-			name:     "multiple occurrences of pattern in one arg",
-			args:     []string{"aa-bb-aa", "cc"},
-			rewrites: [][2]string{{"aa", "xx"}},
-			want:     []string{"xx-bb-xx", "cc"},
-		},
-		{
-			name: "chained rewrites where first produces text matched by second",
-			args: []string{"alpha"},
-			rewrites: [][2]string{
-				{"alpha", "beta"},
-				{"beta", "gamma"},
-			},
-			want: []string{"gamma"},
-		},
-		{
-			name:     "empty args with non-empty rewrites returns empty result",
-			args:     []string{},
-			rewrites: [][2]string{{"a", "b"}},
-			want:     []string{},
-		},
-		{
-			name:     "rewrite matching part of arg",
-			args:     []string{"-c:v h264_nvenc", "-preset fast"},
-			rewrites: [][2]string{{"h264_nvenc", "h264_qsv"}},
-			want:     []string{"-c:v h264_qsv", "-preset fast"},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := applyRewrites(tt.args, tt.rewrites)
-
-			if len(got) != len(tt.want) {
-				t.Fatalf("length mismatch: got %d, want %d", len(got), len(tt.want))
-			}
-
-			for i := range tt.want {
-				if got[i] != tt.want[i] {
-					t.Errorf("arg[%d] = %q, want %q", i, got[i], tt.want[i])
-				}
-			}
-
-			if tt.sameRef {
-				if len(tt.args) > 0 && &got[0] != &tt.args[0] {
-					t.Error("expected returned slice to be the same reference as input, but got a copy")
-				}
-			}
-		})
-	}
-}
-
-func TestApplyRewritesDoesNotMutateInput(t *testing.T) {
-	original := []string{"h264_nvenc", "fast"}
-	argsCopy := make([]string, len(original))
-	copy(argsCopy, original)
-
-	rewrites := [][2]string{{"h264_nvenc", "h264_qsv"}}
-	_ = applyRewrites(original, rewrites)
-
-	for i := range original {
-		if original[i] != argsCopy[i] {
-			t.Errorf("input was mutated: arg[%d] = %q, want %q", i, original[i], argsCopy[i])
-		}
-	}
-}
-
-func TestSendError(t *testing.T) {
-	client, server := net.Pipe()
-	defer client.Close()
-	defer server.Close()
-
-	errMsg := "something went wrong"
-
-	// Write error from server side in a goroutine to avoid blocking
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		sendError(server, errMsg)
-	}()
-
-	// Read the message from the client side
-	msg, err := protocol.ReadMessageFrom(client)
-	if err != nil {
-		t.Fatalf("failed to read message: %v", err)
-	}
-
-	<-done
-
-	if msg.Type != protocol.MsgError {
-		t.Errorf("message type = 0x%02x, want 0x%02x (MsgError)", msg.Type, protocol.MsgError)
-	}
-
-	if string(msg.Payload) != errMsg {
-		t.Errorf("payload = %q, want %q", string(msg.Payload), errMsg)
-	}
+func TestMain(m *testing.M) {
+	// Jobs with resource limits re-execute the test binary as the launch helper
+	server.HelperMain()
+	os.Exit(m.Run())
 }
 
-func TestSendErrorEmptyMessage(t *testing.T) {
-	client, server := net.Pipe()
-	defer client.Close()
-	defer server.Close()
-
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		sendError(server, "")
-	}()
-
-	msg, err := protocol.ReadMessageFrom(client)
+func newServer(t *testing.T, cfg *config.ServerConfig) *server.Server {
+	t.Helper()
+	srv, err := server.New(cfg, server.Options{})
 	if err != nil {
-		t.Fatalf("failed to read message: %v", err)
-	}
-
-	<-done
-
-	if msg.Type != protocol.MsgError {
-		t.Errorf("message type = 0x%02x, want 0x%02x (MsgError)", msg.Type, protocol.MsgError)
-	}
-
-	if len(msg.Payload) != 0 {
-		t.Errorf("payload length = %d, want 0", len(msg.Payload))
-	}
-}
-
-// readAllMessages reads protocol messages from r until EOF or error.
-func readAllMessages(r io.Reader) []*protocol.Message {
-	var msgs []*protocol.Message
-	for {
-		msg, err := protocol.ReadMessageFrom(r)
-		if err != nil {
-			break
-		}
-		msgs = append(msgs, msg)
+		t.Fatal(err)
 	}
-	return msgs
+	return srv
 }
 
-// makeCommandPayload creates a properly encoded CommandMessage payload.
-func makeCommandPayload(secret string, program uint8, args []string) []byte {
-	nonce := [protocol.NonceLength]byte{1, 2, 3}
-	sig := auth.Sign(secret, protocol.CurrentVersion, nonce, program, args)
-	cmd := &protocol.CommandMessage{
-		Nonce:     nonce,
-		Signature: sig,
-		Program:   program,
-		Args:      args,
-	}
-	return cmd.Encode()
-}
-
-func TestHandleConnectionBadFirstMessage(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-
-	ctx := context.Background()
-	cfg := &config.ServerConfig{AuthSecret: "test-secret"}
-
-	go handleConnection(ctx, serverConn, cfg, "/bin/echo", "/bin/echo")
-
-	// Send a MsgPing instead of MsgCommand
-	if err := protocol.WriteMessageTo(clientConn, protocol.MsgPing, nil); err != nil {
-		t.Fatalf("failed to write ping: %v", err)
-	}
-
-	msgs := readAllMessages(clientConn)
-	if len(msgs) == 0 {
-		t.Fatal("expected at least one response message, got none")
-	}
-
-	msg := msgs[0]
-	if msg.Type != protocol.MsgError {
-		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
-	}
-	if !strings.Contains(string(msg.Payload), "expected command") {
-		t.Errorf("error message %q does not contain %q", string(msg.Payload), "expected command")
+func writeConfig(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestHandleConnectionInvalidCommand(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-
-	ctx := context.Background()
-	cfg := &config.ServerConfig{AuthSecret: "test-secret"}
-
-	go handleConnection(ctx, serverConn, cfg, "/bin/echo", "/bin/echo")
-
-	// Send a MsgCommand with a 1-byte payload (too short to decode)
-	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, []byte{0x01}); err != nil {
-		t.Fatalf("failed to write command: %v", err)
-	}
-
-	msgs := readAllMessages(clientConn)
-	if len(msgs) == 0 {
-		t.Fatal("expected at least one response message, got none")
-	}
-
-	msg := msgs[0]
-	if msg.Type != protocol.MsgError {
-		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
-	}
-	if !strings.Contains(string(msg.Payload), "invalid command") {
-		t.Errorf("error message %q does not contain %q", string(msg.Payload), "invalid command")
-	}
-}
-
-func TestHandleConnectionAuthFailure(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-
-	ctx := context.Background()
-	cfg := &config.ServerConfig{AuthSecret: "correct-secret"}
-
-	go handleConnection(ctx, serverConn, cfg, "/bin/echo", "/bin/echo")
-
-	// Sign with wrong secret
-	payload := makeCommandPayload("wrong-secret", protocol.ProgramFFmpeg, []string{"-version"})
-	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
-		t.Fatalf("failed to write command: %v", err)
+func TestReloadAppliesNewConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.jsonc")
+	writeConfig(t, path, `{"address": "127.0.0.1:5050", "authSecret": "old-secret"}`)
+	cfg, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
 	}
+	srv := newServer(t, cfg)
 
-	msgs := readAllMessages(clientConn)
-	if len(msgs) == 0 {
-		t.Fatal("expected at least one response message, got none")
+	writeConfig(t, path, `{
+		"address": "127.0.0.1:5050",
+		"authSecret": "new-secret",
+		"debug": true,
+		"rewrites": [["h264_nvenc", "h264_qsv"]]
+	}`)
+	if err := reload(srv, path); err != nil {
+		t.Fatalf("reload failed: %v", err)
 	}
 
-	msg := msgs[0]
-	if msg.Type != protocol.MsgError {
-		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	got := srv.Config()
+	if got.AuthSecret != "new-secret" {
+		t.Errorf("AuthSecret = %q, want %q", got.AuthSecret, "new-secret")
 	}
-	if !strings.Contains(string(msg.Payload), "authentication failed") {
-		t.Errorf("error message %q does not contain %q", string(msg.Payload), "authentication failed")
+	if !got.Debug {
+		t.Error("Debug = false, want true")
 	}
-}
-
-func TestHandleConnectionUnknownProgram(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-
-	ctx := context.Background()
-	secret := "test-secret"
-	cfg := &config.ServerConfig{AuthSecret: secret}
-
-	go handleConnection(ctx, serverConn, cfg, "/bin/echo", "/bin/echo")
-
-	// Sign with correct secret but unknown program 0xFF
-	payload := makeCommandPayload(secret, 0xFF, []string{"-version"})
-	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
-		t.Fatalf("failed to write command: %v", err)
+	if len(got.Rewrites) != 1 {
+		t.Errorf("Rewrites = %v, want one rule", got.Rewrites)
 	}
 
-	msgs := readAllMessages(clientConn)
-	if len(msgs) == 0 {
-		t.Fatal("expected at least one response message, got none")
-	}
-
-	msg := msgs[0]
-	if msg.Type != protocol.MsgError {
-		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
-	}
-	if !strings.Contains(string(msg.Payload), "unknown program") {
-		t.Errorf("error message %q does not contain %q", string(msg.Payload), "unknown program")
+	// The previous snapshot is untouched, so in-flight connections keep it
+	if cfg.AuthSecret != "old-secret" {
+		t.Errorf("old snapshot mutated: AuthSecret = %q", cfg.AuthSecret)
 	}
 }
 
-func TestHandleConnectionSuccess(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-
-	ctx := context.Background()
-	secret := "test-secret"
-	cfg := &config.ServerConfig{AuthSecret: secret}
-
-	go handleConnection(ctx, serverConn, cfg, "/bin/echo", "/bin/echo")
-
-	// Send a valid command that runs "echo -version" (echo will just print "-version")
-	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"-version"})
-	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
-		t.Fatalf("failed to write command: %v", err)
-	}
-
-	// Read all messages with a timeout
-	type result struct {
-		msgs []*protocol.Message
-	}
-	ch := make(chan result, 1)
-	go func() {
-		ch <- result{msgs: readAllMessages(clientConn)}
-	}()
-
-	var msgs []*protocol.Message
-	select {
-	case r := <-ch:
-		msgs = r.msgs
-	case <-time.After(10 * time.Second):
-		t.Fatal("timed out waiting for response messages")
-	}
-
-	if len(msgs) == 0 {
-		t.Fatal("expected at least one response message, got none")
+func TestReloadInvalidConfigKeepsOld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.jsonc")
+	writeConfig(t, path, `{"address": "127.0.0.1:5050", "authSecret": "old-secret"}`)
+	cfg, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
 	}
+	srv := newServer(t, cfg)
 
-	// We should see at least stdout output and an exit code
-	var gotStdout bool
-	var gotExitCode bool
-	var exitCode int
-
-	for _, msg := range msgs {
-		switch msg.Type {
-		case protocol.MsgStdout:
-			gotStdout = true
-			if !strings.Contains(string(msg.Payload), "-version") {
-				t.Errorf("stdout %q does not contain %q", string(msg.Payload), "-version")
-			}
-		case protocol.MsgExitCode:
-			gotExitCode = true
-			if len(msg.Payload) >= 4 {
-				exitCode = int(binary.BigEndian.Uint32(msg.Payload))
-			}
+	for _, contents := range []string{
+		`{not json`,
+		`{"address": "127.0.0.1:5050"}`,
+	} {
+		writeConfig(t, path, contents)
+		if err := reload(srv, path); err == nil {
+			t.Errorf("reload of %q succeeded, want error", contents)
+		}
+		if srv.Config() != cfg {
+			t.Fatalf("config replaced after failed reload of %q", contents)
 		}
-	}
-
-	if !gotStdout {
-		t.Error("expected MsgStdout in response, got none")
-	}
-	if !gotExitCode {
-		t.Error("expected MsgExitCode in response, got none")
-	}
-	if gotExitCode && exitCode != 0 {
-		t.Errorf("expected exit code 0, got %d", exitCode)
 	}
 }
 
-func TestHandleConnectionProcessNotFound(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-
-	ctx := context.Background()
-	secret := "test-secret"
-	cfg := &config.ServerConfig{AuthSecret: secret}
-
-	// Use a nonexistent binary path
-	go handleConnection(ctx, serverConn, cfg, "/nonexistent/binary/ffmpeg", "/nonexistent/binary/ffprobe")
-
-	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"-version"})
-	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
-		t.Fatalf("failed to write command: %v", err)
+func TestReloadKeepsListenAddress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.jsonc")
+	writeConfig(t, path, `{"address": "127.0.0.1:5050", "authSecret": "secret",
+		"admin": {"address": "127.0.0.1:5051", "authSecret": "admin-secret"}}`)
+	cfg, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
 	}
+	srv := newServer(t, cfg)
 
-	// Read all messages with a timeout
-	type result struct {
-		msgs []*protocol.Message
+	writeConfig(t, path, `{"address": "0.0.0.0:6060", "authSecret": "new-secret",
+		"admin": {"address": "127.0.0.1:6061", "authSecret": "new-admin-secret"}}`)
+	if err := reload(srv, path); err != nil {
+		t.Fatalf("reload failed: %v", err)
 	}
-	ch := make(chan result, 1)
-	go func() {
-		ch <- result{msgs: readAllMessages(clientConn)}
-	}()
 
-	var msgs []*protocol.Message
-	select {
-	case r := <-ch:
-		msgs = r.msgs
-	case <-time.After(10 * time.Second):
-		t.Fatal("timed out waiting for response messages")
+	got := srv.Config()
+	if got.Address != "127.0.0.1:5050" {
+		t.Errorf("Address = %q, want unchanged %q", got.Address, "127.0.0.1:5050")
 	}
-
-	if len(msgs) == 0 {
-		t.Fatal("expected at least one response message, got none")
+	if got.Admin == nil || got.Admin.Address != "127.0.0.1:5051" || got.Admin.AuthSecret != "admin-secret" {
+		t.Errorf("Admin = %+v, want unchanged", got.Admin)
 	}
-
-	msg := msgs[0]
-	if msg.Type != protocol.MsgError {
-		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	// Everything else is still applied
+	if got.AuthSecret != "new-secret" {
+		t.Errorf("AuthSecret = %q, want %q", got.AuthSecret, "new-secret")
 	}
 }
@@ -1,6 +1,7 @@
 #include "fio.h"
 
 #include <errno.h>
+#include <limits.h>
 #include <pthread.h>
 #include <stdint.h>
 #include <stdio.h>
@@ -13,6 +14,7 @@
 #include <io.h>
 #include <direct.h>
 #else
+#include <fcntl.h>
 #include <sys/socket.h>
 #include <netinet/in.h>
 #include <arpa/inet.h>
@@ -860,6 +862,25 @@ static void fio_init(void) {
     pthread_mutex_init(&fio_state.dispatch_mutex, NULL);
     pthread_cond_init(&fio_state.dispatch_cond, NULL);
 
+#ifndef _WIN32
+    /* A sandboxed child has no network; the server hands it one end of a
+     * socketpair instead of a port. */
+    const char *fd_str = getenv("FFOIP_FD");
+    if (fd_str && fd_str[0] != '\0') {
+        char *end;
+        long fd = strtol(fd_str, &end, 10);
+        if (*end != '\0' || fd < 0 || fd > INT_MAX || fcntl((int)fd, F_GETFD) < 0) {
+            fprintf(stderr, "fio: invalid FFOIP_FD=%s, falling back to passthrough\n", fd_str);
+            fio_state.initialized = 1;
+            return;
+        }
+        /* Keep the connection from leaking into processes ffmpeg spawns */
+        fcntl((int)fd, F_SETFD, FD_CLOEXEC);
+        fio_state.sock_fd = (int)fd;
+        goto start_reader;
+    }
+#endif
+
     const char *port_str = getenv("FFOIP_PORT");
     if (!port_str || port_str[0] == '\0') {
         fio_state.initialized = 1; /* passthrough */
@@ -917,12 +938,15 @@ static void fio_init(void) {
 
     fio_state.sock_fd = sock;
 
+#ifndef _WIN32
+start_reader:
+#endif
     /* Start reader thread */
     if (pthread_create(&fio_state.reader_thread, NULL, reader_thread_func, NULL) != 0) {
 #ifdef _WIN32
-        closesocket(sock);
+        closesocket(fio_state.sock_fd);
 #else
-        close(sock);
+        close(fio_state.sock_fd);
 #endif
         fio_state.sock_fd = -1;
         fio_state.initialized = 1; /* passthrough */
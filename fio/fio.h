@@ -16,6 +16,8 @@
  *
  * When FFOIP_PORT is set, these functions tunnel file operations to a remote
  * server over TCP. When unset, they pass through to real POSIX syscalls.
+ * On POSIX systems FFOIP_FD may name an already connected socket to use
+ * instead of connecting to a port.
  *
  * Virtual file descriptors start at FIO_VFD_BASE (10000) to avoid collisions
  * with real fds.
@@ -2,4 +2,4 @@ module github.com/steelbrain/ffmpeg-over-ip
 
 go 1.24.1
 
-require github.com/tidwall/jsonc v0.3.2 // indirect
+require github.com/tidwall/jsonc v0.3.2
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// NewHandler returns the admin HTTP API. Every request must carry
+// "Authorization: Bearer <secret>". drain is called to put the server into
+// drain mode; the endpoint is omitted when drain is nil.
+//
+//	GET    /sessions               list running sessions
+//	GET    /sessions/{id}          show one session
+//	DELETE /sessions/{id}          terminate a session
+//	POST   /sessions/{id}/capture  record a session's messages to a file
+//	DELETE /sessions/{id}/capture  stop recording them
+//	POST   /drain                  stop accepting jobs and shut down once idle
+func NewHandler(reg *Registry, secret string, drain func()) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, reg.List())
+	})
+
+	mux.HandleFunc("GET /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, err := reg.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := reg.Terminate(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("POST /sessions/{id}/capture", func(w http.ResponseWriter, r *http.Request) {
+		path, err := reg.StartCapture(r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"capture": path})
+	})
+
+	mux.HandleFunc("DELETE /sessions/{id}/capture", func(w http.ResponseWriter, r *http.Request) {
+		if err := reg.StopCapture(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if drain != nil {
+		mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+			drain()
+			w.WriteHeader(http.StatusAccepted)
+		})
+	}
+
+	return requireSecret(secret, mux)
+}
+
+func requireSecret(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication failed"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrCaptureDisabled):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
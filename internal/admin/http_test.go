@@ -0,0 +1,224 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+func doRequest(t *testing.T, h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerRequiresAuth(t *testing.T) {
+	h := NewHandler(NewRegistry(), "admin-secret", nil)
+
+	for _, token := range []string{"", "wrong-secret", "admin-secre"} {
+		rec := doRequest(t, h, "GET", "/sessions", token)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want %d", token, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Basic auth scheme is not accepted
+	req := httptest.NewRequest("GET", "/sessions", nil)
+	req.SetBasicAuth("admin", "admin-secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("basic auth: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHandlerListSessions(t *testing.T) {
+	reg := NewRegistry()
+	id := reg.Register(&Entry{
+		RemoteAddr: "10.0.0.1:1234",
+		Program:    "ffmpeg",
+		Args:       []string{"-i", "in.mkv", "out.mp4"},
+		StartTime:  time.Now(),
+	})
+	h := NewHandler(reg, "admin-secret", nil)
+
+	rec := doRequest(t, h, "GET", "/sessions", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	var list []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(list))
+	}
+	if list[0].ID != id || list[0].Program != "ffmpeg" || len(list[0].Args) != 3 {
+		t.Errorf("unexpected session: %+v", list[0])
+	}
+}
+
+func TestHandlerListEmpty(t *testing.T) {
+	h := NewHandler(NewRegistry(), "admin-secret", nil)
+	rec := doRequest(t, h, "GET", "/sessions", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var list []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if list == nil || len(list) != 0 {
+		t.Fatalf("expected empty JSON array, got %s", rec.Body.String())
+	}
+}
+
+func TestHandlerGetSession(t *testing.T) {
+	reg := NewRegistry()
+	id := reg.Register(&Entry{Program: "ffprobe", StartTime: time.Now()})
+	h := NewHandler(reg, "admin-secret", nil)
+
+	rec := doRequest(t, h, "GET", "/sessions/"+id, "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var info SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if info.ID != id || info.Program != "ffprobe" {
+		t.Errorf("unexpected session: %+v", info)
+	}
+
+	rec = doRequest(t, h, "GET", "/sessions/unknown", "admin-secret")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestHandlerDeleteSession(t *testing.T) {
+	reg := NewRegistry()
+	id := reg.Register(&Entry{Program: "ffmpeg", StartTime: time.Now()})
+	h := NewHandler(reg, "admin-secret", nil)
+
+	rec := doRequest(t, h, "DELETE", "/sessions/"+id, "admin-secret")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", rec.Code)
+	}
+
+	rec = doRequest(t, h, "DELETE", "/sessions/unknown", "admin-secret")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestHandlerMethodNotAllowed(t *testing.T) {
+	h := NewHandler(NewRegistry(), "admin-secret", nil)
+	rec := doRequest(t, h, "POST", "/sessions", "admin-secret")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want 405", rec.Code)
+	}
+}
+
+func TestHandlerDrain(t *testing.T) {
+	var calls int
+	h := NewHandler(NewRegistry(), "admin-secret", func() { calls++ })
+
+	rec := doRequest(t, h, "POST", "/drain", "admin-secret")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", rec.Code)
+	}
+	if calls != 1 {
+		t.Errorf("drain called %d times, want 1", calls)
+	}
+
+	rec = doRequest(t, h, "POST", "/drain", "wrong-secret")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated drain: status = %d, want 401", rec.Code)
+	}
+	if calls != 1 {
+		t.Errorf("drain called %d times after unauthenticated request, want 1", calls)
+	}
+}
+
+func TestHandlerDrainDisabled(t *testing.T) {
+	h := NewHandler(NewRegistry(), "admin-secret", nil)
+	rec := doRequest(t, h, "POST", "/drain", "admin-secret")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+}
+
+func TestHandlerCapture(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	sess := session.NewSession(conn, process.NewProcess("true", nil))
+
+	reg := NewRegistry()
+	dir := t.TempDir()
+	id := reg.Register(&Entry{Program: "ffmpeg", StartTime: time.Now(), Session: sess, CaptureDir: dir})
+	disabled := reg.Register(&Entry{Program: "ffmpeg", StartTime: time.Now(), Session: sess})
+	h := NewHandler(reg, "admin-secret", nil)
+
+	rec := doRequest(t, h, "POST", "/sessions/"+id+"/capture", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var started map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	path := started["capture"]
+	if filepath.Dir(path) != dir {
+		t.Fatalf("capture = %q, want a file in %s", path, dir)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = doRequest(t, h, "POST", "/sessions/"+id+"/capture", "admin-secret")
+	if !strings.Contains(rec.Body.String(), path) {
+		t.Errorf("second start = %s, want the same capture", rec.Body)
+	}
+	var info SessionInfo
+	json.Unmarshal(doRequest(t, h, "GET", "/sessions/"+id, "admin-secret").Body.Bytes(), &info)
+	if info.Capture != path {
+		t.Errorf("info.Capture = %q, want %q", info.Capture, path)
+	}
+
+	rec = doRequest(t, h, "DELETE", "/sessions/"+id+"/capture", "admin-secret")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("stop status = %d, want 204", rec.Code)
+	}
+	info = SessionInfo{}
+	json.Unmarshal(doRequest(t, h, "GET", "/sessions/"+id, "admin-secret").Body.Bytes(), &info)
+	if info.Capture != "" {
+		t.Errorf("info.Capture = %q after stopping", info.Capture)
+	}
+
+	if rec := doRequest(t, h, "POST", "/sessions/"+disabled+"/capture", "admin-secret"); rec.Code != http.StatusConflict {
+		t.Errorf("without a capture dir: status = %d, want 409", rec.Code)
+	}
+	if rec := doRequest(t, h, "POST", "/sessions/unknown/capture", "admin-secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,286 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// ErrNotFound is returned when a session ID is not in the registry.
+var ErrNotFound = errors.New("session not found")
+
+// ErrDraining is returned by TryAdd once the registry is draining.
+var ErrDraining = errors.New("draining")
+
+// ErrCaptureDisabled is returned when asked to record a session that has
+// nowhere to record to.
+var ErrCaptureDisabled = errors.New("capture is not enabled")
+
+// Proc is the running job behind a session. Both *process.Process and
+// *session.Session, which follows a job across fallback reruns, satisfy it.
+type Proc interface {
+	PID() int
+	Terminate()
+}
+
+// Entry describes one running session. Proc and Session are used for live
+// counters and termination; everything else is fixed at registration.
+type Entry struct {
+	RemoteAddr string
+	Program    string
+	Args       []string
+	StartTime  time.Time
+	Proc       Proc
+	Session    *session.Session
+	CaptureDir string // where StartCapture records to; empty disables it
+
+	id string
+}
+
+// SessionInfo is the JSON view of a running session.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Program    string    `json:"program"`
+	Args       []string  `json:"args"`
+	StartTime  time.Time `json:"startTime"`
+	PID        int       `json:"pid"`
+	BytesIn    uint64    `json:"bytesIn"`
+	BytesOut   uint64    `json:"bytesOut"`
+	Capture    string    `json:"capture,omitempty"` // path of the capture being recorded
+}
+
+// Registry tracks the sessions currently running on the server.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+	removed chan struct{} // closed and replaced on every Unregister
+	// draining is set by Drain, after which TryAdd refuses new sessions
+	draining bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]*Entry),
+		removed: make(chan struct{}),
+	}
+}
+
+// Register adds an entry and returns its newly assigned session ID.
+func (r *Registry) Register(e *Entry) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addLocked(e)
+}
+
+// TryAdd registers e like Register unless the registry is draining, in
+// which case it returns ErrDraining. Checking and adding under one lock
+// means a session either counts for WaitIdle or is refused.
+func (r *Registry) TryAdd(e *Entry) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return "", ErrDraining
+	}
+	return r.addLocked(e), nil
+}
+
+func (r *Registry) addLocked(e *Entry) string {
+	for {
+		id := newID()
+		if _, exists := r.entries[id]; exists {
+			continue
+		}
+		e.id = id
+		r.entries[id] = e
+		return id
+	}
+}
+
+// Drain makes TryAdd refuse new sessions from now on.
+func (r *Registry) Drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+}
+
+// Draining reports whether Drain has been called.
+func (r *Registry) Draining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// Unregister removes a session. Unknown IDs are ignored.
+func (r *Registry) Unregister(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[id]; !ok {
+		return
+	}
+	delete(r.entries, id)
+	close(r.removed)
+	r.removed = make(chan struct{})
+}
+
+// WaitIdle blocks until no sessions are registered or ctx is done.
+func (r *Registry) WaitIdle(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		if len(r.entries) == 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		removed := r.removed
+		r.mu.Unlock()
+
+		select {
+		case <-removed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Len returns the number of registered sessions.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// List returns a snapshot of all sessions, oldest first.
+func (r *Registry) List() []SessionInfo {
+	r.mu.Lock()
+	entries := make([]*Entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].StartTime.Equal(entries[j].StartTime) {
+			return entries[i].id < entries[j].id
+		}
+		return entries[i].StartTime.Before(entries[j].StartTime)
+	})
+
+	infos := make([]SessionInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e.info()
+	}
+	return infos
+}
+
+// Get returns a snapshot of a single session.
+func (r *Registry) Get(id string) (SessionInfo, error) {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok {
+		return SessionInfo{}, ErrNotFound
+	}
+	return e.info(), nil
+}
+
+// Terminate stops a session's process with the SIGTERM→SIGKILL escalation
+// of process.Terminate. It returns once termination has been initiated; the
+// session unregisters itself when its process exits.
+func (r *Registry) Terminate(id string) error {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	if e.Proc != nil {
+		go e.Proc.Terminate()
+	}
+	return nil
+}
+
+// StartCapture records a session's messages to a new file in its
+// CaptureDir, and returns the file's path. A session already being
+// recorded keeps its capture, whose path is returned.
+func (r *Registry) StartCapture(id string) (string, error) {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok {
+		return "", ErrNotFound
+	}
+	if e.Session == nil || e.CaptureDir == "" {
+		return "", ErrCaptureDisabled
+	}
+	if path := e.Session.CapturePath(); path != "" {
+		return path, nil
+	}
+	w, path, err := capture.CreateIn(e.CaptureDir, id, capture.SideServer)
+	if err != nil {
+		return "", fmt.Errorf("failed to create capture: %w", err)
+	}
+	e.Session.SetCapture(w, path)
+	return path, nil
+}
+
+// StopCapture stops recording a session, if it is being recorded.
+func (r *Registry) StopCapture(id string) error {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	if e.Session == nil {
+		return nil
+	}
+	if err := e.Session.SetCapture(nil, ""); err != nil {
+		return fmt.Errorf("failed to write capture: %w", err)
+	}
+	return nil
+}
+
+// TerminateAll initiates termination of every registered session.
+func (r *Registry) TerminateAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.Proc != nil {
+			go e.Proc.Terminate()
+		}
+	}
+}
+
+func (e *Entry) info() SessionInfo {
+	info := SessionInfo{
+		ID:         e.id,
+		RemoteAddr: e.RemoteAddr,
+		Program:    e.Program,
+		Args:       e.Args,
+		StartTime:  e.StartTime,
+	}
+	if e.Proc != nil {
+		info.PID = e.Proc.PID()
+	}
+	if e.Session != nil {
+		stats := e.Session.Stats()
+		info.BytesIn = stats.BytesIn
+		info.BytesOut = stats.BytesOut
+		info.Capture = e.Session.CapturePath()
+	}
+	return info
+}
+
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,229 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
+)
+
+func TestRegisterAssignsUniqueIDs(t *testing.T) {
+	reg := NewRegistry()
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := reg.Register(&Entry{StartTime: time.Now()})
+		if id == "" {
+			t.Fatal("Register returned empty ID")
+		}
+		if seen[id] {
+			t.Fatalf("duplicate ID %q", id)
+		}
+		seen[id] = true
+	}
+	if reg.Len() != 100 {
+		t.Fatalf("Len = %d, want 100", reg.Len())
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	reg := NewRegistry()
+	id := reg.Register(&Entry{})
+	reg.Unregister(id)
+	if reg.Len() != 0 {
+		t.Fatalf("Len = %d after Unregister, want 0", reg.Len())
+	}
+	// Unknown IDs are ignored
+	reg.Unregister("does-not-exist")
+}
+
+func TestListOrderedByStartTime(t *testing.T) {
+	reg := NewRegistry()
+	now := time.Now()
+	reg.Register(&Entry{Program: "second", StartTime: now.Add(time.Second)})
+	reg.Register(&Entry{Program: "first", StartTime: now})
+	reg.Register(&Entry{Program: "third", StartTime: now.Add(2 * time.Second)})
+
+	list := reg.List()
+	if len(list) != 3 {
+		t.Fatalf("List returned %d entries, want 3", len(list))
+	}
+	for i, want := range []string{"first", "second", "third"} {
+		if list[i].Program != want {
+			t.Errorf("list[%d].Program = %q, want %q", i, list[i].Program, want)
+		}
+	}
+}
+
+func TestGetReturnsInfo(t *testing.T) {
+	reg := NewRegistry()
+	start := time.Now()
+	id := reg.Register(&Entry{
+		RemoteAddr: "10.0.0.1:1234",
+		Program:    "ffmpeg",
+		Args:       []string{"-i", "in.mkv"},
+		StartTime:  start,
+	})
+
+	info, err := reg.Get(id)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info.ID != id || info.RemoteAddr != "10.0.0.1:1234" || info.Program != "ffmpeg" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if len(info.Args) != 2 || info.Args[1] != "in.mkv" {
+		t.Errorf("Args = %v", info.Args)
+	}
+	if !info.StartTime.Equal(start) {
+		t.Errorf("StartTime = %v, want %v", info.StartTime, start)
+	}
+	if info.PID != 0 {
+		t.Errorf("PID = %d for entry without process, want 0", info.PID)
+	}
+}
+
+func TestGetUnknown(t *testing.T) {
+	reg := NewRegistry()
+	if _, err := reg.Get("nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestTerminateUnknown(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.Terminate("nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestTerminateStopsProcess(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		t.Skip("signal tests only on unix")
+	}
+
+	proc := process.NewProcess("sleep", []string{"3600"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := NewRegistry()
+	id := reg.Register(&Entry{Program: "sleep", StartTime: time.Now(), Proc: proc})
+
+	info, err := reg.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PID != proc.PID() || info.PID == 0 {
+		t.Errorf("PID = %d, want %d", info.PID, proc.PID())
+	}
+
+	if err := reg.Terminate(id); err != nil {
+		t.Fatalf("Terminate failed: %v", err)
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		code, _ := proc.Wait()
+		done <- code
+	}()
+	select {
+	case code := <-done:
+		if code != 128+15 {
+			t.Errorf("exit code = %d, want %d (SIGTERM)", code, 128+15)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("process did not exit after Terminate")
+	}
+}
+
+func TestWaitIdleReturnsWhenEmpty(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("WaitIdle on empty registry: %v", err)
+	}
+
+	a := reg.Register(&Entry{})
+	b := reg.Register(&Entry{})
+
+	done := make(chan error, 1)
+	go func() { done <- reg.WaitIdle(context.Background()) }()
+
+	reg.Unregister(a)
+	select {
+	case <-done:
+		t.Fatal("WaitIdle returned while a session was still registered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reg.Unregister(b)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitIdle returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitIdle did not return after last Unregister")
+	}
+}
+
+func TestWaitIdleContextDeadline(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register(&Entry{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := reg.WaitIdle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestTerminateAll(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		t.Skip("signal tests only on unix")
+	}
+
+	reg := NewRegistry()
+	var procs []*process.Process
+	for i := 0; i < 3; i++ {
+		proc := process.NewProcess("sleep", []string{"3600"})
+		if err := proc.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		procs = append(procs, proc)
+		reg.Register(&Entry{Proc: proc})
+	}
+	// Entries without a process are skipped
+	reg.Register(&Entry{})
+
+	reg.TerminateAll()
+
+	for i, proc := range procs {
+		done := make(chan struct{})
+		go func() {
+			proc.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("process %d did not exit after TerminateAll", i)
+		}
+	}
+}
+
+func TestTryAddWhileDraining(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.TryAdd(&Entry{Program: "ffmpeg"}); err != nil {
+		t.Fatalf("TryAdd before Drain: %v", err)
+	}
+	r.Drain()
+	if _, err := r.TryAdd(&Entry{Program: "ffmpeg"}); err != ErrDraining {
+		t.Fatalf("TryAdd after Drain = %v, want ErrDraining", err)
+	}
+	if !r.Draining() || r.Len() != 1 {
+		t.Errorf("Draining = %v, Len = %d; want true, 1", r.Draining(), r.Len())
+	}
+}
@@ -4,35 +4,91 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"hash"
 
 	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
 )
 
 // Sign computes the HMAC-SHA256 signature for a command payload.
-// The signature covers: version + nonce + program + argc + [len + arg]...
-// Args are length-prefixed to avoid null-byte ambiguity.
-func Sign(secret string, version uint8, nonce [protocol.NonceLength]byte, program uint8, args []string) [protocol.HMACLength]byte {
+// The signature covers: version + nonce + len + program + argc +
+// [len + arg]..., followed by envc + [len + entry]... when env is not empty
+// or a profile is given, and by len + profile when a profile is given.
+// Everything is length-prefixed to avoid null-byte ambiguity.
+func Sign(secret string, version uint8, nonce [protocol.NonceLength]byte, program string, args, env []string, profile string) [protocol.HMACLength]byte {
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write([]byte{version})
 	mac.Write(nonce[:])
-	mac.Write([]byte{program})
+	mac.Write([]byte{uint8(len(program))})
+	mac.Write([]byte(program))
+	writeStrings(mac, args)
+	if len(env) > 0 || profile != "" {
+		writeStrings(mac, env)
+	}
+	if profile != "" {
+		mac.Write([]byte{uint8(len(profile))})
+		mac.Write([]byte(profile))
+	}
+
+	var sig [protocol.HMACLength]byte
+	copy(sig[:], mac.Sum(nil))
+	return sig
+}
+
+func writeStrings(mac hash.Hash, list []string) {
 	var countBuf [2]byte
-	binary.BigEndian.PutUint16(countBuf[:], uint16(len(args)))
+	binary.BigEndian.PutUint16(countBuf[:], uint16(len(list)))
 	mac.Write(countBuf[:])
-	for _, arg := range args {
+	for _, s := range list {
 		var lenBuf [2]byte
-		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(arg)))
+		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(s)))
 		mac.Write(lenBuf[:])
-		mac.Write([]byte(arg))
+		mac.Write([]byte(s))
 	}
+}
+
+// Verify checks the HMAC-SHA256 signature against the expected value.
+func Verify(secret string, version uint8, nonce [protocol.NonceLength]byte, signature [protocol.HMACLength]byte, program string, args, env []string, profile string) bool {
+	expected := Sign(secret, version, nonce, program, args, env, profile)
+	return hmac.Equal(signature[:], expected[:])
+}
+
+// SignResume computes the HMAC-SHA256 signature for a resume request. The
+// signature covers: version + token + attempt + received, so only a client
+// that knows the secret can take over a session, and only with a fresh
+// attempt number.
+func SignResume(secret string, version uint8, token [protocol.TokenLength]byte, attempt uint32, received uint64) [protocol.HMACLength]byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte{version})
+	mac.Write(token[:])
+	mac.Write(binary.BigEndian.AppendUint32(nil, attempt))
+	mac.Write(binary.BigEndian.AppendUint64(nil, received))
 
 	var sig [protocol.HMACLength]byte
 	copy(sig[:], mac.Sum(nil))
 	return sig
 }
 
-// Verify checks the HMAC-SHA256 signature against the expected value.
-func Verify(secret string, version uint8, nonce [protocol.NonceLength]byte, signature [protocol.HMACLength]byte, program uint8, args []string) bool {
-	expected := Sign(secret, version, nonce, program, args)
+// VerifyResume checks a resume request's signature.
+func VerifyResume(secret string, version uint8, token [protocol.TokenLength]byte, attempt uint32, received uint64, signature [protocol.HMACLength]byte) bool {
+	expected := SignResume(secret, version, token, attempt, received)
+	return hmac.Equal(signature[:], expected[:])
+}
+
+// SignMux computes the HMAC-SHA256 signature that opens a multiplexed
+// connection. The signature covers: version + "mux" + nonce.
+func SignMux(secret string, version uint8, nonce [protocol.NonceLength]byte) [protocol.HMACLength]byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte{version})
+	mac.Write([]byte("mux"))
+	mac.Write(nonce[:])
+
+	var sig [protocol.HMACLength]byte
+	copy(sig[:], mac.Sum(nil))
+	return sig
+}
+
+// VerifyMux checks the signature of a multiplexed connection request.
+func VerifyMux(secret string, version uint8, nonce [protocol.NonceLength]byte, signature [protocol.HMACLength]byte) bool {
+	expected := SignMux(secret, version, nonce)
 	return hmac.Equal(signature[:], expected[:])
 }
@@ -14,9 +14,9 @@ func TestSignAndVerify(t *testing.T) {
 	program := protocol.ProgramFFmpeg
 	args := []string{"-i", "/media/input.mkv", "-c:v", "h264_nvenc", "output.mp4"}
 
-	sig := Sign(secret, version, nonce, program, args)
+	sig := Sign(secret, version, nonce, program, args, nil, "")
 
-	if !Verify(secret, version, nonce, sig, program, args) {
+	if !Verify(secret, version, nonce, sig, program, args, nil, "") {
 		t.Fatal("Verify should succeed with correct signature")
 	}
 }
@@ -25,9 +25,9 @@ func TestVerifyWrongSecret(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{1, 2, 3}
 	args := []string{"-version"}
 
-	sig := Sign("correct-secret", protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign("correct-secret", protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if Verify("wrong-secret", protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if Verify("wrong-secret", protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should fail with wrong secret")
 	}
 }
@@ -36,9 +36,9 @@ func TestVerifyWrongArgs(t *testing.T) {
 	secret := "my-secret"
 	nonce := [protocol.NonceLength]byte{5, 6, 7}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"-i", "input.mkv"})
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"-i", "input.mkv"}, nil, "")
 
-	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{"-i", "different.mkv"}) {
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{"-i", "different.mkv"}, nil, "") {
 		t.Fatal("Verify should fail with different args")
 	}
 }
@@ -48,9 +48,9 @@ func TestVerifyWrongProgram(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{}
 	args := []string{"-version"}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFprobe, args) {
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFprobe, args, nil, "") {
 		t.Fatal("Verify should fail with different program")
 	}
 }
@@ -60,9 +60,9 @@ func TestVerifyWrongVersion(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{}
 	args := []string{"-version"}
 
-	sig := Sign(secret, 0x05, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, 0x05, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if Verify(secret, 0x06, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if Verify(secret, 0x06, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should fail with different version")
 	}
 }
@@ -74,9 +74,9 @@ func TestVerifyWrongNonce(t *testing.T) {
 	nonce1 := [protocol.NonceLength]byte{1, 2, 3}
 	nonce2 := [protocol.NonceLength]byte{4, 5, 6}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce1, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce1, protocol.ProgramFFmpeg, args, nil, "")
 
-	if Verify(secret, protocol.CurrentVersion, nonce2, sig, protocol.ProgramFFmpeg, args) {
+	if Verify(secret, protocol.CurrentVersion, nonce2, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should fail with different nonce")
 	}
 }
@@ -86,8 +86,8 @@ func TestSignDeterministic(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{42}
 	args := []string{"a", "b", "c"}
 
-	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
-	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
+	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
 	if sig1 != sig2 {
 		t.Fatal("Sign should be deterministic")
@@ -98,9 +98,9 @@ func TestSignEmptyArgs(t *testing.T) {
 	secret := "test"
 	nonce := [protocol.NonceLength]byte{}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{})
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{}, nil, "")
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{}) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{}, nil, "") {
 		t.Fatal("should work with empty args")
 	}
 }
@@ -113,9 +113,9 @@ func TestSignManyArgs(t *testing.T) {
 		args[i] = strings.Repeat("x", i+1)
 	}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should succeed with 100 args")
 	}
 }
@@ -126,9 +126,9 @@ func TestSignLongArgs(t *testing.T) {
 	longArg := strings.Repeat("A", 10*1024) // 10KB
 	args := []string{longArg}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should succeed with 10KB arg")
 	}
 }
@@ -138,9 +138,9 @@ func TestSignEmptySecret(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{1, 2, 3}
 	args := []string{"-version"}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should succeed with empty secret")
 	}
 }
@@ -149,9 +149,9 @@ func TestVerifyDifferentArgCount(t *testing.T) {
 	secret := "test-secret"
 	nonce := [protocol.NonceLength]byte{10}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b", "c"})
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b", "c"}, nil, "")
 
-	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{"a", "b"}) {
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{"a", "b"}, nil, "") {
 		t.Fatal("Verify should fail when arg count differs (3 signed, 2 verified)")
 	}
 }
@@ -160,9 +160,9 @@ func TestVerifyExtraArg(t *testing.T) {
 	secret := "test-secret"
 	nonce := [protocol.NonceLength]byte{11}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b"})
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b"}, nil, "")
 
-	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{"a", "b", "c"}) {
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, []string{"a", "b", "c"}, nil, "") {
 		t.Fatal("Verify should fail when extra arg added (2 signed, 3 verified)")
 	}
 }
@@ -177,9 +177,9 @@ func TestSignSpecialCharArgs(t *testing.T) {
 		"\U0001f600\U0001f525\U0001f4a5", // emoji
 	}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should succeed with special character args")
 	}
 }
@@ -189,9 +189,9 @@ func TestVerifyZeroNonce(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{} // all zeros
 	args := []string{"-i", "input.mp4"}
 
-	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should succeed with all-zero nonce")
 	}
 }
@@ -202,8 +202,8 @@ func TestSignNullByteArgDistinct(t *testing.T) {
 	secret := "null-test"
 	nonce := [protocol.NonceLength]byte{1}
 
-	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a\x00b"})
-	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b"})
+	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a\x00b"}, nil, "")
+	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b"}, nil, "")
 
 	if sig1 == sig2 {
 		t.Fatal("args with embedded null byte must produce different signature from split args")
@@ -216,8 +216,8 @@ func TestSignArgCountMatters(t *testing.T) {
 	secret := "count-test"
 	nonce := [protocol.NonceLength]byte{2}
 
-	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"ab"})
-	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b"})
+	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"ab"}, nil, "")
+	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "b"}, nil, "")
 
 	if sig1 == sig2 {
 		t.Fatal("different arg counts must produce different signatures")
@@ -229,17 +229,131 @@ func TestSignAllProgramTypes(t *testing.T) {
 	nonce := [protocol.NonceLength]byte{30}
 	args := []string{"-version"}
 
-	sigFFmpeg := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args)
-	sigFFprobe := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFprobe, args)
+	sigFFmpeg := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "")
+	sigFFprobe := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFprobe, args, nil, "")
 
 	if sigFFmpeg == sigFFprobe {
 		t.Fatal("Signatures for ProgramFFmpeg and ProgramFFprobe should differ")
 	}
 
-	if !Verify(secret, protocol.CurrentVersion, nonce, sigFFmpeg, protocol.ProgramFFmpeg, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sigFFmpeg, protocol.ProgramFFmpeg, args, nil, "") {
 		t.Fatal("Verify should succeed for ProgramFFmpeg")
 	}
-	if !Verify(secret, protocol.CurrentVersion, nonce, sigFFprobe, protocol.ProgramFFprobe, args) {
+	if !Verify(secret, protocol.CurrentVersion, nonce, sigFFprobe, protocol.ProgramFFprobe, args, nil, "") {
 		t.Fatal("Verify should succeed for ProgramFFprobe")
 	}
 }
+
+func TestSignEnv(t *testing.T) {
+	secret := "env-test"
+	nonce := [protocol.NonceLength]byte{40}
+	args := []string{"-version"}
+	env := []string{"TZ=Europe/Berlin"}
+
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, env, "")
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, env, "") {
+		t.Fatal("Verify should succeed with matching env")
+	}
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, []string{"TZ=UTC"}, "") {
+		t.Fatal("Verify should fail with tampered env")
+	}
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
+		t.Fatal("Verify should fail with env stripped")
+	}
+}
+
+func TestSignEmptyEnvUnchanged(t *testing.T) {
+	// An empty env is left out of the signature, so commands without env
+	// still verify against servers that predate it
+	secret := "compat"
+	nonce := [protocol.NonceLength]byte{41}
+	args := []string{"-i", "in.mkv"}
+
+	if Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "") !=
+		Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, []string{}, "") {
+		t.Fatal("nil and empty env must sign the same")
+	}
+}
+
+func TestSignEnvNotConfusedWithArgs(t *testing.T) {
+	secret := "boundary"
+	nonce := [protocol.NonceLength]byte{42}
+
+	sig1 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a", "TZ=UTC"}, nil, "")
+	sig2 := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, []string{"a"}, []string{"TZ=UTC"}, "")
+	if sig1 == sig2 {
+		t.Fatal("moving an entry between args and env must change the signature")
+	}
+}
+
+func TestSignCustomProgram(t *testing.T) {
+	secret := "programs"
+	nonce := [protocol.NonceLength]byte{43}
+	args := []string{"-i", "in.mkv"}
+
+	sig := Sign(secret, protocol.CurrentVersion, nonce, "ffmpeg-av1", args, nil, "")
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, "ffmpeg-av1", args, nil, "") {
+		t.Fatal("Verify should succeed for a custom program name")
+	}
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
+		t.Fatal("Verify should fail with a different program name")
+	}
+}
+
+func TestSignProfile(t *testing.T) {
+	secret := "profiles"
+	nonce := [protocol.NonceLength]byte{44}
+	args := []string{"-i", "in.mkv"}
+
+	sig := Sign(secret, protocol.CurrentVersion, nonce, protocol.ProgramFFmpeg, args, nil, "beta")
+	if !Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "beta") {
+		t.Fatal("Verify should succeed with matching profile")
+	}
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "stable") {
+		t.Fatal("Verify should fail with a different profile")
+	}
+	if Verify(secret, protocol.CurrentVersion, nonce, sig, protocol.ProgramFFmpeg, args, nil, "") {
+		t.Fatal("Verify should fail with profile stripped")
+	}
+}
+
+func TestSignResume(t *testing.T) {
+	secret := "resume"
+	token := [protocol.TokenLength]byte{7}
+
+	sig := SignResume(secret, protocol.CurrentVersion, token, 1, 100)
+	if !VerifyResume(secret, protocol.CurrentVersion, token, 1, 100, sig) {
+		t.Fatal("VerifyResume should succeed with matching fields")
+	}
+	if VerifyResume("wrong", protocol.CurrentVersion, token, 1, 100, sig) {
+		t.Fatal("VerifyResume should fail with a different secret")
+	}
+	if VerifyResume(secret, protocol.CurrentVersion, token, 2, 100, sig) {
+		t.Fatal("VerifyResume should fail with a different attempt")
+	}
+	if VerifyResume(secret, protocol.CurrentVersion, token, 1, 99, sig) {
+		t.Fatal("VerifyResume should fail with a different count")
+	}
+	if VerifyResume(secret, protocol.CurrentVersion, [protocol.TokenLength]byte{8}, 1, 100, sig) {
+		t.Fatal("VerifyResume should fail with a different token")
+	}
+}
+
+func TestSignMux(t *testing.T) {
+	secret := "mux"
+	nonce := [protocol.NonceLength]byte{1, 2, 3}
+
+	sig := SignMux(secret, protocol.CurrentVersion, nonce)
+	if !VerifyMux(secret, protocol.CurrentVersion, nonce, sig) {
+		t.Fatal("VerifyMux should succeed with matching fields")
+	}
+	if VerifyMux("wrong", protocol.CurrentVersion, nonce, sig) {
+		t.Fatal("VerifyMux should fail with a different secret")
+	}
+	if VerifyMux(secret, protocol.CurrentVersion, [protocol.NonceLength]byte{9}, sig) {
+		t.Fatal("VerifyMux should fail with a different nonce")
+	}
+	if sig == Sign(secret, protocol.CurrentVersion, nonce, "", nil, nil, "") {
+		t.Fatal("mux and command signatures must differ")
+	}
+}
@@ -0,0 +1,264 @@
+// Package capture records the messages of a session to a file, and reads
+// them back for inspection.
+//
+// A capture file starts with a header:
+//
+//	[magic "FFOIPCAP"][format 1B][protocol version 1B][side 1B][start unix nano 8B]
+//
+// followed by one record per frame, in the order they were sent or
+// received:
+//
+//	[direction 1B][unix nano 8B][type 1B][len 4B][payload]
+//
+// All integers are big-endian. Frames are recorded as they are on the
+// wire, so large messages appear as their MsgFragment frames, and
+// acknowledgements and frames sent again after a resume are included.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+const (
+	magic         = "FFOIPCAP"
+	formatVersion = uint8(1)
+	headerLength  = len(magic) + 1 + 1 + 1 + 8
+	recordHeader  = 1 + 8 + 1 + 4
+)
+
+// Side is the end of the connection a capture was taken on.
+type Side uint8
+
+const (
+	SideClient = Side('c')
+	SideServer = Side('s')
+)
+
+func (s Side) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideServer:
+		return "server"
+	default:
+		return fmt.Sprintf("side(0x%02x)", uint8(s))
+	}
+}
+
+// Direction is whether a frame was sent or received by the side that took
+// the capture.
+type Direction uint8
+
+const (
+	Sent     = Direction(1)
+	Received = Direction(2)
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Sent:
+		return "sent"
+	case Received:
+		return "received"
+	default:
+		return fmt.Sprintf("direction(%d)", uint8(d))
+	}
+}
+
+// Header describes a capture.
+type Header struct {
+	Side            Side
+	ProtocolVersion uint8
+	Start           time.Time
+}
+
+// Sender returns the side that sent a frame recorded in direction dir.
+func (h Header) Sender(dir Direction) Side {
+	if (dir == Sent) == (h.Side == SideClient) {
+		return SideClient
+	}
+	return SideServer
+}
+
+// Record is one frame of a capture.
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Message   protocol.Message
+}
+
+// Writer records frames to a capture. It is safe for concurrent use, and
+// stops recording after the first error, which Close returns.
+type Writer struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	c      io.Closer // nil if the underlying writer is not closed with the capture
+	err    error
+	closed bool
+}
+
+// Create creates a capture file at path, which must not exist yet.
+func Create(path string, side Side) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f, side)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	w.c = f
+	return w, nil
+}
+
+// CreateIn creates a new capture file in dir, named after name, and
+// returns it with its path.
+func CreateIn(dir, name string, side Side) (*Writer, string, error) {
+	f, err := os.CreateTemp(dir, name+"-*.ffcap")
+	if err != nil {
+		return nil, "", err
+	}
+	w, err := NewWriter(f, side)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	w.c = f
+	return w, f.Name(), nil
+}
+
+// NewWriter writes the header of a capture to w, and returns a Writer for
+// its records.
+func NewWriter(w io.Writer, side Side) (*Writer, error) {
+	cw := &Writer{w: bufio.NewWriterSize(w, 256*1024)}
+	var header [headerLength]byte
+	copy(header[:], magic)
+	header[len(magic)] = formatVersion
+	header[len(magic)+1] = protocol.CurrentVersion
+	header[len(magic)+2] = uint8(side)
+	binary.BigEndian.PutUint64(header[len(magic)+3:], uint64(time.Now().UnixNano()))
+	if _, err := cw.w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Record adds a frame, timestamped now.
+func (w *Writer) Record(dir Direction, msgType uint8, payload []byte) {
+	w.recordAt(time.Now(), dir, msgType, payload)
+}
+
+func (w *Writer) recordAt(at time.Time, dir Direction, msgType uint8, payload []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.err != nil {
+		return
+	}
+	var header [recordHeader]byte
+	header[0] = uint8(dir)
+	binary.BigEndian.PutUint64(header[1:], uint64(at.UnixNano()))
+	header[9] = msgType
+	binary.BigEndian.PutUint32(header[10:], uint32(len(payload)))
+	if _, err := w.w.Write(header[:]); err != nil {
+		w.err = err
+		return
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		w.err = err
+	}
+}
+
+// Close flushes the capture and closes the file it was created with.
+// Frames recorded after Close are dropped.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if err := w.w.Flush(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.c != nil {
+		if err := w.c.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+// Reader reads the records of a capture.
+type Reader struct {
+	r      *bufio.Reader
+	header Header
+}
+
+// NewReader reads the header of the capture in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	var header [headerLength]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("not a capture file: too short")
+		}
+		return nil, err
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("not a capture file")
+	}
+	if v := header[len(magic)]; v != formatVersion {
+		return nil, fmt.Errorf("unsupported capture format %d", v)
+	}
+	return &Reader{
+		r: br,
+		header: Header{
+			ProtocolVersion: header[len(magic)+1],
+			Side:            Side(header[len(magic)+2]),
+			Start:           time.Unix(0, int64(binary.BigEndian.Uint64(header[len(magic)+3:]))),
+		},
+	}, nil
+}
+
+// Header returns the header of the capture.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next record, or io.EOF after the last one. A capture
+// cut short in the middle of a record, such as one still being written,
+// returns io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Record, error) {
+	var header [recordHeader]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[10:])
+	if n > protocol.MaxPayload {
+		return nil, fmt.Errorf("record payload too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &Record{
+		Direction: Direction(header[0]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:]))),
+		Message:   protocol.Message{Type: header[9], Payload: payload},
+	}, nil
+}
@@ -0,0 +1,138 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	before := time.Now()
+	w, err := NewWriter(&buf, SideServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(Received, protocol.MsgStdin, []byte("hello"))
+	w.Record(Sent, protocol.MsgStdinClose, nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w.Record(Sent, protocol.MsgPing, nil) // dropped after Close
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.Header()
+	if h.Side != SideServer || h.ProtocolVersion != protocol.CurrentVersion {
+		t.Fatalf("header = %+v", h)
+	}
+	if h.Start.Before(before) || h.Start.After(time.Now()) {
+		t.Fatalf("start time %v not between %v and now", h.Start, before)
+	}
+
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Direction != Received || rec.Message.Type != protocol.MsgStdin || string(rec.Message.Payload) != "hello" {
+		t.Fatalf("first record = %+v", rec)
+	}
+	if rec.Time.Before(h.Start) {
+		t.Fatalf("record time %v before start %v", rec.Time, h.Start)
+	}
+	rec, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Direction != Sent || rec.Message.Type != protocol.MsgStdinClose || len(rec.Message.Payload) != 0 {
+		t.Fatalf("second record = %+v", rec)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Next after the last record = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, SideClient)
+	w.Record(Sent, protocol.MsgStdin, []byte("0123456789"))
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Next = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReaderRejectsOtherFiles(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("FFOIP"),
+		"magic":      []byte("NOTACAPTURE-------------"),
+		"format":     append([]byte(magic), 99, protocol.CurrentVersion, 's', 0, 0, 0, 0, 0, 0, 0, 0),
+		"raw frames": {protocol.MsgStdin, 0, 0, 0, 1, 'x', 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := NewReader(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: NewReader succeeded", name)
+		}
+	}
+}
+
+func TestCreateDoesNotOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.ffcap")
+	w, err := Create(path, SideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(Sent, protocol.MsgPing, nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(path, SideClient); err == nil {
+		t.Fatal("Create replaced an existing file")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := r.Next(); err != nil || rec.Message.Type != protocol.MsgPing {
+		t.Fatalf("Next = %+v, %v", rec, err)
+	}
+}
+
+func TestCreateInNamesFiles(t *testing.T) {
+	dir := t.TempDir()
+	seen := make(map[string]bool)
+	for range 3 {
+		w, path, err := CreateIn(dir, "ffmpeg", SideServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if filepath.Dir(path) != dir || !strings.HasPrefix(filepath.Base(path), "ffmpeg-") || filepath.Ext(path) != ".ffcap" {
+			t.Errorf("path = %q, want an ffmpeg-*.ffcap file in %s", path, dir)
+		}
+		if seen[path] {
+			t.Errorf("path %q used twice", path)
+		}
+		seen[path] = true
+	}
+}
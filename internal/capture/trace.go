@@ -0,0 +1,594 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+var names = map[uint8]string{
+	protocol.MsgCommand: "Command", protocol.MsgCancel: "Cancel", protocol.MsgExitCode: "ExitCode",
+	protocol.MsgError: "Error", protocol.MsgPing: "Ping", protocol.MsgPong: "Pong", protocol.MsgExitReason: "ExitReason",
+	protocol.MsgSession: "Session", protocol.MsgResume: "Resume", protocol.MsgResumeOk: "ResumeOk",
+	protocol.MsgAck: "Ack", protocol.MsgFragment: "Fragment",
+	protocol.MsgStdin: "Stdin", protocol.MsgStdinClose: "StdinClose", protocol.MsgStdout: "Stdout",
+	protocol.MsgStderr: "Stderr", protocol.MsgCredit: "Credit", protocol.MsgProgress: "Progress",
+	protocol.MsgOpen: "Open", protocol.MsgRead: "Read", protocol.MsgWrite: "Write", protocol.MsgSeek: "Seek",
+	protocol.MsgClose: "Close", protocol.MsgFstat: "Fstat", protocol.MsgFtruncate: "Ftruncate",
+	protocol.MsgUnlink: "Unlink", protocol.MsgRename: "Rename", protocol.MsgMkdir: "Mkdir",
+	protocol.MsgMux: "Mux", protocol.MsgMuxOk: "MuxOk", protocol.MsgStreamData: "StreamData",
+	protocol.MsgStreamWindow: "StreamWindow", protocol.MsgStreamClose: "StreamClose",
+	protocol.MsgOpenOk: "OpenOk", protocol.MsgReadOk: "ReadOk", protocol.MsgWriteOk: "WriteOk",
+	protocol.MsgSeekOk: "SeekOk", protocol.MsgCloseOk: "CloseOk", protocol.MsgFstatOk: "FstatOk",
+	protocol.MsgFtruncateOk: "FtruncateOk", protocol.MsgUnlinkOk: "UnlinkOk", protocol.MsgRenameOk: "RenameOk",
+	protocol.MsgMkdirOk: "MkdirOk", protocol.MsgIoError: "IoError",
+}
+
+// Name returns the name of a message type, without the Msg prefix.
+func Name(msgType uint8) string {
+	if name, ok := names[msgType]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", msgType)
+}
+
+// Describe summarizes a message in one line, decoding its payload with the
+// protocol's Decode functions. Data is shown by its length only.
+func Describe(msg *protocol.Message) string {
+	s, err := describe(msg)
+	if err != nil {
+		return fmt.Sprintf("malformed (%d bytes): %v", len(msg.Payload), err)
+	}
+	return s
+}
+
+func describe(msg *protocol.Message) (string, error) {
+	p := msg.Payload
+	switch msg.Type {
+	case protocol.MsgCommand:
+		m, err := protocol.DecodeCommandMessage(p)
+		if err != nil {
+			return "", err
+		}
+		s := m.Program + " " + strings.Join(quoteAll(m.Args), " ")
+		if m.Profile != "" {
+			s += fmt.Sprintf(" (profile %q)", m.Profile)
+		}
+		if len(m.Env) > 0 {
+			s += fmt.Sprintf(" env %s", strings.Join(quoteAll(m.Env), " "))
+		}
+		return s, nil
+	case protocol.MsgExitCode:
+		if len(p) != 4 {
+			return "", fmt.Errorf("exit code must be 4 bytes, got %d", len(p))
+		}
+		return fmt.Sprintf("code %d", binary.BigEndian.Uint32(p)), nil
+	case protocol.MsgError, protocol.MsgStderr:
+		return strconv.Quote(truncate(string(p), 200)), nil
+	case protocol.MsgExitReason:
+		m, err := protocol.DecodeExitReasonMessage(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("reason %d %q", m.Reason, m.Message), nil
+	case protocol.MsgSession:
+		m, err := protocol.DecodeSessionMessage(p)
+		if err != nil {
+			return "", err
+		}
+		if m.GracePeriod == 0 {
+			return "not resumable", nil
+		}
+		return fmt.Sprintf("resumable for %v", m.GracePeriod), nil
+	case protocol.MsgResume:
+		m, err := protocol.DecodeResumeMessage(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("attempt %d, received %d", m.Attempt, m.Received), nil
+	case protocol.MsgResumeOk, protocol.MsgAck:
+		n, err := protocol.DecodeCount(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("received %d", n), nil
+	case protocol.MsgFragment:
+		m, err := protocol.DecodeFragmentMessage(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("of %s, %d bytes", Name(m.Type), len(m.Data)), nil
+	case protocol.MsgCredit:
+		m, err := protocol.DecodeCreditMessage(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s +%d", Name(m.Channel), m.Bytes), nil
+	case protocol.MsgProgress:
+		m, err := protocol.DecodeProgressMessage(p)
+		if err != nil {
+			return "", err
+		}
+		var fields []string
+		for _, f := range m.Fields {
+			fields = append(fields, f.Key+"="+f.Value)
+		}
+		return strings.Join(fields, " "), nil
+	case protocol.MsgStreamData:
+		m, err := protocol.DecodeStreamData(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("stream %d, %d bytes", m.StreamID, len(m.Data)), nil
+	case protocol.MsgStreamWindow:
+		m, err := protocol.DecodeStreamWindow(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("stream %d +%d", m.StreamID, m.Increment), nil
+	case protocol.MsgStreamClose:
+		if len(p) != 4 {
+			return "", fmt.Errorf("stream close must be 4 bytes, got %d", len(p))
+		}
+		return fmt.Sprintf("stream %d", binary.BigEndian.Uint32(p)), nil
+	case protocol.MsgOpen:
+		m, err := protocol.DecodeOpenRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d %q %s mode %o", m.RequestID, m.FileID, m.Path, openFlags(m.Flags), m.Mode), nil
+	case protocol.MsgRead:
+		m, err := protocol.DecodeReadRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d, %d bytes", m.RequestID, m.FileID, m.NBytes), nil
+	case protocol.MsgWrite:
+		m, err := protocol.DecodeWriteRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d, %d bytes", m.RequestID, m.FileID, len(m.Data)), nil
+	case protocol.MsgSeek:
+		m, err := protocol.DecodeSeekRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d, %d from %s", m.RequestID, m.FileID, m.Offset, whence(m.Whence)), nil
+	case protocol.MsgClose:
+		m, err := protocol.DecodeCloseRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d", m.RequestID, m.FileID), nil
+	case protocol.MsgFstat:
+		m, err := protocol.DecodeFstatRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d", m.RequestID, m.FileID), nil
+	case protocol.MsgFtruncate:
+		m, err := protocol.DecodeFtruncateRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d file %d to %d", m.RequestID, m.FileID, m.Length), nil
+	case protocol.MsgUnlink:
+		m, err := protocol.DecodeUnlinkRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d %q", m.RequestID, m.Path), nil
+	case protocol.MsgRename:
+		m, err := protocol.DecodeRenameRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d %q to %q", m.RequestID, m.OldPath, m.NewPath), nil
+	case protocol.MsgMkdir:
+		m, err := protocol.DecodeMkdirRequest(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d %q mode %o", m.RequestID, m.Path, m.Mode), nil
+	case protocol.MsgOpenOk:
+		m, err := protocol.DecodeOpenOkResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d size %d", m.RequestID, m.FileSize), nil
+	case protocol.MsgReadOk:
+		m, err := protocol.DecodeReadOkResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d %d bytes", m.RequestID, len(m.Data)), nil
+	case protocol.MsgWriteOk:
+		m, err := protocol.DecodeWriteOkResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d %d bytes", m.RequestID, m.BytesWritten), nil
+	case protocol.MsgSeekOk:
+		m, err := protocol.DecodeSeekOkResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d offset %d", m.RequestID, m.Offset), nil
+	case protocol.MsgFstatOk:
+		m, err := protocol.DecodeFstatOkResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d size %d mode %o", m.RequestID, m.FileSize, m.Mode), nil
+	case protocol.MsgCloseOk, protocol.MsgFtruncateOk, protocol.MsgUnlinkOk, protocol.MsgRenameOk, protocol.MsgMkdirOk:
+		m, err := protocol.DecodeRequestIDResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d", m.RequestID), nil
+	case protocol.MsgIoError:
+		m, err := protocol.DecodeIoErrorResponse(p)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("#%d errno %d", m.RequestID, m.Errno), nil
+	default:
+		if len(p) == 0 {
+			return "", nil
+		}
+		return fmt.Sprintf("%d bytes", len(p)), nil
+	}
+}
+
+func quoteAll(list []string) []string {
+	quoted := make([]string, len(list))
+	for i, s := range list {
+		if s == "" || strings.ContainsAny(s, " \t\n\"'\\") {
+			s = strconv.Quote(s)
+		}
+		quoted[i] = s
+	}
+	return quoted
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func openFlags(flags uint32) string {
+	var s string
+	switch flags & 0x3 {
+	case protocol.FioOWRONLY:
+		s = "wronly"
+	case protocol.FioORDWR:
+		s = "rdwr"
+	default:
+		s = "rdonly"
+	}
+	if flags&protocol.FioOCREAT != 0 {
+		s += "|creat"
+	}
+	if flags&protocol.FioOTRUNC != 0 {
+		s += "|trunc"
+	}
+	return s
+}
+
+func whence(w uint8) string {
+	switch w {
+	case protocol.FioSeekSet:
+		return "start"
+	case protocol.FioSeekCur:
+		return "current"
+	case protocol.FioSeekEnd:
+		return "end"
+	default:
+		return fmt.Sprintf("whence %d", w)
+	}
+}
+
+// requestID returns the RequestID of a file I/O request or response.
+func requestID(msg *protocol.Message) (uint16, bool) {
+	if !protocol.IsFileIORequest(msg.Type) && !protocol.IsFileIOResponse(msg.Type) || len(msg.Payload) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(msg.Payload), true
+}
+
+// fileOp is a file I/O request, and once it arrives, its response.
+type fileOp struct {
+	request  *protocol.Message
+	sent     time.Time
+	file     *openFile // nil for requests by path, other than open
+	response *protocol.Message
+	latency  time.Duration
+}
+
+// openFile is a file from its open to its close.
+type openFile struct {
+	id     uint16
+	path   string
+	ops    []*fileOp
+	failed bool // the open failed
+	closed bool
+}
+
+// tracer follows the records of a capture to write its trace.
+type tracer struct {
+	w      io.Writer
+	header Header
+
+	partial map[Direction]map[uint8][]byte // fragments received so far
+	pending map[uint16]*fileOp             // requests without a response, by RequestID
+	open    map[uint16]*openFile           // files open now, by FileID
+	files   []*openFile
+	others  []*fileOp // requests by path: unlink, rename, mkdir
+	ops     []*fileOp // every request, in order
+}
+
+// Inspect writes a human-readable trace of the capture in r to w: one line
+// per message, then a timeline of the operations on each file, and the
+// latency of file I/O by request type.
+func Inspect(w io.Writer, r io.Reader) error {
+	cr, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	t := &tracer{
+		w:       w,
+		header:  cr.Header(),
+		partial: make(map[Direction]map[uint8][]byte),
+		pending: make(map[uint16]*fileOp),
+		open:    make(map[uint16]*openFile),
+	}
+	fmt.Fprintf(w, "capture taken on the %s, protocol 0x%02x, started %s\n\n",
+		t.header.Side, t.header.ProtocolVersion, t.header.Start.Format(time.RFC3339Nano))
+
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				fmt.Fprintf(w, "(capture ends in the middle of a record)\n")
+				break
+			}
+			return err
+		}
+		t.record(rec)
+	}
+	t.summary()
+	return nil
+}
+
+// arrow shows which way a message went.
+func (t *tracer) arrow(dir Direction) string {
+	if t.header.Sender(dir) == SideClient {
+		return "C->S"
+	}
+	return "S->C"
+}
+
+func (t *tracer) offset(at time.Time) string {
+	return fmt.Sprintf("%+11.6fs", at.Sub(t.header.Start).Seconds())
+}
+
+func (t *tracer) record(rec *Record) {
+	msg := &rec.Message
+	line := fmt.Sprintf("%s  %s  %-12s %s", t.offset(rec.Time), t.arrow(rec.Direction), Name(msg.Type), Describe(msg))
+
+	// Messages split into fragments are traced once whole
+	if msg.Type == protocol.MsgFragment {
+		if f, err := protocol.DecodeFragmentMessage(msg.Payload); err == nil {
+			if t.partial[rec.Direction] == nil {
+				t.partial[rec.Direction] = make(map[uint8][]byte)
+			}
+			t.partial[rec.Direction][f.Type] = append(t.partial[rec.Direction][f.Type], f.Data...)
+			return
+		}
+	} else if data, ok := t.partial[rec.Direction][msg.Type]; ok {
+		delete(t.partial[rec.Direction], msg.Type)
+		msg = &protocol.Message{Type: msg.Type, Payload: append(data, msg.Payload...)}
+		line = fmt.Sprintf("%s  %s  %-12s %s (in fragments)", t.offset(rec.Time), t.arrow(rec.Direction), Name(msg.Type), Describe(msg))
+	}
+
+	if id, ok := requestID(msg); ok {
+		if protocol.IsFileIORequest(msg.Type) {
+			t.request(id, msg, rec.Time)
+		} else if op := t.response(id, msg, rec.Time); op != nil {
+			line += fmt.Sprintf("  [%s after %s]", formatLatency(op.latency), Name(op.request.Type))
+		}
+	}
+	fmt.Fprintln(t.w, strings.TrimRight(line, " "))
+}
+
+func (t *tracer) request(id uint16, msg *protocol.Message, at time.Time) {
+	op := &fileOp{request: msg, sent: at}
+	t.pending[id] = op
+	t.ops = append(t.ops, op)
+
+	switch msg.Type {
+	case protocol.MsgOpen:
+		req, err := protocol.DecodeOpenRequest(msg.Payload)
+		if err != nil {
+			return
+		}
+		op.file = &openFile{id: req.FileID, path: req.Path}
+		t.files = append(t.files, op.file)
+		op.file.ops = append(op.file.ops, op)
+		return
+	case protocol.MsgUnlink, protocol.MsgRename, protocol.MsgMkdir:
+		t.others = append(t.others, op)
+		return
+	}
+	// The other requests start with the RequestID and FileID
+	if len(msg.Payload) < 4 {
+		return
+	}
+	if f := t.open[binary.BigEndian.Uint16(msg.Payload[2:])]; f != nil {
+		op.file = f
+		f.ops = append(f.ops, op)
+	}
+}
+
+func (t *tracer) response(id uint16, msg *protocol.Message, at time.Time) *fileOp {
+	op := t.pending[id]
+	if op == nil {
+		return nil
+	}
+	delete(t.pending, id)
+	op.response = msg
+	op.latency = at.Sub(op.sent)
+
+	if f := op.file; f != nil {
+		switch {
+		case op.request.Type == protocol.MsgOpen && msg.Type == protocol.MsgOpenOk:
+			t.open[f.id] = f
+		case op.request.Type == protocol.MsgOpen:
+			f.failed = true
+		case op.request.Type == protocol.MsgClose:
+			f.closed = true
+			if t.open[f.id] == f {
+				delete(t.open, f.id)
+			}
+		}
+	}
+	return op
+}
+
+func (t *tracer) summary() {
+	if len(t.files) > 0 {
+		fmt.Fprintf(t.w, "\nfiles\n")
+	}
+	for _, f := range t.files {
+		fmt.Fprintf(t.w, "\nfile %d %q\n", f.id, f.path)
+		var read, written int
+		for _, op := range f.ops {
+			fmt.Fprintf(t.w, "  %s  %-9s %-28s -> %s\n", t.offset(op.sent), Name(op.request.Type), opRequest(op), opResult(op))
+			if op.response == nil {
+				continue
+			}
+			switch op.response.Type {
+			case protocol.MsgReadOk:
+				if r, err := protocol.DecodeReadOkResponse(op.response.Payload); err == nil {
+					read += len(r.Data)
+				}
+			case protocol.MsgWriteOk:
+				if r, err := protocol.DecodeWriteOkResponse(op.response.Payload); err == nil {
+					written += int(r.BytesWritten)
+				}
+			}
+		}
+		state := "closed"
+		switch {
+		case f.failed:
+			state = "open failed"
+		case !f.closed:
+			state = "not closed"
+		}
+		fmt.Fprintf(t.w, "  %d operations, %d bytes read, %d bytes written, %s\n", len(f.ops), read, written, state)
+	}
+	if len(t.others) > 0 {
+		fmt.Fprintf(t.w, "\npaths\n")
+		for _, op := range t.others {
+			fmt.Fprintf(t.w, "  %s  %-9s %-28s -> %s\n", t.offset(op.sent), Name(op.request.Type), opRequest(op), opResult(op))
+		}
+	}
+	t.latencies()
+}
+
+// latencies writes how long file I/O requests took, by type.
+func (t *tracer) latencies() {
+	byType := make(map[uint8][]time.Duration)
+	unanswered := make(map[uint8]int)
+	for _, op := range t.ops {
+		if op.response == nil {
+			unanswered[op.request.Type]++
+			continue
+		}
+		byType[op.request.Type] = append(byType[op.request.Type], op.latency)
+	}
+	if len(byType) == 0 && len(unanswered) == 0 {
+		return
+	}
+
+	fmt.Fprintf(t.w, "\nlatency\n")
+	for msgType := protocol.MsgOpen; msgType <= protocol.MsgMkdir; msgType++ {
+		latencies := byType[msgType]
+		if len(latencies) == 0 && unanswered[msgType] == 0 {
+			continue
+		}
+		line := fmt.Sprintf("  %-9s %6d", Name(msgType), len(latencies))
+		if len(latencies) > 0 {
+			slices.Sort(latencies)
+			var total time.Duration
+			for _, l := range latencies {
+				total += l
+			}
+			line += fmt.Sprintf("  avg %s  p50 %s  p99 %s  max %s",
+				formatLatency(total/time.Duration(len(latencies))),
+				formatLatency(percentile(latencies, 50)),
+				formatLatency(percentile(latencies, 99)),
+				formatLatency(latencies[len(latencies)-1]))
+		}
+		if n := unanswered[msgType]; n > 0 {
+			line += fmt.Sprintf("  (%d unanswered)", n)
+		}
+		fmt.Fprintln(t.w, line)
+	}
+}
+
+// percentile returns the p-th percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
+
+// opRequest describes a request without its RequestID and FileID, which
+// the timeline it is listed in already shows.
+func opRequest(op *fileOp) string {
+	s := withoutRequestID(Describe(op.request))
+	if rest, ok := strings.CutPrefix(s, "file "); ok {
+		_, s, _ = strings.Cut(rest, " ")
+		s = strings.TrimPrefix(s, ", ")
+	}
+	return s
+}
+
+func opResult(op *fileOp) string {
+	if op.response == nil {
+		return "no response"
+	}
+	s := withoutRequestID(Describe(op.response))
+	switch {
+	case op.response.Type == protocol.MsgIoError:
+		s = "error, " + s
+	case s == "":
+		s = "ok"
+	}
+	return fmt.Sprintf("%s in %s", s, formatLatency(op.latency))
+}
+
+// withoutRequestID drops the leading "#id" of a described file I/O message.
+func withoutRequestID(s string) string {
+	if !strings.HasPrefix(s, "#") {
+		return s
+	}
+	_, rest, _ := strings.Cut(s, " ")
+	return rest
+}
@@ -0,0 +1,118 @@
+package capture
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// traceOf returns the trace of a server capture of msgs, each recorded
+// step after the one before.
+func traceOf(t *testing.T, step time.Duration, msgs ...struct {
+	dir Direction
+	msg protocol.Message
+}) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, SideServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now()
+	for _, m := range msgs {
+		at = at.Add(step)
+		w.recordAt(at, m.dir, m.msg.Type, m.msg.Payload)
+	}
+	w.Close()
+
+	var out strings.Builder
+	if err := Inspect(&out, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func frame(dir Direction, msgType uint8, payload []byte) struct {
+	dir Direction
+	msg protocol.Message
+} {
+	return struct {
+		dir Direction
+		msg protocol.Message
+	}{dir, protocol.Message{Type: msgType, Payload: payload}}
+}
+
+func TestInspectFileTimeline(t *testing.T) {
+	out := traceOf(t, 2*time.Millisecond,
+		frame(Sent, protocol.MsgOpen, (&protocol.OpenRequest{RequestID: 1, FileID: 3, Flags: protocol.FioORDONLY, Mode: 0644, Path: "/media/in.mkv"}).Encode()),
+		frame(Received, protocol.MsgOpenOk, (&protocol.OpenOkResponse{RequestID: 1, FileSize: 4096}).Encode()),
+		frame(Sent, protocol.MsgRead, (&protocol.ReadRequest{RequestID: 2, FileID: 3, NBytes: 4096}).Encode()),
+		frame(Sent, protocol.MsgStderr, []byte("frame=1\n")),
+		frame(Received, protocol.MsgReadOk, (&protocol.ReadOkResponse{RequestID: 2, Data: make([]byte, 4096)}).Encode()),
+		frame(Sent, protocol.MsgSeek, (&protocol.SeekRequest{RequestID: 3, FileID: 3, Offset: 99999, Whence: protocol.FioSeekSet}).Encode()),
+		frame(Received, protocol.MsgIoError, (&protocol.IoErrorResponse{RequestID: 3, Errno: protocol.FioEINVAL}).Encode()),
+		frame(Sent, protocol.MsgClose, (&protocol.CloseRequest{RequestID: 4, FileID: 3}).Encode()),
+		frame(Received, protocol.MsgCloseOk, (&protocol.RequestIDResponse{RequestID: 4}).Encode()),
+		frame(Sent, protocol.MsgUnlink, (&protocol.UnlinkRequest{RequestID: 5, Path: "/media/tmp"}).Encode()),
+	)
+
+	for _, want := range []string{
+		"capture taken on the server",
+		`S->C  Open         #1 file 3 "/media/in.mkv" rdonly mode 644`,
+		"C->S  OpenOk       #1 size 4096  [2.000ms after Open]",
+		"C->S  ReadOk       #2 4096 bytes  [4.000ms after Read]",
+		`S->C  Stderr       "frame=1\n"`,
+		`file 3 "/media/in.mkv"`,
+		"Read      4096 bytes                   -> 4096 bytes in 4.000ms",
+		"Seek      99999 from start             -> error, errno 22 in 2.000ms",
+		"Close                                  -> ok in 2.000ms",
+		"4 operations, 4096 bytes read, 0 bytes written, closed",
+		`Unlink    "/media/tmp"                 -> no response`,
+		"Open           1  avg 2.000ms",
+		"Read           1  avg 4.000ms",
+		"Unlink         0  (1 unanswered)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestInspectReassemblesFragments(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 300)
+	payload := (&protocol.ReadOkResponse{RequestID: 7, Data: data}).Encode()
+	out := traceOf(t, time.Millisecond,
+		frame(Sent, protocol.MsgRead, (&protocol.ReadRequest{RequestID: 7, FileID: 1, NBytes: 300}).Encode()),
+		frame(Received, protocol.MsgFragment, (&protocol.FragmentMessage{Type: protocol.MsgReadOk, Data: payload[:100]}).Encode()),
+		frame(Received, protocol.MsgStdin, []byte("in between")),
+		frame(Received, protocol.MsgFragment, (&protocol.FragmentMessage{Type: protocol.MsgReadOk, Data: payload[100:200]}).Encode()),
+		frame(Received, protocol.MsgReadOk, payload[200:]),
+	)
+
+	if want := "C->S  ReadOk       #7 300 bytes (in fragments)  [4.000ms after Read]"; !strings.Contains(out, want) {
+		t.Errorf("trace is missing %q:\n%s", want, out)
+	}
+	if strings.Contains(out, "Fragment") {
+		t.Errorf("fragments traced on their own:\n%s", out)
+	}
+	// A request for a file opened before the capture still counts
+	if want := "Read           1  avg 4.000ms"; !strings.Contains(out, want) {
+		t.Errorf("trace is missing %q:\n%s", want, out)
+	}
+}
+
+func TestInspectMalformed(t *testing.T) {
+	out := traceOf(t, time.Millisecond, frame(Received, protocol.MsgOpenOk, []byte{1}))
+	if !strings.Contains(out, "OpenOk       malformed (1 bytes)") {
+		t.Errorf("malformed message not reported:\n%s", out)
+	}
+}
+
+func TestInspectNotACapture(t *testing.T) {
+	if err := Inspect(&strings.Builder{}, strings.NewReader("ffmpeg version 7.0")); err == nil {
+		t.Fatal("Inspect accepted a file that is not a capture")
+	}
+}
@@ -5,11 +5,19 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/rewrite"
 	"github.com/tidwall/jsonc"
 )
 
@@ -29,18 +37,361 @@ func (l *LogValue) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Duration is a time.Duration that accepts either a Go duration string
+// ("90s", "5m") or a JSON number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		if seconds < 0 {
+			return fmt.Errorf("duration must not be negative: %v", seconds)
+		}
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string or number of seconds: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	if parsed < 0 {
+		return fmt.Errorf("duration must not be negative: %s", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ByteSize is a size in bytes that accepts either a JSON number or a string
+// with a binary unit suffix ("512M", "4G").
+type ByteSize uint64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a string or number of bytes: %w", err)
+	}
+	units := map[string]uint64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	trimmed := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	number := strings.TrimRight(trimmed, "KMGT")
+	unit, ok := units[trimmed[len(number):]]
+	if !ok {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	value, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if value > math.MaxUint64/unit {
+		return fmt.Errorf("size %q is too large", s)
+	}
+	*b = ByteSize(value * unit)
+	return nil
+}
+
+// DefaultDrainTimeout is how long the server waits for running sessions
+// on shutdown when drainTimeout is not configured.
+const DefaultDrainTimeout = 5 * time.Minute
+
+// DefaultResumeGracePeriod is how long the server keeps a session whose
+// client connection broke, waiting for the client to resume it, when
+// resumeGracePeriod is not configured.
+const DefaultResumeGracePeriod = 30 * time.Second
+
 type ServerConfig struct {
-	Log        LogValue    `json:"log"`
-	Address    string      `json:"address"`
-	AuthSecret string      `json:"authSecret"`
-	Rewrites   [][2]string `json:"rewrites"`
-	Debug      bool        `json:"debug"`
+	Log          LogValue                 `json:"log"`
+	Address      string                   `json:"address"`
+	AuthSecret   string                   `json:"authSecret"`
+	Rewrites     []rewrite.Rule           `json:"rewrites"`
+	Debug        bool                     `json:"debug"`
+	Admin        *AdminConfig             `json:"admin"`
+	DrainTimeout Duration                 `json:"drainTimeout"`
+	Fallback     *FallbackConfig          `json:"fallback"`
+	Programs     map[string]ProgramConfig `json:"programs"`
+	Profiles     map[string]ProfileConfig `json:"profiles"`
+	Limits       map[string]ProgramLimits `json:"limits"` // by program name
+	Sandbox      *SandboxConfig           `json:"sandbox"`
+	EnvAllowlist []string                 `json:"envAllowlist"`
+	Capture      *CaptureConfig           `json:"capture"`
+
+	// ResumeGracePeriod is how long a session survives losing its client
+	// connection. Zero disables resuming.
+	ResumeGracePeriod Duration `json:"resumeGracePeriod"`
+}
+
+// AdminConfig enables the admin API. It is disabled when omitted.
+type AdminConfig struct {
+	Address    string `json:"address"`
+	AuthSecret string `json:"authSecret"`
+}
+
+// FallbackConfig reruns a failed job once with extra rewrites applied, for
+// example to switch from a hardware to a software encoder. It only applies
+// when the job's stderr matches one of Patterns and nothing has been written
+// to the client's output yet. It is disabled when omitted.
+type FallbackConfig struct {
+	Patterns []*regexp.Regexp `json:"patterns"`
+	Rewrites []rewrite.Rule   `json:"rewrites"`
+}
+
+// CaptureConfig records the messages of sessions to files in Dir, for
+// debugging. All records every session; otherwise a session is recorded
+// when asked through the admin API. It is disabled when omitted.
+type CaptureConfig struct {
+	Dir string `json:"dir"`
+	All bool   `json:"all"`
+}
+
+// BuiltinPrograms are the programs the server runs without configuration,
+// from binaries next to the server executable.
+var BuiltinPrograms = []string{"ffmpeg", "ffprobe"}
+
+// ProgramConfig is a binary clients can run by name. Path is required for
+// programs other than the built-in ones; a relative path is resolved
+// against the server executable's directory. Args are inserted before the
+// client's arguments. Progress, for ffmpeg builds only, sends the reports
+// of ffmpeg's -progress option to the client.
+type ProgramConfig struct {
+	Path     string   `json:"path"`
+	Args     []string `json:"args"`
+	Progress bool     `json:"progress"`
+}
+
+func (p *ProgramConfig) validate(name string) error {
+	if name == "" || len(name) > protocol.MaxProgramLength || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("config: programs: invalid program name %q", name)
+	}
+	if p.Path == "" && !slices.Contains(BuiltinPrograms, name) {
+		return fmt.Errorf("config: programs.%s.path is required", name)
+	}
+	return nil
+}
+
+// ProfileConfig is an alternative ffmpeg build that clients can select by
+// name, for example to try a new release next to the production one. Path
+// and FFprobePath replace the ffmpeg and ffprobe binaries and are resolved
+// like ProgramConfig.Path. Rewrites run after the top-level ones, and Env
+// holds "NAME=value" entries set for every job, taking precedence over the
+// client's. Clients that select no profile keep the default binaries.
+type ProfileConfig struct {
+	Path        string         `json:"path"`
+	FFprobePath string         `json:"ffprobePath"`
+	Rewrites    []rewrite.Rule `json:"rewrites"`
+	Env         []string       `json:"env"`
+}
+
+func (p *ProfileConfig) validate(name string) error {
+	if name == "" || len(name) > protocol.MaxProfileLength {
+		return fmt.Errorf("config: profiles: invalid profile name %q", name)
+	}
+	for _, kv := range p.Env {
+		if key, _, ok := strings.Cut(kv, "="); !ok || !validEnvName(key) {
+			return fmt.Errorf("config: profiles.%s.env: invalid entry %q, want NAME=value", name, kv)
+		}
+	}
+	return nil
+}
+
+// ProgramLimits bounds the jobs run for one program. Zero disables a limit.
+type ProgramLimits struct {
+	// MaxRuntime terminates a job that runs longer than this.
+	MaxRuntime Duration `json:"maxRuntime"`
+	// StallTimeout terminates a job that has produced no stdout or stderr
+	// output and no file I/O for this long.
+	StallTimeout Duration `json:"stallTimeout"`
+
+	// Resource limits for the process, enforced on Linux only
+	AddressSpace ByteSize      `json:"addressSpace"`
+	OpenFiles    uint64        `json:"openFiles"`
+	CPUTime      Duration      `json:"cpuTime"`
+	Nice         *int          `json:"nice"`
+	IOPriority   *IOPriority   `json:"ioPriority"`
+	Cgroup       *CgroupConfig `json:"cgroup"`
+}
+
+// IOPriority is an I/O scheduling class ("realtime", "best-effort", or
+// "idle") and, except for idle, a level from 0 (highest) to 7.
+type IOPriority struct {
+	Class string `json:"class"`
+	Level int    `json:"level"`
+}
+
+// CgroupConfig runs each job in its own cgroup v2 group under Parent.
+type CgroupConfig struct {
+	Parent string   `json:"parent"`
+	Memory ByteSize `json:"memory"`
+	CPUs   float64  `json:"cpus"`
+}
+
+// SandboxConfig runs every job as an unprivileged user in its own Linux
+// namespaces, seeing only the program, system libraries, Paths and
+// Devices. It is disabled when omitted.
+type SandboxConfig struct {
+	UID     int      `json:"uid"`
+	GID     int      `json:"gid"`
+	Groups  []int    `json:"groups"`
+	Devices []string `json:"devices"`
+	Paths   []string `json:"paths"`
+	Network bool     `json:"network"`
 }
 
+func (s *SandboxConfig) validate() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("config: sandbox is only supported on Linux")
+	}
+	if s.UID <= 0 || s.GID <= 0 {
+		return fmt.Errorf("config: sandbox.uid and sandbox.gid must be set to a non-root user")
+	}
+	for _, paths := range [][]string{s.Devices, s.Paths} {
+		for _, path := range paths {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("config: sandbox: path %q is not absolute", path)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultLimits are the limits used for programs the config does not list.
+// ffprobe only reads headers and should finish quickly, so it gets tight
+// limits; encodes are unrestricted.
+func DefaultLimits() map[string]ProgramLimits {
+	nice := 10
+	return map[string]ProgramLimits{
+		"ffprobe": {
+			MaxRuntime:   Duration(5 * time.Minute),
+			StallTimeout: Duration(2 * time.Minute),
+			CPUTime:      Duration(5 * time.Minute),
+			OpenFiles:    256,
+			Nice:         &nice,
+		},
+	}
+}
+
+func (l *ProgramLimits) validate(program string) error {
+	if l.Nice != nil && (*l.Nice < -20 || *l.Nice > 19) {
+		return fmt.Errorf("config: limits.%s.nice must be between -20 and 19", program)
+	}
+	if p := l.IOPriority; p != nil {
+		switch p.Class {
+		case "realtime", "best-effort", "idle":
+		default:
+			return fmt.Errorf("config: limits.%s.ioPriority.class must be realtime, best-effort, or idle", program)
+		}
+		if p.Level < 0 || p.Level > 7 {
+			return fmt.Errorf("config: limits.%s.ioPriority.level must be between 0 and 7", program)
+		}
+	}
+	if l.Cgroup != nil {
+		if l.Cgroup.Parent == "" {
+			return fmt.Errorf("config: limits.%s.cgroup.parent is required", program)
+		}
+		if l.Cgroup.CPUs < 0 {
+			return fmt.Errorf("config: limits.%s.cgroup.cpus must not be negative", program)
+		}
+	}
+	return nil
+}
+
+// Defaults for how long the client waits at each step of starting a job
+// on a server before trying the next: connecting, sending the command, and
+// receiving the server's first message. The server pings connections that
+// have been idle for 30 seconds, so a running job answers well within the
+// last one.
+const (
+	DefaultConnectTimeout       = 10 * time.Second
+	DefaultHandshakeTimeout     = 10 * time.Second
+	DefaultFirstResponseTimeout = 60 * time.Second
+)
+
 type ClientConfig struct {
-	Log        LogValue `json:"log"`
-	Address    string   `json:"address"`
-	AuthSecret string   `json:"authSecret"`
+	Log            LogValue      `json:"log"`
+	Address        string        `json:"address"`
+	Servers        []ServerEntry `json:"servers"` // instead of Address
+	ConnectTimeout Duration      `json:"connectTimeout"`
+	// HandshakeTimeout bounds sending the command; FirstResponseTimeout
+	// bounds the wait for the server's first message after that.
+	HandshakeTimeout     Duration `json:"handshakeTimeout"`
+	FirstResponseTimeout Duration `json:"firstResponseTimeout"`
+	AuthSecret           string   `json:"authSecret"`
+	ForwardEnv           []string `json:"forwardEnv"`
+	Profile              string   `json:"profile"`
+	// LocalFallback maps program names to local binaries run with the
+	// client's arguments when no server is available.
+	LocalFallback map[string]string `json:"localFallback"`
+	// AgentSocket is the Unix socket of the client agent. The client hands
+	// jobs to the agent listening there, and runs them itself if none is.
+	AgentSocket string `json:"agentSocket"`
+	// Progress is where the progress reports of servers that send them are
+	// written as JSON lines: "stderr", "unix:" and a socket path, or a file.
+	Progress string `json:"progress"`
+	// Capture records the messages of each job, for debugging: to a new
+	// file in it if it is a directory, or to the file itself otherwise.
+	Capture string `json:"capture"`
+}
+
+// ServerEntry is one server the client can run jobs on. Servers with the
+// lowest priority are tried first, in random order weighted by Weight, or
+// in the listed order if they all have weight zero.
+type ServerEntry struct {
+	Address  string `json:"address"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+}
+
+// ServerList returns the servers to try: Servers, or Address on its own.
+func (c *ClientConfig) ServerList() []ServerEntry {
+	if len(c.Servers) > 0 {
+		return c.Servers
+	}
+	return []ServerEntry{{Address: c.Address}}
+}
+
+// DefaultEnvAllowlist is the environment clients may set for their jobs
+// when the server config does not list one: time zone, locale, and log
+// colors, which affect output but nothing outside the job.
+func DefaultEnvAllowlist() []string {
+	return []string{"TZ", "LANG", "LANGUAGE", "LC_*", "AV_LOG_FORCE_*"}
+}
+
+// EnvAllowed reports whether an environment variable name matches one of
+// allowlist's entries, which are exact names or prefixes ending in "*".
+func EnvAllowed(allowlist []string, name string) bool {
+	for _, entry := range allowlist {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// envEntryReserved reports whether an envAllowlist entry could match one
+// of the server's own FFOIP_* and FFMPEG_OVER_IP_* variables, which tell
+// fio where to connect and may include the auth secret.
+func envEntryReserved(entry string) bool {
+	name, wildcard := strings.CutSuffix(entry, "*")
+	for _, reserved := range []string{"FFOIP_", "FFMPEG_OVER_IP_"} {
+		if strings.HasPrefix(name, reserved) || wildcard && strings.HasPrefix(reserved, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func validEnvName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "=\x00")
 }
 
 // LoadServerConfig loads the server config. If explicitPath is non-empty, it
@@ -58,17 +409,110 @@ func LoadServerConfig(explicitPath string) (*ServerConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	var cfg ServerConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
+	return ParseServerConfig(data)
+}
+
+// DefaultServerConfig returns the settings a server config has before its
+// file is applied.
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		DrainTimeout:      Duration(DefaultDrainTimeout),
+		ResumeGracePeriod: Duration(DefaultResumeGracePeriod),
+		Limits:            DefaultLimits(),
+		EnvAllowlist:      DefaultEnvAllowlist(),
+	}
+}
+
+// ParseServerConfig parses and validates the contents of a server config
+// file, JSON with comments, on top of DefaultServerConfig.
+func ParseServerConfig(data []byte) (*ServerConfig, error) {
+	// Programs listed under "limits" replace their defaults entirely
+	cfg := DefaultServerConfig()
+	if err := json.Unmarshal(jsonc.ToJSON(data), cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	var err error
 	if cfg.Address == "" {
 		return nil, fmt.Errorf("config: address is required")
 	}
 	if cfg.AuthSecret == "" {
 		return nil, fmt.Errorf("config: authSecret is required")
 	}
-	return &cfg, nil
+	if cfg.Admin != nil {
+		if cfg.Admin.Address == "" {
+			return nil, fmt.Errorf("config: admin.address is required")
+		}
+		if cfg.Admin.AuthSecret == "" {
+			return nil, fmt.Errorf("config: admin.authSecret is required")
+		}
+	}
+	if cfg.Capture != nil && cfg.Capture.Dir == "" {
+		return nil, fmt.Errorf("config: capture.dir is required")
+	}
+	if cfg.Fallback != nil {
+		if len(cfg.Fallback.Patterns) == 0 {
+			return nil, fmt.Errorf("config: fallback.patterns is required")
+		}
+		if len(cfg.Fallback.Rewrites) == 0 {
+			return nil, fmt.Errorf("config: fallback.rewrites is required")
+		}
+	}
+	for name, program := range cfg.Programs {
+		if err := program.validate(name); err != nil {
+			return nil, err
+		}
+		if program.Path, err = resolveBinary(program.Path); err != nil {
+			return nil, fmt.Errorf("config: programs.%s.path: %w", name, err)
+		}
+		cfg.Programs[name] = program
+	}
+	for name, profile := range cfg.Profiles {
+		if err := profile.validate(name); err != nil {
+			return nil, err
+		}
+		if profile.Path, err = resolveBinary(profile.Path); err != nil {
+			return nil, fmt.Errorf("config: profiles.%s.path: %w", name, err)
+		}
+		if profile.FFprobePath, err = resolveBinary(profile.FFprobePath); err != nil {
+			return nil, fmt.Errorf("config: profiles.%s.ffprobePath: %w", name, err)
+		}
+		cfg.Profiles[name] = profile
+	}
+	for program, limits := range cfg.Limits {
+		if _, ok := cfg.Programs[program]; !ok && !slices.Contains(BuiltinPrograms, program) {
+			return nil, fmt.Errorf("config: limits: unknown program %q", program)
+		}
+		if err := limits.validate(program); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Sandbox != nil {
+		if err := cfg.Sandbox.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range cfg.EnvAllowlist {
+		if !validEnvName(strings.TrimSuffix(entry, "*")) && entry != "*" {
+			return nil, fmt.Errorf("config: envAllowlist: invalid entry %q", entry)
+		}
+		if envEntryReserved(entry) {
+			return nil, fmt.Errorf("config: envAllowlist: %q matches the server's own FFOIP_* or FFMPEG_OVER_IP_* variables", entry)
+		}
+	}
+	return cfg, nil
+}
+
+// resolveBinary resolves a relative binary path against the directory of
+// the running executable. Empty and absolute paths are returned as-is.
+func resolveBinary(path string) (string, error) {
+	if path == "" || filepath.IsAbs(path) {
+		return path, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exe), path), nil
 }
 
 // LoadClientConfig loads the client config. If explicitPath is non-empty, it
@@ -86,16 +530,44 @@ func LoadClientConfig(explicitPath string) (*ClientConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	var cfg ClientConfig
+	cfg := ClientConfig{
+		ConnectTimeout:       Duration(DefaultConnectTimeout),
+		HandshakeTimeout:     Duration(DefaultHandshakeTimeout),
+		FirstResponseTimeout: Duration(DefaultFirstResponseTimeout),
+	}
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
-	if cfg.Address == "" {
-		return nil, fmt.Errorf("config: address is required")
+	if cfg.Address == "" && len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("config: address is required, or a list of servers")
+	}
+	if cfg.Address != "" && len(cfg.Servers) > 0 {
+		return nil, fmt.Errorf("config: address and servers cannot both be set")
+	}
+	for i, server := range cfg.Servers {
+		if server.Address == "" {
+			return nil, fmt.Errorf("config: servers[%d].address is required", i)
+		}
+		if server.Priority < 0 || server.Weight < 0 {
+			return nil, fmt.Errorf("config: servers[%d]: priority and weight must not be negative", i)
+		}
 	}
 	if cfg.AuthSecret == "" {
 		return nil, fmt.Errorf("config: authSecret is required")
 	}
+	for _, name := range cfg.ForwardEnv {
+		if !validEnvName(name) {
+			return nil, fmt.Errorf("config: forwardEnv: invalid variable name %q", name)
+		}
+	}
+	if len(cfg.Profile) > protocol.MaxProfileLength {
+		return nil, fmt.Errorf("config: profile must be at most %d bytes", protocol.MaxProfileLength)
+	}
+	for program, path := range cfg.LocalFallback {
+		if path == "" {
+			return nil, fmt.Errorf("config: localFallback.%s: path is required", program)
+		}
+	}
 	return &cfg, nil
 }
 
@@ -107,12 +579,12 @@ func serverConfigFromEnv() *ServerConfig {
 	if address == "" || authSecret == "" {
 		return nil
 	}
-	return &ServerConfig{
-		Address:    address,
-		AuthSecret: authSecret,
-		Log:        LogValue(os.Getenv("FFMPEG_OVER_IP_SERVER_LOG")),
-		Debug:      parseLaxBool(os.Getenv("FFMPEG_OVER_IP_SERVER_DEBUG")),
-	}
+	cfg := DefaultServerConfig()
+	cfg.Address = address
+	cfg.AuthSecret = authSecret
+	cfg.Log = LogValue(os.Getenv("FFMPEG_OVER_IP_SERVER_LOG"))
+	cfg.Debug = parseLaxBool(os.Getenv("FFMPEG_OVER_IP_SERVER_DEBUG"))
+	return cfg
 }
 
 // clientConfigFromEnv builds a ClientConfig from individual environment variables.
@@ -123,11 +595,47 @@ func clientConfigFromEnv() *ClientConfig {
 	if address == "" || authSecret == "" {
 		return nil
 	}
-	return &ClientConfig{
-		Address:    address,
-		AuthSecret: authSecret,
-		Log:        LogValue(os.Getenv("FFMPEG_OVER_IP_CLIENT_LOG")),
+	cfg := &ClientConfig{
+		Address:              address,
+		ConnectTimeout:       Duration(DefaultConnectTimeout),
+		HandshakeTimeout:     Duration(DefaultHandshakeTimeout),
+		FirstResponseTimeout: Duration(DefaultFirstResponseTimeout),
+		AuthSecret:           authSecret,
+		Log:                  LogValue(os.Getenv("FFMPEG_OVER_IP_CLIENT_LOG")),
+		ForwardEnv:           splitList(os.Getenv("FFMPEG_OVER_IP_CLIENT_FORWARD_ENV")),
+		Profile:              os.Getenv("FFMPEG_OVER_IP_CLIENT_PROFILE"),
+		AgentSocket:          os.Getenv("FFMPEG_OVER_IP_CLIENT_AGENT_SOCKET"),
+		Progress:             os.Getenv("FFMPEG_OVER_IP_CLIENT_PROGRESS"),
+		Capture:              os.Getenv("FFMPEG_OVER_IP_CLIENT_CAPTURE"),
+	}
+	// Local fallbacks are comma-separated program=path pairs
+	for _, pair := range splitList(os.Getenv("FFMPEG_OVER_IP_CLIENT_LOCAL_FALLBACK")) {
+		if program, path, ok := strings.Cut(pair, "="); ok && program != "" && path != "" {
+			if cfg.LocalFallback == nil {
+				cfg.LocalFallback = make(map[string]string)
+			}
+			cfg.LocalFallback[program] = path
+		}
+	}
+	// A comma-separated address is a list of servers, tried in order
+	if addresses := splitList(address); len(addresses) > 1 {
+		cfg.Address = ""
+		for _, addr := range addresses {
+			cfg.Servers = append(cfg.Servers, ServerEntry{Address: addr})
+		}
+	}
+	return cfg
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
 
 // parseLaxBool parses a boolean string leniently.
@@ -2,12 +2,17 @@ package config
 
 import (
 	"bytes"
+	"encoding/json"
 	"log"
+	"maps"
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadServerConfig(t *testing.T) {
@@ -34,7 +39,7 @@ func TestLoadServerConfig(t *testing.T) {
 	if cfg.AuthSecret != "test-secret" {
 		t.Errorf("AuthSecret = %q, want %q", cfg.AuthSecret, "test-secret")
 	}
-	if len(cfg.Rewrites) != 1 || cfg.Rewrites[0][0] != "h264_nvenc" || cfg.Rewrites[0][1] != "h264_qsv" {
+	if len(cfg.Rewrites) != 1 || cfg.Rewrites[0].From != "h264_nvenc" || cfg.Rewrites[0].To != "h264_qsv" {
 		t.Errorf("Rewrites = %v, want [[h264_nvenc h264_qsv]]", cfg.Rewrites)
 	}
 }
@@ -212,8 +217,8 @@ func TestServerConfigMultipleRewrites(t *testing.T) {
 		{"av1_nvenc", "av1_qsv"},
 	}
 	for i, pair := range expected {
-		if cfg.Rewrites[i] != pair {
-			t.Errorf("Rewrites[%d] = %v, want %v", i, cfg.Rewrites[i], pair)
+		if cfg.Rewrites[i].From != pair[0] || cfg.Rewrites[i].To != pair[1] {
+			t.Errorf("Rewrites[%d] = [%s %s], want %v", i, cfg.Rewrites[i].From, cfg.Rewrites[i].To, pair)
 		}
 	}
 }
@@ -456,8 +461,8 @@ func TestLoadServerConfigAllFields(t *testing.T) {
 		{"av1_nvenc", "libsvtav1"},
 	}
 	for i, pair := range expected {
-		if cfg.Rewrites[i] != pair {
-			t.Errorf("Rewrites[%d] = %v, want %v", i, cfg.Rewrites[i], pair)
+		if cfg.Rewrites[i].From != pair[0] || cfg.Rewrites[i].To != pair[1] {
+			t.Errorf("Rewrites[%d] = [%s %s], want %v", i, cfg.Rewrites[i].From, cfg.Rewrites[i].To, pair)
 		}
 	}
 }
@@ -1333,3 +1338,1046 @@ func TestParseAddress(t *testing.T) {
 	}
 }
 
+
+func TestServerConfigAdmin(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"admin": {"address": "unix:/run/ffoip-admin.sock", "authSecret": "admin-secret"}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if cfg.Admin == nil {
+		t.Fatal("Admin is nil, want non-nil")
+	}
+	if cfg.Admin.Address != "unix:/run/ffoip-admin.sock" {
+		t.Errorf("Admin.Address = %q", cfg.Admin.Address)
+	}
+	if cfg.Admin.AuthSecret != "admin-secret" {
+		t.Errorf("Admin.AuthSecret = %q", cfg.Admin.AuthSecret)
+	}
+}
+
+func TestServerConfigAdminDisabledByDefault(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "no-admin.jsonc")
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret"}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if cfg.Admin != nil {
+		t.Errorf("Admin = %+v, want nil", cfg.Admin)
+	}
+}
+
+func TestServerConfigAdminRequiresFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		admin string
+		want  string
+	}{
+		{"missing address", `{"authSecret": "admin-secret"}`, "admin.address is required"},
+		{"missing secret", `{"address": "127.0.0.1:5051"}`, "admin.authSecret is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "admin.jsonc")
+			os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "admin": `+tt.admin+`}`), 0o644)
+
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{`"90s"`, 90 * time.Second, false},
+		{`"5m"`, 5 * time.Minute, false},
+		{`"1h30m"`, 90 * time.Minute, false},
+		{`30`, 30 * time.Second, false},
+		{`0.5`, 500 * time.Millisecond, false},
+		{`0`, 0, false},
+		{`"0s"`, 0, false},
+		{`"soon"`, 0, true},
+		{`-1`, 0, true},
+		{`"-5s"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var d Duration
+			err := json.Unmarshal([]byte(tt.input), &d)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", time.Duration(d))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if time.Duration(d) != tt.want {
+				t.Errorf("got %v, want %v", time.Duration(d), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigDrainTimeout(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "drain.jsonc")
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "drainTimeout": "30m"}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if time.Duration(cfg.DrainTimeout) != 30*time.Minute {
+		t.Errorf("DrainTimeout = %v, want 30m", time.Duration(cfg.DrainTimeout))
+	}
+}
+
+func TestServerConfigDrainTimeoutDefault(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "drain.jsonc")
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret"}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if time.Duration(cfg.DrainTimeout) != DefaultDrainTimeout {
+		t.Errorf("DrainTimeout = %v, want %v", time.Duration(cfg.DrainTimeout), DefaultDrainTimeout)
+	}
+
+	// Explicit zero means "terminate immediately", not "use the default"
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "drainTimeout": 0}`), 0o644)
+	cfg, err = LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if cfg.DrainTimeout != 0 {
+		t.Errorf("DrainTimeout = %v, want 0", time.Duration(cfg.DrainTimeout))
+	}
+}
+
+func TestServerEnvConfigDrainTimeoutDefault(t *testing.T) {
+	t.Setenv("FFMPEG_OVER_IP_SERVER_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_SERVER_ADDRESS", "0.0.0.0:5050")
+	t.Setenv("FFMPEG_OVER_IP_SERVER_AUTH_SECRET", "secret")
+
+	cfg, err := LoadServerConfig("")
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if time.Duration(cfg.DrainTimeout) != DefaultDrainTimeout {
+		t.Errorf("DrainTimeout = %v, want %v", time.Duration(cfg.DrainTimeout), DefaultDrainTimeout)
+	}
+}
+
+func TestServerConfigResumeGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resume.jsonc")
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret"}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if time.Duration(cfg.ResumeGracePeriod) != DefaultResumeGracePeriod {
+		t.Errorf("ResumeGracePeriod = %v, want %v", time.Duration(cfg.ResumeGracePeriod), DefaultResumeGracePeriod)
+	}
+
+	// Zero disables resuming
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "resumeGracePeriod": 0}`), 0o644)
+	cfg, err = LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if cfg.ResumeGracePeriod != 0 {
+		t.Errorf("ResumeGracePeriod = %v, want 0", time.Duration(cfg.ResumeGracePeriod))
+	}
+}
+
+func TestServerConfigRewriteRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"rewrites": [
+			["h264_nvenc", "h264_qsv"],
+			{"option": "-c:a", "match": "^aac$", "replace": "libfdk_aac", "program": "ffmpeg"},
+		]
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if len(cfg.Rewrites) != 2 {
+		t.Fatalf("len(Rewrites) = %d, want 2", len(cfg.Rewrites))
+	}
+	rule := cfg.Rewrites[1]
+	if rule.Option != "-c:a" || rule.Match != "^aac$" || rule.Replace == nil || *rule.Replace != "libfdk_aac" || rule.Program != "ffmpeg" {
+		t.Errorf("Rewrites[1] = %+v", rule)
+	}
+}
+
+func TestServerConfigInvalidRewriteRule(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"rewrites": [{"match": "(", "replace": "x"}]
+	}`), 0o644)
+
+	_, err := LoadServerConfig(path)
+	if err == nil {
+		t.Fatal("expected error for invalid regex")
+	}
+	if !strings.Contains(err.Error(), "invalid rewrite match") {
+		t.Errorf("error = %q, want mention of invalid rewrite match", err.Error())
+	}
+}
+
+func TestServerConfigFallback(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fallback.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"fallback": {
+			"patterns": ["OpenEncodeSessionEx failed", "(?i)no nvenc capable devices"],
+			"rewrites": [["h264_nvenc", "libx264"]]
+		}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if cfg.Fallback == nil {
+		t.Fatal("Fallback is nil, want non-nil")
+	}
+	if len(cfg.Fallback.Patterns) != 2 {
+		t.Fatalf("len(Patterns) = %d, want 2", len(cfg.Fallback.Patterns))
+	}
+	if !cfg.Fallback.Patterns[1].MatchString("[h264_nvenc] No NVENC capable devices found") {
+		t.Errorf("Patterns[1] = %v did not match", cfg.Fallback.Patterns[1])
+	}
+	if len(cfg.Fallback.Rewrites) != 1 || cfg.Fallback.Rewrites[0].To != "libx264" {
+		t.Errorf("Rewrites = %+v", cfg.Fallback.Rewrites)
+	}
+}
+
+func TestServerConfigFallbackInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback string
+		want     string
+	}{
+		{"missing patterns", `{"rewrites": [["a", "b"]]}`, "fallback.patterns is required"},
+		{"missing rewrites", `{"patterns": ["x"]}`, "fallback.rewrites is required"},
+		{"invalid pattern", `{"patterns": ["("], "rewrites": [["a", "b"]]}`, "parsing config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "fallback.jsonc")
+			os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "fallback": `+tt.fallback+`}`), 0o644)
+
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limits.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"limits": {
+			"ffmpeg": {"maxRuntime": "6h", "stallTimeout": "5m"},
+			"ffprobe": {"maxRuntime": 60},
+		}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	ffmpeg := cfg.Limits["ffmpeg"]
+	if time.Duration(ffmpeg.MaxRuntime) != 6*time.Hour || time.Duration(ffmpeg.StallTimeout) != 5*time.Minute {
+		t.Errorf("ffmpeg limits = %+v", ffmpeg)
+	}
+	ffprobe := cfg.Limits["ffprobe"]
+	if time.Duration(ffprobe.MaxRuntime) != time.Minute || ffprobe.StallTimeout != 0 {
+		t.Errorf("ffprobe limits = %+v", ffprobe)
+	}
+}
+
+func TestServerConfigLimitsUnknownProgram(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limits.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"limits": {"ffplay": {"maxRuntime": "1h"}}
+	}`), 0o644)
+
+	_, err := LoadServerConfig(path)
+	if err == nil {
+		t.Fatal("expected error for unknown program")
+	}
+	if !strings.Contains(err.Error(), `unknown program "ffplay"`) {
+		t.Errorf("error = %q", err.Error())
+	}
+}
+
+func TestByteSizeUnmarshal(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ByteSize
+		wantErr bool
+	}{
+		{`1048576`, 1 << 20, false},
+		{`"512"`, 512, false},
+		{`"64K"`, 64 << 10, false},
+		{`"512M"`, 512 << 20, false},
+		{`"4G"`, 4 << 30, false},
+		{`"4GB"`, 4 << 30, false},
+		{`"2t"`, 2 << 40, false},
+		{`"16777215T"`, 16777215 << 40, false},
+		{`"16777216T"`, 0, true},
+		{`"1.5G"`, 0, true},
+		{`"G"`, 0, true},
+		{`"4X"`, 0, true},
+		{`-1`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		var b ByteSize
+		err := json.Unmarshal([]byte(tt.input), &b)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %d", tt.input, b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.input, err)
+			continue
+		}
+		if b != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.input, b, tt.want)
+		}
+	}
+}
+
+func TestServerConfigResourceLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limits.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"limits": {
+			"ffmpeg": {
+				"addressSpace": "16G",
+				"openFiles": 4096,
+				"cpuTime": "12h",
+				"nice": 5,
+				"ioPriority": {"class": "best-effort", "level": 6},
+				"cgroup": {"parent": "/sys/fs/cgroup/ffmpeg-over-ip", "memory": "8G", "cpus": 4}
+			}
+		}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	l := cfg.Limits["ffmpeg"]
+	if l.AddressSpace != 16<<30 || l.OpenFiles != 4096 || time.Duration(l.CPUTime) != 12*time.Hour {
+		t.Errorf("rlimits = %+v", l)
+	}
+	if l.Nice == nil || *l.Nice != 5 {
+		t.Errorf("Nice = %v, want 5", l.Nice)
+	}
+	if l.IOPriority == nil || l.IOPriority.Class != "best-effort" || l.IOPriority.Level != 6 {
+		t.Errorf("IOPriority = %+v", l.IOPriority)
+	}
+	if l.Cgroup == nil || l.Cgroup.Parent != "/sys/fs/cgroup/ffmpeg-over-ip" || l.Cgroup.Memory != 8<<30 || l.Cgroup.CPUs != 4 {
+		t.Errorf("Cgroup = %+v", l.Cgroup)
+	}
+}
+
+func TestServerConfigFFprobeDefaultLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limits.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"limits": {"ffmpeg": {"maxRuntime": "6h"}}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	ffprobe, ok := cfg.Limits["ffprobe"]
+	if !ok {
+		t.Fatal("ffprobe defaults missing")
+	}
+	if ffprobe.MaxRuntime == 0 || ffprobe.CPUTime == 0 || ffprobe.Nice == nil {
+		t.Errorf("ffprobe limits = %+v, want tight defaults", ffprobe)
+	}
+	if ffmpeg := cfg.Limits["ffmpeg"]; ffmpeg.CPUTime != 0 || ffmpeg.Nice != nil {
+		t.Errorf("ffmpeg limits = %+v, want only maxRuntime", ffmpeg)
+	}
+
+	t.Setenv("FFMPEG_OVER_IP_SERVER_ADDRESS", "0.0.0.0:5050")
+	t.Setenv("FFMPEG_OVER_IP_SERVER_AUTH_SECRET", "secret")
+	if envCfg := serverConfigFromEnv(); envCfg == nil || envCfg.Limits["ffprobe"].MaxRuntime == 0 {
+		t.Error("env config missing ffprobe defaults")
+	}
+}
+
+func TestServerConfigLimitsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits string
+		want   string
+	}{
+		{"nice too low", `{"nice": -21}`, "nice must be between -20 and 19"},
+		{"nice too high", `{"nice": 20}`, "nice must be between -20 and 19"},
+		{"io class", `{"ioPriority": {"class": "low"}}`, "ioPriority.class"},
+		{"io level", `{"ioPriority": {"class": "best-effort", "level": 8}}`, "ioPriority.level"},
+		{"cgroup parent", `{"cgroup": {"memory": "1G"}}`, "cgroup.parent is required"},
+		{"cgroup cpus", `{"cgroup": {"parent": "/sys/fs/cgroup/x", "cpus": -1}}`, "cgroup.cpus"},
+		{"address space", `{"addressSpace": "lots"}`, "invalid size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "limits.jsonc")
+			os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "limits": {"ffmpeg": `+tt.limits+`}}`), 0o644)
+
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandbox is Linux only")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sandbox.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"sandbox": {
+			"uid": 1000,
+			"gid": 1000,
+			"groups": [44, 109],
+			"devices": ["/dev/dri"],
+			"paths": ["/usr/share/fonts"]
+		}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sb := cfg.Sandbox
+	if sb == nil {
+		t.Fatal("expected sandbox config")
+	}
+	if sb.UID != 1000 || sb.GID != 1000 || !slices.Equal(sb.Groups, []int{44, 109}) {
+		t.Errorf("uid/gid/groups = %d/%d/%v", sb.UID, sb.GID, sb.Groups)
+	}
+	if !slices.Equal(sb.Devices, []string{"/dev/dri"}) || !slices.Equal(sb.Paths, []string{"/usr/share/fonts"}) {
+		t.Errorf("devices/paths = %v/%v", sb.Devices, sb.Paths)
+	}
+	if sb.Network {
+		t.Error("expected network to default to false")
+	}
+}
+
+func TestServerConfigSandboxInvalid(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandbox is Linux only")
+	}
+	tests := []struct {
+		name    string
+		sandbox string
+		want    string
+	}{
+		{"missing uid", `{"gid": 1000}`, "non-root user"},
+		{"root", `{"uid": 0, "gid": 0}`, "non-root user"},
+		{"relative device", `{"uid": 1000, "gid": 1000, "devices": ["dev/dri"]}`, "not absolute"},
+		{"relative path", `{"uid": 1000, "gid": 1000, "paths": ["fonts"]}`, "not absolute"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "sandbox.jsonc")
+			os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "sandbox": `+tt.sandbox+`}`), 0o644)
+
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigPrograms(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "programs.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"programs": {
+			"ffmpeg-av1": {"path": "/opt/ffmpeg-av1/ffmpeg", "args": ["-hide_banner"]},
+			"analyze": {"path": "bin/analyze"},
+			"ffmpeg": {"args": ["-nostdin"], "progress": true}
+		},
+		"limits": {"analyze": {"maxRuntime": "1m"}}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	av1 := cfg.Programs["ffmpeg-av1"]
+	if av1.Path != "/opt/ffmpeg-av1/ffmpeg" || !slices.Equal(av1.Args, []string{"-hide_banner"}) {
+		t.Errorf("ffmpeg-av1 = %+v", av1)
+	}
+	exe, _ := os.Executable()
+	if got, want := cfg.Programs["analyze"].Path, filepath.Join(filepath.Dir(exe), "bin/analyze"); got != want {
+		t.Errorf("analyze path = %q, want %q", got, want)
+	}
+	if ffmpeg := cfg.Programs["ffmpeg"]; ffmpeg.Path != "" || !slices.Equal(ffmpeg.Args, []string{"-nostdin"}) || !ffmpeg.Progress {
+		t.Errorf("ffmpeg = %+v", ffmpeg)
+	}
+	if got := time.Duration(cfg.Limits["analyze"].MaxRuntime); got != time.Minute {
+		t.Errorf("analyze maxRuntime = %v, want 1m", got)
+	}
+}
+
+func TestServerConfigProgramsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"missing path", `"programs": {"analyze": {"args": ["-v"]}}`, "programs.analyze.path is required"},
+		{"empty name", `"programs": {"": {"path": "/bin/true"}}`, "invalid program name"},
+		{"name with slash", `"programs": {"bin/analyze": {"path": "/bin/true"}}`, "invalid program name"},
+		{"unregistered limits", `"limits": {"analyze": {"maxRuntime": "1m"}}`, "unknown program"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "programs.jsonc")
+			os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", `+tt.config+`}`), 0o644)
+
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigProfiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profiles.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "0.0.0.0:5050",
+		"authSecret": "secret",
+		"profiles": {
+			"beta": {
+				"path": "jellyfin-ffmpeg-7.1/ffmpeg",
+				"ffprobePath": "/opt/jellyfin-ffmpeg-7.1/ffprobe",
+				"rewrites": [["h264_nvenc", "h264_qsv"]],
+				"env": ["LIBVA_DRIVER_NAME=iHD"]
+			}
+		}
+	}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	beta, ok := cfg.Profiles["beta"]
+	if !ok {
+		t.Fatal("expected beta profile")
+	}
+	exe, _ := os.Executable()
+	if want := filepath.Join(filepath.Dir(exe), "jellyfin-ffmpeg-7.1/ffmpeg"); beta.Path != want {
+		t.Errorf("path = %q, want %q", beta.Path, want)
+	}
+	if beta.FFprobePath != "/opt/jellyfin-ffmpeg-7.1/ffprobe" {
+		t.Errorf("ffprobePath = %q", beta.FFprobePath)
+	}
+	if len(beta.Rewrites) != 1 || !slices.Equal(beta.Env, []string{"LIBVA_DRIVER_NAME=iHD"}) {
+		t.Errorf("rewrites/env = %v/%v", beta.Rewrites, beta.Env)
+	}
+}
+
+func TestServerConfigProfilesInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles string
+		want     string
+	}{
+		{"empty name", `{"": {"path": "/opt/ffmpeg"}}`, "invalid profile name"},
+		{"env without value", `{"beta": {"env": ["LIBVA_DRIVER_NAME"]}}`, "profiles.beta.env"},
+		{"env without name", `{"beta": {"env": ["=iHD"]}}`, "profiles.beta.env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "profiles.jsonc")
+			os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "profiles": `+tt.profiles+`}`), 0o644)
+
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestClientConfigProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "profile": "beta"}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Profile != "beta" {
+		t.Errorf("profile = %q, want beta", cfg.Profile)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "profile": "`+strings.Repeat("x", 256)+`"}`), 0o644)
+	if _, err := LoadClientConfig(path); err == nil {
+		t.Error("expected error for overlong profile name")
+	}
+}
+
+func TestClientConfigServers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{
+		"servers": [
+			{"address": "10.0.0.1:5050", "priority": 0, "weight": 3},
+			{"address": "10.0.0.2:5050", "priority": 0, "weight": 1},
+			{"address": "unix:/run/ffmpeg-over-ip.sock", "priority": 1}
+		],
+		"connectTimeout": "2s",
+		"authSecret": "secret"
+	}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ServerEntry{
+		{Address: "10.0.0.1:5050", Weight: 3},
+		{Address: "10.0.0.2:5050", Weight: 1},
+		{Address: "unix:/run/ffmpeg-over-ip.sock", Priority: 1},
+	}
+	if !slices.Equal(cfg.ServerList(), want) {
+		t.Errorf("ServerList = %+v, want %+v", cfg.ServerList(), want)
+	}
+	if got := time.Duration(cfg.ConnectTimeout); got != 2*time.Second {
+		t.Errorf("ConnectTimeout = %v, want 2s", got)
+	}
+}
+
+func TestClientConfigSingleAddress(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret"}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []ServerEntry{{Address: "127.0.0.1:5050"}}; !slices.Equal(cfg.ServerList(), want) {
+		t.Errorf("ServerList = %+v, want %+v", cfg.ServerList(), want)
+	}
+	if got := time.Duration(cfg.ConnectTimeout); got != DefaultConnectTimeout {
+		t.Errorf("ConnectTimeout = %v, want default %v", got, DefaultConnectTimeout)
+	}
+	if got := time.Duration(cfg.HandshakeTimeout); got != DefaultHandshakeTimeout {
+		t.Errorf("HandshakeTimeout = %v, want default %v", got, DefaultHandshakeTimeout)
+	}
+	if got := time.Duration(cfg.FirstResponseTimeout); got != DefaultFirstResponseTimeout {
+		t.Errorf("FirstResponseTimeout = %v, want default %v", got, DefaultFirstResponseTimeout)
+	}
+}
+
+func TestClientConfigTimeouts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "127.0.0.1:5050",
+		"authSecret": "secret",
+		"connectTimeout": "3s",
+		"handshakeTimeout": 5,
+		"firstResponseTimeout": 0
+	}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Duration(cfg.ConnectTimeout) != 3*time.Second ||
+		time.Duration(cfg.HandshakeTimeout) != 5*time.Second ||
+		cfg.FirstResponseTimeout != 0 {
+		t.Errorf("timeouts = %v/%v/%v, want 3s/5s/0s",
+			time.Duration(cfg.ConnectTimeout), time.Duration(cfg.HandshakeTimeout), time.Duration(cfg.FirstResponseTimeout))
+	}
+}
+
+func TestClientConfigServersInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"both", `"address": "127.0.0.1:5050", "servers": [{"address": "127.0.0.2:5050"}]`, "cannot both be set"},
+		{"missing address", `"servers": [{"priority": 1}]`, "servers[0].address is required"},
+		{"negative weight", `"servers": [{"address": "127.0.0.1:5050", "weight": -1}]`, "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "client.jsonc")
+			os.WriteFile(path, []byte(`{"authSecret": "secret", `+tt.config+`}`), 0o644)
+
+			_, err := LoadClientConfig(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestClientConfigServersFromEnv(t *testing.T) {
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "10.0.0.1:5050, 10.0.0.2:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "client-env-secret")
+
+	cfg, err := LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	want := []ServerEntry{{Address: "10.0.0.1:5050"}, {Address: "10.0.0.2:5050"}}
+	if cfg.Address != "" || !slices.Equal(cfg.ServerList(), want) {
+		t.Errorf("Address = %q, ServerList = %+v, want %+v", cfg.Address, cfg.ServerList(), want)
+	}
+}
+
+func TestClientConfigLocalFallback(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "127.0.0.1:5050",
+		"authSecret": "secret",
+		"localFallback": {"ffmpeg": "/usr/lib/jellyfin-ffmpeg/ffmpeg", "ffprobe": "/usr/lib/jellyfin-ffmpeg/ffprobe"}
+	}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.LocalFallback["ffprobe"]; got != "/usr/lib/jellyfin-ffmpeg/ffprobe" {
+		t.Errorf("localFallback.ffprobe = %q", got)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "localFallback": {"ffmpeg": ""}}`), 0o644)
+	if _, err := LoadClientConfig(path); err == nil || !strings.Contains(err.Error(), "localFallback.ffmpeg") {
+		t.Errorf("error = %v, want invalid localFallback", err)
+	}
+}
+
+func TestClientConfigLocalFallbackFromEnv(t *testing.T) {
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "192.168.1.100:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "client-env-secret")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_LOCAL_FALLBACK", "ffmpeg=/usr/bin/ffmpeg, ffprobe=/usr/bin/ffprobe, bogus")
+
+	cfg, err := LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	want := map[string]string{"ffmpeg": "/usr/bin/ffmpeg", "ffprobe": "/usr/bin/ffprobe"}
+	if !maps.Equal(cfg.LocalFallback, want) {
+		t.Errorf("LocalFallback = %v, want %v", cfg.LocalFallback, want)
+	}
+}
+
+func TestClientConfigForwardEnv(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{
+		"address": "127.0.0.1:5050",
+		"authSecret": "secret",
+		"forwardEnv": ["TZ", "LANG"],
+	}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(cfg.ForwardEnv, []string{"TZ", "LANG"}) {
+		t.Errorf("ForwardEnv = %q", cfg.ForwardEnv)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "forwardEnv": ["TZ=UTC"]}`), 0o644)
+	if _, err := LoadClientConfig(path); err == nil || !strings.Contains(err.Error(), "forwardEnv") {
+		t.Errorf("error = %v, want invalid forwardEnv", err)
+	}
+}
+
+func TestClientConfigForwardEnvFromEnv(t *testing.T) {
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "192.168.1.100:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "client-env-secret")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_FORWARD_ENV", "TZ, LC_ALL,,")
+
+	cfg, err := LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	if !slices.Equal(cfg.ForwardEnv, []string{"TZ", "LC_ALL"}) {
+		t.Errorf("ForwardEnv = %q, want [TZ LC_ALL]", cfg.ForwardEnv)
+	}
+}
+
+func TestClientConfigProfileFromEnv(t *testing.T) {
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "192.168.1.100:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "client-env-secret")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_PROFILE", "beta")
+
+	cfg, err := LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	if cfg.Profile != "beta" {
+		t.Errorf("Profile = %q, want beta", cfg.Profile)
+	}
+}
+
+func TestServerConfigEnvAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.jsonc")
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret"}`), 0o644)
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(cfg.EnvAllowlist, DefaultEnvAllowlist()) {
+		t.Errorf("EnvAllowlist = %q, want defaults", cfg.EnvAllowlist)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "envAllowlist": ["FFREPORT"]}`), 0o644)
+	if cfg, err = LoadServerConfig(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(cfg.EnvAllowlist, []string{"FFREPORT"}) {
+		t.Errorf("EnvAllowlist = %q, want [FFREPORT]", cfg.EnvAllowlist)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "envAllowlist": []}`), 0o644)
+	if cfg, err = LoadServerConfig(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.EnvAllowlist) != 0 {
+		t.Errorf("EnvAllowlist = %q, want empty", cfg.EnvAllowlist)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "envAllowlist": ["A=B"]}`), 0o644)
+	if _, err := LoadServerConfig(path); err == nil || !strings.Contains(err.Error(), "envAllowlist") {
+		t.Errorf("error = %v, want invalid envAllowlist", err)
+	}
+	for _, entry := range []string{"*", "FF*", "FFOIP_FD", "FFMPEG_OVER_IP_*"} {
+		os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "envAllowlist": ["`+entry+`"]}`), 0o644)
+		if _, err := LoadServerConfig(path); err == nil || !strings.Contains(err.Error(), "server's own") {
+			t.Errorf("%s: error = %v, want the server's own variables refused", entry, err)
+		}
+	}
+}
+
+func TestEnvAllowed(t *testing.T) {
+	allowlist := []string{"TZ", "LC_*"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"TZ", true},
+		{"TZDIR", false},
+		{"LC_ALL", true},
+		{"LC_", true},
+		{"LANG", false},
+		{"LD_PRELOAD", false},
+	}
+	for _, tt := range tests {
+		if got := EnvAllowed(allowlist, tt.name); got != tt.want {
+			t.Errorf("EnvAllowed(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !EnvAllowed([]string{"*"}, "ANYTHING") {
+		t.Error(`"*" should allow every name`)
+	}
+}
+
+func TestClientConfigAgentSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "agentSocket": "/run/user/1000/ffmpeg-over-ip.sock"}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AgentSocket != "/run/user/1000/ffmpeg-over-ip.sock" {
+		t.Errorf("agentSocket = %q", cfg.AgentSocket)
+	}
+
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "192.168.1.100:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "secret")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AGENT_SOCKET", "/tmp/agent.sock")
+	cfg, err = LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	if cfg.AgentSocket != "/tmp/agent.sock" {
+		t.Errorf("agentSocket from env = %q", cfg.AgentSocket)
+	}
+}
+
+func TestClientConfigProgress(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "progress": "unix:/run/ui/progress.sock"}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Progress != "unix:/run/ui/progress.sock" {
+		t.Errorf("progress = %q", cfg.Progress)
+	}
+
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "192.168.1.100:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "secret")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_PROGRESS", "stderr")
+	cfg, err = LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	if cfg.Progress != "stderr" {
+		t.Errorf("progress from env = %q", cfg.Progress)
+	}
+}
+
+func TestServerConfigCapture(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.jsonc")
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "capture": {"dir": "/var/tmp/captures", "all": true}}`), 0o644)
+
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if cfg.Capture == nil || cfg.Capture.Dir != "/var/tmp/captures" || !cfg.Capture.All {
+		t.Errorf("Capture = %+v", cfg.Capture)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "0.0.0.0:5050", "authSecret": "secret", "capture": {"all": true}}`), 0o644)
+	if _, err := LoadServerConfig(path); err == nil || !strings.Contains(err.Error(), "capture.dir is required") {
+		t.Errorf("error = %v, want capture.dir is required", err)
+	}
+}
+
+func TestClientConfigCapture(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.jsonc")
+	os.WriteFile(path, []byte(`{"address": "127.0.0.1:5050", "authSecret": "secret", "capture": "/var/tmp/captures"}`), 0o644)
+
+	cfg, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Capture != "/var/tmp/captures" {
+		t.Errorf("capture = %q", cfg.Capture)
+	}
+
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CONFIG", "")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_ADDRESS", "192.168.1.100:5050")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_AUTH_SECRET", "secret")
+	t.Setenv("FFMPEG_OVER_IP_CLIENT_CAPTURE", "/tmp/job.ffcap")
+	cfg, err = LoadClientConfig("")
+	if err != nil {
+		t.Fatalf("LoadClientConfig from env failed: %v", err)
+	}
+	if cfg.Capture != "/tmp/job.ffcap" {
+		t.Errorf("capture from env = %q", cfg.Capture)
+	}
+}
@@ -0,0 +1,194 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+)
+
+// DefaultFailedTTL is how long a server that failed is tried after the
+// others.
+const DefaultFailedTTL = 30 * time.Second
+
+// Server is one server a client may connect to. Lower priorities are tried
+// first; among servers of equal priority, higher weights are more likely
+// to be tried first.
+type Server struct {
+	Address  string
+	Priority int
+	Weight   int
+}
+
+// Order returns servers in the order to try them: by ascending priority,
+// and within a priority by weighted random choice as in DNS SRV records.
+// Servers with weight zero come after the weighted ones, and a priority
+// whose servers all have weight zero keeps the configured order.
+func Order(servers []Server, rnd *rand.Rand) []Server {
+	sorted := make([]Server, len(servers))
+	copy(sorted, servers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]Server, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		group := sorted[start:end]
+		for len(group) > 0 {
+			total := 0
+			for _, s := range group {
+				total += s.Weight
+			}
+			if total == 0 {
+				ordered = append(ordered, group...)
+				break
+			}
+			pick := rnd.IntN(total)
+			for i, s := range group {
+				if pick < s.Weight {
+					ordered = append(ordered, s)
+					group = append(group[:i:i], group[i+1:]...)
+					break
+				}
+				pick -= s.Weight
+			}
+		}
+		start = end
+	}
+	return ordered
+}
+
+// Cache remembers servers that recently failed, in a file shared by all
+// client processes, so that a down server does not cost every job a
+// connect timeout. It is a hint: errors reading or writing the file are
+// ignored, and concurrent clients may lose each other's updates.
+type Cache struct {
+	path string
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewCache returns a cache stored at path whose entries expire after ttl.
+func NewCache(path string, ttl time.Duration) *Cache {
+	return &Cache{path: path, ttl: ttl, now: time.Now}
+}
+
+// DefaultCachePath is where the client keeps its cache of failed servers:
+// the user cache directory, or the temp directory if there is none.
+func DefaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "ffmpeg-over-ip", "failed-servers.json")
+}
+
+// Demote moves servers that failed within the TTL to the end of servers,
+// keeping the relative order of both parts. Failed servers are still
+// tried, in case none of the others is up either.
+func (c *Cache) Demote(servers []Server) []Server {
+	c.mu.Lock()
+	failed := c.load()
+	c.mu.Unlock()
+
+	result := make([]Server, 0, len(servers))
+	var demoted []Server
+	for _, s := range servers {
+		if _, ok := failed[s.Address]; ok {
+			demoted = append(demoted, s)
+		} else {
+			result = append(result, s)
+		}
+	}
+	return append(result, demoted...)
+}
+
+// MarkFailed records that connecting to address failed just now.
+func (c *Cache) MarkFailed(address string) {
+	c.update(func(failed map[string]time.Time) {
+		failed[address] = c.now()
+	})
+}
+
+// MarkOK forgets any failure recorded for address.
+func (c *Cache) MarkOK(address string) {
+	c.update(func(failed map[string]time.Time) {
+		delete(failed, address)
+	})
+}
+
+func (c *Cache) update(fn func(map[string]time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failed := c.load()
+	before := len(failed)
+	fn(failed)
+	if len(failed) == 0 && before == 0 {
+		return
+	}
+	c.save(failed)
+}
+
+// load returns the unexpired entries of the cache file, by address.
+func (c *Cache) load() map[string]time.Time {
+	failed := make(map[string]time.Time)
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return failed
+	}
+	var entries map[string]time.Time
+	if json.Unmarshal(data, &entries) != nil {
+		return failed
+	}
+	now := c.now()
+	for address, at := range entries {
+		if now.Sub(at) < c.ttl {
+			failed[address] = at
+		}
+	}
+	return failed
+}
+
+// save writes the cache file through a rename, so concurrent readers see
+// either the old or the new contents.
+func (c *Cache) save(failed map[string]time.Time) {
+	data, err := json.Marshal(failed)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".failed-servers-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || os.Rename(tmp.Name(), c.path) != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// Dial connects to a server address ("host:port" or "unix:/path"), giving
+// up after timeout. A zero timeout waits as long as the OS does.
+func Dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	network, addr := config.ParseAddress(address)
+	d := net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, network, addr)
+}
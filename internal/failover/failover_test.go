@@ -0,0 +1,134 @@
+package failover
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func addresses(servers []Server) []string {
+	var list []string
+	for _, s := range servers {
+		list = append(list, s.Address)
+	}
+	return list
+}
+
+func TestOrderByPriority(t *testing.T) {
+	servers := []Server{
+		{Address: "backup", Priority: 2},
+		{Address: "a", Priority: 1},
+		{Address: "b", Priority: 1},
+		{Address: "c", Priority: 0},
+	}
+	got := addresses(Order(servers, rand.New(rand.NewPCG(1, 2))))
+	want := []string{"c", "a", "b", "backup"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Order = %v, want %v", got, want)
+	}
+	if servers[0].Address != "backup" {
+		t.Error("Order modified its input")
+	}
+}
+
+func TestOrderWeighted(t *testing.T) {
+	servers := []Server{
+		{Address: "light", Weight: 1},
+		{Address: "heavy", Weight: 9},
+		{Address: "spare", Weight: 0},
+	}
+	rnd := rand.New(rand.NewPCG(3, 4))
+	heavyFirst := 0
+	for i := 0; i < 1000; i++ {
+		got := addresses(Order(servers, rnd))
+		if len(got) != 3 || got[2] != "spare" {
+			t.Fatalf("Order = %v, want weight-zero server last", got)
+		}
+		if got[0] == "heavy" {
+			heavyFirst++
+		}
+	}
+	// Expected 900; allow for randomness
+	if heavyFirst < 850 || heavyFirst > 950 {
+		t.Errorf("heavy server first %d/1000 times, want about 900", heavyFirst)
+	}
+}
+
+func TestCacheDemote(t *testing.T) {
+	cache := NewCache(filepath.Join(t.TempDir(), "failed.json"), time.Minute)
+	servers := []Server{{Address: "a"}, {Address: "b"}, {Address: "c"}}
+
+	cache.MarkFailed("a")
+	cache.MarkFailed("b")
+	if got, want := addresses(cache.Demote(servers)), []string{"c", "a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("Demote = %v, want %v", got, want)
+	}
+
+	cache.MarkOK("a")
+	if got, want := addresses(cache.Demote(servers)), []string{"a", "c", "b"}; !slices.Equal(got, want) {
+		t.Errorf("Demote after MarkOK = %v, want %v", got, want)
+	}
+}
+
+func TestCacheSharedBetweenProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "failed.json")
+	NewCache(path, time.Minute).MarkFailed("a")
+
+	servers := []Server{{Address: "a"}, {Address: "b"}}
+	if got, want := addresses(NewCache(path, time.Minute).Demote(servers)), []string{"b", "a"}; !slices.Equal(got, want) {
+		t.Errorf("Demote = %v, want %v", got, want)
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	cache := NewCache(filepath.Join(t.TempDir(), "failed.json"), time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	cache.MarkFailed("a")
+
+	servers := []Server{{Address: "a"}, {Address: "b"}}
+	now = now.Add(time.Minute)
+	if got, want := addresses(cache.Demote(servers)), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("Demote after TTL = %v, want %v", got, want)
+	}
+}
+
+func TestCacheIgnoresBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed.json")
+	os.WriteFile(path, []byte("not json"), 0o600)
+	cache := NewCache(path, time.Minute)
+
+	servers := []Server{{Address: "a"}, {Address: "b"}}
+	if got := addresses(cache.Demote(servers)); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("Demote = %v, want input order", got)
+	}
+	// The bad file is replaced on the next update
+	cache.MarkFailed("a")
+	if got := addresses(cache.Demote(servers)); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("Demote = %v, want [b a]", got)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	conn, err := Dial(context.Background(), addr, time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+
+	ln.Close()
+	if _, err := Dial(context.Background(), addr, time.Second); err == nil {
+		t.Error("expected error dialing a closed port")
+	}
+}
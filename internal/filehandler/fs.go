@@ -0,0 +1,68 @@
+package filehandler
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FS is the filesystem a Handler serves file I/O requests from. Paths are
+// as the server sent them. Errors that wrap a syscall.Errno or one of the
+// io/fs errors reach ffmpeg as the matching errno; others as EIO.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Mkdir(name string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+// File is a file opened by an FS. *os.File implements it.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// OSFS returns the local filesystem, with relative paths resolved against
+// dir, or against the current directory if dir is "".
+func OSFS(dir string) FS {
+	return osFS{dir: dir}
+}
+
+type osFS struct {
+	dir string
+}
+
+func (fsys osFS) path(p string) string {
+	if fsys.dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(fsys.dir, p)
+}
+
+func (fsys osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(fsys.path(name), flag, perm)
+	if err != nil {
+		// Not a nil *os.File in a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fsys osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(fsys.path(path), perm)
+}
+
+func (fsys osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(fsys.path(name), perm)
+}
+
+func (fsys osFS) Remove(name string) error {
+	return os.Remove(fsys.path(name))
+}
+
+func (fsys osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(fsys.path(oldpath), fsys.path(newpath))
+}
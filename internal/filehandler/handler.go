@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sync"
@@ -12,15 +13,29 @@ import (
 	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
 )
 
-// Handler executes file I/O operations against the local filesystem.
+// Handler executes file I/O operations against a filesystem, the local one
+// unless it was created with NewHandlerFS.
 type Handler struct {
 	mu    sync.Mutex
-	files map[uint16]*os.File
+	files map[uint16]File
+	fs    FS
 }
 
 func NewHandler() *Handler {
+	return NewHandlerFS(OSFS(""))
+}
+
+// NewHandlerIn returns a handler that resolves relative paths against dir
+// instead of the current directory, for jobs started from another directory.
+func NewHandlerIn(dir string) *Handler {
+	return NewHandlerFS(OSFS(dir))
+}
+
+// NewHandlerFS returns a handler that serves requests from fsys.
+func NewHandlerFS(fsys FS) *Handler {
 	return &Handler{
-		files: make(map[uint16]*os.File),
+		files: make(map[uint16]File),
+		fs:    fsys,
 	}
 }
 
@@ -83,12 +98,12 @@ func (h *Handler) handleOpen(payload []byte) (uint8, []byte, error) {
 
 	if req.Flags&protocol.FioOCREAT != 0 {
 		dir := filepath.Dir(req.Path)
-		if err := os.MkdirAll(dir, 0o755); err != nil {
+		if err := h.fs.MkdirAll(dir, 0o755); err != nil {
 			return protocol.MsgIoError, ioErr(req.RequestID, mapErrno(err)), nil
 		}
 	}
 
-	f, err := os.OpenFile(req.Path, osFlags, mode)
+	f, err := h.fs.OpenFile(req.Path, osFlags, mode)
 	if err != nil {
 		return protocol.MsgIoError, ioErr(req.RequestID, mapErrno(err)), nil
 	}
@@ -243,7 +258,7 @@ func (h *Handler) handleUnlink(payload []byte) (uint8, []byte, error) {
 		return 0, nil, err
 	}
 
-	if err := os.Remove(req.Path); err != nil {
+	if err := h.fs.Remove(req.Path); err != nil {
 		return protocol.MsgIoError, ioErr(req.RequestID, mapErrno(err)), nil
 	}
 
@@ -257,7 +272,7 @@ func (h *Handler) handleRename(payload []byte) (uint8, []byte, error) {
 		return 0, nil, err
 	}
 
-	if err := os.Rename(req.OldPath, req.NewPath); err != nil {
+	if err := h.fs.Rename(req.OldPath, req.NewPath); err != nil {
 		return protocol.MsgIoError, ioErr(req.RequestID, mapErrno(err)), nil
 	}
 
@@ -271,7 +286,7 @@ func (h *Handler) handleMkdir(payload []byte) (uint8, []byte, error) {
 		return 0, nil, err
 	}
 
-	if err := os.Mkdir(req.Path, os.FileMode(req.Mode)); err != nil {
+	if err := h.fs.Mkdir(req.Path, os.FileMode(req.Mode)); err != nil {
 		return protocol.MsgIoError, ioErr(req.RequestID, mapErrno(err)), nil
 	}
 
@@ -346,6 +361,17 @@ func mapErrno(err error) int32 {
 			return protocol.FioERANGE
 		}
 	}
+	// Errors of an FS other than the local one
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return protocol.FioENOENT
+	case errors.Is(err, fs.ErrExist):
+		return protocol.FioEEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return protocol.FioEACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return protocol.FioEINVAL
+	}
 	return protocol.FioEIO
 }
 
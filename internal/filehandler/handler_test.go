@@ -3,6 +3,7 @@ package filehandler
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sync"
@@ -1945,3 +1946,83 @@ func TestMkdirWithMode(t *testing.T) {
 		t.Fatalf("expected owner rwx (0700) in mode, got %04o", actualMode)
 	}
 }
+
+func TestHandlerInResolvesRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHandlerIn(dir)
+	defer h.CloseAll()
+
+	rt, _ := dispatch(t, h, protocol.MsgOpen, (&protocol.OpenRequest{
+		RequestID: 1, FileID: 1, Flags: protocol.FioOWRONLY | protocol.FioOCREAT,
+		Mode: 0o644, Path: "out/file.txt",
+	}).Encode())
+	if rt != protocol.MsgOpenOk {
+		t.Fatalf("expected MsgOpenOk, got 0x%02x", rt)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "file.txt")); err != nil {
+		t.Fatalf("relative path was not created in the handler's directory: %v", err)
+	}
+
+	rt, _ = dispatch(t, h, protocol.MsgRename, (&protocol.RenameRequest{
+		RequestID: 2, OldPath: "out/file.txt", NewPath: filepath.Join(dir, "moved.txt"),
+	}).Encode())
+	if rt != protocol.MsgRenameOk {
+		t.Fatalf("expected MsgRenameOk, got 0x%02x", rt)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved.txt")); err != nil {
+		t.Fatalf("absolute path was not used as is: %v", err)
+	}
+}
+
+// readOnlyFS serves a directory, refusing anything that would change it.
+type readOnlyFS struct{ FS }
+
+func (fsys readOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return fsys.FS.OpenFile(name, flag, perm)
+}
+
+func (fsys readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func TestHandlerFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlerFS(readOnlyFS{OSFS(dir)})
+	defer h.CloseAll()
+
+	rt, rp := dispatch(t, h, protocol.MsgOpen, (&protocol.OpenRequest{
+		RequestID: 1, FileID: 1, Flags: protocol.FioORDONLY, Path: "in.txt",
+	}).Encode())
+	if rt != protocol.MsgOpenOk || decodeOpenOk(t, rp).FileSize != 5 {
+		t.Fatalf("open through the FS: got 0x%02x", rt)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		msgType uint8
+		payload []byte
+		errno   int32
+	}{
+		{"write", protocol.MsgOpen, (&protocol.OpenRequest{RequestID: 2, FileID: 2, Flags: protocol.FioOWRONLY, Path: "in.txt"}).Encode(), protocol.FioEACCES},
+		{"unlink", protocol.MsgUnlink, (&protocol.UnlinkRequest{RequestID: 3, Path: "in.txt"}).Encode(), protocol.FioEACCES},
+		{"missing", protocol.MsgOpen, (&protocol.OpenRequest{RequestID: 4, FileID: 3, Flags: protocol.FioORDONLY, Path: "missing.txt"}).Encode(), protocol.FioENOENT},
+	} {
+		rt, rp := dispatch(t, h, tc.msgType, tc.payload)
+		if rt != protocol.MsgIoError {
+			t.Errorf("%s: expected MsgIoError, got 0x%02x", tc.name, rt)
+			continue
+		}
+		if resp := decodeIoError(t, rp); resp.Errno != tc.errno {
+			t.Errorf("%s: errno = %d, want %d", tc.name, resp.Errno, tc.errno)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "in.txt")); err != nil {
+		t.Fatalf("file changed through a read-only FS: %v", err)
+	}
+}
@@ -0,0 +1,548 @@
+// Package mux runs many streams over one connection. Each stream is a
+// net.Conn of its own, carrying the messages of one job exactly as a
+// dedicated connection would, so a client can run many concurrent jobs over
+// a single authenticated connection.
+//
+// Stream bytes travel in MsgStreamData frames tagged with the stream ID.
+// The client opens a stream by sending an empty data frame for it,
+// numbering streams upwards from 1; the stream exists until either side
+// sends MsgStreamClose. Each stream has its own flow control: a side may
+// have at most window bytes in flight that the other side has not read, and
+// MsgStreamWindow hands back credit as the reader consumes them. A stream
+// whose reader stalls therefore never blocks the connection or the other
+// streams.
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+const (
+	// window is how many unread bytes a stream may have in flight in each
+	// direction. Credit is handed back once half of it has been read.
+	window = 256 << 10
+
+	// maxFrame bounds the data in one frame, so that streams sharing the
+	// connection take turns.
+	maxFrame = 32 << 10
+
+	// MaxStreams is how many streams may be open on a connection at once.
+	// The server refuses streams beyond it by closing them.
+	MaxStreams = 1024
+
+	// acceptBacklog is how many new streams may wait for Accept.
+	acceptBacklog = 64
+)
+
+// ErrTooManyStreams is returned by Open when MaxStreams are already open.
+var ErrTooManyStreams = errors.New("too many streams")
+
+// Conn is a multiplexed connection.
+type Conn struct {
+	conn    net.Conn
+	client  bool
+	writeMu sync.Mutex
+	openMu  sync.Mutex // keeps streams opening in the order of their IDs
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	lastID  uint32 // last stream ID opened (client) or seen (server)
+	closed  bool
+	err     error // returned once closed
+
+	accept chan *Stream
+	done   chan struct{}
+
+	lastSend atomic.Int64
+	lastRecv atomic.Int64
+}
+
+// Client returns the client side of a multiplexed connection over conn,
+// which opens streams with Open. The handshake must already be done.
+func Client(conn net.Conn) *Conn {
+	return newConn(conn, true)
+}
+
+// Server returns the server side of a multiplexed connection over conn,
+// which receives streams with Accept. The handshake must already be done.
+func Server(conn net.Conn) *Conn {
+	return newConn(conn, false)
+}
+
+func newConn(conn net.Conn, client bool) *Conn {
+	c := &Conn{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	now := time.Now().UnixNano()
+	c.lastSend.Store(now)
+	c.lastRecv.Store(now)
+	go c.readLoop()
+	return c
+}
+
+// Open starts a new stream. Only the client side opens streams.
+func (c *Conn) Open() (*Stream, error) {
+	if !c.client {
+		return nil, errors.New("only the client side opens streams")
+	}
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if len(c.streams) >= MaxStreams {
+		c.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	c.lastID++
+	s := newStream(c, c.lastID)
+	c.streams[s.id] = s
+	c.mu.Unlock()
+
+	if err := c.writeFrame(protocol.MsgStreamData, (&protocol.StreamData{StreamID: s.id}).Encode()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for the client to open a stream. It fails once the
+// connection is closed.
+func (c *Conn) Accept() (*Stream, error) {
+	select {
+	case s := <-c.accept:
+		return s, nil
+	case <-c.done:
+		// Streams opened just before the connection closed are still
+		// handed out, so that their first messages get an answer
+		select {
+		case s := <-c.accept:
+			return s, nil
+		default:
+		}
+		return nil, c.Err()
+	}
+}
+
+// Ping sends a keepalive on the connection itself.
+func (c *Conn) Ping() error {
+	return c.writeFrame(protocol.MsgPing, nil)
+}
+
+// Keepalive pings the other side whenever nothing was sent for interval,
+// and closes the connection when nothing was received for timeout. It
+// returns once the connection is closed.
+func (c *Conn) Keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, c.lastRecv.Load())) >= timeout {
+			c.fail(fmt.Errorf("no data received for %v", timeout))
+			return
+		}
+		if time.Since(time.Unix(0, c.lastSend.Load())) >= interval {
+			c.Ping()
+		}
+	}
+}
+
+// NumStreams returns how many streams are open.
+func (c *Conn) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+// Done is closed when the connection closes.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection closed, or nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection and every stream on it.
+func (c *Conn) Close() error {
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+// RemoteAddr returns the address of the other side.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// fail closes the connection with err and fails every open stream.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.err = err
+	streams := c.streams
+	c.streams = nil
+	close(c.done)
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
+func (c *Conn) writeFrame(msgType uint8, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if err := protocol.WriteMessageTo(c.conn, msgType, payload); err != nil {
+		c.fail(err)
+		return err
+	}
+	c.lastSend.Store(time.Now().UnixNano())
+	return nil
+}
+
+// forget removes a stream once either side closed it. Frames that still
+// arrive for it are ignored.
+func (c *Conn) forget(id uint32) {
+	c.mu.Lock()
+	delete(c.streams, id)
+	c.mu.Unlock()
+}
+
+// readLoop reads frames and hands them to their streams. It never blocks on
+// a stream: each stream buffers what it receives, bounded by its window.
+func (c *Conn) readLoop() {
+	for {
+		msg, err := protocol.ReadMessageFrom(c.conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+
+		switch msg.Type {
+		case protocol.MsgPing:
+			go c.writeFrame(protocol.MsgPong, nil)
+		case protocol.MsgPong:
+		case protocol.MsgStreamData:
+			frame, err := protocol.DecodeStreamData(msg.Payload)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			s := c.stream(frame.StreamID)
+			if s == nil {
+				continue
+			}
+			if err := s.push(frame.Data); err != nil {
+				c.fail(err)
+				return
+			}
+		case protocol.MsgStreamWindow:
+			update, err := protocol.DecodeStreamWindow(msg.Payload)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if s := c.lookup(update.StreamID); s != nil {
+				s.grant(int(update.Increment))
+			}
+		case protocol.MsgStreamClose:
+			frame, err := protocol.DecodeStreamData(msg.Payload)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if s := c.lookup(frame.StreamID); s != nil {
+				s.remoteClose()
+			}
+		default:
+			c.fail(fmt.Errorf("unexpected message type 0x%02x on a multiplexed connection", msg.Type))
+			return
+		}
+	}
+}
+
+func (c *Conn) lookup(id uint32) *Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+// stream returns the stream a data frame belongs to. On the server, a
+// frame with a new ID opens a stream; it returns nil for frames of streams
+// that are already closed or that were refused.
+func (c *Conn) stream(id uint32) *Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.streams[id]; s != nil || c.client || id <= c.lastID {
+		return s
+	}
+	c.lastID = id
+	if len(c.streams) >= MaxStreams || len(c.accept) == cap(c.accept) {
+		go c.writeFrame(protocol.MsgStreamClose, (&protocol.StreamData{StreamID: id}).Encode())
+		return nil
+	}
+	s := newStream(c, id)
+	c.streams[id] = s
+	c.accept <- s
+	return s
+}
+
+// Stream is one stream of a multiplexed connection.
+type Stream struct {
+	c  *Conn
+	id uint32
+
+	// writeMu keeps the frames of one Write together when it waits for
+	// credit partway through
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	changed  *sync.Cond
+	buf      []byte // received and not yet read
+	consumed int    // read since credit was last handed back
+	credit   int    // bytes that may still be sent
+	closed   bool   // closed by Close
+	eof      bool   // closed by the other side
+	err      error  // the connection failed
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(c *Conn, id uint32) *Stream {
+	s := &Stream{c: c, id: id, credit: window}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the stream's ID on its connection.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads bytes the other side wrote. It returns io.EOF once the other
+// side closed the stream and everything it sent was read.
+func (s *Stream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	for len(s.buf) == 0 {
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.eof:
+			err = io.EOF
+		case s.err != nil:
+			err = s.err
+		case s.readDeadline.passed():
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.changed.Wait()
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	s.consumed += n
+	var increment int
+	if s.consumed >= window/2 && !s.eof {
+		increment = s.consumed
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if increment > 0 {
+		s.c.writeFrame(protocol.MsgStreamWindow, (&protocol.StreamWindow{StreamID: s.id, Increment: uint32(increment)}).Encode())
+	}
+	return n, nil
+}
+
+// Write sends p to the other side, waiting for credit when the other side
+// has not read what was already sent.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.credit == 0 && !s.closed && !s.eof && s.err == nil && !s.writeDeadline.passed() {
+			s.changed.Wait()
+		}
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.eof:
+			err = io.ErrClosedPipe
+		case s.err != nil:
+			err = s.err
+		case s.writeDeadline.passed():
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), s.credit, maxFrame)
+		s.credit -= n
+		s.mu.Unlock()
+
+		frame := &protocol.StreamData{StreamID: s.id, Data: p[:n]}
+		if err := s.c.writeFrame(protocol.MsgStreamData, frame.Encode()); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream. The other side reads what was already sent,
+// then io.EOF.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	notify := !s.eof && s.err == nil
+	s.readDeadline.stop()
+	s.writeDeadline.stop()
+	s.changed.Broadcast()
+	s.mu.Unlock()
+
+	s.c.forget(s.id)
+	if notify {
+		s.c.writeFrame(protocol.MsgStreamClose, (&protocol.StreamData{StreamID: s.id}).Encode())
+	}
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return s.c.conn.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr { return s.c.conn.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline.set(t, s.changed)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline.set(t, s.changed)
+	return nil
+}
+
+func (s *Stream) push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if len(s.buf)+len(data) > window {
+		return fmt.Errorf("stream %d exceeded its flow control window", s.id)
+	}
+	s.buf = append(s.buf, data...)
+	s.changed.Broadcast()
+	return nil
+}
+
+func (s *Stream) grant(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.changed.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.eof = true
+	s.changed.Broadcast()
+	s.mu.Unlock()
+	s.c.forget(s.id)
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.changed.Broadcast()
+	s.mu.Unlock()
+}
+
+// deadline wakes a stream's waiters when it passes. It is protected by the
+// stream's mu.
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+func (d *deadline) set(t time.Time, cond *sync.Cond) {
+	d.stop()
+	d.t = t
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		})
+	}
+	cond.Broadcast()
+}
+
+func (d *deadline) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+func (d *deadline) passed() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
@@ -0,0 +1,202 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns both sides of a multiplexed connection over a loopback TCP
+// connection.
+func pair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.Fatal("accept failed")
+	}
+	client, server := Client(dialed), Server(serverConn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreamsCarryIndependentData(t *testing.T) {
+	client, server := pair(t)
+
+	// The server echoes every stream back
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// Larger than the window, so credit must be handed back
+			data := make([]byte, 3*window+123)
+			rand.Read(data)
+			go func() {
+				s.Write(data)
+			}()
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(s, got); err != nil {
+				t.Errorf("stream %d: %v", s.ID(), err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("stream %d: data corrupted", s.ID())
+			}
+			s.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStalledStreamDoesNotBlockOthers(t *testing.T) {
+	client, server := pair(t)
+
+	stalled, _ := client.Open()
+	stalled.Write([]byte("x"))
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the stalled stream, so its writer runs out of credit
+	wrote := make(chan struct{})
+	go func() {
+		stalled.Write(make([]byte, 2*window))
+		close(wrote)
+	}()
+
+	other, _ := client.Open()
+	if _, err := other.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	select {
+	case <-wrote:
+		t.Error("write beyond the window should wait for the reader")
+	default:
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := pair(t)
+
+	c, _ := client.Open()
+	c.Write([]byte("bye"))
+	c.Close()
+
+	s, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil || string(got) != "bye" {
+		t.Errorf("read %q, %v; want bye then EOF", got, err)
+	}
+	if _, err := s.Write([]byte("late")); err == nil {
+		t.Error("write to a stream closed by the other side should fail")
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after Close = %v, want net.ErrClosed", err)
+	}
+	if client.NumStreams() != 0 {
+		t.Errorf("client still tracks %d streams", client.NumStreams())
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, _ := pair(t)
+	s, _ := client.Open()
+	s.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestConnFailureFailsStreams(t *testing.T) {
+	client, server := pair(t)
+	c, _ := client.Open()
+	c.Write([]byte("x"))
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("read should fail once the connection is gone")
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Error("client connection did not close")
+	}
+	if _, err := client.Open(); err == nil {
+		t.Error("Open should fail on a closed connection")
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Error("Accept should fail on a closed connection")
+	}
+}
+
+func TestKeepaliveClosesSilentConnection(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := Server(a)
+	go c.Keepalive(10*time.Millisecond, 50*time.Millisecond)
+
+	// Nobody answers the pings
+	go io.Copy(io.Discard, b)
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("keepalive did not close a silent connection")
+	}
+}
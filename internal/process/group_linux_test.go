@@ -0,0 +1,148 @@
+package process
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const prSetChildSubreaper = 36
+
+// startWithChild starts a shell script that prints the PID of a background
+// child first, and returns the process and that PID.
+func startWithChild(t *testing.T, script string) (*Process, int) {
+	t.Helper()
+	p := NewProcess("sh", []string{"-c", script})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	line, err := bufio.NewReader(p.Stdout()).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read child PID: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("invalid child PID %q", line)
+	}
+	return p, pid
+}
+
+// processState returns the state letter from /proc/<pid>/stat, or "" if
+// the process no longer exists.
+func processState(pid int) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	return fields[0]
+}
+
+// waitGone waits for pid to exit. A zombie counts as exited: whoever it
+// was orphaned to is responsible for reaping it.
+func waitGone(t *testing.T, pid int, allowZombie bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		state := processState(pid)
+		if state == "" || (allowZombie && state == "Z") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d still present in state %s", pid, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartsInOwnProcessGroup(t *testing.T) {
+	p, _ := startWithChild(t, "echo $$; sleep 60")
+	defer p.Terminate()
+	pgid, err := syscall.Getpgid(p.PID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgid != p.PID() {
+		t.Errorf("pgid = %d, want %d", pgid, p.PID())
+	}
+}
+
+func TestTerminateKillsProcessGroup(t *testing.T) {
+	p, child := startWithChild(t, "sleep 60 & echo $!; wait")
+	p.Terminate()
+	waitGone(t, child, true)
+}
+
+func TestTerminateEscalatesForGroup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for KillTimeout")
+	}
+	// The background child inherits the ignored SIGTERM
+	p, child := startWithChild(t, `trap "" TERM; sleep 60 & echo $!; wait`)
+	start := time.Now()
+	p.Terminate()
+	if elapsed := time.Since(start); elapsed < KillTimeout {
+		t.Errorf("Terminate returned after %v, before escalating to SIGKILL", elapsed)
+	}
+	waitGone(t, child, true)
+}
+
+func TestExitKillsLeftoverGroup(t *testing.T) {
+	p, child := startWithChild(t, "sleep 60 & echo $!")
+	// The leftover sleep holds stdout open until it is killed
+	stdout := readAsync(p.Stdout())
+	p.Wait()
+	done := make(chan struct{})
+	go func() {
+		stdout()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stdout still open after exit")
+	}
+	waitGone(t, child, true)
+}
+
+func TestExitReapsOrphanedGroup(t *testing.T) {
+	// Act like PID 1 in a container: orphans are reparented to this process
+	if err := setSubreaper(1); err != nil {
+		t.Skipf("cannot become subreaper: %v", err)
+	}
+	defer setSubreaper(0)
+
+	p, child := startWithChild(t, "sleep 60 & echo $!")
+	p.Wait()
+	waitGone(t, child, false)
+}
+
+func setSubreaper(on uintptr) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, on, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func TestNoGroupSignalAfterReap(t *testing.T) {
+	p := NewProcess("true", nil)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	p.Wait()
+	// The group's ID is free for reuse once it is reaped
+	if err := p.signalGroup(syscall.SIGKILL); err != nil || !p.groupReaped {
+		t.Errorf("signalGroup after reap = %v, reaped = %v; want no signal", err, p.groupReaped)
+	}
+	start := time.Now()
+	p.Terminate()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Terminate of an exited process took %v", elapsed)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package process
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Without process groups only the child itself is signalled.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func (p *Process) signalGroup(sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return p.cmd.Process.Kill()
+	}
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *Process) reapGroup() {}
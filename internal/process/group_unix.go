@@ -0,0 +1,62 @@
+//go:build unix
+
+package process
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts the child as the leader of a new process group,
+// so that wrapper scripts and helpers it spawns can be signalled with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends sig to every process in the child's group, and to the
+// child directly if it has moved to a group of its own.
+func (p *Process) signalGroup(sig syscall.Signal) error {
+	p.groupMu.Lock()
+	defer p.groupMu.Unlock()
+	if p.groupReaped {
+		return nil
+	}
+	pid := p.cmd.Process.Pid
+	err := syscall.Kill(-pid, sig)
+	if pgid, gerr := syscall.Getpgid(pid); gerr == nil && pgid != pid {
+		return p.cmd.Process.Signal(sig)
+	}
+	return err
+}
+
+// reapGroup kills whatever the child left running in its process group,
+// which would otherwise keep the GPU busy and hold the output pipes open.
+// Members orphaned to this process, as happens when the server is PID 1 in
+// a container, are reaped. Called after the child itself has been waited
+// for, so its status cannot be taken here.
+func (p *Process) reapGroup() {
+	p.groupMu.Lock()
+	defer p.groupMu.Unlock()
+	p.groupReaped = true
+	pgid := p.cmd.Process.Pid
+	if syscall.Kill(-pgid, syscall.SIGKILL) != nil {
+		return // group already empty
+	}
+	deadline := time.Now().Add(KillTimeout)
+	for time.Now().Before(deadline) {
+		for {
+			pid, err := syscall.Wait4(-pgid, nil, syscall.WNOHANG, nil)
+			if pid <= 0 || err != nil {
+				break
+			}
+		}
+		if syscall.Kill(-pgid, 0) == syscall.ESRCH {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
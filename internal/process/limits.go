@@ -0,0 +1,77 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// helperArg is argv[1] when the server binary is re-executed to apply
+// limits or a sandbox to itself before exec'ing the real program. See
+// HelperMain.
+const helperArg = "__ffoip-exec"
+
+// ErrNoHelper is returned by Start for a process that needs the launch
+// helper in a binary whose main does not call HelperMain. Re-executing such
+// a binary would run its main again instead of the program.
+var ErrNoHelper = errors.New("resource limits and the sandbox need HelperMain to be called first in main")
+
+// IOClass is a Linux I/O scheduling class.
+type IOClass int
+
+const (
+	IOClassNone IOClass = iota
+	IOClassRealtime
+	IOClassBestEffort
+	IOClassIdle
+)
+
+// IOPriority is an I/O scheduling class and a level from 0 (highest) to 7.
+type IOPriority struct {
+	Class IOClass
+	Level int
+}
+
+// Cgroup places the process in its own cgroup v2 group under Parent, which
+// must already exist with the memory and cpu controllers enabled for its
+// children. The group is removed once the process exits.
+type Cgroup struct {
+	Parent    string
+	MemoryMax uint64  // memory.max in bytes, 0 for no limit
+	CPUs      float64 // cpu.max in CPUs, 0 for no limit
+}
+
+// Limits are resource limits for the child process. Zero values leave the
+// server's own settings in place. They are only enforced on Linux; on other
+// platforms they are ignored with a warning.
+type Limits struct {
+	AddressSpace uint64        // RLIMIT_AS in bytes
+	OpenFiles    uint64        // RLIMIT_NOFILE
+	CPUTime      time.Duration // RLIMIT_CPU, rounded up to whole seconds
+	Nice         *int
+	IOPriority   *IOPriority
+	Cgroup       *Cgroup
+}
+
+func (l *Limits) isZero() bool {
+	return !l.needsHelper() && l.Cgroup == nil
+}
+
+// needsHelper reports whether any limit must be applied by the child
+// itself, before it execs the program.
+func (l *Limits) needsHelper() bool {
+	return l.AddressSpace != 0 || l.OpenFiles != 0 || l.CPUTime != 0 || l.Nice != nil || l.IOPriority != nil
+}
+
+// SetLimits sets resource limits for the child. Must be called before Start.
+func (p *Process) SetLimits(l Limits) {
+	p.limits = l
+}
+
+// helperFail reports a helper error on stderr, which is relayed to the
+// client, and exits with the shell's "cannot execute" status.
+func helperFail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "ffmpeg-over-ip: "+format+"\n", args...)
+	os.Exit(126)
+}
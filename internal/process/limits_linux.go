@@ -0,0 +1,220 @@
+package process
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const ioprioWhoProcess = 1
+
+// helperSpec is what the launch helper is asked to set up, passed as JSON
+// in argv[2].
+type helperSpec struct {
+	Limits  Limits
+	Sandbox *Sandbox
+}
+
+// HelperMain must be called first thing in main by any binary that starts
+// processes with limits or a sandbox. When the binary was re-executed as
+// the launch helper, HelperMain sets up its own process and execs the
+// target program in its place, so everything is in force before the
+// program's first instruction. Otherwise it returns immediately.
+func HelperMain() {
+	helperInstalled.Store(true)
+	if len(os.Args) < 4 || os.Args[1] != helperArg {
+		return
+	}
+	// nice and ioprio are per thread; the thread that sets them must be the
+	// one that execs.
+	runtime.LockOSThread()
+
+	var spec helperSpec
+	if err := json.Unmarshal([]byte(os.Args[2]), &spec); err != nil {
+		helperFail("invalid launch settings: %v", err)
+	}
+	if spec.Sandbox != nil {
+		if err := enterSandbox(spec.Sandbox, os.Args[3]); err != nil {
+			helperFail("failed to set up sandbox: %v", err)
+		}
+	}
+	// Before dropping privileges, which negative nice values need
+	if err := applyOwnLimits(&spec.Limits); err != nil {
+		helperFail("failed to apply resource limits: %v", err)
+	}
+	if spec.Sandbox != nil {
+		if err := spec.Sandbox.dropPrivileges(); err != nil {
+			helperFail("failed to drop privileges: %v", err)
+		}
+	}
+	err := syscall.Exec(os.Args[3], os.Args[3:], os.Environ())
+	helperFail("failed to exec %s: %v", os.Args[3], err)
+}
+
+// helperInstalled is set once HelperMain has been called.
+var helperInstalled atomic.Bool
+
+// HelperInstalled reports whether HelperMain has been called, so that
+// processes with limits or a sandbox can be started.
+func HelperInstalled() bool {
+	return helperInstalled.Load()
+}
+
+func applyOwnLimits(l *Limits) error {
+	if l.AddressSpace != 0 {
+		if err := setRlimit(syscall.RLIMIT_AS, l.AddressSpace); err != nil {
+			return fmt.Errorf("address space: %w", err)
+		}
+	}
+	if l.OpenFiles != 0 {
+		if err := setRlimit(syscall.RLIMIT_NOFILE, l.OpenFiles); err != nil {
+			return fmt.Errorf("open files: %w", err)
+		}
+	}
+	if l.CPUTime != 0 {
+		seconds := uint64((l.CPUTime + time.Second - 1) / time.Second)
+		if err := setRlimit(syscall.RLIMIT_CPU, seconds); err != nil {
+			return fmt.Errorf("cpu time: %w", err)
+		}
+	}
+	if l.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *l.Nice); err != nil {
+			return fmt.Errorf("nice: %w", err)
+		}
+	}
+	if l.IOPriority != nil {
+		prio := uintptr(l.IOPriority.Class)<<13 | uintptr(l.IOPriority.Level)
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prio); errno != 0 {
+			return fmt.Errorf("io priority: %w", errno)
+		}
+	}
+	return nil
+}
+
+func setRlimit(resource int, value uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value})
+}
+
+// applyLimits rewrites cmd to run through the launch helper, in new
+// namespaces and a new cgroup, as p.limits and p.sandbox require. Called
+// just before cmd.Start.
+func (p *Process) applyLimits(cmd *exec.Cmd) error {
+	if (p.limits.isZero() && p.sandbox == nil) || cmd.Err != nil {
+		return nil
+	}
+	attr := &syscall.SysProcAttr{}
+
+	if p.limits.needsHelper() || p.sandbox != nil {
+		if !HelperInstalled() {
+			return ErrNoHelper
+		}
+		// Fail here rather than in the helper, like exec.Cmd.Start would
+		path, err := exec.LookPath(cmd.Path)
+		if err != nil {
+			return err
+		}
+		if p.sandbox != nil {
+			// The program is bound into the sandbox at its absolute path
+			if path, err = filepath.Abs(path); err != nil {
+				return err
+			}
+			attr.Cloneflags = p.sandbox.cloneflags()
+		}
+		self, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to resolve helper executable: %w", err)
+		}
+		encoded, err := json.Marshal(helperSpec{Limits: p.limits, Sandbox: p.sandbox})
+		if err != nil {
+			return err
+		}
+		cmd.Args = append([]string{self, helperArg, string(encoded), path}, cmd.Args[1:]...)
+		cmd.Path = self
+	}
+
+	if cg := p.limits.Cgroup; cg != nil {
+		dir, err := createCgroup(cg)
+		if err != nil {
+			return err
+		}
+		fd, err := os.Open(dir)
+		if err != nil {
+			os.Remove(dir)
+			return fmt.Errorf("failed to open cgroup: %w", err)
+		}
+		p.cgroupDir, p.cgroupFD = dir, fd
+		attr.UseCgroupFD, attr.CgroupFD = true, int(fd.Fd())
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// createCgroup creates a uniquely named child group of cg.Parent with cg's
+// limits and returns its path.
+func createCgroup(cg *Cgroup) (string, error) {
+	var id [8]byte
+	rand.Read(id[:])
+	dir := filepath.Join(cg.Parent, "ffoip-"+hex.EncodeToString(id[:]))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	if cg.MemoryMax != 0 {
+		if err := writeCgroupFile(dir, "memory.max", fmt.Sprint(cg.MemoryMax)); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	if cg.CPUs != 0 {
+		const period = 100000
+		quota := uint64(cg.CPUs * period)
+		if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, period)); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("failed to set cgroup %s: %w", name, err)
+	}
+	return nil
+}
+
+// releaseCgroupFD closes the cgroup directory handle once the child has
+// been placed in it.
+func (p *Process) releaseCgroupFD() {
+	if p.cgroupFD != nil {
+		p.cgroupFD.Close()
+		p.cgroupFD = nil
+	}
+}
+
+// removeCgroup kills anything the process left behind in its cgroup and
+// removes the group. Called after the process has exited.
+func (p *Process) removeCgroup() {
+	p.releaseCgroupFD()
+	if p.cgroupDir == "" {
+		return
+	}
+	// cgroup.kill needs Linux 5.14; without it, leftovers keep the group
+	// busy and it is left in place.
+	os.WriteFile(filepath.Join(p.cgroupDir, "cgroup.kill"), []byte("1"), 0o644)
+	for i := 0; i < 10; i++ {
+		err := os.Remove(p.cgroupDir)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
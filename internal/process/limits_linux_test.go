@@ -0,0 +1,172 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runLimited runs a shell script with limits and returns its stdout.
+func runLimited(t *testing.T, limits Limits, script string) string {
+	t.Helper()
+	p := NewProcess("sh", []string{"-c", script})
+	p.SetLimits(limits)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	stdout := readAsync(p.Stdout())
+	stderr := readAsync(p.Stderr())
+	code, _ := p.Wait()
+	out, _ := stdout()
+	errOut, _ := stderr()
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	return string(out)
+}
+
+func TestLimitsRlimits(t *testing.T) {
+	out := runLimited(t, Limits{
+		AddressSpace: 4 << 30,
+		OpenFiles:    64,
+		CPUTime:      1500 * time.Millisecond,
+	}, "ulimit -n; ulimit -v; ulimit -t")
+
+	lines := strings.Fields(out)
+	want := []string{"64", strconv.Itoa(4 << 20), "2"}
+	if len(lines) != len(want) {
+		t.Fatalf("output = %q", out)
+	}
+	for i, name := range []string{"open files", "address space (KiB)", "cpu seconds"} {
+		if lines[i] != want[i] {
+			t.Errorf("%s = %s, want %s", name, lines[i], want[i])
+		}
+	}
+}
+
+func TestLimitsNice(t *testing.T) {
+	nice := 7
+	// Field 19 of /proc/<pid>/stat is the nice value
+	out := runLimited(t, Limits{Nice: &nice}, "cut -d' ' -f19 /proc/self/stat")
+	if strings.TrimSpace(out) != "7" {
+		t.Errorf("nice = %q, want 7", strings.TrimSpace(out))
+	}
+}
+
+func TestLimitsIOPriority(t *testing.T) {
+	p := NewProcess("sleep", []string{"5"})
+	p.SetLimits(Limits{IOPriority: &IOPriority{Class: IOClassIdle}})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Terminate()
+
+	// Wait for the helper to exec sleep, then read its I/O priority
+	want := uintptr(IOClassIdle) << 13
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prio, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(p.PID()), 0)
+		if errno != 0 {
+			t.Fatalf("ioprio_get: %v", errno)
+		}
+		if prio == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ioprio = %#x, want %#x", prio, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimitsHelperKeepsEnvironment(t *testing.T) {
+	out := runLimited(t, Limits{OpenFiles: 128}, `echo "$FFOIP_PORT"`)
+	if strings.TrimSpace(out) == "" {
+		t.Error("FFOIP_PORT not passed through the helper")
+	}
+}
+
+func TestLimitsProgramNotFound(t *testing.T) {
+	p := NewProcess("/nonexistent/ffmpeg", nil)
+	p.SetLimits(Limits{OpenFiles: 128})
+	if err := p.Start(context.Background()); err == nil {
+		t.Fatal("expected error for missing program")
+	}
+}
+
+func TestLimitsWithoutHelper(t *testing.T) {
+	helperInstalled.Store(false)
+	defer helperInstalled.Store(true)
+	nice := 5
+	p := NewProcess("true", nil)
+	p.SetLimits(Limits{Nice: &nice})
+	if err := p.Start(context.Background()); !errors.Is(err, ErrNoHelper) {
+		t.Fatalf("Start error = %v, want ErrNoHelper", err)
+	}
+}
+
+func TestCreateCgroup(t *testing.T) {
+	parent := t.TempDir()
+	dir, err := createCgroup(&Cgroup{Parent: parent, MemoryMax: 1 << 30, CPUs: 1.5})
+	if err != nil {
+		t.Fatalf("createCgroup failed: %v", err)
+	}
+	if filepath.Dir(dir) != parent || !strings.HasPrefix(filepath.Base(dir), "ffoip-") {
+		t.Errorf("dir = %q, want ffoip-* under %q", dir, parent)
+	}
+	for file, want := range map[string]string{
+		"memory.max": strconv.Itoa(1 << 30),
+		"cpu.max":    "150000 100000",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestCreateCgroupMissingParent(t *testing.T) {
+	if _, err := createCgroup(&Cgroup{Parent: "/nonexistent/cgroup"}); err == nil {
+		t.Fatal("expected error for missing parent")
+	}
+}
+
+func TestLimitsCgroup(t *testing.T) {
+	const root = "/sys/fs/cgroup"
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		t.Skip("cgroup v2 not mounted")
+	}
+	parent, err := os.MkdirTemp(root, "ffoip-test-")
+	if err != nil {
+		t.Skipf("cannot create cgroup: %v", err)
+	}
+	defer os.Remove(parent)
+
+	p := NewProcess("cat", []string{"/proc/self/cgroup"})
+	p.SetLimits(Limits{Cgroup: &Cgroup{Parent: parent}})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	stdout := readAsync(p.Stdout())
+	p.Wait()
+	out, _ := stdout()
+	if !strings.Contains(string(out), filepath.Base(parent)+"/ffoip-") {
+		t.Errorf("process cgroup = %q, want a group under %s", out, parent)
+	}
+
+	entries, _ := os.ReadDir(parent)
+	for _, e := range entries {
+		if e.IsDir() {
+			t.Errorf("cgroup %s not removed after exit", e.Name())
+		}
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package process
+
+import (
+	"log"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+var warnLimitsOnce sync.Once
+
+// HelperMain must be called first thing in main by any binary that starts
+// processes with limits. Limits are only enforced on Linux, so here it
+// always returns immediately.
+func HelperMain() {}
+
+// HelperInstalled reports whether processes with limits can be started,
+// which they always can here, as the limits are not applied.
+func HelperInstalled() bool { return true }
+
+func (p *Process) applyLimits(cmd *exec.Cmd) error {
+	if !p.limits.isZero() {
+		warnLimitsOnce.Do(func() {
+			log.Printf("warning: resource limits are not supported on %s, ignoring", runtime.GOOS)
+		})
+	}
+	return nil
+}
+
+func (p *Process) releaseCgroupFD() {}
+
+func (p *Process) removeCgroup() {}
@@ -7,6 +7,9 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -20,6 +23,9 @@ const KillTimeout = 5 * time.Second
 type Process struct {
 	programPath string
 	args        []string
+	env         []string
+	limits      Limits
+	sandbox     *Sandbox
 
 	cmd      *exec.Cmd
 	listener net.Listener
@@ -31,8 +37,21 @@ type Process struct {
 	stdoutPipe io.ReadCloser
 	stderrPipe io.ReadCloser
 
+	progress     bool
+	progressPipe io.ReadCloser
+
 	waitDone chan struct{}
 	waitErr  error
+
+	// groupMu serializes signalling the child's process group with reaping
+	// it, after which groupReaped is set and the group, whose ID may be
+	// reused, is no longer signalled.
+	groupMu     sync.Mutex
+	groupReaped bool
+
+	// cgroup created for this process, if Limits.Cgroup is set
+	cgroupDir string
+	cgroupFD  *os.File
 }
 
 func NewProcess(programPath string, args []string) *Process {
@@ -44,24 +63,85 @@ func NewProcess(programPath string, args []string) *Process {
 	}
 }
 
+// SetEnv adds "NAME=value" entries to the environment the child inherits
+// from the server, replacing variables of the same name. The server's own
+// FFOIP_* and FFMPEG_OVER_IP_* variables are dropped: they tell fio where
+// to connect and may include the auth secret. Must be called before Start.
+func (p *Process) SetEnv(env []string) {
+	p.env = withoutServerEnv(env)
+}
+
+// withoutServerEnv returns env without the server's own variables.
+func withoutServerEnv(env []string) []string {
+	filtered := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "FFMPEG_OVER_IP_") && !strings.HasPrefix(kv, "FFOIP_") {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
+
+// EnableProgress makes the child, which must be ffmpeg, write its
+// -progress reports to a pipe read with Progress: "-progress pipe:N" is
+// added before its arguments. Windows cannot pass the pipe, so there it
+// does nothing. Must be called before Start.
+func (p *Process) EnableProgress() {
+	p.progress = runtime.GOOS != "windows"
+}
+
 // Start launches the child process with FFOIP_PORT set and starts the
 // loopback listener. Returns immediately — the loopback accept and process
-// wait happen in background goroutines.
+// wait happen in background goroutines. A sandboxed child gets a connected
+// socket in FFOIP_FD instead.
 func (p *Process) Start(ctx context.Context) error {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return fmt.Errorf("failed to create loopback listener: %w", err)
-	}
-	p.listener = listener
+	cmd := exec.Command(p.programPath, p.args...)
 
-	port := listener.Addr().(*net.TCPAddr).Port
+	if p.sandbox != nil {
+		conn, childEnd, err := socketPair()
+		if err != nil {
+			return fmt.Errorf("failed to create loopback socket: %w", err)
+		}
+		// The child holds its own copy once started
+		defer childEnd.Close()
+		p.loopbackConn = conn
+		close(p.loopbackDone)
+		cmd.ExtraFiles = []*os.File{childEnd}
+		// Nothing of the server's own settings, which may include the auth
+		// secret, is passed into the sandbox
+		cmd.Env = append(withoutServerEnv(cmd.Environ()), p.env...)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("FFOIP_FD=%d", sandboxFD))
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("failed to create loopback listener: %w", err)
+		}
+		p.listener = listener
+		port := listener.Addr().(*net.TCPAddr).Port
+		cmd.Env = append(cmd.Environ(), p.env...)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("FFOIP_PORT=%d", port))
+	}
 
-	cmd := exec.Command(p.programPath, p.args...)
-	cmd.Env = append(cmd.Environ(), fmt.Sprintf("FFOIP_PORT=%d", port))
+	var progressR, progressW *os.File
+	if p.progress {
+		var err error
+		progressR, progressW, err = os.Pipe()
+		if err != nil {
+			p.CloseLoopback()
+			return fmt.Errorf("failed to create progress pipe: %w", err)
+		}
+		// The child's file descriptors 0–2 are stdio, followed by ExtraFiles
+		fd := 3 + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, progressW)
+		cmd.Args = append([]string{cmd.Args[0], "-progress", fmt.Sprintf("pipe:%d", fd)}, cmd.Args[1:]...)
+		// Closed in the parent once the child holds its own copy
+		defer progressW.Close()
+	}
 
 	stdinPipe, err := cmd.StdinPipe()
 	if err != nil {
-		listener.Close()
+		p.CloseLoopback()
+		closeFile(progressR)
 		return fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 	p.stdinPipe = stdinPipe
@@ -71,22 +151,31 @@ func (p *Process) Start(ctx context.Context) error {
 	// os.Pipe we own the read end so it stays open until we close it.
 	stdoutR, stdoutW, err := os.Pipe()
 	if err != nil {
-		listener.Close()
+		p.CloseLoopback()
+		closeFile(progressR)
 		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 	cmd.Stdout = stdoutW
 
 	stderrR, stderrW, err := os.Pipe()
 	if err != nil {
-		listener.Close()
+		p.CloseLoopback()
+		closeFile(progressR)
 		stdoutR.Close()
 		stdoutW.Close()
 		return fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
 	cmd.Stderr = stderrW
 
-	if err := cmd.Start(); err != nil {
-		listener.Close()
+	err = p.applyLimits(cmd)
+	setProcessGroup(cmd)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		p.removeCgroup()
+		p.CloseLoopback()
+		closeFile(progressR)
 		stdoutR.Close()
 		stdoutW.Close()
 		stderrR.Close()
@@ -94,29 +183,39 @@ func (p *Process) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start process: %w", err)
 	}
 	p.cmd = cmd
+	p.releaseCgroupFD()
 
 	// Close write ends in parent — only the child writes to these.
 	stdoutW.Close()
 	stderrW.Close()
 	p.stdoutPipe = stdoutR
 	p.stderrPipe = stderrR
+	if progressR != nil {
+		p.progressPipe = progressR
+	}
 
 	// Wait for process in background (ensures cmd.Wait is called exactly once)
 	go func() {
 		p.waitErr = cmd.Wait()
+		p.reapGroup()
+		p.removeCgroup()
 		close(p.waitDone)
 		// Close listener to unblock Accept if process exits without connecting
-		listener.Close()
+		if p.listener != nil {
+			p.listener.Close()
+		}
 	}()
 
 	// Accept loopback connection in background
-	go func() {
-		conn, err := listener.Accept()
-		if err == nil {
-			p.loopbackConn = conn
-		}
-		close(p.loopbackDone)
-	}()
+	if p.listener != nil {
+		go func() {
+			conn, err := p.listener.Accept()
+			if err == nil {
+				p.loopbackConn = conn
+			}
+			close(p.loopbackDone)
+		}()
+	}
 
 	return nil
 }
@@ -144,9 +243,21 @@ func (p *Process) Stdout() io.ReadCloser { return p.stdoutPipe }
 // Stderr returns the child's stderr pipe.
 func (p *Process) Stderr() io.ReadCloser { return p.stderrPipe }
 
+// Progress returns the pipe the child writes its -progress reports to, or
+// nil if EnableProgress was not called.
+func (p *Process) Progress() io.ReadCloser { return p.progressPipe }
+
 // Stdin returns the child's stdin pipe.
 func (p *Process) Stdin() io.WriteCloser { return p.stdinPipe }
 
+// PID returns the child's process ID, or 0 if the process has not started.
+func (p *Process) PID() int {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
 // Wait blocks until the child exits and returns the exit code.
 func (p *Process) Wait() (int, error) {
 	<-p.waitDone
@@ -161,16 +272,23 @@ func (p *Process) Signal(sig os.Signal) error {
 	return p.cmd.Process.Signal(sig)
 }
 
-// Terminate sends SIGTERM, waits up to KillTimeout, then sends SIGKILL.
+// Terminate sends SIGTERM to the child's process group, waits up to
+// KillTimeout for the child to exit, then sends SIGKILL. Anything left in
+// the group once the child has exited is killed.
 func (p *Process) Terminate() {
 	if p.cmd == nil || p.cmd.Process == nil {
 		return
 	}
-	_ = p.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-p.waitDone:
+		return
+	default:
+	}
+	_ = p.signalGroup(syscall.SIGTERM)
 	select {
 	case <-p.waitDone:
 	case <-time.After(KillTimeout):
-		_ = p.cmd.Process.Kill()
+		_ = p.signalGroup(syscall.SIGKILL)
 		<-p.waitDone
 	}
 }
@@ -185,6 +303,13 @@ func (p *Process) CloseLoopback() {
 	}
 }
 
+// closeFile closes f if it is not nil.
+func closeFile(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
+
 func getExitCode(waitErr error) int {
 	if waitErr == nil {
 		return 0
@@ -5,7 +5,9 @@ import (
 	"context"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -13,6 +15,12 @@ import (
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Limits tests re-execute the test binary as the launch helper
+	HelperMain()
+	os.Exit(m.Run())
+}
+
 // readAsync starts reading from r in a goroutine and returns a function
 // that blocks until the read completes, returning the data and error.
 // This avoids a race where cmd.Wait() closes pipes before ReadAll starts.
@@ -135,6 +143,92 @@ func TestFFOIPPortSet(t *testing.T) {
 	proc.Wait()
 }
 
+func TestSetEnv(t *testing.T) {
+	t.Setenv("FFOIP_TEST_KEEP", "server")
+	t.Setenv("TZ", "UTC")
+	proc := NewProcess("sh", []string{"-c", `echo "$FFOIP_TEST_KEEP $TZ $FFOIP_PORT ${FFOIP_FD-unset}"`})
+	proc.SetEnv([]string{"TZ=Europe/Berlin", "FFOIP_PORT=1", "FFOIP_FD=0"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	getStdout := readAsync(proc.Stdout())
+	out, _ := getStdout()
+	proc.Wait()
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 4 {
+		t.Fatalf("output = %q", out)
+	}
+	if fields[0] != "server" {
+		t.Errorf("inherited variable = %q, want server", fields[0])
+	}
+	if fields[1] != "Europe/Berlin" {
+		t.Errorf("TZ = %q, want Europe/Berlin", fields[1])
+	}
+	if fields[2] == "1" {
+		t.Error("SetEnv overrode FFOIP_PORT")
+	}
+	if fields[3] != "unset" {
+		t.Errorf("FFOIP_FD = %q, want it unset", fields[3])
+	}
+}
+
+func TestWithoutServerEnv(t *testing.T) {
+	env := []string{
+		"PATH=/usr/bin",
+		"FFMPEG_OVER_IP_SERVER_AUTH_SECRET=secret",
+		"FFOIP_PORT=1234",
+		"NVIDIA_VISIBLE_DEVICES=all",
+	}
+	got := withoutServerEnv(env)
+	want := []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=all"}
+	if !slices.Equal(got, want) {
+		t.Errorf("withoutServerEnv = %q, want %q", got, want)
+	}
+	if env[1] != "FFMPEG_OVER_IP_SERVER_AUTH_SECRET=secret" {
+		t.Error("withoutServerEnv modified its input")
+	}
+}
+
+func TestProgressPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no progress pipe on windows")
+	}
+	// Stands in for ffmpeg, writing a report to the fd named by -progress
+	script := filepath.Join(t.TempDir(), "fake-ffmpeg")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\"\necho frame=1 >&${2#pipe:}\necho progress=end >&${2#pipe:}\n"), 0o755)
+
+	proc := NewProcess(script, []string{"-i", "in.mkv"})
+	proc.EnableProgress()
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	getStdout := readAsync(proc.Stdout())
+	getProgress := readAsync(proc.Progress())
+	out, _ := getStdout()
+	progress, _ := getProgress()
+	proc.Wait()
+
+	if string(out) != "-progress pipe:3 -i in.mkv\n" {
+		t.Errorf("args = %q, want -progress first", out)
+	}
+	if string(progress) != "frame=1\nprogress=end\n" {
+		t.Errorf("progress = %q", progress)
+	}
+}
+
+func TestProgressNilByDefault(t *testing.T) {
+	proc := NewProcess("true", nil)
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	proc.Wait()
+	if proc.Progress() != nil {
+		t.Error("Progress() is not nil without EnableProgress")
+	}
+}
+
 func TestLoopbackNilWhenNoConnect(t *testing.T) {
 	// echo doesn't connect to the loopback
 	proc := NewProcess("echo", []string{"hi"})
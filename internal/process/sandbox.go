@@ -0,0 +1,27 @@
+package process
+
+// sandboxFD is the descriptor a sandboxed child finds its end of the fio
+// connection on (the first of exec.Cmd.ExtraFiles).
+const sandboxFD = 3
+
+// Sandbox isolates the child from the server on Linux. The launch helper
+// moves it into new mount, IPC and PID namespaces, and a new network
+// namespace unless Network is set, whose root holds only the program, the
+// system libraries, Paths and Devices. It then drops to UID and GID before
+// exec'ing the program. The server must run as root.
+//
+// A sandboxed child cannot reach a loopback listener, so fio is handed an
+// already connected socket in FFOIP_FD instead of a port in FFOIP_PORT.
+type Sandbox struct {
+	UID     int
+	GID     int
+	Groups  []int    // supplementary groups, e.g. video or render for devices
+	Devices []string // device nodes or directories of them, read-write
+	Paths   []string // extra files and directories, read-only
+	Network bool     // keep the host's network
+}
+
+// SetSandbox runs the child in sb. Must be called before Start.
+func (p *Process) SetSandbox(sb *Sandbox) {
+	p.sandbox = sb
+}
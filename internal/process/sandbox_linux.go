@@ -0,0 +1,264 @@
+package process
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const prSetNoNewPrivs = 38
+
+// defaultSandboxPaths are bound read-only into every sandbox when they
+// exist, so that dynamically linked programs can run.
+var defaultSandboxPaths = []string{
+	"/lib", "/lib32", "/lib64", "/libx32",
+	"/usr/lib", "/usr/lib32", "/usr/lib64", "/usr/libx32",
+	"/etc/ld.so.cache",
+}
+
+// sandboxDevices are the basic device nodes every sandbox gets.
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
+
+// socketPair returns a connected pair of sockets for the fio connection:
+// the server's end as a net.Conn and the child's as a file to inherit.
+func socketPair() (net.Conn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := os.NewFile(uintptr(fds[0]), "fio")
+	defer server.Close()
+	conn, err := net.FileConn(server)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return conn, os.NewFile(uintptr(fds[1]), "fio"), nil
+}
+
+func (sb *Sandbox) cloneflags() uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID)
+	if !sb.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return flags
+}
+
+// sandboxMount is one entry of the new root, at the same path as on the
+// host.
+type sandboxMount struct {
+	path     string
+	source   string // host path with symlinks resolved, for binds
+	link     string // relative symlink target, recreated instead of bound
+	writable bool
+}
+
+// enterSandbox runs in the launch helper, which the server started in new
+// namespaces. It replaces the root filesystem with one holding only what
+// sb and program need. Privileges are dropped separately, so that limits
+// can still be applied in between.
+func enterSandbox(sb *Sandbox, program string) error {
+	// Resolve everything while the host's root is still in place
+	var mounts []sandboxMount
+	for _, path := range defaultSandboxPaths {
+		m, err := resolveSandboxMount(path, false, true)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		mounts = append(mounts, m)
+	}
+	for _, path := range append([]string{program}, sb.Paths...) {
+		m, err := resolveSandboxMount(path, false, false)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, m)
+	}
+	for _, path := range append(sandboxDevices, sb.Devices...) {
+		m, err := resolveSandboxMount(path, true, false)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, m)
+	}
+
+	// Keep the mounts below from propagating to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+
+	// Assemble the new root in /newroot of a scratch tmpfs, with the host's
+	// root still reachable under /oldroot. The tmpfs is mounted over /tmp
+	// because that exists everywhere; pivoting into it uncovers the host's
+	// /tmp again under /oldroot.
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mount scratch tmpfs: %w", err)
+	}
+	for _, dir := range []string{"/tmp/newroot", "/tmp/oldroot"} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.PivotRoot("/tmp", "/tmp/oldroot"); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	// pivot_root needs the new root to be a mount point
+	if err := syscall.Mount("/newroot", "/newroot", "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind new root: %w", err)
+	}
+
+	if err := mountSandboxFilesystems(); err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if err := m.mount(); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Unmount("/oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount host root: %w", err)
+	}
+	// Stack /newroot over the scratch tmpfs and drop the latter
+	if err := os.Chdir("/newroot"); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount scratch tmpfs: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	// Only /dev, /proc, /tmp and the bound devices stay writable
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("remount root read-only: %w", err)
+	}
+	return nil
+}
+
+// resolveSandboxMount describes how path is reproduced in the sandbox.
+// With keepLinks, a path that is a relative symlink is recreated as one,
+// as /lib is on merged-/usr systems.
+func resolveSandboxMount(path string, writable, keepLinks bool) (sandboxMount, error) {
+	path = filepath.Clean(path)
+	m := sandboxMount{path: path, writable: writable}
+	if keepLinks {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return m, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(path); err == nil && !filepath.IsAbs(target) {
+				m.link = target
+				return m, nil
+			}
+		}
+	}
+	source, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return m, fmt.Errorf("sandbox path %s: %w", path, err)
+	}
+	m.source = source
+	return m, nil
+}
+
+func (m *sandboxMount) mount() error {
+	dst := filepath.Join("/newroot", m.path)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if m.link != "" {
+		return os.Symlink(m.link, dst)
+	}
+
+	src := filepath.Join("/oldroot", m.source)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = os.MkdirAll(dst, 0o755)
+	} else if _, err = os.Lstat(dst); os.IsNotExist(err) {
+		// Paths inside an earlier bind already exist, read-only
+		var f *os.File
+		if f, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", m.path, err)
+	}
+	if !m.writable {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+		if err := syscall.Mount("", dst, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %w", m.path, err)
+		}
+	}
+	return nil
+}
+
+// mountSandboxFilesystems gives the new root the rest of what programs
+// expect to find: a /proc for the new PID namespace, a private /tmp and
+// /dev/shm, and the /dev symlinks. Device nodes are bound separately, and
+// keep the flags of the host's /dev.
+func mountSandboxFilesystems() error {
+	for _, m := range []struct {
+		target, fstype string
+		flags          uintptr
+		data           string
+	}{
+		{"/newroot/proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+		{"/newroot/tmp", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, "mode=1777"},
+		{"/newroot/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, "mode=1777"},
+	} {
+		if err := os.MkdirAll(m.target, 0o755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.fstype, m.target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("mount %s: %w", m.target, err)
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join("/newroot/dev", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPrivileges switches to sb's user and groups for good.
+func (sb *Sandbox) dropPrivileges() error {
+	if err := syscall.Setgroups(sb.Groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(sb.GID); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(sb.UID); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("no_new_privs: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package process
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSandbox returns a sandbox with the shell utilities bound in, or skips
+// the test when not running as root.
+func testSandbox(t *testing.T) *Sandbox {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("sandbox requires root")
+	}
+	return &Sandbox{UID: 65534, GID: 65534, Paths: []string{"/bin", "/usr/bin"}}
+}
+
+// runSandboxed runs a shell script in sb and returns its stdout, stderr and
+// exit code.
+func runSandboxed(t *testing.T, sb *Sandbox, script string) (string, string, int) {
+	t.Helper()
+	p := NewProcess("sh", []string{"-c", script})
+	p.SetSandbox(sb)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer p.CloseLoopback()
+	stdout := readAsync(p.Stdout())
+	stderr := readAsync(p.Stderr())
+	code, _ := p.Wait()
+	out, _ := stdout()
+	errOut, _ := stderr()
+	return string(out), string(errOut), code
+}
+
+func TestSandboxDropsPrivileges(t *testing.T) {
+	sb := testSandbox(t)
+	sb.Groups = []int{44}
+	out, errOut, code := runSandboxed(t, sb, "id -u; id -g; id -G")
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	if got := strings.Fields(out); strings.Join(got, " ") != "65534 65534 65534 44" {
+		t.Errorf("ids = %q, want uid 65534, gid 65534, groups 65534 44", out)
+	}
+}
+
+func TestSandboxHidesFilesystem(t *testing.T) {
+	sb := testSandbox(t)
+	secret := filepath.Join(t.TempDir(), "server.jsonc")
+	if err := os.WriteFile(secret, []byte(`{"authSecret": "x"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shared := t.TempDir()
+	if err := os.WriteFile(filepath.Join(shared, "font.ttf"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sb.Paths = append(sb.Paths, shared)
+
+	script := `
+		test -e ` + secret + ` && echo secret visible
+		test -e /etc/passwd && echo etc visible
+		test -e ` + shared + `/font.ttf || echo path missing
+		touch ` + shared + `/new 2>/dev/null && echo path writable
+		test -c /dev/null || echo dev/null missing
+		echo ok > /tmp/scratch || echo tmp not writable
+		ls /proc | grep -c '^[0-9]'
+	`
+	out, errOut, code := runSandboxed(t, sb, script)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		t.Error(line)
+	}
+	// Only sh itself and ls run in the new PID namespace
+	if procs := lines[len(lines)-1]; procs != "2" && procs != "3" {
+		t.Errorf("%s processes visible in /proc, want only the sandbox's own", procs)
+	}
+}
+
+func TestSandboxNetwork(t *testing.T) {
+	sb := testSandbox(t)
+	// /proc/net/dev lists two header lines, then one line per interface
+	out, errOut, code := runSandboxed(t, sb, "tail -n +3 /proc/net/dev | cut -d: -f1")
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	if got := strings.Fields(out); len(got) != 1 || got[0] != "lo" {
+		t.Errorf("interfaces = %q, want only lo", got)
+	}
+}
+
+func TestSandboxEnvironment(t *testing.T) {
+	sb := testSandbox(t)
+	t.Setenv("FFMPEG_OVER_IP_SERVER_AUTH_SECRET", "secret")
+	t.Setenv("FFOIP_PORT", "1234")
+	out, errOut, code := runSandboxed(t, sb, `echo "$FFOIP_FD:$FFOIP_PORT:$FFMPEG_OVER_IP_SERVER_AUTH_SECRET"`)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	if got := strings.TrimSpace(out); got != "3::" {
+		t.Errorf("FFOIP_FD:FFOIP_PORT:secret = %q, want %q", got, "3::")
+	}
+}
+
+func TestSandboxLoopback(t *testing.T) {
+	sb := testSandbox(t)
+	p := NewProcess("sh", []string{"-c", "printf hello >&3; read reply <&3; echo $reply"})
+	p.SetSandbox(sb)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer p.CloseLoopback()
+	stdout := readAsync(p.Stdout())
+	stderr := readAsync(p.Stderr())
+
+	conn := p.Loopback()
+	if conn == nil {
+		t.Fatal("no loopback connection")
+	}
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("read from child failed: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("child sent %q, want hello", buf)
+	}
+	conn.Write([]byte("world\n"))
+
+	code, _ := p.Wait()
+	out, _ := stdout()
+	errOut, _ := stderr()
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	if strings.TrimSpace(string(out)) != "world" {
+		t.Errorf("child received %q, want world", out)
+	}
+}
+
+func TestSandboxWithLimits(t *testing.T) {
+	sb := testSandbox(t)
+	nice := -5
+	p := NewProcess("sh", []string{"-c", "cut -d' ' -f19 /proc/self/stat; id -u"})
+	p.SetSandbox(sb)
+	// Negative nice values need root, so limits go on before the drop
+	p.SetLimits(Limits{Nice: &nice})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer p.CloseLoopback()
+	stdout := readAsync(p.Stdout())
+	stderr := readAsync(p.Stderr())
+	code, _ := p.Wait()
+	out, _ := stdout()
+	errOut, _ := stderr()
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, errOut)
+	}
+	if got := strings.Fields(string(out)); strings.Join(got, " ") != "-5 65534" {
+		t.Errorf("nice and uid = %q, want -5 65534", got)
+	}
+}
+
+func TestSandboxMissingDevice(t *testing.T) {
+	sb := testSandbox(t)
+	sb.Devices = []string{"/dev/nonexistent"}
+	_, errOut, code := runSandboxed(t, sb, "true")
+	if code != 126 {
+		t.Errorf("exit code = %d, want 126", code)
+	}
+	if !strings.Contains(errOut, "/dev/nonexistent") {
+		t.Errorf("stderr = %q, want it to name the missing device", errOut)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package process
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func socketPair() (net.Conn, *os.File, error) {
+	return nil, nil, errors.New("sandbox is only supported on Linux")
+}
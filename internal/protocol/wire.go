@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 )
 
 // Message represents a protocol message envelope.
@@ -13,24 +15,39 @@ type Message struct {
 }
 
 // Protocol version
-const CurrentVersion = uint8(0x06)
+const CurrentVersion = uint8(0x0D)
 
 // Control message types
 const (
-	MsgCommand  = uint8(0x01)
-	MsgCancel   = uint8(0x02)
-	MsgExitCode = uint8(0x03)
-	MsgError    = uint8(0x04)
-	MsgPing     = uint8(0x05)
-	MsgPong     = uint8(0x06)
+	MsgCommand    = uint8(0x01)
+	MsgCancel     = uint8(0x02)
+	MsgExitCode   = uint8(0x03)
+	MsgError      = uint8(0x04)
+	MsgPing       = uint8(0x05)
+	MsgPong       = uint8(0x06)
+	MsgExitReason = uint8(0x07) // precedes MsgExitCode when the server ended the job
 )
 
+// Session resume message types
+const (
+	MsgSession  = uint8(0x08) // server's first reply to a command, after any pings while it starts
+	MsgResume   = uint8(0x09) // first message of a reconnecting client
+	MsgResumeOk = uint8(0x0A)
+	MsgAck      = uint8(0x0B)
+)
+
+// MsgFragment carries part of a message split so that others can be sent
+// in between. The message's last part is sent as the message itself.
+const MsgFragment = uint8(0x0C)
+
 // Output piping message types
 const (
 	MsgStdin      = uint8(0x10)
 	MsgStdinClose = uint8(0x11)
 	MsgStdout     = uint8(0x12)
 	MsgStderr     = uint8(0x13)
+	MsgCredit     = uint8(0x14) // lets the other side send more on a stdio channel
+	MsgProgress   = uint8(0x15) // a report from ffmpeg's -progress option
 )
 
 // File I/O request message types
@@ -47,6 +64,15 @@ const (
 	MsgMkdir     = uint8(0x29)
 )
 
+// Multiplexing message types, for running many jobs over one connection
+const (
+	MsgMux          = uint8(0x30) // first message of a multiplexed connection
+	MsgMuxOk        = uint8(0x31)
+	MsgStreamData   = uint8(0x32)
+	MsgStreamWindow = uint8(0x33)
+	MsgStreamClose  = uint8(0x34)
+)
+
 // File I/O response message types
 const (
 	MsgOpenOk      = uint8(0x40)
@@ -93,10 +119,35 @@ const (
 	FioERANGE  = int32(34)
 )
 
-// Program type for command message
+// Built-in program names for command messages. Servers may offer others.
+const (
+	ProgramFFmpeg  = "ffmpeg"
+	ProgramFFprobe = "ffprobe"
+)
+
+// MaxProgramLength is the longest program name a command message can carry.
+const MaxProgramLength = 255
+
+// MaxProfileLength is the longest profile name a command message can carry.
+const MaxProfileLength = 255
+
+// MsgError payloads with special meaning to the client
+const (
+	// ErrServerDraining is sent to new connections while the server is
+	// shutting down. The job was not started and can be retried elsewhere.
+	ErrServerDraining = "server draining"
+	// ErrUnknownSession answers a resume for a session that has ended or
+	// whose grace period has passed.
+	ErrUnknownSession = "unknown session"
+	// ErrNoMux answers a MsgMux the server will not multiplex, which a
+	// client then connects to once per job.
+	ErrNoMux = "multiplexing not supported"
+)
+
+// Exit reasons carried by MsgExitReason
 const (
-	ProgramFFmpeg  = uint8(0x01)
-	ProgramFFprobe = uint8(0x02)
+	ExitReasonTimeout = uint8(0x01) // ran longer than the program's maxRuntime
+	ExitReasonStalled = uint8(0x02) // no output or file I/O within stallTimeout
 )
 
 // HMAC signature length (raw HMAC-SHA256 = 32 bytes)
@@ -105,6 +156,18 @@ const HMACLength = 32
 // Nonce length (UUID v4 = 16 bytes)
 const NonceLength = 16
 
+// Session token length
+const TokenLength = 16
+
+// MaxPayload is the largest payload a message may have.
+const MaxPayload = 100 * 1024 * 1024
+
+// StdioWindow is how many bytes of stdin, stdout and stderr each may be in
+// flight unconsumed. A side may send that much on each channel at first,
+// and more as the other side returns credit with MsgCredit. The server
+// ends the session of a client that sends more stdin than its credit.
+const StdioWindow = 1 << 20
+
 // IsFileIORequest returns true for file I/O request message types (0x20–0x29).
 func IsFileIORequest(msgType uint8) bool {
 	return msgType >= 0x20 && msgType <= 0x29
@@ -135,7 +198,7 @@ func ReadMessageFrom(r io.Reader) (*Message, error) {
 	}
 	payloadLen := binary.BigEndian.Uint32(lenBuf[:])
 
-	if payloadLen > 100*1024*1024 {
+	if payloadLen > MaxPayload {
 		return nil, fmt.Errorf("payload length too large: %d bytes", payloadLen)
 	}
 
@@ -586,42 +649,357 @@ func DecodeIoErrorResponse(payload []byte) (*IoErrorResponse, error) {
 	}, nil
 }
 
+// --- Exit reason ---
+
+type ExitReasonMessage struct {
+	Reason  uint8
+	Message string
+}
+
+func (m *ExitReasonMessage) Encode() []byte {
+	buf := make([]byte, 1+len(m.Message))
+	buf[0] = m.Reason
+	copy(buf[1:], m.Message)
+	return buf
+}
+
+func DecodeExitReasonMessage(payload []byte) (*ExitReasonMessage, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("ExitReasonMessage payload too short: %d bytes", len(payload))
+	}
+	return &ExitReasonMessage{
+		Reason:  payload[0],
+		Message: string(payload[1:]),
+	}, nil
+}
+
+// ProgressMessage is one report written by ffmpeg's -progress option: the
+// key=value fields of a block, such as frame, fps, bitrate, out_time and
+// speed, in the order ffmpeg wrote them. The last field is progress, with
+// "continue" or "end".
+type ProgressMessage struct {
+	Fields []ProgressField
+}
+
+type ProgressField struct {
+	Key   string
+	Value string
+}
+
+// Encode writes the fields as ffmpeg does, one key=value line each.
+func (m *ProgressMessage) Encode() []byte {
+	var buf []byte
+	for _, f := range m.Fields {
+		buf = append(buf, f.Key...)
+		buf = append(buf, '=')
+		buf = append(buf, f.Value...)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+func DecodeProgressMessage(payload []byte) (*ProgressMessage, error) {
+	msg := &ProgressMessage{}
+	for line := range strings.Lines(string(payload)) {
+		key, value, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "=")
+		if !ok {
+			return nil, fmt.Errorf("ProgressMessage line without '=': %q", line)
+		}
+		msg.Fields = append(msg.Fields, ProgressField{Key: key, Value: value})
+	}
+	return msg, nil
+}
+
+// Get returns the value of the field key, or "" if there is none.
+func (m *ProgressMessage) Get(key string) string {
+	for _, f := range m.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// --- Session resume ---
+
+// SessionMessage is the server's first reply to a command, sent once the
+// program has started. A zero GracePeriod means the session cannot be
+// resumed.
+type SessionMessage struct {
+	Token       [TokenLength]byte
+	GracePeriod time.Duration
+}
+
+func (m *SessionMessage) Encode() []byte {
+	buf := make([]byte, TokenLength+4)
+	copy(buf, m.Token[:])
+	binary.BigEndian.PutUint32(buf[TokenLength:], uint32(m.GracePeriod/time.Millisecond))
+	return buf
+}
+
+func DecodeSessionMessage(payload []byte) (*SessionMessage, error) {
+	if len(payload) < TokenLength+4 {
+		return nil, fmt.Errorf("SessionMessage payload too short: %d bytes", len(payload))
+	}
+	msg := &SessionMessage{
+		GracePeriod: time.Duration(binary.BigEndian.Uint32(payload[TokenLength:])) * time.Millisecond,
+	}
+	copy(msg.Token[:], payload)
+	return msg, nil
+}
+
+// ResumeMessage asks the server to continue a session on a new connection.
+// Received is how many messages the client has received from the server.
+// Attempt must increase with every resume of a session, so a recorded
+// resume cannot be replayed.
+type ResumeMessage struct {
+	Token     [TokenLength]byte
+	Attempt   uint32
+	Received  uint64
+	Signature [HMACLength]byte
+}
+
+func (m *ResumeMessage) Encode() []byte {
+	buf := make([]byte, 1+TokenLength+4+8+HMACLength)
+	buf[0] = CurrentVersion
+	copy(buf[1:], m.Token[:])
+	binary.BigEndian.PutUint32(buf[1+TokenLength:], m.Attempt)
+	binary.BigEndian.PutUint64(buf[1+TokenLength+4:], m.Received)
+	copy(buf[1+TokenLength+12:], m.Signature[:])
+	return buf
+}
+
+func DecodeResumeMessage(payload []byte) (*ResumeMessage, error) {
+	want := 1 + TokenLength + 4 + 8 + HMACLength
+	if len(payload) < want {
+		return nil, fmt.Errorf("resume payload too short: %d bytes (minimum %d)", len(payload), want)
+	}
+	if payload[0] != CurrentVersion {
+		return nil, fmt.Errorf("unsupported protocol version: 0x%02x (expected 0x%02x)", payload[0], CurrentVersion)
+	}
+	msg := &ResumeMessage{
+		Attempt:  binary.BigEndian.Uint32(payload[1+TokenLength:]),
+		Received: binary.BigEndian.Uint64(payload[1+TokenLength+4:]),
+	}
+	copy(msg.Token[:], payload[1:])
+	copy(msg.Signature[:], payload[1+TokenLength+12:])
+	return msg, nil
+}
+
+// EncodeCount encodes the message count carried by MsgResumeOk and MsgAck.
+func EncodeCount(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// DecodeCount decodes the message count carried by MsgResumeOk and MsgAck.
+func DecodeCount(payload []byte) (uint64, error) {
+	if len(payload) < 8 {
+		return 0, fmt.Errorf("count payload too short: %d bytes", len(payload))
+	}
+	return binary.BigEndian.Uint64(payload), nil
+}
+
+// --- Fragments ---
+
+// FragmentMessage is a part of a message of Type, other than its last.
+type FragmentMessage struct {
+	Type uint8
+	Data []byte
+}
+
+func (m *FragmentMessage) Encode() []byte {
+	buf := make([]byte, 1+len(m.Data))
+	buf[0] = m.Type
+	copy(buf[1:], m.Data)
+	return buf
+}
+
+// DecodeFragmentMessage decodes a MsgFragment payload. Data aliases
+// payload.
+func DecodeFragmentMessage(payload []byte) (*FragmentMessage, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("Fragment payload too short: %d bytes", len(payload))
+	}
+	return &FragmentMessage{Type: payload[0], Data: payload[1:]}, nil
+}
+
+// --- Flow control ---
+
+// CreditMessage returns Bytes of credit on the stdio channel named by the
+// message type that carries its data: MsgStdin, MsgStdout or MsgStderr.
+type CreditMessage struct {
+	Channel uint8
+	Bytes   uint32
+}
+
+func (m *CreditMessage) Encode() []byte {
+	buf := make([]byte, 5)
+	buf[0] = m.Channel
+	binary.BigEndian.PutUint32(buf[1:], m.Bytes)
+	return buf
+}
+
+func DecodeCreditMessage(payload []byte) (*CreditMessage, error) {
+	if len(payload) < 5 {
+		return nil, fmt.Errorf("Credit payload too short: %d bytes", len(payload))
+	}
+	return &CreditMessage{
+		Channel: payload[0],
+		Bytes:   binary.BigEndian.Uint32(payload[1:]),
+	}, nil
+}
+
+// --- Multiplexing ---
+
+// MuxMessage opens a multiplexed connection. It authenticates the
+// connection; the commands run over it are signed as usual.
+type MuxMessage struct {
+	Nonce     [NonceLength]byte
+	Signature [HMACLength]byte
+}
+
+func (m *MuxMessage) Encode() []byte {
+	buf := make([]byte, 1+NonceLength+HMACLength)
+	buf[0] = CurrentVersion
+	copy(buf[1:], m.Nonce[:])
+	copy(buf[1+NonceLength:], m.Signature[:])
+	return buf
+}
+
+func DecodeMuxMessage(payload []byte) (*MuxMessage, error) {
+	want := 1 + NonceLength + HMACLength
+	if len(payload) < want {
+		return nil, fmt.Errorf("multiplex payload too short: %d bytes (minimum %d)", len(payload), want)
+	}
+	if payload[0] != CurrentVersion {
+		return nil, fmt.Errorf("unsupported protocol version: 0x%02x (expected 0x%02x)", payload[0], CurrentVersion)
+	}
+	msg := &MuxMessage{}
+	copy(msg.Nonce[:], payload[1:])
+	copy(msg.Signature[:], payload[1+NonceLength:])
+	return msg, nil
+}
+
+// StreamData carries bytes of one stream of a multiplexed connection
+// (MsgStreamData), or closes the stream (MsgStreamClose, without data).
+type StreamData struct {
+	StreamID uint32
+	Data     []byte
+}
+
+func (m *StreamData) Encode() []byte {
+	buf := make([]byte, 4+len(m.Data))
+	binary.BigEndian.PutUint32(buf, m.StreamID)
+	copy(buf[4:], m.Data)
+	return buf
+}
+
+// DecodeStreamData decodes a MsgStreamData or MsgStreamClose payload.
+// Data aliases payload.
+func DecodeStreamData(payload []byte) (*StreamData, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("stream payload too short: %d bytes", len(payload))
+	}
+	return &StreamData{
+		StreamID: binary.BigEndian.Uint32(payload),
+		Data:     payload[4:],
+	}, nil
+}
+
+// StreamWindow lets the other side send Increment more bytes on a stream.
+type StreamWindow struct {
+	StreamID  uint32
+	Increment uint32
+}
+
+func (m *StreamWindow) Encode() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf, m.StreamID)
+	binary.BigEndian.PutUint32(buf[4:], m.Increment)
+	return buf
+}
+
+func DecodeStreamWindow(payload []byte) (*StreamWindow, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("StreamWindow payload too short: %d bytes", len(payload))
+	}
+	return &StreamWindow{
+		StreamID:  binary.BigEndian.Uint32(payload),
+		Increment: binary.BigEndian.Uint32(payload[4:]),
+	}, nil
+}
+
 // --- Command message ---
 
 type CommandMessage struct {
 	Nonce     [NonceLength]byte
 	Signature [HMACLength]byte
-	Program   uint8
-	Args      []string
+	// Program names the program to run, at most MaxProgramLength bytes.
+	Program string
+	Args    []string
+	// Env holds "NAME=value" entries to set for the program. It is optional
+	// on the wire: when empty, nothing follows the args.
+	Env []string
+	// Profile names the server profile to run the program with, at most
+	// MaxProfileLength bytes. It follows the env, which is then written even
+	// when empty, and is omitted for the default profile.
+	Profile string
 }
 
 func (m *CommandMessage) Encode() []byte {
 	// Args are length-prefixed: [argc 2B][len 2B][arg bytes]...
 	// This avoids the null-byte ambiguity of the old null-separated format.
-	argsSize := 2 // argc
+	// Env entries, if any, follow in the same format.
+	// The program and profile names are prefixed with a 1-byte length.
+	argsSize := 1 + len(m.Program) + 2 // program + argc
 	for _, arg := range m.Args {
 		argsSize += 2 + len(arg) // len + arg bytes
 	}
+	writeEnv := len(m.Env) > 0 || m.Profile != ""
+	if writeEnv {
+		argsSize += 2 // envc
+		for _, kv := range m.Env {
+			argsSize += 2 + len(kv)
+		}
+	}
+	if m.Profile != "" {
+		argsSize += 1 + len(m.Profile)
+	}
 
-	buf := make([]byte, 1+NonceLength+HMACLength+1+argsSize)
+	buf := make([]byte, 1+NonceLength+HMACLength+argsSize)
 	buf[0] = CurrentVersion
 	copy(buf[1:], m.Nonce[:])
 	copy(buf[1+NonceLength:], m.Signature[:])
-	buf[1+NonceLength+HMACLength] = m.Program
 
-	offset := 1 + NonceLength + HMACLength + 1
-	binary.BigEndian.PutUint16(buf[offset:], uint16(len(m.Args)))
-	offset += 2
-	for _, arg := range m.Args {
-		binary.BigEndian.PutUint16(buf[offset:], uint16(len(arg)))
-		offset += 2
-		copy(buf[offset:], []byte(arg))
-		offset += len(arg)
+	offset := 1 + NonceLength + HMACLength
+	buf[offset] = uint8(len(m.Program))
+	offset += 1 + copy(buf[offset+1:], m.Program)
+	offset = putStrings(buf, offset, m.Args)
+	if writeEnv {
+		offset = putStrings(buf, offset, m.Env)
+	}
+	if m.Profile != "" {
+		buf[offset] = uint8(len(m.Profile))
+		copy(buf[offset+1:], m.Profile)
 	}
 
 	return buf
 }
 
+// putStrings writes a count followed by length-prefixed strings at offset
+// and returns the offset after them.
+func putStrings(buf []byte, offset int, list []string) int {
+	binary.BigEndian.PutUint16(buf[offset:], uint16(len(list)))
+	offset += 2
+	for _, s := range list {
+		binary.BigEndian.PutUint16(buf[offset:], uint16(len(s)))
+		offset += 2
+		copy(buf[offset:], s)
+		offset += len(s)
+	}
+	return offset
+}
+
 func DecodeCommandMessage(payload []byte) (*CommandMessage, error) {
 	minLen := 1 + NonceLength + HMACLength + 1
 	if len(payload) < minLen {
@@ -633,31 +1011,68 @@ func DecodeCommandMessage(payload []byte) (*CommandMessage, error) {
 		return nil, fmt.Errorf("unsupported protocol version: 0x%02x (expected 0x%02x)", version, CurrentVersion)
 	}
 
-	msg := &CommandMessage{
-		Program: payload[1+NonceLength+HMACLength],
-	}
+	msg := &CommandMessage{}
 	copy(msg.Nonce[:], payload[1:1+NonceLength])
 	copy(msg.Signature[:], payload[1+NonceLength:1+NonceLength+HMACLength])
 
+	programLen := int(payload[1+NonceLength+HMACLength])
+	if len(payload) < minLen+programLen {
+		return nil, fmt.Errorf("command payload truncated at program name")
+	}
+	msg.Program = string(payload[minLen : minLen+programLen])
+
 	// Args are length-prefixed: [argc 2B][len 2B][arg bytes]...
-	argsData := payload[minLen:]
+	argsData := payload[minLen+programLen:]
 	if len(argsData) < 2 {
 		return nil, fmt.Errorf("command payload too short for arg count")
 	}
-	argc := int(binary.BigEndian.Uint16(argsData[:2]))
-	offset := 2
-	for i := 0; i < argc; i++ {
-		if offset+2 > len(argsData) {
-			return nil, fmt.Errorf("command payload truncated at arg %d length", i)
+	args, offset, err := decodeStrings(argsData, "arg")
+	if err != nil {
+		return nil, err
+	}
+	msg.Args = args
+
+	if rest := argsData[offset:]; len(rest) > 0 {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("command payload too short for env count")
 		}
-		argLen := int(binary.BigEndian.Uint16(argsData[offset:]))
-		offset += 2
-		if offset+argLen > len(argsData) {
-			return nil, fmt.Errorf("command payload truncated at arg %d data", i)
+		var n int
+		if msg.Env, n, err = decodeStrings(rest, "env entry"); err != nil {
+			return nil, err
+		}
+		if rest = rest[n:]; len(rest) > 0 {
+			profileLen := int(rest[0])
+			if len(rest) < 1+profileLen {
+				return nil, fmt.Errorf("command payload truncated at profile name")
+			}
+			msg.Profile = string(rest[1 : 1+profileLen])
+			if len(rest) > 1+profileLen {
+				return nil, fmt.Errorf("command payload has %d bytes after the profile name", len(rest)-1-profileLen)
+			}
 		}
-		msg.Args = append(msg.Args, string(argsData[offset:offset+argLen]))
-		offset += argLen
 	}
 
 	return msg, nil
 }
+
+// decodeStrings reads a count followed by length-prefixed strings from the
+// start of data, which must hold at least the count. It returns the strings
+// and the number of bytes consumed.
+func decodeStrings(data []byte, what string) ([]string, int, error) {
+	count := int(binary.BigEndian.Uint16(data[:2]))
+	offset := 2
+	var list []string
+	for i := 0; i < count; i++ {
+		if offset+2 > len(data) {
+			return nil, 0, fmt.Errorf("command payload truncated at %s %d length", what, i)
+		}
+		n := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+		if offset+n > len(data) {
+			return nil, 0, fmt.Errorf("command payload truncated at %s %d data", what, i)
+		}
+		list = append(list, string(data[offset:offset+n]))
+		offset += n
+	}
+	return list, offset, nil
+}
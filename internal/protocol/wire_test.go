@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 // --- Envelope tests ---
@@ -408,6 +410,23 @@ func TestIoErrorResponseRoundTrip(t *testing.T) {
 	}
 }
 
+// --- Exit reason ---
+
+func TestExitReasonMessageRoundTrip(t *testing.T) {
+	msg := &ExitReasonMessage{Reason: ExitReasonStalled, Message: "no progress for 5m0s"}
+	decoded, err := DecodeExitReasonMessage(msg.Encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.Reason != ExitReasonStalled || decoded.Message != msg.Message {
+		t.Errorf("got %+v, want %+v", decoded, msg)
+	}
+
+	if _, err := DecodeExitReasonMessage(nil); err == nil {
+		t.Error("expected error for empty payload")
+	}
+}
+
 // --- Command message ---
 
 func TestCommandMessageRoundTrip(t *testing.T) {
@@ -431,7 +450,7 @@ func TestCommandMessageRoundTrip(t *testing.T) {
 	}
 
 	if decoded.Program != ProgramFFmpeg {
-		t.Errorf("Program: got %d, want %d", decoded.Program, ProgramFFmpeg)
+		t.Errorf("Program: got %q, want %q", decoded.Program, ProgramFFmpeg)
 	}
 	if decoded.Nonce != msg.Nonce {
 		t.Errorf("Nonce mismatch")
@@ -462,15 +481,15 @@ func TestCommandMessageByteLayout(t *testing.T) {
 		t.Errorf("version: got 0x%02x, want 0x%02x", encoded[0], CurrentVersion)
 	}
 
-	// Check program byte position
+	// Check program: [len 1B][name]
 	programOffset := 1 + NonceLength + HMACLength
-	if encoded[programOffset] != ProgramFFprobe {
-		t.Errorf("program byte at offset %d: got 0x%02x, want 0x%02x",
-			programOffset, encoded[programOffset], ProgramFFprobe)
+	if encoded[programOffset] != 7 || string(encoded[programOffset+1:programOffset+8]) != ProgramFFprobe {
+		t.Errorf("program at offset %d: got %v, want length-prefixed %q",
+			programOffset, encoded[programOffset:programOffset+8], ProgramFFprobe)
 	}
 
 	// Check args: [argc 2B][len0 2B][arg0][len1 2B][arg1]
-	argsOffset := programOffset + 1
+	argsOffset := programOffset + 1 + len(ProgramFFprobe)
 	expectedArgs := []byte{
 		0x00, 0x02, // argc = 2
 		0x00, 0x01, // len("a") = 1
@@ -482,20 +501,25 @@ func TestCommandMessageByteLayout(t *testing.T) {
 		t.Errorf("args bytes:\n  got  %v\n  want %v", encoded[argsOffset:], expectedArgs)
 	}
 
-	// Check total length: 1 + 16 + 32 + 1 + 2 + (2+1) + (2+1) = 58
-	if len(encoded) != 58 {
-		t.Errorf("total length: got %d, want 58", len(encoded))
+	// Check total length: 1 + 16 + 32 + (1+7) + 2 + (2+1) + (2+1) = 65
+	if len(encoded) != 65 {
+		t.Errorf("total length: got %d, want 65", len(encoded))
 	}
 }
 
 func TestCommandMessageWrongVersion(t *testing.T) {
+	if CurrentVersion != 0x0D {
+		t.Errorf("CurrentVersion = 0x%02x, want 0x0D", CurrentVersion)
+	}
 	msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{"test"}}
-	encoded := msg.Encode()
-	encoded[0] = 0x05 // wrong version
+	// 0x06 predates the env block, 0x08 the profile
+	for _, version := range []uint8{0x05, 0x06, 0x08} {
+		encoded := msg.Encode()
+		encoded[0] = version
 
-	_, err := DecodeCommandMessage(encoded)
-	if err == nil {
-		t.Fatal("expected error for wrong version, got nil")
+		if _, err := DecodeCommandMessage(encoded); err == nil {
+			t.Errorf("expected error for version 0x%02x, got nil", version)
+		}
 	}
 }
 
@@ -623,14 +647,170 @@ func TestUTF8Paths(t *testing.T) {
 	}
 }
 
+func TestProgressMessageRoundTrip(t *testing.T) {
+	orig := &ProgressMessage{Fields: []ProgressField{
+		{"frame", "120"}, {"fps", "29.97"}, {"out_time", "00:00:04.004000"}, {"speed", "1.5x"}, {"progress", "continue"},
+	}}
+	encoded := orig.Encode()
+	if !strings.HasPrefix(string(encoded), "frame=120\nfps=29.97\n") {
+		t.Errorf("encoded = %q, want ffmpeg's key=value lines", encoded)
+	}
+	decoded, err := DecodeProgressMessage(encoded)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !slices.Equal(decoded.Fields, orig.Fields) {
+		t.Errorf("got %+v, want %+v", decoded.Fields, orig.Fields)
+	}
+	if got := decoded.Get("speed"); got != "1.5x" {
+		t.Errorf("Get(speed) = %q", got)
+	}
+	if _, err := DecodeProgressMessage([]byte("frame=1\ngarbage\n")); err == nil {
+		t.Error("expected error for a line without '='")
+	}
+}
+
+// --- Session resume ---
+
+func TestSessionMessageRoundTrip(t *testing.T) {
+	orig := &SessionMessage{GracePeriod: 30 * time.Second}
+	copy(orig.Token[:], "0123456789abcdef")
+	decoded, err := DecodeSessionMessage(orig.Encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if *decoded != *orig {
+		t.Errorf("got %+v, want %+v", decoded, orig)
+	}
+	if _, err := DecodeSessionMessage(make([]byte, TokenLength)); err == nil {
+		t.Error("expected error for short payload")
+	}
+}
+
+func TestResumeMessageRoundTrip(t *testing.T) {
+	orig := &ResumeMessage{Attempt: 3, Received: math.MaxUint32 + 7}
+	copy(orig.Token[:], "0123456789abcdef")
+	for i := range orig.Signature {
+		orig.Signature[i] = byte(i)
+	}
+	encoded := orig.Encode()
+	decoded, err := DecodeResumeMessage(encoded)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if *decoded != *orig {
+		t.Errorf("got %+v, want %+v", decoded, orig)
+	}
+
+	if _, err := DecodeResumeMessage(encoded[:len(encoded)-1]); err == nil {
+		t.Error("expected error for short payload")
+	}
+	encoded[0] = 0x07
+	if _, err := DecodeResumeMessage(encoded); err == nil || !strings.Contains(err.Error(), "unsupported protocol version") {
+		t.Errorf("expected version error, got %v", err)
+	}
+}
+
+func TestCountRoundTrip(t *testing.T) {
+	n, err := DecodeCount(EncodeCount(1 << 40))
+	if err != nil || n != 1<<40 {
+		t.Errorf("DecodeCount = %d, %v; want %d", n, err, uint64(1<<40))
+	}
+	if _, err := DecodeCount([]byte{1, 2, 3}); err == nil {
+		t.Error("expected error for short payload")
+	}
+}
+
+// --- Fragments ---
+
+func TestFragmentMessageRoundTrip(t *testing.T) {
+	orig := &FragmentMessage{Type: MsgReadOk, Data: []byte("part of a read")}
+	decoded, err := DecodeFragmentMessage(orig.Encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.Type != orig.Type || !bytes.Equal(decoded.Data, orig.Data) {
+		t.Errorf("got %+v, want %+v", decoded, orig)
+	}
+	if _, err := DecodeFragmentMessage(nil); err == nil {
+		t.Error("expected error for empty payload")
+	}
+}
+
+// --- Flow control ---
+
+func TestCreditMessageRoundTrip(t *testing.T) {
+	orig := &CreditMessage{Channel: MsgStdout, Bytes: StdioWindow}
+	decoded, err := DecodeCreditMessage(orig.Encode())
+	if err != nil || *decoded != *orig {
+		t.Errorf("got %+v, %v; want %+v", decoded, err, orig)
+	}
+	if _, err := DecodeCreditMessage([]byte{MsgStdin, 0}); err == nil {
+		t.Error("expected error for short payload")
+	}
+}
+
+// --- Multiplexing ---
+
+func TestMuxMessageRoundTrip(t *testing.T) {
+	orig := &MuxMessage{Nonce: [NonceLength]byte{1, 2}, Signature: [HMACLength]byte{3, 4}}
+	encoded := orig.Encode()
+	decoded, err := DecodeMuxMessage(encoded)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if *decoded != *orig {
+		t.Errorf("got %+v, want %+v", decoded, orig)
+	}
+	if _, err := DecodeMuxMessage(encoded[:10]); err == nil {
+		t.Error("expected error for short payload")
+	}
+	encoded[0] = 0x01
+	if _, err := DecodeMuxMessage(encoded); err == nil {
+		t.Error("expected error for wrong version")
+	}
+}
+
+func TestStreamDataRoundTrip(t *testing.T) {
+	decoded, err := DecodeStreamData((&StreamData{StreamID: 0x01020304, Data: []byte("hello")}).Encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.StreamID != 0x01020304 || string(decoded.Data) != "hello" {
+		t.Errorf("got %+v", decoded)
+	}
+
+	// Close frames carry no data
+	decoded, err = DecodeStreamData((&StreamData{StreamID: 7}).Encode())
+	if err != nil || decoded.StreamID != 7 || len(decoded.Data) != 0 {
+		t.Errorf("got %+v, %v", decoded, err)
+	}
+	if _, err := DecodeStreamData([]byte{1, 2}); err == nil {
+		t.Error("expected error for short payload")
+	}
+}
+
+func TestStreamWindowRoundTrip(t *testing.T) {
+	orig := &StreamWindow{StreamID: 9, Increment: 1 << 20}
+	decoded, err := DecodeStreamWindow(orig.Encode())
+	if err != nil || *decoded != *orig {
+		t.Errorf("got %+v, %v; want %+v", decoded, err, orig)
+	}
+	if _, err := DecodeStreamWindow(make([]byte, 7)); err == nil {
+		t.Error("expected error for short payload")
+	}
+}
+
 // --- Message type constants ---
 
 func TestMessageTypeValues(t *testing.T) {
 	// Verify no collisions and correct values per spec
 	types := map[uint8]string{
 		0x01: "Command", 0x02: "Cancel", 0x03: "ExitCode", 0x04: "Error",
-		0x05: "Ping", 0x06: "Pong",
-		0x10: "Stdin", 0x11: "StdinClose", 0x12: "Stdout", 0x13: "Stderr",
+		0x05: "Ping", 0x06: "Pong", 0x07: "ExitReason",
+		0x08: "Session", 0x09: "Resume", 0x0A: "ResumeOk", 0x0B: "Ack", 0x0C: "Fragment",
+		0x30: "Mux", 0x31: "MuxOk", 0x32: "StreamData", 0x33: "StreamWindow", 0x34: "StreamClose",
+		0x10: "Stdin", 0x11: "StdinClose", 0x12: "Stdout", 0x13: "Stderr", 0x14: "Credit", 0x15: "Progress",
 		0x20: "Open", 0x21: "Read", 0x22: "Write", 0x23: "Seek",
 		0x24: "Close", 0x25: "Fstat", 0x26: "Ftruncate",
 		0x27: "Unlink", 0x28: "Rename", 0x29: "Mkdir",
@@ -642,8 +822,10 @@ func TestMessageTypeValues(t *testing.T) {
 
 	consts := map[string]uint8{
 		"Command": MsgCommand, "Cancel": MsgCancel, "ExitCode": MsgExitCode, "Error": MsgError,
-		"Ping": MsgPing, "Pong": MsgPong,
-		"Stdin": MsgStdin, "StdinClose": MsgStdinClose, "Stdout": MsgStdout, "Stderr": MsgStderr,
+		"Ping": MsgPing, "Pong": MsgPong, "ExitReason": MsgExitReason,
+		"Session": MsgSession, "Resume": MsgResume, "ResumeOk": MsgResumeOk, "Ack": MsgAck, "Fragment": MsgFragment,
+		"Mux": MsgMux, "MuxOk": MsgMuxOk, "StreamData": MsgStreamData, "StreamWindow": MsgStreamWindow, "StreamClose": MsgStreamClose,
+		"Stdin": MsgStdin, "StdinClose": MsgStdinClose, "Stdout": MsgStdout, "Stderr": MsgStderr, "Credit": MsgCredit, "Progress": MsgProgress,
 		"Open": MsgOpen, "Read": MsgRead, "Write": MsgWrite, "Seek": MsgSeek,
 		"Close": MsgClose, "Fstat": MsgFstat, "Ftruncate": MsgFtruncate,
 		"Unlink": MsgUnlink, "Rename": MsgRename, "Mkdir": MsgMkdir,
@@ -744,7 +926,7 @@ func TestCommandMessageNoArgs(t *testing.T) {
 		t.Fatalf("decode failed: %v", err)
 	}
 	if decoded.Program != ProgramFFmpeg {
-		t.Errorf("Program: got %d, want %d", decoded.Program, ProgramFFmpeg)
+		t.Errorf("Program: got %q, want %q", decoded.Program, ProgramFFmpeg)
 	}
 	if len(decoded.Args) != 0 {
 		t.Errorf("Args: got %v (len %d), want empty", decoded.Args, len(decoded.Args))
@@ -797,6 +979,31 @@ func TestCommandMessageDecodeArgCountTruncated(t *testing.T) {
 	}
 }
 
+func TestCommandMessageCustomProgram(t *testing.T) {
+	name := strings.Repeat("x", MaxProgramLength)
+	for _, program := range []string{"ffmpeg-av1", name} {
+		msg := &CommandMessage{Program: program, Args: []string{"-version"}}
+		decoded, err := DecodeCommandMessage(msg.Encode())
+		if err != nil {
+			t.Fatalf("decode %q failed: %v", program, err)
+		}
+		if decoded.Program != program || !slices.Equal(decoded.Args, msg.Args) {
+			t.Errorf("got %q %q, want %q %q", decoded.Program, decoded.Args, program, msg.Args)
+		}
+	}
+}
+
+func TestCommandMessageDecodeProgramTruncated(t *testing.T) {
+	// Program length says 10 bytes, but only 3 follow
+	headerLen := 1 + NonceLength + HMACLength
+	payload := make([]byte, headerLen+1+3)
+	payload[0] = CurrentVersion
+	payload[headerLen] = 10
+	if _, err := DecodeCommandMessage(payload); err == nil {
+		t.Fatal("expected error for truncated program name, got nil")
+	}
+}
+
 func TestCommandMessageDecodeArgTruncated(t *testing.T) {
 	// Build a valid header, then argc=1 but truncate the arg data.
 	headerLen := 1 + NonceLength + HMACLength + 1
@@ -811,18 +1018,124 @@ func TestCommandMessageDecodeArgTruncated(t *testing.T) {
 	}
 }
 
+func TestCommandMessageEnvRoundTrip(t *testing.T) {
+	msg := &CommandMessage{
+		Program: ProgramFFmpeg,
+		Args:    []string{"-i", "in.mkv"},
+		Env:     []string{"TZ=Europe/Berlin", "LANG=de_DE.UTF-8", "EMPTY="},
+	}
+	decoded, err := DecodeCommandMessage(msg.Encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !slices.Equal(decoded.Args, msg.Args) {
+		t.Errorf("Args: got %q, want %q", decoded.Args, msg.Args)
+	}
+	if !slices.Equal(decoded.Env, msg.Env) {
+		t.Errorf("Env: got %q, want %q", decoded.Env, msg.Env)
+	}
+}
+
+func TestCommandMessageEnvByteLayout(t *testing.T) {
+	msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{"a"}, Env: []string{"X=1"}}
+	encoded := msg.Encode()
+
+	argsOffset := 1 + NonceLength + HMACLength + 1 + len(ProgramFFmpeg)
+	expected := []byte{
+		0x00, 0x01, // argc = 1
+		0x00, 0x01, 'a',
+		0x00, 0x01, // envc = 1
+		0x00, 0x03, 'X', '=', '1',
+	}
+	if !bytes.Equal(encoded[argsOffset:], expected) {
+		t.Errorf("args and env bytes:\n  got  %v\n  want %v", encoded[argsOffset:], expected)
+	}
+}
+
+func TestCommandMessageWithoutEnv(t *testing.T) {
+	// Nothing follows the args, as in messages from older clients
+	msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{"-version"}, Env: []string{}}
+	encoded := msg.Encode()
+	if want := 1 + NonceLength + HMACLength + 1 + len(ProgramFFmpeg) + 2 + 2 + len("-version"); len(encoded) != want {
+		t.Fatalf("length: got %d, want %d", len(encoded), want)
+	}
+	decoded, err := DecodeCommandMessage(encoded)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.Env != nil {
+		t.Errorf("Env: got %q, want nil", decoded.Env)
+	}
+}
+
+func TestCommandMessageProfile(t *testing.T) {
+	for _, env := range [][]string{nil, {"TZ=UTC"}} {
+		msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{"-version"}, Env: env, Profile: "beta"}
+		decoded, err := DecodeCommandMessage(msg.Encode())
+		if err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		if decoded.Profile != "beta" || !slices.Equal(decoded.Env, env) {
+			t.Errorf("got profile %q env %q, want %q %q", decoded.Profile, decoded.Env, "beta", env)
+		}
+	}
+}
+
+func TestCommandMessageProfileByteLayout(t *testing.T) {
+	// An empty env block is written so the profile has a fixed position
+	msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{"a"}, Profile: "b2"}
+	encoded := msg.Encode()
+
+	argsOffset := 1 + NonceLength + HMACLength + 1 + len(ProgramFFmpeg)
+	expected := []byte{
+		0x00, 0x01, // argc = 1
+		0x00, 0x01, 'a',
+		0x00, 0x00, // envc = 0
+		0x02, 'b', '2',
+	}
+	if !bytes.Equal(encoded[argsOffset:], expected) {
+		t.Errorf("args, env and profile bytes:\n  got  %v\n  want %v", encoded[argsOffset:], expected)
+	}
+}
+
+func TestCommandMessageDecodeProfileTruncated(t *testing.T) {
+	msg := &CommandMessage{Program: ProgramFFmpeg, Profile: "beta"}
+	encoded := msg.Encode()
+	if _, err := DecodeCommandMessage(encoded[:len(encoded)-1]); err == nil {
+		t.Error("expected error for truncated profile name, got nil")
+	}
+}
+
+func TestCommandMessageDecodeProfileTrailingBytes(t *testing.T) {
+	msg := &CommandMessage{Program: ProgramFFmpeg, Profile: "beta"}
+	encoded := append(msg.Encode(), 'x')
+	if _, err := DecodeCommandMessage(encoded); err == nil {
+		t.Error("expected error for bytes after the profile name, got nil")
+	}
+}
+
+func TestCommandMessageDecodeEnvTruncated(t *testing.T) {
+	msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{"a"}, Env: []string{"TZ=UTC"}}
+	encoded := msg.Encode()
+	for _, cut := range []int{1, 3, 5} {
+		if _, err := DecodeCommandMessage(encoded[:len(encoded)-len("TZ=UTC")-4+cut]); err == nil {
+			t.Errorf("expected error for env block cut to %d bytes, got nil", cut)
+		}
+	}
+}
+
 func TestCommandMessageNoArgsSerialization(t *testing.T) {
 	msg := &CommandMessage{Program: ProgramFFmpeg, Args: []string{}}
 	encoded := msg.Encode()
 
-	// Expected: [version 1B][nonce 16B][sig 32B][program 1B][argc 0x00 0x00]
-	expectedLen := 1 + NonceLength + HMACLength + 1 + 2
+	// Expected: [version 1B][nonce 16B][sig 32B][len 1B][program][argc 0x00 0x00]
+	expectedLen := 1 + NonceLength + HMACLength + 1 + len(ProgramFFmpeg) + 2
 	if len(encoded) != expectedLen {
 		t.Fatalf("length: got %d, want %d", len(encoded), expectedLen)
 	}
 
 	// Check argc bytes are 0x00, 0x00
-	argcOffset := 1 + NonceLength + HMACLength + 1
+	argcOffset := 1 + NonceLength + HMACLength + 1 + len(ProgramFFmpeg)
 	if encoded[argcOffset] != 0x00 || encoded[argcOffset+1] != 0x00 {
 		t.Errorf("argc bytes: got [0x%02x, 0x%02x], want [0x00, 0x00]",
 			encoded[argcOffset], encoded[argcOffset+1])
@@ -0,0 +1,190 @@
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rule is one server-side argument rewrite. In config it is written either
+// as the pair shorthand ["from", "to"], which replaces every occurrence of
+// "from" in every argument, or as an object:
+//
+//	{
+//	  "match":   "^h264_nvenc$",     // regexp tested against each argument, or the option's value
+//	  "option":  "-c:v",             // only consider the argument following this flag
+//	  "replace": "h264_qsv",         // replacement, may reference capture groups ($1)
+//	  "remove":  true,               // drop the matched argument (flag and value with "option")
+//	  "insert":  ["-hwaccel", "qsv"], // insert before the match, or at the start if nothing to match
+//	  "program": "ffmpeg"            // only apply to this program
+//	}
+type Rule struct {
+	// From and To hold the pair shorthand.
+	From string `json:"-"`
+	To   string `json:"-"`
+
+	Match   string   `json:"match"`
+	Option  string   `json:"option"`
+	Replace *string  `json:"replace"`
+	Remove  bool     `json:"remove"`
+	Insert  []string `json:"insert"`
+	Program string   `json:"program"`
+
+	pair bool
+	re   *regexp.Regexp
+}
+
+// Pair returns a plain substring replacement rule, equivalent to the
+// ["from", "to"] config shorthand.
+func Pair(from, to string) Rule {
+	return Rule{From: from, To: to, pair: true}
+}
+
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var pair []string
+		if err := json.Unmarshal(data, &pair); err != nil {
+			return fmt.Errorf("rewrite pair must be [\"from\", \"to\"]: %w", err)
+		}
+		if len(pair) != 2 {
+			return fmt.Errorf("rewrite pair must have exactly 2 elements, got %d", len(pair))
+		}
+		*r = Pair(pair[0], pair[1])
+		return nil
+	}
+
+	// Decode into an alias type so this method is not called recursively.
+	type rule Rule
+	var decoded rule
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&decoded); err != nil {
+		return fmt.Errorf("invalid rewrite rule: %w", err)
+	}
+	*r = Rule(decoded)
+	return r.Compile()
+}
+
+// Compile checks an object rule and compiles its match. Rules decoded from
+// config are compiled already; others need it before Apply, except those
+// made with Pair.
+func (r *Rule) Compile() error {
+	if r.Replace != nil && r.Remove {
+		return fmt.Errorf("rewrite rule cannot both replace and remove")
+	}
+	if r.Replace == nil && !r.Remove && len(r.Insert) == 0 {
+		return fmt.Errorf("rewrite rule needs at least one of replace, remove, or insert")
+	}
+	if r.Remove && r.Match == "" && r.Option == "" {
+		return fmt.Errorf("rewrite rule with remove needs match or option")
+	}
+	if r.Replace != nil && r.Match == "" && r.Option == "" {
+		return fmt.Errorf("rewrite rule with replace needs match or option")
+	}
+	if r.Match != "" {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite match %q: %w", r.Match, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// Apply runs rules in order over args for the given program name, such as
+// "ffmpeg" or "ffprobe". Each rule sees the output of the previous one. args is never
+// modified; when no rules are given it is returned as-is.
+func Apply(rules []Rule, program string, args []string) []string {
+	if len(rules) == 0 {
+		return args
+	}
+	result := make([]string, len(args))
+	copy(result, args)
+	for i := range rules {
+		if rules[i].Program != "" && rules[i].Program != program {
+			continue
+		}
+		result = rules[i].apply(result)
+	}
+	return result
+}
+
+func (r *Rule) apply(args []string) []string {
+	switch {
+	case r.pair:
+		for i := range args {
+			args[i] = strings.ReplaceAll(args[i], r.From, r.To)
+		}
+		return args
+	case r.Option != "":
+		return r.applyOption(args)
+	case r.re != nil:
+		return r.applyMatch(args)
+	default:
+		// Insert-only rule with nothing to match: prepend.
+		return append(append([]string{}, r.Insert...), args...)
+	}
+}
+
+// applyOption handles rules scoped to the value following a flag.
+func (r *Rule) applyOption(args []string) []string {
+	out := make([]string, 0, len(args)+len(r.Insert))
+	for i := 0; i < len(args); i++ {
+		if !matchesOption(args[i], r.Option) || i+1 >= len(args) {
+			out = append(out, args[i])
+			continue
+		}
+		flag, value := args[i], args[i+1]
+		if r.re != nil && !r.re.MatchString(value) {
+			out = append(out, args[i])
+			continue
+		}
+		i++ // consume the value
+
+		out = append(out, r.Insert...)
+		if r.Remove {
+			continue
+		}
+		if r.Replace != nil {
+			if r.re != nil {
+				value = r.re.ReplaceAllString(value, *r.Replace)
+			} else {
+				value = *r.Replace
+			}
+		}
+		out = append(out, flag, value)
+	}
+	return out
+}
+
+// applyMatch handles rules that test every argument against a regexp.
+func (r *Rule) applyMatch(args []string) []string {
+	out := make([]string, 0, len(args)+len(r.Insert))
+	for _, arg := range args {
+		if !r.re.MatchString(arg) {
+			out = append(out, arg)
+			continue
+		}
+		out = append(out, r.Insert...)
+		if r.Remove {
+			continue
+		}
+		if r.Replace != nil {
+			arg = r.re.ReplaceAllString(arg, *r.Replace)
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// matchesOption reports whether arg is the given flag, optionally followed
+// by an ffmpeg stream specifier: "-c:v" matches "-c:v" and "-c:v:0".
+func matchesOption(arg, option string) bool {
+	if arg == option {
+		return true
+	}
+	return strings.HasPrefix(arg, option+":")
+}
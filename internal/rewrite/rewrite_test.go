@@ -0,0 +1,354 @@
+package rewrite
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseRules decodes a JSON array of rules, failing the test on error.
+func parseRules(t *testing.T, data string) []Rule {
+	t.Helper()
+	var rules []Rule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		t.Fatalf("failed to parse rules %s: %v", data, err)
+	}
+	return rules
+}
+
+func TestApplyPairs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		rules   []Rule
+		want    []string
+		sameRef bool // if true, expect returned slice is the same reference as input
+	}{
+		{
+			name:    "empty rewrites returns same slice",
+			args:    []string{"-c:v", "h264_nvenc", "-i", "input.mp4"},
+			rules:   nil,
+			want:    []string{"-c:v", "h264_nvenc", "-i", "input.mp4"},
+			sameRef: true,
+		},
+		{
+			name:    "empty rewrites with explicit empty slice returns same slice",
+			args:    []string{"-c:v", "h264_nvenc"},
+			rules:   []Rule{},
+			want:    []string{"-c:v", "h264_nvenc"},
+			sameRef: true,
+		},
+		{
+			name:  "single rewrite replaces codec",
+			args:  []string{"-c:v", "h264_nvenc", "-i", "input.mp4"},
+			rules: []Rule{Pair("h264_nvenc", "h264_qsv")},
+			want:  []string{"-c:v", "h264_qsv", "-i", "input.mp4"},
+		},
+		{
+			name: "multiple rewrites applied in order",
+			args: []string{"-c:v", "h264_nvenc", "-preset", "fast"},
+			rules: []Rule{
+				Pair("h264_nvenc", "h264_qsv"),
+				Pair("fast", "medium"),
+			},
+			want: []string{"-c:v", "h264_qsv", "-preset", "medium"},
+		},
+		{
+			name:  "rewrite that does not match leaves args unchanged",
+			args:  []string{"-c:v", "libx264", "-i", "input.mp4"},
+			rules: []Rule{Pair("h264_nvenc", "h264_qsv")},
+			want:  []string{"-c:v", "libx264", "-i", "input.mp4"},
+		},
+		{
+			name:  "rewrite applied to all args not just first match",
+			args:  []string{"h264_nvenc", "foo", "h264_nvenc"},
+			rules: []Rule{Pair("h264_nvenc", "h264_qsv")},
+			want:  []string{"h264_qsv", "foo", "h264_qsv"},
+		},
+		{
+			name:  "rewrite with empty replacement deletes pattern",
+			args:  []string{"-nostdin", "-c:v", "libx264"},
+			rules: []Rule{Pair("-nostdin", "")},
+			want:  []string{"", "-c:v", "libx264"},
+		},
+		{
+			name:  "multiple occurrences of pattern in one arg",
+			args:  []string{"aa-bb-aa", "cc"},
+			rules: []Rule{Pair("aa", "xx")},
+			want:  []string{"xx-bb-xx", "cc"},
+		},
+		{
+			name: "chained rewrites where first produces text matched by second",
+			args: []string{"alpha"},
+			rules: []Rule{
+				Pair("alpha", "beta"),
+				Pair("beta", "gamma"),
+			},
+			want: []string{"gamma"},
+		},
+		{
+			name:  "empty args with non-empty rewrites returns empty result",
+			args:  []string{},
+			rules: []Rule{Pair("a", "b")},
+			want:  []string{},
+		},
+		{
+			name:  "rewrite matching part of arg",
+			args:  []string{"-c:v h264_nvenc", "-preset fast"},
+			rules: []Rule{Pair("h264_nvenc", "h264_qsv")},
+			want:  []string{"-c:v h264_qsv", "-preset fast"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Apply(tt.rules, "ffmpeg", tt.args)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("length mismatch: got %d, want %d", len(got), len(tt.want))
+			}
+
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("arg[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+
+			if tt.sameRef {
+				if len(tt.args) > 0 && &got[0] != &tt.args[0] {
+					t.Error("expected returned slice to be the same reference as input, but got a copy")
+				}
+			}
+		})
+	}
+}
+
+func TestApplyDoesNotMutateInput(t *testing.T) {
+	original := []string{"h264_nvenc", "fast"}
+	argsCopy := make([]string, len(original))
+	copy(argsCopy, original)
+
+	rules := []Rule{Pair("h264_nvenc", "h264_qsv")}
+	_ = Apply(rules, "ffmpeg", original)
+
+	for i := range original {
+		if original[i] != argsCopy[i] {
+			t.Errorf("input was mutated: arg[%d] = %q, want %q", i, original[i], argsCopy[i])
+		}
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		program string
+		args    []string
+		want    []string
+	}{
+		{
+			name:  "pair shorthand mangles substrings",
+			rules: `[["aac", "libfdk_aac"]]`,
+			args:  []string{"-c:a", "aac", "-i", "/media/aac-test.mkv"},
+			want:  []string{"-c:a", "libfdk_aac", "-i", "/media/libfdk_aac-test.mkv"},
+		},
+		{
+			name:  "anchored regex leaves paths alone",
+			rules: `[{"match": "^aac$", "replace": "libfdk_aac"}]`,
+			args:  []string{"-c:a", "aac", "-i", "/media/aac-test.mkv"},
+			want:  []string{"-c:a", "libfdk_aac", "-i", "/media/aac-test.mkv"},
+		},
+		{
+			name:  "regex replace with capture group",
+			rules: `[{"match": "^(h264|hevc)_nvenc$", "replace": "${1}_qsv"}]`,
+			args:  []string{"-c:v:0", "hevc_nvenc", "-c:v:1", "h264_nvenc"},
+			want:  []string{"-c:v:0", "hevc_qsv", "-c:v:1", "h264_qsv"},
+		},
+		{
+			name:  "option replaces only the flag's value",
+			rules: `[{"option": "-c:v", "replace": "libx264"}]`,
+			args:  []string{"-i", "h264_nvenc.mkv", "-c:v", "h264_nvenc", "-c:a", "copy"},
+			want:  []string{"-i", "h264_nvenc.mkv", "-c:v", "libx264", "-c:a", "copy"},
+		},
+		{
+			name:  "option matches stream specifiers",
+			rules: `[{"option": "-c:v", "replace": "libx264"}]`,
+			args:  []string{"-c:v:0", "h264_nvenc", "-c:a:0", "aac"},
+			want:  []string{"-c:v:0", "libx264", "-c:a:0", "aac"},
+		},
+		{
+			name:  "option does not match a longer flag",
+			rules: `[{"option": "-c", "replace": "copy"}]`,
+			args:  []string{"-codec:v", "h264_nvenc", "-c", "aac"},
+			want:  []string{"-codec:v", "h264_nvenc", "-c", "copy"},
+		},
+		{
+			name:  "option with match only rewrites matching values",
+			rules: `[{"option": "-c:a", "match": "^aac$", "replace": "libfdk_aac"}]`,
+			args:  []string{"-c:a:0", "aac", "-c:a:1", "ac3", "-metadata", "aac"},
+			want:  []string{"-c:a:0", "libfdk_aac", "-c:a:1", "ac3", "-metadata", "aac"},
+		},
+		{
+			name:  "option at end of args without value is left alone",
+			rules: `[{"option": "-c:v", "replace": "libx264"}]`,
+			args:  []string{"-i", "in.mkv", "-c:v"},
+			want:  []string{"-i", "in.mkv", "-c:v"},
+		},
+		{
+			name:  "remove option and its value",
+			rules: `[{"option": "-preset", "remove": true}]`,
+			args:  []string{"-c:v", "h264_nvenc", "-preset", "p4", "out.mp4"},
+			want:  []string{"-c:v", "h264_nvenc", "out.mp4"},
+		},
+		{
+			name:  "remove option only when value matches",
+			rules: `[{"option": "-preset", "match": "^p[0-9]$", "remove": true}]`,
+			args:  []string{"-preset", "p4", "-preset", "fast"},
+			want:  []string{"-preset", "fast"},
+		},
+		{
+			name:  "remove matching argument",
+			rules: `[{"match": "^-nostdin$", "remove": true}]`,
+			args:  []string{"-nostdin", "-c:v", "libx264"},
+			want:  []string{"-c:v", "libx264"},
+		},
+		{
+			name:  "insert at start",
+			rules: `[{"insert": ["-hwaccel", "cuda"]}]`,
+			args:  []string{"-i", "in.mkv", "out.mp4"},
+			want:  []string{"-hwaccel", "cuda", "-i", "in.mkv", "out.mp4"},
+		},
+		{
+			name:  "insert before option",
+			rules: `[{"option": "-i", "insert": ["-hwaccel", "qsv"]}]`,
+			args:  []string{"-y", "-i", "in.mkv", "out.mp4"},
+			want:  []string{"-y", "-hwaccel", "qsv", "-i", "in.mkv", "out.mp4"},
+		},
+		{
+			name:  "insert before matching argument",
+			rules: `[{"match": "\\.mp4$", "insert": ["-movflags", "+faststart"]}]`,
+			args:  []string{"-i", "in.mkv", "out.mp4"},
+			want:  []string{"-i", "in.mkv", "-movflags", "+faststart", "out.mp4"},
+		},
+		{
+			name:  "insert and replace together",
+			rules: `[{"option": "-c:v", "match": "^h264_nvenc$", "replace": "h264_vaapi", "insert": ["-vaapi_device", "/dev/dri/renderD128"]}]`,
+			args:  []string{"-c:v", "h264_nvenc"},
+			want:  []string{"-vaapi_device", "/dev/dri/renderD128", "-c:v", "h264_vaapi"},
+		},
+		{
+			name:    "program condition matches",
+			rules:   `[{"match": "^aac$", "replace": "libfdk_aac", "program": "ffmpeg"}]`,
+			program: "ffmpeg",
+			args:    []string{"aac"},
+			want:    []string{"libfdk_aac"},
+		},
+		{
+			name:    "program condition skips other programs",
+			rules:   `[{"match": "^aac$", "replace": "libfdk_aac", "program": "ffmpeg"}]`,
+			program: "ffprobe",
+			args:    []string{"aac"},
+			want:    []string{"aac"},
+		},
+		{
+			name:  "mixed pairs and rules applied in order",
+			rules: `[["h264_nvenc", "h264_qsv"], {"option": "-preset", "remove": true}, {"insert": ["-hwaccel", "qsv"]}]`,
+			args:  []string{"-c:v", "h264_nvenc", "-preset", "p4"},
+			want:  []string{"-hwaccel", "qsv", "-c:v", "h264_qsv"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := tt.program
+			if program == "" {
+				program = "ffmpeg"
+			}
+			got := Apply(parseRules(t, tt.rules), program, tt.args)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRulesDoNotMutateInput(t *testing.T) {
+	rules := parseRules(t, `[
+		{"option": "-c:v", "replace": "libx264"},
+		{"match": "^-y$", "remove": true},
+		{"insert": ["-hide_banner"]}
+	]`)
+	original := []string{"-y", "-c:v", "h264_nvenc"}
+	argsCopy := append([]string{}, original...)
+
+	_ = Apply(rules, "ffmpeg", original)
+
+	if !reflect.DeepEqual(original, argsCopy) {
+		t.Errorf("input was mutated: %q, want %q", original, argsCopy)
+	}
+}
+
+func TestUnmarshalPair(t *testing.T) {
+	rules := parseRules(t, `[["h264_nvenc", "h264_qsv"]]`)
+	if len(rules) != 1 || rules[0].From != "h264_nvenc" || rules[0].To != "h264_qsv" {
+		t.Fatalf("got %+v", rules)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"pair with one element", `[["a"]]`, "exactly 2"},
+		{"pair with three elements", `[["a", "b", "c"]]`, "exactly 2"},
+		{"pair with non-string", `[["a", 1]]`, "rewrite pair"},
+		{"unknown field", `[{"match": "a", "replace": "b", "replce": "c"}]`, "unknown field"},
+		{"invalid regex", `[{"match": "(", "replace": "b"}]`, "invalid rewrite match"},
+		{"no action", `[{"match": "a"}]`, "at least one of"},
+		{"replace and remove", `[{"match": "a", "replace": "b", "remove": true}]`, "both replace and remove"},
+		{"remove without target", `[{"remove": true}]`, "needs match or option"},
+		{"replace without target", `[{"replace": "b"}]`, "needs match or option"},
+		{"not an object or array", `["a"]`, "invalid rewrite rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []Rule
+			err := json.Unmarshal([]byte(tt.data), &rules)
+			if err == nil {
+				t.Fatalf("expected error, got %+v", rules)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want mention of %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEmptyReplaceDeletesMatch(t *testing.T) {
+	rules := parseRules(t, `[{"match": "_nvenc$", "replace": ""}]`)
+	got := Apply(rules, "ffmpeg", []string{"h264_nvenc"})
+	if !reflect.DeepEqual(got, []string{"h264"}) {
+		t.Errorf("got %q, want [h264]", got)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	replace := "h264_qsv"
+	rule := Rule{Option: "-c:v", Match: "^h264_nvenc$", Replace: &replace}
+	if err := rule.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	got := Apply([]Rule{rule}, "ffmpeg", []string{"-c:v", "h264_nvenc", "-c:a", "h264_nvenc"})
+	want := []string{"-c:v", "h264_qsv", "-c:a", "h264_nvenc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	invalid := Rule{Match: "(", Replace: &replace}
+	if err := invalid.Compile(); err == nil || !strings.Contains(err.Error(), "invalid rewrite match") {
+		t.Errorf("Compile error = %v, want invalid rewrite match", err)
+	}
+}
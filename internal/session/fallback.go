@@ -0,0 +1,167 @@
+package session
+
+import (
+	"encoding/binary"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// stderrTailSize is how much of a run's stderr is kept for matching
+// fallback patterns. ffmpeg prints the fatal error last.
+const stderrTailSize = 64 * 1024
+
+// fallbackCleanupTimeout bounds how long a retry waits for the client to
+// answer the failed run's outstanding file requests.
+const fallbackCleanupTimeout = 10 * time.Second
+
+// Fallback describes how to rerun a job that failed before any of its
+// output reached the client. See SetFallback.
+type Fallback struct {
+	// Patterns are tested against the end of the failed run's stderr. The
+	// job is only retried if one of them matches.
+	Patterns []*regexp.Regexp
+	// Start launches the replacement process.
+	Start func() (Process, error)
+}
+
+func (f *Fallback) matches(stderr []byte) bool {
+	for _, re := range f.Patterns {
+		if re.Match(stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
+
+// fioTracker follows the file requests relayed between fio and the client,
+// so that before a retry the session knows when the failed run's requests
+// have all been answered and which files the client still holds open for
+// it. Request and file IDs are allocated by fio and start over in the new
+// process, so both must be settled before it starts.
+type fioTracker struct {
+	mu      sync.Mutex
+	pending map[uint16]pendingRequest // by request ID
+	open    map[uint16]struct{}       // file IDs
+	idle    chan struct{}             // closed while nothing is pending
+}
+
+type pendingRequest struct {
+	msgType uint8
+	fileID  uint16 // for open and close
+	// internal requests are issued by the session itself; their responses
+	// are not forwarded to fio.
+	internal bool
+}
+
+func newFioTracker() *fioTracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &fioTracker{
+		pending: make(map[uint16]pendingRequest),
+		open:    make(map[uint16]struct{}),
+		idle:    idle,
+	}
+}
+
+// request records a request on its way to the client.
+func (t *fioTracker) request(msgType uint8, payload []byte, internal bool) {
+	if len(payload) < 2 {
+		return
+	}
+	req := pendingRequest{msgType: msgType, internal: internal}
+	if (msgType == protocol.MsgOpen || msgType == protocol.MsgClose) && len(payload) >= 4 {
+		req.fileID = binary.BigEndian.Uint16(payload[2:])
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.pending[binary.BigEndian.Uint16(payload)] = req
+	if msgType == protocol.MsgClose {
+		// The client forgets the file ID whether or not the close succeeds
+		delete(t.open, req.fileID)
+	}
+}
+
+// response records a response from the client and reports whether it
+// should be forwarded to fio. Responses to internal requests, and to
+// requests that are not pending, are not.
+func (t *fioTracker) response(msgType uint8, payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	requestID := binary.BigEndian.Uint16(payload)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	req, ok := t.pending[requestID]
+	if !ok {
+		return false
+	}
+	delete(t.pending, requestID)
+	if req.msgType == protocol.MsgOpen && msgType == protocol.MsgOpenOk {
+		t.open[req.fileID] = struct{}{}
+	}
+	if len(t.pending) == 0 {
+		close(t.idle)
+	}
+	return !req.internal
+}
+
+// waitIdle waits until every request has been answered. It reports false
+// if that did not happen within timeout.
+func (t *fioTracker) waitIdle(timeout time.Duration) bool {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// openFiles returns the file IDs the client holds open.
+func (t *fioTracker) openFiles() []uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]uint16, 0, len(t.open))
+	for id := range t.open {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,76 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+func TestTailBufferKeepsEnd(t *testing.T) {
+	tail := newTailBuffer(8)
+	tail.Write([]byte("hello "))
+	tail.Write([]byte("world"))
+	if got := string(tail.Bytes()); got != "lo world" {
+		t.Errorf("Bytes() = %q, want %q", got, "lo world")
+	}
+
+	tail.Write(bytes.Repeat([]byte("x"), 20))
+	if got := string(tail.Bytes()); got != "xxxxxxxx" {
+		t.Errorf("Bytes() = %q after large write", got)
+	}
+}
+
+func TestFioTrackerOpenAndClose(t *testing.T) {
+	tr := newFioTracker()
+
+	open := (&protocol.OpenRequest{RequestID: 1, FileID: 7, Path: "/in.mkv"}).Encode()
+	tr.request(protocol.MsgOpen, open, false)
+	if tr.waitIdle(10 * time.Millisecond) {
+		t.Fatal("tracker idle with an open request pending")
+	}
+
+	if !tr.response(protocol.MsgOpenOk, (&protocol.OpenOkResponse{RequestID: 1}).Encode()) {
+		t.Error("response to fio's request was not forwarded")
+	}
+	if !tr.waitIdle(10 * time.Millisecond) {
+		t.Fatal("tracker not idle after response")
+	}
+	if ids := tr.openFiles(); len(ids) != 1 || ids[0] != 7 {
+		t.Fatalf("openFiles() = %v, want [7]", ids)
+	}
+
+	closeReq := (&protocol.CloseRequest{RequestID: 2, FileID: 7}).Encode()
+	tr.request(protocol.MsgClose, closeReq, false)
+	if ids := tr.openFiles(); len(ids) != 0 {
+		t.Errorf("openFiles() = %v after close, want none", ids)
+	}
+}
+
+func TestFioTrackerFailedOpenNotTracked(t *testing.T) {
+	tr := newFioTracker()
+	tr.request(protocol.MsgOpen, (&protocol.OpenRequest{RequestID: 1, FileID: 3}).Encode(), false)
+	tr.response(protocol.MsgIoError, (&protocol.IoErrorResponse{RequestID: 1, Errno: 2}).Encode())
+	if ids := tr.openFiles(); len(ids) != 0 {
+		t.Errorf("openFiles() = %v after failed open, want none", ids)
+	}
+}
+
+func TestFioTrackerDropsUnknownAndInternal(t *testing.T) {
+	tr := newFioTracker()
+	if tr.response(protocol.MsgCloseOk, (&protocol.RequestIDResponse{RequestID: 9}).Encode()) {
+		t.Error("response without a pending request was forwarded")
+	}
+	if tr.response(protocol.MsgCloseOk, []byte{0}) {
+		t.Error("truncated response was forwarded")
+	}
+
+	tr.request(protocol.MsgClose, (&protocol.CloseRequest{RequestID: 1, FileID: 1}).Encode(), true)
+	if tr.response(protocol.MsgCloseOk, (&protocol.RequestIDResponse{RequestID: 1}).Encode()) {
+		t.Error("response to an internal request was forwarded")
+	}
+	if !tr.waitIdle(10 * time.Millisecond) {
+		t.Error("tracker not idle after internal response")
+	}
+}
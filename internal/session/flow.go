@@ -0,0 +1,143 @@
+package session
+
+import (
+	"sync"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// Credit counts the bytes a stdio channel may still send before the other
+// side reports, with MsgCredit, that it has consumed them.
+type Credit struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	n       int
+	closed  bool
+	waiting int // callers of Take waiting for credit
+}
+
+func NewCredit(n int) *Credit {
+	c := &Credit{n: n}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// Take waits until there is credit, and takes up to max bytes of it.
+// Credit taken but not used is returned with Add.
+func (c *Credit) Take(max int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.n <= 0 && !c.closed {
+		c.waiting++
+		c.changed.Wait()
+		c.waiting--
+	}
+	if c.closed {
+		return max
+	}
+	n := min(c.n, max)
+	c.n -= n
+	return n
+}
+
+// Add returns n bytes of credit. A negative n spends credit without
+// waiting for it, for messages that must go out regardless.
+func (c *Credit) Add(n int) {
+	c.mu.Lock()
+	c.n += n
+	c.changed.Broadcast()
+	c.mu.Unlock()
+}
+
+// Waiting reports whether Take is waiting for credit.
+func (c *Credit) Waiting() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waiting > 0
+}
+
+// Close stops limiting the channel, once there is no one left to return
+// credit. Take no longer waits.
+func (c *Credit) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.changed.Broadcast()
+	c.mu.Unlock()
+}
+
+// Queue hands the messages received for one destination to a goroutine of
+// its own, which writes them in order. The connection's reader only queues
+// them, so a destination that does not keep up holds up its own messages
+// and nothing else. What is queued is bounded by the sender's credit, or
+// for file I/O, by the requests outstanding.
+type Queue struct {
+	write func(*protocol.Message)
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	msgs    []*protocol.Message
+	closed  bool
+	done    chan struct{}
+}
+
+// NewQueue starts a queue that passes each message to write.
+func NewQueue(write func(*protocol.Message)) *Queue {
+	q := &Queue{write: write, done: make(chan struct{})}
+	q.changed = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// Push queues msg. It never blocks; messages pushed after Close or Abort
+// are dropped.
+func (q *Queue) Push(msg *protocol.Message) {
+	q.mu.Lock()
+	if !q.closed {
+		q.msgs = append(q.msgs, msg)
+		q.changed.Signal()
+	}
+	q.mu.Unlock()
+}
+
+// Close stops the queue once everything queued is written. Done is closed
+// then.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.changed.Signal()
+	q.mu.Unlock()
+}
+
+// Abort drops what is queued and stops the queue after the current write.
+func (q *Queue) Abort() {
+	q.mu.Lock()
+	q.closed = true
+	q.msgs = nil
+	q.changed.Signal()
+	q.mu.Unlock()
+}
+
+// Done is closed when the queue has stopped.
+func (q *Queue) Done() <-chan struct{} {
+	return q.done
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		for len(q.msgs) == 0 && !q.closed {
+			q.changed.Wait()
+		}
+		if len(q.msgs) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		msg := q.msgs[0]
+		q.msgs[0] = nil
+		q.msgs = q.msgs[1:]
+		q.mu.Unlock()
+
+		q.write(msg)
+	}
+}
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+func TestCreditTakeWaitsForAdd(t *testing.T) {
+	c := NewCredit(10)
+	if n := c.Take(4); n != 4 {
+		t.Fatalf("Take(4) = %d, want 4", n)
+	}
+	if n := c.Take(100); n != 6 {
+		t.Fatalf("Take(100) = %d, want the remaining 6", n)
+	}
+
+	got := make(chan int, 1)
+	go func() { got <- c.Take(100) }()
+	select {
+	case n := <-got:
+		t.Fatalf("Take returned %d without credit", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Add(7)
+	select {
+	case n := <-got:
+		if n != 7 {
+			t.Fatalf("Take = %d, want 7", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take did not return after Add")
+	}
+}
+
+func TestCreditNegativeAdd(t *testing.T) {
+	c := NewCredit(10)
+	c.Add(-15)
+	c.Add(8)
+	if n := c.Take(100); n != 3 {
+		t.Fatalf("Take = %d, want 3", n)
+	}
+}
+
+func TestCreditClose(t *testing.T) {
+	c := NewCredit(0)
+	got := make(chan int, 1)
+	go func() { got <- c.Take(100) }()
+
+	c.Close()
+	select {
+	case n := <-got:
+		if n != 100 {
+			t.Fatalf("Take = %d, want 100 after Close", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take did not return after Close")
+	}
+	if n := c.Take(5); n != 5 {
+		t.Fatalf("Take(5) = %d after Close, want 5", n)
+	}
+}
+
+func TestQueueWritesInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var got []byte
+	q := NewQueue(func(msg *protocol.Message) {
+		mu.Lock()
+		got = append(got, msg.Payload...)
+		mu.Unlock()
+	})
+	for i := range 100 {
+		q.Push(&protocol.Message{Type: protocol.MsgStdin, Payload: []byte{byte(i)}})
+	}
+	q.Close()
+
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		t.Fatal("queue did not stop after Close")
+	}
+	if len(got) != 100 {
+		t.Fatalf("wrote %d messages, want 100", len(got))
+	}
+	for i, b := range got {
+		if b != byte(i) {
+			t.Fatalf("message %d = %d, out of order", i, b)
+		}
+	}
+}
+
+func TestQueuePushDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	q := NewQueue(func(msg *protocol.Message) { <-release })
+	defer close(release)
+
+	pushed := make(chan struct{})
+	go func() {
+		for range 1000 {
+			q.Push(&protocol.Message{Type: protocol.MsgStdin})
+		}
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Push blocked behind a write that does not return")
+	}
+}
+
+func TestQueueAbortDropsQueued(t *testing.T) {
+	release := make(chan struct{})
+	var written int
+	q := NewQueue(func(msg *protocol.Message) {
+		<-release
+		written++
+	})
+	for range 10 {
+		q.Push(&protocol.Message{Type: protocol.MsgStdin})
+	}
+	q.Abort()
+	q.Push(&protocol.Message{Type: protocol.MsgStdin})
+	close(release)
+
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		t.Fatal("queue did not stop after Abort")
+	}
+	// Only the write already under way when aborted
+	if written > 1 {
+		t.Fatalf("wrote %d messages after Abort, want at most 1", written)
+	}
+}
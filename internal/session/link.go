@@ -0,0 +1,561 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+const (
+	// A resumable link acknowledges received messages after ackEvery
+	// messages or ackBytes bytes, and at least every ackInterval.
+	ackEvery    = 32
+	ackBytes    = 1 << 20
+	ackInterval = time.Second
+
+	// maxPendingBytes bounds what a resumable link buffers while
+	// disconnected. Writers block beyond it until the link resumes.
+	maxPendingBytes = 32 << 20
+)
+
+// ErrLinkClosed is returned by a link that was closed with Close.
+var ErrLinkClosed = errors.New("link closed")
+
+// Link carries a session's messages over a connection that can be
+// replaced when it breaks. Each side counts the messages it receives and
+// acknowledges them with MsgAck. The sender keeps messages until they are
+// acknowledged, and when the session resumes on a new connection, sends
+// again whatever the other side did not receive.
+//
+// Until EnableResume or DisableResume is called, sent messages are kept in
+// case the other side turns out to support resuming. Without resume, a
+// link is a Writer on a single connection and closes when it breaks.
+//
+// Like a Writer, a link sends concurrent messages in priority order and
+// splits large ones into fragments. Each fragment counts as a message of
+// its own for acknowledgements and resuming.
+type Link struct {
+	// sched serializes writes to the connection, one frame at a time. mu
+	// protects the state below and is never held during I/O, so a blocked
+	// write does not stop the reader.
+	sched   *scheduler
+	mu      sync.Mutex
+	changed *sync.Cond
+
+	conn       net.Conn      // nil while disconnected
+	done       chan struct{} // closed when conn is dropped
+	gen        uint64        // incremented for every connection
+	attachedAt time.Time     // when conn was attached by Attach
+	reading    net.Conn      // connection ReadMessage is reading from
+	closed     bool
+	err        error // returned once closed
+
+	decided bool
+	resume  bool
+	grace   time.Duration
+	onDrop  func()
+	stop    chan struct{} // closed with the link, stops the ack loop
+
+	sent         uint64
+	pending      []pendingMessage // the last len(pending) messages sent, unacknowledged
+	pendingBytes int
+
+	received     uint64
+	assembler    assembler
+	ackedCount   uint64 // last count sent in a MsgAck
+	unackedBytes int
+	ackNow       chan struct{}
+
+	capture *capture.Writer // records every frame, if set
+
+	lastSend atomic.Int64
+	lastRecv atomic.Int64
+	written  atomic.Uint64
+}
+
+type pendingMessage struct {
+	msgType uint8
+	payload []byte
+}
+
+// NewLink returns a link over conn.
+func NewLink(conn net.Conn) *Link {
+	l := &Link{
+		sched:  newScheduler(),
+		conn:   conn,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		ackNow: make(chan struct{}, 1),
+	}
+	l.changed = sync.NewCond(&l.mu)
+	l.lastSend.Store(time.Now().UnixNano())
+	l.lastRecv.Store(time.Now().UnixNano())
+	return l
+}
+
+// EnableResume makes the link survive losing its connection: it waits up
+// to grace for Resume or Attach before closing. onDrop, if set, is called
+// in a new goroutine whenever the connection is lost.
+func (l *Link) EnableResume(grace time.Duration, onDrop func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decided = true
+	l.resume = true
+	l.grace = grace
+	l.onDrop = onDrop
+	go l.ackLoop()
+}
+
+// DisableResume makes the link close when its connection breaks, and
+// drops the messages kept so far.
+func (l *Link) DisableResume() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decided = true
+	l.resume = false
+	l.pending = nil
+	l.pendingBytes = 0
+	l.changed.Broadcast()
+}
+
+// Resumable reports whether EnableResume was called.
+func (l *Link) Resumable() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.resume
+}
+
+// Connected reports whether the link has a connection, which a resumable
+// link lacks while it waits for the client to resume.
+func (l *Link) Connected() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn != nil
+}
+
+// keep reports whether sent messages are kept for replay.
+func (l *Link) keep() bool {
+	return l.resume || !l.decided
+}
+
+// SetCapture records every frame sent and received from now on to w, or
+// stops recording if w is nil. Closing w is up to the caller.
+func (l *Link) SetCapture(w *capture.Writer) {
+	l.mu.Lock()
+	l.capture = w
+	l.mu.Unlock()
+}
+
+// WriteMessage sends a message. While a resumable link is disconnected,
+// the message is kept and sent once it resumes. Returns an error only if
+// the link is closed.
+func (l *Link) WriteMessage(msgType uint8, payload []byte) error {
+	l.mu.Lock()
+	for l.keep() && l.conn == nil && !l.closed && l.pendingBytes >= maxPendingBytes {
+		l.changed.Wait()
+	}
+	l.mu.Unlock()
+
+	return l.sched.send(msgType, payload, l.writeFrame)
+}
+
+// writeFrame sends one frame, holding the scheduler's turn.
+func (l *Link) writeFrame(msgType uint8, payload []byte) error {
+	l.mu.Lock()
+	if l.closed {
+		err := l.err
+		l.mu.Unlock()
+		return err
+	}
+	if l.keep() {
+		l.pending = append(l.pending, pendingMessage{msgType, bytes.Clone(payload)})
+		l.pendingBytes += 5 + len(payload)
+	}
+	l.sent++
+	c := l.conn
+	rec := l.capture
+	l.mu.Unlock()
+
+	l.lastSend.Store(time.Now().UnixNano())
+	if c == nil {
+		return nil
+	}
+	if rec != nil {
+		rec.Record(capture.Sent, msgType, payload)
+	}
+	l.written.Add(uint64(5 + len(payload)))
+	if err := protocol.WriteMessageTo(c, msgType, payload); err != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.drop(c, err)
+		if l.closed {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMessage returns the next message from the other side, waiting
+// through disconnects of a resumable link. Acknowledgements are handled
+// here and not returned. Returns an error once the link is closed.
+func (l *Link) ReadMessage() (*protocol.Message, error) {
+	for {
+		l.mu.Lock()
+		for l.conn == nil && !l.closed {
+			l.changed.Wait()
+		}
+		if l.closed {
+			err := l.err
+			l.mu.Unlock()
+			return nil, err
+		}
+		c := l.conn
+		l.reading = c
+		l.mu.Unlock()
+
+		msg, err := protocol.ReadMessageFrom(c)
+
+		l.mu.Lock()
+		l.reading = nil
+		l.changed.Broadcast()
+		if err != nil {
+			l.drop(c, err)
+			l.mu.Unlock()
+			continue
+		}
+		l.lastRecv.Store(time.Now().UnixNano())
+		if l.capture != nil {
+			l.capture.Record(capture.Received, msg.Type, msg.Payload)
+		}
+		if msg.Type == protocol.MsgAck {
+			if n, err := protocol.DecodeCount(msg.Payload); err == nil {
+				l.trim(n)
+			}
+			l.mu.Unlock()
+			continue
+		}
+		l.received++
+		l.unackedBytes += 5 + len(msg.Payload)
+		if l.resume && (l.received-l.ackedCount >= ackEvery || l.unackedBytes >= ackBytes) {
+			select {
+			case l.ackNow <- struct{}{}:
+			default:
+			}
+		}
+		msg, err = l.assembler.add(msg)
+		if err != nil {
+			l.closeLocked(err)
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.mu.Unlock()
+		if msg == nil {
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// trim forgets kept messages up to count, which the other side has
+// received. Must hold mu.
+func (l *Link) trim(count uint64) {
+	oldest := l.sent - uint64(len(l.pending))
+	if count <= oldest || count > l.sent {
+		return
+	}
+	n := int(count - oldest)
+	for _, m := range l.pending[:n] {
+		l.pendingBytes -= 5 + len(m.payload)
+	}
+	l.pending = append(l.pending[:0:0], l.pending[n:]...)
+	l.changed.Broadcast()
+}
+
+// ackLoop sends acknowledgements until the link is closed.
+func (l *Link) ackLoop() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		case <-l.ackNow:
+		}
+		l.Ack()
+	}
+}
+
+// Ack tells the other side how many messages have been received, if that
+// changed since the last acknowledgement.
+func (l *Link) Ack() {
+	l.sched.acquire(priorityControl)
+	defer l.sched.release()
+
+	l.mu.Lock()
+	c := l.conn
+	n := l.received
+	if c == nil || !l.resume || n == l.ackedCount {
+		l.mu.Unlock()
+		return
+	}
+	l.ackedCount = n
+	l.unackedBytes = 0
+	rec := l.capture
+	l.mu.Unlock()
+
+	payload := protocol.EncodeCount(n)
+	if rec != nil {
+		rec.Record(capture.Sent, protocol.MsgAck, payload)
+	}
+	if err := protocol.WriteMessageTo(c, protocol.MsgAck, payload); err != nil {
+		l.mu.Lock()
+		l.drop(c, err)
+		l.mu.Unlock()
+	}
+}
+
+// drop stops using c after err. A resumable link waits for a new
+// connection; any other link closes. Must hold mu.
+func (l *Link) drop(c net.Conn, err error) {
+	if l.conn != c || c == nil {
+		return
+	}
+	c.Close()
+	l.conn = nil
+	close(l.done)
+	l.changed.Broadcast()
+	if !l.resume {
+		l.closeLocked(err)
+		return
+	}
+
+	gen, grace := l.gen, l.grace
+	time.AfterFunc(grace, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.conn == nil && l.gen == gen {
+			l.closeLocked(fmt.Errorf("connection lost and not resumed within %v: %w", grace, err))
+		}
+	})
+	if l.onDrop != nil {
+		go l.onDrop()
+	}
+}
+
+// Drop closes the current connection, which a resumable link can then
+// replace, for example after a keepalive timeout. Reports whether there
+// was a connection to drop.
+func (l *Link) Drop(err error) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return false
+	}
+	l.drop(l.conn, err)
+	return true
+}
+
+// Received returns how many messages have been received. It waits until
+// ReadMessage is no longer reading from a dropped connection, so the count
+// is final for that connection.
+func (l *Link) Received() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.reading != nil && l.reading != l.conn {
+		l.changed.Wait()
+	}
+	return l.received
+}
+
+// Resume continues the link on conn, a new connection from the other side,
+// which has received peerReceived messages. Any current connection is
+// dropped. The other side is told how many messages this side received
+// with MsgResumeOk, then sent what it missed. The returned channel is
+// closed when conn is dropped.
+func (l *Link) Resume(conn net.Conn, peerReceived uint64) (<-chan struct{}, error) {
+	l.mu.Lock()
+	if !l.resume || l.closed {
+		l.mu.Unlock()
+		return nil, errors.New("session cannot be resumed")
+	}
+	if err := l.checkReceived(peerReceived); err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	if l.conn != nil {
+		l.drop(l.conn, errors.New("replaced by a resumed connection"))
+	}
+	for l.reading != nil {
+		l.changed.Wait()
+	}
+	received := l.received
+	rec := l.capture
+	l.mu.Unlock()
+
+	payload := protocol.EncodeCount(received)
+	if rec != nil {
+		rec.Record(capture.Sent, protocol.MsgResumeOk, payload)
+	}
+	if err := protocol.WriteMessageTo(conn, protocol.MsgResumeOk, payload); err != nil {
+		return nil, err
+	}
+	return l.Attach(conn, peerReceived)
+}
+
+// Attach continues a resumable link on conn, after the other side accepted
+// the resume and reported that it has received peerReceived messages.
+// Messages it did not receive are sent again. The returned channel is
+// closed when conn is dropped.
+func (l *Link) Attach(conn net.Conn, peerReceived uint64) (<-chan struct{}, error) {
+	l.sched.acquire(priorityControl)
+	defer l.sched.release()
+
+	l.mu.Lock()
+	if l.closed {
+		err := l.err
+		l.mu.Unlock()
+		return nil, err
+	}
+	if err := l.checkReceived(peerReceived); err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	if l.conn != nil {
+		l.drop(l.conn, errors.New("replaced by a resumed connection"))
+	}
+	l.trim(peerReceived)
+	resend := append([]pendingMessage(nil), l.pending...)
+	l.conn = conn
+	l.done = make(chan struct{})
+	l.gen++
+	l.attachedAt = time.Now()
+	done := l.done
+	rec := l.capture
+	l.lastRecv.Store(time.Now().UnixNano())
+	l.changed.Broadcast()
+	l.mu.Unlock()
+
+	for _, m := range resend {
+		if rec != nil {
+			rec.Record(capture.Sent, m.msgType, m.payload)
+		}
+		l.written.Add(uint64(5 + len(m.payload)))
+		if err := protocol.WriteMessageTo(conn, m.msgType, m.payload); err != nil {
+			l.mu.Lock()
+			l.drop(conn, err)
+			l.mu.Unlock()
+			break
+		}
+	}
+	return done, nil
+}
+
+// checkReceived returns an error if the link cannot continue for a peer
+// that received count messages. Must hold mu.
+func (l *Link) checkReceived(count uint64) error {
+	oldest := l.sent - uint64(len(l.pending))
+	if count < oldest || count > l.sent {
+		return fmt.Errorf("cannot resume from message %d, have %d to %d", count, oldest, l.sent)
+	}
+	return nil
+}
+
+// Flush waits for the other side to acknowledge every message sent. It
+// gives up once the link has been connected for timeout without that
+// happening, or the link closes. Reports whether everything was
+// acknowledged. Links without resume do not wait.
+func (l *Link) Flush(timeout time.Duration) bool {
+	start := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.resume && len(l.pending) > 0 && !l.closed {
+		if l.conn == nil {
+			// Resumed or closed by the grace period
+			l.changed.Wait()
+			continue
+		}
+		wait := time.Until(later(start, l.attachedAt).Add(timeout))
+		if wait <= 0 {
+			break
+		}
+		timer := time.AfterFunc(wait, func() {
+			l.mu.Lock()
+			l.changed.Broadcast()
+			l.mu.Unlock()
+		})
+		l.changed.Wait()
+		timer.Stop()
+	}
+	return !l.resume || len(l.pending) == 0
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Close closes the link and its connection. Pending reads and writes
+// return ErrLinkClosed.
+func (l *Link) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeLocked(ErrLinkClosed)
+}
+
+// Abort closes the link like Close, making reads and writes return err.
+func (l *Link) Abort(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeLocked(err)
+}
+
+// closeLocked closes the link. Must hold mu.
+func (l *Link) closeLocked(err error) {
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.err = err
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+		close(l.done)
+	}
+	close(l.stop)
+	l.pending = nil
+	l.pendingBytes = 0
+	l.changed.Broadcast()
+}
+
+// Closed reports whether the link is closed.
+func (l *Link) Closed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// BytesWritten returns the total number of bytes written, including
+// message headers and messages sent again after resuming.
+func (l *Link) BytesWritten() uint64 {
+	return l.written.Load()
+}
+
+func (l *Link) LastSendTime() time.Time {
+	return time.Unix(0, l.lastSend.Load())
+}
+
+// LastReceiveTime returns when a message, including an acknowledgement,
+// last arrived, or when the link last resumed.
+func (l *Link) LastReceiveTime() time.Time {
+	return time.Unix(0, l.lastRecv.Load())
+}
@@ -0,0 +1,216 @@
+package session
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection, which unlike
+// net.Pipe buffers writes.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		server.Close()
+	})
+	return server, dialed
+}
+
+func readPayload(t *testing.T, l *Link) string {
+	t.Helper()
+	msg, err := l.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	return string(msg.Payload)
+}
+
+func TestLinkWithoutResume(t *testing.T) {
+	serverConn, clientConn := tcpPair(t)
+	l := NewLink(serverConn)
+	l.DisableResume()
+
+	if err := l.WriteMessage(protocol.MsgStdout, []byte("out")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	msg, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil || string(msg.Payload) != "out" {
+		t.Fatalf("client read %v, %v", msg, err)
+	}
+
+	clientConn.Close()
+	if _, err := l.ReadMessage(); err != io.EOF {
+		t.Fatalf("ReadMessage error = %v, want io.EOF", err)
+	}
+	if !l.Closed() {
+		t.Error("link should close when its connection breaks")
+	}
+	if err := l.WriteMessage(protocol.MsgStdout, nil); err == nil {
+		t.Error("WriteMessage on a closed link should fail")
+	}
+}
+
+func TestLinkResumeReplaysUnreceived(t *testing.T) {
+	serverConn, clientConn := tcpPair(t)
+	server := NewLink(serverConn)
+	server.EnableResume(time.Minute, nil)
+	client := NewLink(clientConn)
+	client.EnableResume(time.Minute, nil)
+	defer server.Close()
+	defer client.Close()
+
+	// Each side receives the first of two messages before the connection
+	// breaks
+	client.WriteMessage(protocol.MsgStdin, []byte("a"))
+	client.WriteMessage(protocol.MsgStdin, []byte("b"))
+	server.WriteMessage(protocol.MsgStdout, []byte("x"))
+	server.WriteMessage(protocol.MsgStdout, []byte("y"))
+	if got := readPayload(t, server); got != "a" {
+		t.Fatalf("server read %q, want a", got)
+	}
+	if got := readPayload(t, client); got != "x" {
+		t.Fatalf("client read %q, want x", got)
+	}
+	server.Drop(io.ErrUnexpectedEOF)
+	client.Drop(io.ErrUnexpectedEOF)
+
+	// Sent while disconnected, so only a resume can deliver it
+	server.WriteMessage(protocol.MsgStdout, []byte("z"))
+
+	serverConn2, clientConn2 := tcpPair(t)
+	received := client.Received()
+	if received != 1 {
+		t.Fatalf("client Received = %d, want 1", received)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.Resume(serverConn2, received)
+		errCh <- err
+	}()
+	reply, err := protocol.ReadMessageFrom(clientConn2)
+	if err != nil || reply.Type != protocol.MsgResumeOk {
+		t.Fatalf("expected MsgResumeOk, got %v, %v", reply, err)
+	}
+	serverReceived, _ := protocol.DecodeCount(reply.Payload)
+	if serverReceived != 1 {
+		t.Fatalf("server received = %d, want 1", serverReceived)
+	}
+	if _, err := client.Attach(clientConn2, serverReceived); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	if got := readPayload(t, server); got != "b" {
+		t.Errorf("server read %q after resume, want b", got)
+	}
+	if got := readPayload(t, client); got != "y" {
+		t.Errorf("client read %q after resume, want y", got)
+	}
+	if got := readPayload(t, client); got != "z" {
+		t.Errorf("client read %q after resume, want z", got)
+	}
+}
+
+func TestLinkResumeRejectsUnknownCount(t *testing.T) {
+	serverConn, _ := tcpPair(t)
+	l := NewLink(serverConn)
+	l.EnableResume(time.Minute, nil)
+	defer l.Close()
+	l.WriteMessage(protocol.MsgStdout, []byte("x"))
+
+	serverConn2, _ := tcpPair(t)
+	if _, err := l.Resume(serverConn2, 5); err == nil || !strings.Contains(err.Error(), "cannot resume") {
+		t.Errorf("Resume with a count beyond what was sent: err = %v", err)
+	}
+}
+
+func TestLinkClosesAfterGracePeriod(t *testing.T) {
+	serverConn, clientConn := tcpPair(t)
+	dropped := make(chan struct{}, 1)
+	l := NewLink(serverConn)
+	l.EnableResume(50*time.Millisecond, func() { dropped <- struct{}{} })
+
+	clientConn.Close()
+	_, err := l.ReadMessage()
+	if err == nil || !strings.Contains(err.Error(), "not resumed within") {
+		t.Fatalf("ReadMessage error = %v, want grace period expiry", err)
+	}
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Error("onDrop was not called")
+	}
+}
+
+func TestLinkFlushWaitsForAck(t *testing.T) {
+	serverConn, clientConn := tcpPair(t)
+	server := NewLink(serverConn)
+	server.EnableResume(time.Minute, nil)
+	client := NewLink(clientConn)
+	client.EnableResume(time.Minute, nil)
+	defer server.Close()
+	defer client.Close()
+
+	server.WriteMessage(protocol.MsgExitCode, []byte{0, 0, 0, 0})
+	if server.Flush(10 * time.Millisecond) {
+		t.Fatal("Flush succeeded before the client received anything")
+	}
+
+	// The server reads acknowledgements as part of reading messages
+	go server.ReadMessage()
+	readPayload(t, client)
+	client.Ack()
+	if !server.Flush(time.Second) {
+		t.Error("Flush did not see the acknowledgement")
+	}
+}
+
+func TestLinkReassemblesFragments(t *testing.T) {
+	serverConn, clientConn := tcpPair(t)
+	server := NewLink(serverConn)
+	server.DisableResume()
+	client := NewLink(clientConn)
+	client.DisableResume()
+	defer server.Close()
+	defer client.Close()
+
+	payload := []byte(strings.Repeat("0123456789", 3*maxChunk/10+1))
+	go server.WriteMessage(protocol.MsgReadOk, payload)
+
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if msg.Type != protocol.MsgReadOk || string(msg.Payload) != string(payload) {
+		t.Fatalf("got 0x%02x with %d bytes, want MsgReadOk with %d", msg.Type, len(msg.Payload), len(payload))
+	}
+	// Each fragment counts as a message for resuming
+	if got := client.Received(); got != 4 {
+		t.Errorf("Received = %d, want 4", got)
+	}
+}
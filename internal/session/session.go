@@ -1,92 +1,271 @@
 package session
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
 )
 
 const (
 	keepaliveSendInterval = 30 * time.Second
 	keepaliveRecvTimeout  = 150 * time.Second
+
+	// exitAckTimeout is how long a resumable session waits while connected
+	// for the client to acknowledge the exit code.
+	exitAckTimeout = 5 * time.Second
 )
 
 // Session manages one client connection: multiplexes between the TCP
 // connection, the child process pipes, and the fio loopback connection.
 type Session struct {
-	conn net.Conn
-	proc *process.Process
-	w    *Writer
+	link *Link
+
+	bytesIn atomic.Uint64
+	// lastActivity is the last time the job produced output or file I/O,
+	// or was held up by the client
+	lastActivity atomic.Int64
+
+	timeouts   Timeouts
+	exitReason atomic.Pointer[protocol.ExitReasonMessage]
+
+	// cur is the running attempt, protected by mu. It only changes when a
+	// failed job is rerun with its fallback.
+	mu          sync.Mutex
+	cur         *attempt
+	stdinClosed bool
+	failure     error // why the client was cut off, returned by Run
+
+	fallback *Fallback
+	fio      *fioTracker // only tracked when a fallback is set
+
+	// Each stdio channel and file I/O flows on its own, so a process that
+	// does not read its stdin or a client that does not keep up with
+	// output holds up only that channel. Output is sent as the client
+	// returns credit; stdin and file I/O responses are queued for
+	// goroutines that write them to the process.
+	stdoutCredit *Credit
+	stderrCredit *Credit
+	stdin        *Queue
+	fioResponses *Queue
+	// stdinInFlight is the stdin received but not yet written to the
+	// process, which the client's credit keeps within StdioWindow
+	stdinInFlight atomic.Int64
+
+	// committed is set once the job has had an effect that a rerun cannot
+	// undo: output sent to the client, input consumed, or a file modified.
+	committed atomic.Bool
+	// stopped is set when the job is cancelled or terminated.
+	stopped atomic.Bool
+	// ended is set once the exit code has been sent.
+	ended atomic.Bool
+
+	// resumeMu serializes resumes, and protects resumeAttempt, the highest
+	// attempt number seen
+	resumeMu      sync.Mutex
+	resumeAttempt uint32
+
+	// captureMu protects the capture being recorded, and where it goes
+	captureMu   sync.Mutex
+	capture     *capture.Writer
+	capturePath string
+}
+
+// Process is the program a session runs. *process.Process implements it;
+// Terminate follows its SIGTERM→SIGKILL escalation.
+type Process interface {
+	Stdin() io.WriteCloser
+	Stdout() io.ReadCloser
+	Stderr() io.ReadCloser
+	// Progress returns the program's -progress reports, or nil if it does
+	// not send them.
+	Progress() io.ReadCloser
+	// Loopback blocks until the program's fio layer connects or the
+	// program exits, and returns the connection, or nil if it exited.
+	Loopback() net.Conn
+	// Wait blocks until the program exits and returns its exit code.
+	Wait() (int, error)
+	PID() int
+	Terminate()
+}
 
-	lastRecv atomic.Int64
+// attempt is one run of the child process.
+type attempt struct {
+	proc       Process
+	stderrTail *tailBuffer // only kept when a fallback is set
 
 	// loopback is set when fio connects, protected by loopbackMu
-	loopbackMu   sync.Mutex
-	loopback     net.Conn
+	loopbackMu    sync.Mutex
+	loopback      net.Conn
 	loopbackReady chan struct{}
+	// forwardDone is closed once no more fio requests will be forwarded
+	forwardDone chan struct{}
 }
 
-func NewSession(conn net.Conn, proc *process.Process) *Session {
-	s := &Session{
-		conn:          conn,
+func newAttempt(proc Process) *attempt {
+	return &attempt{
 		proc:          proc,
-		w:             NewWriter(conn),
 		loopbackReady: make(chan struct{}),
+		forwardDone:   make(chan struct{}),
+	}
+}
+
+func NewSession(conn net.Conn, proc Process) *Session {
+	s := &Session{
+		link:         NewLink(conn),
+		cur:          newAttempt(proc),
+		stdoutCredit: NewCredit(protocol.StdioWindow),
+		stderrCredit: NewCredit(protocol.StdioWindow),
 	}
-	s.lastRecv.Store(time.Now().UnixNano())
+	s.link.DisableResume()
+	s.lastActivity.Store(time.Now().UnixNano())
 	return s
 }
 
+// Timeouts bound how long a job may run. Zero disables a timeout.
+type Timeouts struct {
+	// MaxRuntime is the wall-clock limit for the whole job.
+	MaxRuntime time.Duration
+	// StallTimeout is how long the job may go without stdout or stderr
+	// output and without file I/O.
+	StallTimeout time.Duration
+}
+
+// SetTimeouts enables terminating the job when it exceeds t. The client is
+// told why before it receives the exit code. Must be called before Run.
+func (s *Session) SetTimeouts(t Timeouts) {
+	s.timeouts = t
+}
+
+// SetFallback enables rerunning the job once with f when the process exits
+// non-zero, its stderr matches one of f.Patterns, and nothing the client
+// can observe has happened yet. The client sees a single job. Must be
+// called before Run.
+func (s *Session) SetFallback(f *Fallback) {
+	s.fallback = f
+	s.fio = newFioTracker()
+}
+
+// EnableResume lets the client continue the session on a new connection
+// with Resume if the current one breaks. The job keeps running, and its
+// output and file requests are held, for up to grace while disconnected.
+// Must be called before Run.
+func (s *Session) EnableResume(grace time.Duration) {
+	s.link.EnableResume(grace, nil)
+}
+
+// Resume continues the session on conn, a new connection from a client
+// that has received received messages. attempt must be higher than that
+// of any earlier resume of the session. The returned channel is closed
+// when conn is no longer used.
+func (s *Session) Resume(conn net.Conn, attempt uint32, received uint64) (<-chan struct{}, error) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	if attempt <= s.resumeAttempt {
+		return nil, fmt.Errorf("stale resume attempt %d", attempt)
+	}
+	s.resumeAttempt = attempt
+	return s.link.Resume(conn, received)
+}
+
+// PID returns the process ID of the currently running attempt.
+func (s *Session) PID() int {
+	return s.current().proc.PID()
+}
+
+// Terminate stops the job with the SIGTERM→SIGKILL escalation of
+// Process.Terminate. A terminated job is never rerun.
+func (s *Session) Terminate() {
+	s.mu.Lock()
+	s.stopped.Store(true)
+	proc := s.cur.proc
+	s.mu.Unlock()
+	proc.Terminate()
+}
+
+func (s *Session) current() *attempt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// Stats is a snapshot of a session's wire traffic counters.
+type Stats struct {
+	BytesIn  uint64 // bytes received from the client, including headers
+	BytesOut uint64 // bytes sent to the client, including headers
+}
+
+// Stats returns the current traffic counters. Safe to call concurrently
+// with Run.
+func (s *Session) Stats() Stats {
+	return Stats{
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.link.BytesWritten(),
+	}
+}
+
+// SetCapture records the session's messages to w from now on, and closes
+// the capture recorded so far, if any, returning its error. path is where
+// w writes, for CapturePath. A nil w stops recording. The capture is
+// closed when Run returns.
+func (s *Session) SetCapture(w *capture.Writer, path string) error {
+	s.captureMu.Lock()
+	old := s.capture
+	s.capture = w
+	s.capturePath = path
+	s.link.SetCapture(w)
+	s.captureMu.Unlock()
+	if old == nil || old == w {
+		return nil
+	}
+	return old.Close()
+}
+
+// CapturePath returns where the session's messages are being recorded, or
+// "" if they are not.
+func (s *Session) CapturePath() string {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	return s.capturePath
+}
+
 // Run blocks until the child process exits. Returns the exit code.
 func (s *Session) Run(ctx context.Context) (int, error) {
+	defer func() {
+		if err := s.SetCapture(nil, ""); err != nil {
+			log.Printf("failed to write capture: %v", err)
+		}
+	}()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// pipeWg tracks stdout/stderr goroutines — they must finish draining
-	// before we send the exit code or close the connection.
-	var pipeWg sync.WaitGroup
 	// otherWg tracks loopback, dispatch, keepalive goroutines — these
 	// depend on the connection and are cleaned up with a timeout.
 	var otherWg sync.WaitGroup
 
-	// Pipe stdout → TCP
-	pipeWg.Add(1)
-	go func() {
-		defer pipeWg.Done()
-		s.pipeOutput(s.proc.Stdout(), protocol.MsgStdout)
-	}()
-
-	// Pipe stderr → TCP
-	pipeWg.Add(1)
-	go func() {
-		defer pipeWg.Done()
-		s.pipeOutput(s.proc.Stderr(), protocol.MsgStderr)
-	}()
-
-	// Wait for loopback in background, start forwarding when ready
-	otherWg.Add(1)
-	go func() {
-		defer otherWg.Done()
-		conn := s.proc.Loopback()
-		if conn == nil {
-			return
+	s.stdin = NewQueue(s.writeStdin)
+	defer s.stdin.Abort()
+	s.fioResponses = NewQueue(func(msg *protocol.Message) {
+		// Wait for loopback to be ready before forwarding
+		a := s.current()
+		select {
+		case <-a.loopbackReady:
+			protocol.WriteMessageTo(a.loopback, msg.Type, msg.Payload)
+		case <-ctx.Done():
 		}
-		s.loopbackMu.Lock()
-		s.loopback = conn
-		s.loopbackMu.Unlock()
-		close(s.loopbackReady)
-
-		// Forward fio requests from loopback → TCP
-		s.forwardLoopbackToTCP(ctx, conn)
-	}()
+	})
+	defer s.fioResponses.Abort()
 
 	// TCP → dispatch: runs immediately (handles stdin, cancel, ping, and
 	// fio responses once loopback is ready)
@@ -103,28 +282,41 @@ func (s *Session) Run(ctx context.Context) (int, error) {
 		s.keepalive(ctx, cancel)
 	}()
 
-	// Wait for child to exit
-	exitCode, _ := s.proc.Wait()
+	// Watchdog for maxRuntime and stalls, stopped once the job is over
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	otherWg.Add(1)
+	go func() {
+		defer otherWg.Done()
+		s.watchdog(watchCtx)
+	}()
 
-	// Close loopback to flush forwarder
-	s.loopbackMu.Lock()
-	if s.loopback != nil {
-		s.loopback.Close()
+	a := s.current()
+	exitCode := s.runAttempt(ctx, a, &otherWg)
+	if s.shouldFallBack(ctx, a, exitCode) {
+		if next := s.startFallback(a); next != nil {
+			exitCode = s.runAttempt(ctx, next, &otherWg)
+		}
 	}
-	s.loopbackMu.Unlock()
+	stopWatch()
 
-	// Wait for stdout/stderr to finish draining before sending exit code.
-	// pipeOutput reads from os.Pipe fds we own, so it will get EOF once
-	// the child exits and the OS pipe buffer is drained — no timeout needed.
-	pipeWg.Wait()
+	if reason := s.exitReason.Load(); reason != nil {
+		s.link.WriteMessage(protocol.MsgExitReason, reason.Encode())
+	}
 
 	// Send exit code after all output has been sent
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(exitCode))
-	s.w.WriteMessage(protocol.MsgExitCode, payload)
+	s.link.WriteMessage(protocol.MsgExitCode, payload)
+	s.ended.Store(true)
 
-	// Close conn to unblock TCP reader goroutine
-	s.conn.Close()
+	// A resumable session waits until the client has everything, so a
+	// connection lost at the very end can still be resumed
+	if s.link.Resumable() && !s.link.Flush(exitAckTimeout) {
+		log.Printf("session: client did not acknowledge the exit code")
+	}
+
+	// Close the link to unblock the TCP reader goroutine
+	s.link.Close()
 
 	// Give remaining goroutines time to drain
 	done := make(chan struct{})
@@ -137,15 +329,156 @@ func (s *Session) Run(ctx context.Context) (int, error) {
 	case <-time.After(2 * time.Second):
 	}
 
-	return exitCode, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return exitCode, s.failure
+}
+
+// runAttempt relays a's pipes and loopback until its process exits and
+// all of its output has been sent. Returns the exit code.
+func (s *Session) runAttempt(ctx context.Context, a *attempt, otherWg *sync.WaitGroup) int {
+	// pipeWg tracks stdout/stderr goroutines — they must finish draining
+	// before we send the exit code or close the connection.
+	var pipeWg sync.WaitGroup
+
+	// Pipe stdout → TCP
+	pipeWg.Add(1)
+	go func() {
+		defer pipeWg.Done()
+		s.pipeOutput(a.proc.Stdout(), protocol.MsgStdout)
+	}()
+
+	// Pipe stderr → TCP, keeping the tail for fallback patterns
+	var stderr io.Reader = a.proc.Stderr()
+	if s.fallback != nil {
+		a.stderrTail = newTailBuffer(stderrTailSize)
+		stderr = io.TeeReader(stderr, a.stderrTail)
+	}
+	pipeWg.Add(1)
+	go func() {
+		defer pipeWg.Done()
+		s.pipeOutput(stderr, protocol.MsgStderr)
+	}()
+
+	// Pipe -progress reports → TCP
+	if progress := a.proc.Progress(); progress != nil {
+		pipeWg.Add(1)
+		go func() {
+			defer pipeWg.Done()
+			s.pipeProgress(progress)
+		}()
+	}
+
+	// Wait for loopback in background, start forwarding when ready
+	otherWg.Add(1)
+	go func() {
+		defer otherWg.Done()
+		defer close(a.forwardDone)
+		conn := a.proc.Loopback()
+		if conn == nil {
+			return
+		}
+		a.loopbackMu.Lock()
+		a.loopback = conn
+		a.loopbackMu.Unlock()
+		close(a.loopbackReady)
+
+		// Forward fio requests from loopback → TCP
+		s.forwardLoopbackToTCP(ctx, conn)
+	}()
+
+	// Wait for child to exit
+	exitCode, _ := a.proc.Wait()
+
+	// Close loopback to flush forwarder
+	a.loopbackMu.Lock()
+	if a.loopback != nil {
+		a.loopback.Close()
+	}
+	a.loopbackMu.Unlock()
+
+	// Wait for stdout/stderr to finish draining before sending exit code.
+	// pipeOutput reads from os.Pipe fds we own, so it will get EOF once
+	// the child exits and the OS pipe buffer is drained — no timeout needed.
+	pipeWg.Wait()
+
+	return exitCode
+}
+
+// shouldFallBack reports whether the failed attempt a should be rerun with
+// the fallback.
+func (s *Session) shouldFallBack(ctx context.Context, a *attempt, exitCode int) bool {
+	if s.fallback == nil || exitCode == 0 || ctx.Err() != nil {
+		return false
+	}
+	if s.stopped.Load() || s.committed.Load() {
+		return false
+	}
+	return s.fallback.matches(a.stderrTail.Bytes())
+}
+
+// startFallback settles the failed attempt's file requests with the client
+// and starts the fallback process. Returns nil if the job cannot be rerun.
+func (s *Session) startFallback(failed *attempt) *attempt {
+	// Let the client answer everything the failed run asked for, then close
+	// the files it left open so their IDs are free for the new process.
+	<-failed.forwardDone
+	if !s.fio.waitIdle(fallbackCleanupTimeout) {
+		log.Printf("session: not falling back, client did not answer pending file requests")
+		return nil
+	}
+	for i, fileID := range s.fio.openFiles() {
+		payload := (&protocol.CloseRequest{RequestID: uint16(i + 1), FileID: fileID}).Encode()
+		s.fio.request(protocol.MsgClose, payload, true)
+		s.link.WriteMessage(protocol.MsgClose, payload)
+	}
+	if !s.fio.waitIdle(fallbackCleanupTimeout) {
+		log.Printf("session: not falling back, client did not close files")
+		return nil
+	}
+
+	// Holding mu orders the checks against stdin arriving and Terminate:
+	// anything after this point goes to the new process.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped.Load() || s.committed.Load() {
+		return nil
+	}
+	proc, err := s.fallback.Start()
+	if err != nil {
+		log.Printf("session: failed to start fallback: %v", err)
+		return nil
+	}
+	if s.stdinClosed {
+		proc.Stdin().Close()
+	}
+	notice := []byte("ffmpeg-over-ip: job failed, retrying with fallback settings\n")
+	s.stderrCredit.Add(-len(notice))
+	s.link.WriteMessage(protocol.MsgStderr, notice)
+
+	s.cur = newAttempt(proc)
+	s.lastActivity.Store(time.Now().UnixNano())
+	return s.cur
 }
 
 func (s *Session) pipeOutput(r io.Reader, msgType uint8) {
+	credit := s.stdoutCredit
+	if msgType == protocol.MsgStderr {
+		credit = s.stderrCredit
+	}
 	buf := make([]byte, 32*1024)
 	for {
-		n, err := r.Read(buf)
+		// Reading no more than the client can take holds the process back
+		// when the client does not keep up
+		limit := credit.Take(len(buf))
+		n, err := r.Read(buf[:limit])
+		credit.Add(limit - n)
 		if n > 0 {
-			s.w.WriteMessage(msgType, buf[:n])
+			s.lastActivity.Store(time.Now().UnixNano())
+			if msgType == protocol.MsgStdout {
+				s.committed.Store(true)
+			}
+			s.link.WriteMessage(msgType, buf[:n])
 		}
 		if err != nil {
 			return
@@ -153,6 +486,28 @@ func (s *Session) pipeOutput(r io.Reader, msgType uint8) {
 	}
 }
 
+// pipeProgress sends each block of ffmpeg's -progress reports read from r
+// as a MsgProgress.
+func (s *Session) pipeProgress(r io.ReadCloser) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	var msg protocol.ProgressMessage
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		msg.Fields = append(msg.Fields, protocol.ProgressField{Key: key, Value: value})
+		// Every block ends with progress=continue or progress=end
+		if key == "progress" {
+			s.link.WriteMessage(protocol.MsgProgress, msg.Encode())
+			msg.Fields = nil
+		}
+	}
+	// Keep ffmpeg from blocking on a report too long to scan
+	io.Copy(io.Discard, r)
+}
+
 func (s *Session) forwardLoopbackToTCP(ctx context.Context, loopback net.Conn) {
 	for {
 		if ctx.Err() != nil {
@@ -162,47 +517,100 @@ func (s *Session) forwardLoopbackToTCP(ctx context.Context, loopback net.Conn) {
 		if err != nil {
 			return
 		}
-		if protocol.IsFileIORequest(msg.Type) {
-			s.w.WriteMessage(msg.Type, msg.Payload)
+		if !protocol.IsFileIORequest(msg.Type) {
+			continue
+		}
+		s.lastActivity.Store(time.Now().UnixNano())
+		switch msg.Type {
+		case protocol.MsgWrite, protocol.MsgFtruncate, protocol.MsgUnlink, protocol.MsgRename, protocol.MsgMkdir:
+			s.committed.Store(true)
 		}
+		if s.fio != nil {
+			s.fio.request(msg.Type, msg.Payload, false)
+		}
+		s.link.WriteMessage(msg.Type, msg.Payload)
 	}
 }
 
 func (s *Session) dispatchTCPMessages(ctx context.Context, cancel context.CancelFunc) {
+	// Output no longer waits for credit once the client cannot return it
+	defer s.stdoutCredit.Close()
+	defer s.stderrCredit.Close()
+
 	for {
 		if ctx.Err() != nil {
 			return
 		}
-		msg, err := protocol.ReadMessageFrom(s.conn)
+		msg, err := s.link.ReadMessage()
 		if err != nil {
+			// A resumable session only fails once its grace period is over
+			if s.link.Resumable() && !s.ended.Load() {
+				log.Printf("session: %v", err)
+				s.Terminate()
+			}
 			return
 		}
 
-		s.lastRecv.Store(time.Now().UnixNano())
+		s.bytesIn.Add(uint64(5 + len(msg.Payload)))
 
 		switch {
 		case protocol.IsFileIOResponse(msg.Type):
-			// Wait for loopback to be ready before forwarding
-			select {
-			case <-s.loopbackReady:
-				protocol.WriteMessageTo(s.loopback, msg.Type, msg.Payload)
-			case <-ctx.Done():
-				return
+			s.lastActivity.Store(time.Now().UnixNano())
+			if s.fio != nil && !s.fio.response(msg.Type, msg.Payload) {
+				// Answers a request fio is no longer waiting for
+				break
 			}
+			s.fioResponses.Push(msg)
 		case msg.Type == protocol.MsgStdin:
-			s.proc.Stdin().Write(msg.Payload)
+			// Input cannot be replayed, so the job can no longer be rerun
+			s.committed.Store(true)
+			if n := s.stdinInFlight.Add(int64(len(msg.Payload))); n > protocol.StdioWindow {
+				s.fail(fmt.Errorf("client sent %d bytes of stdin, more than its credit of %d", n, protocol.StdioWindow))
+				cancel()
+				return
+			}
+			s.stdin.Push(msg)
 		case msg.Type == protocol.MsgStdinClose:
-			s.proc.Stdin().Close()
+			s.stdin.Push(msg)
+		case msg.Type == protocol.MsgCredit:
+			credit, err := protocol.DecodeCreditMessage(msg.Payload)
+			if err != nil {
+				break
+			}
+			switch credit.Channel {
+			case protocol.MsgStdout:
+				s.stdoutCredit.Add(int(credit.Bytes))
+			case protocol.MsgStderr:
+				s.stderrCredit.Add(int(credit.Bytes))
+			}
 		case msg.Type == protocol.MsgCancel:
-			go s.proc.Terminate()
+			go s.Terminate()
 		case msg.Type == protocol.MsgPing:
-			s.w.WriteMessage(protocol.MsgPong, msg.Payload)
+			s.link.WriteMessage(protocol.MsgPong, msg.Payload)
 		default:
 			log.Printf("session: unknown message type 0x%02x from client, dropping", msg.Type)
 		}
 	}
 }
 
+// writeStdin writes a MsgStdin or MsgStdinClose from the client to the
+// running process, returning the credit once the process has taken the
+// input.
+func (s *Session) writeStdin(msg *protocol.Message) {
+	if msg.Type == protocol.MsgStdinClose {
+		s.mu.Lock()
+		s.stdinClosed = true
+		proc := s.cur.proc
+		s.mu.Unlock()
+		proc.Stdin().Close()
+		return
+	}
+	s.current().proc.Stdin().Write(msg.Payload)
+	s.stdinInFlight.Add(-int64(len(msg.Payload)))
+	credit := &protocol.CreditMessage{Channel: protocol.MsgStdin, Bytes: uint32(len(msg.Payload))}
+	s.link.WriteMessage(protocol.MsgCredit, credit.Encode())
+}
+
 func (s *Session) keepalive(ctx context.Context, cancel context.CancelFunc) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -212,16 +620,84 @@ func (s *Session) keepalive(ctx context.Context, cancel context.CancelFunc) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if time.Since(s.w.LastSendTime()) >= keepaliveSendInterval {
-				s.w.WriteMessage(protocol.MsgPing, nil)
+			if time.Since(s.link.LastSendTime()) >= keepaliveSendInterval {
+				s.link.WriteMessage(protocol.MsgPing, nil)
+			}
+			if time.Since(s.link.LastReceiveTime()) < keepaliveRecvTimeout {
+				continue
 			}
-			lastRecv := time.Unix(0, s.lastRecv.Load())
-			if time.Since(lastRecv) >= keepaliveRecvTimeout {
+			if s.link.Resumable() {
+				// Wait for the client to resume on a new connection
+				if s.link.Drop(errors.New("client keepalive timeout")) {
+					log.Printf("session: client keepalive timeout, waiting for it to resume")
+				}
+			} else {
 				log.Printf("session: client keepalive timeout")
-				s.proc.Terminate()
+				s.Terminate()
 				cancel()
 				return
 			}
 		}
 	}
 }
+
+// watchdog terminates the job when it exceeds its timeouts.
+func (s *Session) watchdog(ctx context.Context) {
+	var deadline <-chan time.Time
+	if s.timeouts.MaxRuntime > 0 {
+		timer := time.NewTimer(s.timeouts.MaxRuntime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var check <-chan time.Time
+	if s.timeouts.StallTimeout > 0 {
+		// Check often enough to stop within about a quarter of the timeout
+		interval := min(s.timeouts.StallTimeout/4, 5*time.Second)
+		ticker := time.NewTicker(max(interval, time.Millisecond))
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	if deadline == nil && check == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			s.stop(protocol.ExitReasonTimeout, fmt.Sprintf("job exceeded the maximum runtime of %v", s.timeouts.MaxRuntime))
+			return
+		case <-check:
+			// A job waiting for the client to take its output or to resume
+			// is not stalled
+			if s.stdoutCredit.Waiting() || s.stderrCredit.Waiting() || !s.link.Connected() {
+				s.lastActivity.Store(time.Now().UnixNano())
+				continue
+			}
+			lastActivity := time.Unix(0, s.lastActivity.Load())
+			if time.Since(lastActivity) >= s.timeouts.StallTimeout {
+				s.stop(protocol.ExitReasonStalled, fmt.Sprintf("job stalled, no output or file activity for %v", s.timeouts.StallTimeout))
+				return
+			}
+		}
+	}
+}
+
+// fail ends a session whose client broke the protocol: the job is
+// terminated and the connection closed, and Run returns err.
+func (s *Session) fail(err error) {
+	log.Printf("session: %v", err)
+	s.mu.Lock()
+	s.failure = err
+	s.mu.Unlock()
+	s.link.Abort(err)
+	s.Terminate()
+}
+
+// stop terminates the job and records why, to be sent to the client.
+func (s *Session) stop(reason uint8, message string) {
+	log.Printf("session: %s", message)
+	s.exitReason.Store(&protocol.ExitReasonMessage{Reason: reason, Message: message})
+	s.Terminate()
+}
@@ -3,14 +3,21 @@ package session
 import (
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"io"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
 	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
 )
@@ -173,6 +180,36 @@ func TestSessionCancel(t *testing.T) {
 	}
 }
 
+func TestSessionCancelWrapperScript(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		t.Skip("signal tests only on unix")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// A wrapper whose child would keep the output pipes open if it survived
+	proc := process.NewProcess("sh", []string{"-c", "sleep 3600 & wait"})
+	proc.Start(context.Background())
+
+	done := make(chan int, 1)
+	go func() {
+		sess := NewSession(serverConn, proc)
+		code, _ := sess.Run(context.Background())
+		done <- code
+	}()
+
+	go readMessages(clientConn)
+	time.Sleep(100 * time.Millisecond)
+	protocol.WriteMessageTo(clientConn, protocol.MsgCancel, nil)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not finish after cancel; wrapper's child survived")
+	}
+}
+
 func TestSessionPingPong(t *testing.T) {
 	clientConn, serverConn := net.Pipe()
 	defer clientConn.Close()
@@ -1034,3 +1071,795 @@ s.close()
 		t.Fatalf("exit code = %d, want 0 (stderr=%q)", exitCode, string(stderr))
 	}
 }
+
+// collectOutput splits messages into stdout, stderr, and the exit code.
+func collectOutput(msgs []*protocol.Message) (stdout, stderr string, exitCode int) {
+	exitCode = -1
+	for _, m := range msgs {
+		switch m.Type {
+		case protocol.MsgStdout:
+			stdout += string(m.Payload)
+		case protocol.MsgStderr:
+			stderr += string(m.Payload)
+		case protocol.MsgExitCode:
+			exitCode = int(binary.BigEndian.Uint32(m.Payload))
+		}
+	}
+	return stdout, stderr, exitCode
+}
+
+// runWithFallback runs script under sh with a fallback that runs
+// fallbackScript, and returns the client's view of the job along with
+// whether the fallback was started.
+func runWithFallback(t *testing.T, script, fallbackScript string) (stdout, stderr string, exitCode int, fellBack bool) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	proc := process.NewProcess("sh", []string{"-c", script})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{}, 1)
+	done := make(chan int, 1)
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.SetFallback(&Fallback{
+			Patterns: []*regexp.Regexp{regexp.MustCompile(`No NVENC capable devices`)},
+			Start: func() (Process, error) {
+				started <- struct{}{}
+				p := process.NewProcess("sh", []string{"-c", fallbackScript})
+				return p, p.Start(context.Background())
+			},
+		})
+		code, _ := sess.Run(context.Background())
+		serverConn.Close()
+		done <- code
+	}()
+
+	stdout, stderr, exitCode = collectOutput(readMessages(clientConn))
+	if code := <-done; code != exitCode {
+		t.Errorf("Run returned %d, client saw %d", code, exitCode)
+	}
+	select {
+	case <-started:
+		fellBack = true
+	default:
+	}
+	return stdout, stderr, exitCode, fellBack
+}
+
+func TestSessionFallbackOnMatchingFailure(t *testing.T) {
+	stdout, stderr, exitCode, fellBack := runWithFallback(t,
+		`echo "[h264_nvenc] No NVENC capable devices found" >&2; exit 1`,
+		`echo encoded`)
+
+	if !fellBack {
+		t.Fatal("fallback was not started")
+	}
+	if exitCode != 0 {
+		t.Errorf("exit code = %d, want 0 from the fallback", exitCode)
+	}
+	if stdout != "encoded\n" {
+		t.Errorf("stdout = %q, want %q", stdout, "encoded\n")
+	}
+	if !strings.Contains(stderr, "retrying with fallback") {
+		t.Errorf("stderr = %q, want retry notice", stderr)
+	}
+}
+
+func TestSessionFallbackPatternMismatch(t *testing.T) {
+	_, _, exitCode, fellBack := runWithFallback(t,
+		`echo "Invalid argument" >&2; exit 1`,
+		`echo encoded`)
+
+	if fellBack {
+		t.Fatal("fallback started for a non-matching error")
+	}
+	if exitCode != 1 {
+		t.Errorf("exit code = %d, want 1", exitCode)
+	}
+}
+
+func TestSessionFallbackNotAfterStdout(t *testing.T) {
+	stdout, _, exitCode, fellBack := runWithFallback(t,
+		`echo partial; echo "No NVENC capable devices found" >&2; exit 1`,
+		`echo encoded`)
+
+	if fellBack {
+		t.Fatal("fallback started after output was sent to the client")
+	}
+	if exitCode != 1 || stdout != "partial\n" {
+		t.Errorf("exit code = %d, stdout = %q; want 1, %q", exitCode, stdout, "partial\n")
+	}
+}
+
+func TestSessionFallbackNotOnSuccess(t *testing.T) {
+	_, _, exitCode, fellBack := runWithFallback(t,
+		`echo "No NVENC capable devices found" >&2; exit 0`,
+		`echo encoded`)
+
+	if fellBack || exitCode != 0 {
+		t.Fatalf("fellBack = %v, exit code = %d; want no fallback and 0", fellBack, exitCode)
+	}
+}
+
+func TestSessionFallbackOnlyOnce(t *testing.T) {
+	_, stderr, exitCode, _ := runWithFallback(t,
+		`echo "No NVENC capable devices found" >&2; exit 1`,
+		`echo "No NVENC capable devices found" >&2; exit 3`)
+
+	if exitCode != 3 {
+		t.Errorf("exit code = %d, want 3 from the fallback", exitCode)
+	}
+	if n := strings.Count(stderr, "retrying with fallback"); n != 1 {
+		t.Errorf("retried %d times, want 1", n)
+	}
+}
+
+func TestSessionFallbackClosesOpenFiles(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// Opens file ID 1 over fio, then fails the way NVENC does
+	pyScript := `
+import socket, struct, os, sys
+s = socket.create_connection(('127.0.0.1', int(os.environ['FFOIP_PORT'])))
+payload = struct.pack('>HHIH', 1, 1, 0, 0) + b'/in.mkv'
+s.sendall(struct.pack('>BI', 0x20, len(payload)) + payload)
+hdr = b''
+while len(hdr) < 5:
+    hdr += s.recv(5 - len(hdr))
+sys.stderr.write('No NVENC capable devices found\n')
+sys.exit(1)
+`
+	proc := process.NewProcess("python3", []string{"-c", pyScript})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.SetFallback(&Fallback{
+			Patterns: []*regexp.Regexp{regexp.MustCompile(`No NVENC`)},
+			Start: func() (Process, error) {
+				p := process.NewProcess("echo", []string{"encoded"})
+				return p, p.Start(context.Background())
+			},
+		})
+		code, _ := sess.Run(context.Background())
+		serverConn.Close()
+		done <- code
+	}()
+
+	msg, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil || msg.Type != protocol.MsgOpen {
+		t.Fatalf("expected MsgOpen, got %v (err %v)", msg, err)
+	}
+	openOk := (&protocol.OpenOkResponse{RequestID: 1, FileSize: 42}).Encode()
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgOpenOk, openOk); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session must release file ID 1 before starting the fallback
+	var closed bool
+	var rest []*protocol.Message
+	for {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			break
+		}
+		if msg.Type != protocol.MsgClose {
+			rest = append(rest, msg)
+			continue
+		}
+		req, err := protocol.DecodeCloseRequest(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.FileID != 1 {
+			t.Errorf("closed file ID %d, want 1", req.FileID)
+		}
+		closed = true
+		closeOk := (&protocol.RequestIDResponse{RequestID: req.RequestID}).Encode()
+		protocol.WriteMessageTo(clientConn, protocol.MsgCloseOk, closeOk)
+	}
+	exitCode := <-done
+
+	if !closed {
+		t.Fatal("session did not close the failed run's open file")
+	}
+	stdout, _, _ := collectOutput(rest)
+	if exitCode != 0 || stdout != "encoded\n" {
+		t.Errorf("exit code = %d, stdout = %q; want 0, %q", exitCode, stdout, "encoded\n")
+	}
+}
+
+func TestSessionFallbackNotAfterMkdir(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// Creates a directory over fio, then fails the way NVENC does
+	mkdir := (&protocol.MkdirRequest{RequestID: 1, Mode: 0o755, Path: "/out"}).Encode()
+	pyScript := `
+import socket, struct, os, sys
+s = socket.create_connection(('127.0.0.1', int(os.environ['FFOIP_PORT'])))
+payload = bytes.fromhex(sys.argv[1])
+s.sendall(struct.pack('>BI', 0x29, len(payload)) + payload)
+hdr = b''
+while len(hdr) < 5:
+    hdr += s.recv(5 - len(hdr))
+sys.stderr.write('No NVENC capable devices found\n')
+sys.exit(1)
+`
+	proc := process.NewProcess("python3", []string{"-c", pyScript, hex.EncodeToString(mkdir)})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var fellBack atomic.Bool
+	done := make(chan int, 1)
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.SetFallback(&Fallback{
+			Patterns: []*regexp.Regexp{regexp.MustCompile(`No NVENC`)},
+			Start: func() (Process, error) {
+				fellBack.Store(true)
+				p := process.NewProcess("echo", []string{"encoded"})
+				return p, p.Start(context.Background())
+			},
+		})
+		code, _ := sess.Run(context.Background())
+		serverConn.Close()
+		done <- code
+	}()
+
+	msg, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil || msg.Type != protocol.MsgMkdir {
+		t.Fatalf("expected MsgMkdir, got %v (err %v)", msg, err)
+	}
+	mkdirOk := (&protocol.RequestIDResponse{RequestID: 1}).Encode()
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgMkdirOk, mkdirOk); err != nil {
+		t.Fatal(err)
+	}
+	readMessages(clientConn)
+
+	if exitCode := <-done; exitCode != 1 || fellBack.Load() {
+		t.Errorf("exit code = %d, fell back = %v; want 1 and no rerun after creating a directory", exitCode, fellBack.Load())
+	}
+}
+
+func TestSessionFallbackNotAfterTerminate(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		t.Skip("signal tests only on unix")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// Exits non-zero with a matching message when terminated
+	proc := process.NewProcess("sh", []string{"-c", `trap 'echo "No NVENC capable devices found" >&2; exit 1' TERM; while :; do sleep 0.05; done`})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sess := NewSession(serverConn, proc)
+	var fellBack bool
+	sess.SetFallback(&Fallback{
+		Patterns: []*regexp.Regexp{regexp.MustCompile(`No NVENC`)},
+		Start: func() (Process, error) {
+			fellBack = true
+			p := process.NewProcess("true", nil)
+			return p, p.Start(context.Background())
+		},
+	})
+	done := make(chan int, 1)
+	go func() {
+		code, _ := sess.Run(context.Background())
+		serverConn.Close()
+		done <- code
+	}()
+	go readMessages(clientConn)
+
+	time.Sleep(100 * time.Millisecond)
+	if sess.PID() != proc.PID() {
+		t.Errorf("PID = %d, want %d", sess.PID(), proc.PID())
+	}
+	sess.Terminate()
+
+	select {
+	case code := <-done:
+		if code != 1 {
+			t.Errorf("exit code = %d, want 1", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not exit after Terminate")
+	}
+	if fellBack {
+		t.Error("fallback started for a terminated job")
+	}
+}
+
+// runWithTimeouts runs script under sh with the given timeouts and returns
+// the messages the client received.
+func runWithTimeouts(t *testing.T, script string, timeouts Timeouts) []*protocol.Message {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	proc := process.NewProcess("sh", []string{"-c", script})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.SetTimeouts(timeouts)
+		sess.Run(context.Background())
+		serverConn.Close()
+		close(done)
+	}()
+
+	msgs := readMessages(clientConn)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not finish")
+	}
+	return msgs
+}
+
+// exitReason returns the reason sent before the exit code, or nil.
+func exitReason(t *testing.T, msgs []*protocol.Message) *protocol.ExitReasonMessage {
+	t.Helper()
+	for i, m := range msgs {
+		if m.Type != protocol.MsgExitReason {
+			continue
+		}
+		if i+1 >= len(msgs) || msgs[i+1].Type != protocol.MsgExitCode {
+			t.Error("exit reason not immediately followed by exit code")
+		}
+		reason, err := protocol.DecodeExitReasonMessage(m.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reason
+	}
+	return nil
+}
+
+func TestSessionMaxRuntime(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		t.Skip("signal tests only on unix")
+	}
+
+	// Keeps producing output, so only the runtime limit applies
+	start := time.Now()
+	msgs := runWithTimeouts(t, `while :; do echo tick; sleep 0.05; done`, Timeouts{
+		MaxRuntime:   300 * time.Millisecond,
+		StallTimeout: time.Minute,
+	})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("job ran for %v", elapsed)
+	}
+
+	reason := exitReason(t, msgs)
+	if reason == nil || reason.Reason != protocol.ExitReasonTimeout {
+		t.Fatalf("exit reason = %+v, want timeout", reason)
+	}
+	if !strings.Contains(reason.Message, "maximum runtime") {
+		t.Errorf("message = %q", reason.Message)
+	}
+	if _, _, code := collectOutput(msgs); code != 128+15 {
+		t.Errorf("exit code = %d, want %d (SIGTERM)", code, 128+15)
+	}
+}
+
+func TestSessionStallTimeout(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "linux" {
+		t.Skip("signal tests only on unix")
+	}
+
+	msgs := runWithTimeouts(t, `echo started; exec sleep 60`, Timeouts{StallTimeout: 300 * time.Millisecond})
+
+	reason := exitReason(t, msgs)
+	if reason == nil || reason.Reason != protocol.ExitReasonStalled {
+		t.Fatalf("exit reason = %+v, want stalled", reason)
+	}
+	if stdout, _, _ := collectOutput(msgs); stdout != "started\n" {
+		t.Errorf("stdout = %q", stdout)
+	}
+}
+
+func TestSessionStallTimeoutResetByOutput(t *testing.T) {
+	// Output every 100ms keeps a 500ms stall timeout from firing
+	msgs := runWithTimeouts(t, `for i in 1 2 3 4 5 6 7 8 9 10; do echo $i >&2; sleep 0.1; done`, Timeouts{StallTimeout: 500 * time.Millisecond})
+
+	if reason := exitReason(t, msgs); reason != nil {
+		t.Fatalf("unexpected exit reason %+v", reason)
+	}
+	if _, _, code := collectOutput(msgs); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
+
+func TestSessionStallTimeoutPausedWithoutCredit(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	const total = 2 * protocol.StdioWindow
+	proc := process.NewProcess("head", []string{"-c", strconv.Itoa(total), "/dev/zero"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.SetTimeouts(Timeouts{StallTimeout: 200 * time.Millisecond})
+		sess.Run(context.Background())
+		serverConn.Close()
+	}()
+
+	// The job waits for credit for longer than the stall timeout
+	var received int
+	for received < protocol.StdioWindow {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.MsgStdout {
+			received += len(msg.Payload)
+		}
+	}
+	time.Sleep(time.Second)
+
+	credit := func(n int) {
+		c := &protocol.CreditMessage{Channel: protocol.MsgStdout, Bytes: uint32(n)}
+		protocol.WriteMessageTo(clientConn, protocol.MsgCredit, c.Encode())
+	}
+	credit(received)
+	var msgs []*protocol.Message
+	for {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+		if msg.Type == protocol.MsgStdout {
+			received += len(msg.Payload)
+			credit(len(msg.Payload))
+		}
+	}
+	if reason := exitReason(t, msgs); reason != nil {
+		t.Fatalf("unexpected exit reason %+v", reason)
+	}
+	if _, _, code := collectOutput(msgs); code != 0 || received != total {
+		t.Errorf("exit code = %d after %d bytes, want 0 after %d", code, received, total)
+	}
+}
+
+func TestSessionStallTimeoutPausedWhileDisconnected(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	proc := process.NewProcess("sh", []string{"-c", "echo started; sleep 0.6; echo done"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sess := NewSession(serverConn, proc)
+	sess.SetTimeouts(Timeouts{StallTimeout: 200 * time.Millisecond})
+	sess.EnableResume(10 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		sess.Run(context.Background())
+		close(done)
+	}()
+
+	// The connection breaks once the job started, and stays down for
+	// longer than the stall timeout
+	if msg, err := protocol.ReadMessageFrom(clientConn); err != nil || msg.Type != protocol.MsgStdout {
+		t.Fatalf("expected MsgStdout, got %v, %v", msg, err)
+	}
+	clientConn.Close()
+	time.Sleep(time.Second)
+
+	clientConn, serverConn = net.Pipe()
+	defer clientConn.Close()
+	go sess.Resume(serverConn, 1, 0)
+	var msgs []*protocol.Message
+	for {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.MsgResumeOk || msg.Type == protocol.MsgAck {
+			continue
+		}
+		msgs = append(msgs, msg)
+		if msg.Type == protocol.MsgExitCode {
+			break
+		}
+	}
+	protocol.WriteMessageTo(clientConn, protocol.MsgAck, protocol.EncodeCount(uint64(len(msgs))))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not finish")
+	}
+
+	if reason := exitReason(t, msgs); reason != nil {
+		t.Fatalf("unexpected exit reason %+v", reason)
+	}
+	if stdout, _, code := collectOutput(msgs); stdout != "started\ndone\n" || code != 0 {
+		t.Errorf("stdout = %q, exit code = %d", stdout, code)
+	}
+}
+
+func TestSessionNoTimeoutsNoReason(t *testing.T) {
+	msgs := runWithTimeouts(t, `exit 2`, Timeouts{})
+	if reason := exitReason(t, msgs); reason != nil {
+		t.Fatalf("unexpected exit reason %+v", reason)
+	}
+}
+
+func TestSessionUnreadStdinDoesNotBlockOtherMessages(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// sleep never reads stdin, so writing to it blocks once the pipe is full
+	proc := process.NewProcess("sleep", []string{"2"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.Run(context.Background())
+		serverConn.Close()
+	}()
+
+	data := make([]byte, 32*1024)
+	for range protocol.StdioWindow / len(data) {
+		clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := protocol.WriteMessageTo(clientConn, protocol.MsgStdin, data); err != nil {
+			t.Fatalf("stdin the process does not read blocked the connection: %v", err)
+		}
+	}
+	clientConn.SetWriteDeadline(time.Time{})
+
+	protocol.WriteMessageTo(clientConn, protocol.MsgPing, []byte("still there"))
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			t.Fatalf("no pong while stdin is full: %v", err)
+		}
+		// Credit for what fit in the pipe may come first
+		if msg.Type == protocol.MsgCredit {
+			continue
+		}
+		if msg.Type != protocol.MsgPong {
+			t.Fatalf("expected MsgPong, got 0x%02x", msg.Type)
+		}
+		break
+	}
+}
+
+func TestSessionStdinPastCredit(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// sleep never reads stdin, so no credit comes back
+	proc := process.NewProcess("sleep", []string{"10"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		sess := NewSession(serverConn, proc)
+		_, err := sess.Run(context.Background())
+		serverConn.Close()
+		errc <- err
+	}()
+	go io.Copy(io.Discard, clientConn)
+
+	// Past the window plus what the stdin pipe takes and is credited for
+	data := make([]byte, 32*1024)
+	for range 2 * protocol.StdioWindow / len(data) {
+		if protocol.WriteMessageTo(clientConn, protocol.MsgStdin, data) != nil {
+			break
+		}
+	}
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "credit") {
+			t.Errorf("Run error = %v, want stdin past the credit", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session kept running after the client overran its credit")
+	}
+}
+
+func TestSessionStdoutWaitsForCredit(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	const total = 4 * protocol.StdioWindow
+	proc := process.NewProcess("head", []string{"-c", strconv.Itoa(total), "/dev/zero"})
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.Run(context.Background())
+		serverConn.Close()
+	}()
+
+	// Without credit returned, no more than the window arrives
+	var received int
+	for received < protocol.StdioWindow {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.MsgStdout {
+			received += len(msg.Payload)
+		}
+	}
+	if received != protocol.StdioWindow {
+		t.Fatalf("received %d bytes of stdout without credit, want %d", received, protocol.StdioWindow)
+	}
+	clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if msg, err := protocol.ReadMessageFrom(clientConn); err == nil {
+		t.Fatalf("received 0x%02x past the window", msg.Type)
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	// Crediting what arrives lets the rest through
+	credit := func(n int) {
+		c := &protocol.CreditMessage{Channel: protocol.MsgStdout, Bytes: uint32(n)}
+		protocol.WriteMessageTo(clientConn, protocol.MsgCredit, c.Encode())
+	}
+	credit(received)
+	exitCode := -1
+	for exitCode < 0 {
+		msg, err := protocol.ReadMessageFrom(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Type {
+		case protocol.MsgStdout:
+			received += len(msg.Payload)
+			credit(len(msg.Payload))
+		case protocol.MsgExitCode:
+			exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+		}
+	}
+	if received != total {
+		t.Fatalf("received %d bytes of stdout, want %d", received, total)
+	}
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0", exitCode)
+	}
+}
+
+func TestSessionSendsProgress(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no progress pipe on windows")
+	}
+	// Stands in for ffmpeg: two progress blocks, and stderr of its own
+	script := filepath.Join(t.TempDir(), "fake-ffmpeg")
+	os.WriteFile(script, []byte(`#!/bin/sh
+fd=${2#pipe:}
+printf 'frame=1\nfps=0.0\nspeed=N/A\nprogress=continue\n' >&$fd
+echo "frame=    1" >&2
+printf 'frame=2\nfps=25.0\nspeed=1.5x\nprogress=end\n' >&$fd
+`), 0o755)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	proc := process.NewProcess(script, nil)
+	proc.EnableProgress()
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess := NewSession(serverConn, proc)
+		sess.Run(context.Background())
+		serverConn.Close()
+	}()
+
+	msgs := readMessages(clientConn)
+	var reports []*protocol.ProgressMessage
+	for _, msg := range msgs {
+		if msg.Type == protocol.MsgProgress {
+			report, err := protocol.DecodeProgressMessage(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reports = append(reports, report)
+		}
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got %d progress reports, want 2", len(reports))
+	}
+	if reports[0].Get("frame") != "1" || reports[1].Get("speed") != "1.5x" || reports[1].Get("progress") != "end" {
+		t.Errorf("reports = %+v, %+v", reports[0].Fields, reports[1].Fields)
+	}
+	if _, stderr, _ := collectOutput(msgs); stderr != "frame=    1\n" {
+		t.Errorf("stderr = %q, want the program's own", stderr)
+	}
+}
+
+func TestSessionCapture(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	proc := process.NewProcess("cat", nil)
+	if err := proc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "session.ffcap")
+	w, err := capture.Create(path, capture.SideServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := NewSession(serverConn, proc)
+	sess.SetCapture(w, path)
+	if got := sess.CapturePath(); got != path {
+		t.Fatalf("CapturePath = %q, want %q", got, path)
+	}
+	done := make(chan struct{})
+	go func() {
+		sess.Run(context.Background())
+		serverConn.Close()
+		close(done)
+	}()
+
+	protocol.WriteMessageTo(clientConn, protocol.MsgStdin, []byte("captured"))
+	protocol.WriteMessageTo(clientConn, protocol.MsgStdinClose, nil)
+	readMessages(clientConn)
+	<-done
+	if got := sess.CapturePath(); got != "" {
+		t.Fatalf("CapturePath = %q after Run, want none", got)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdin, stdout, exitCode bool
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case rec.Direction == capture.Received && rec.Message.Type == protocol.MsgStdin:
+			stdin = string(rec.Message.Payload) == "captured"
+		case rec.Direction == capture.Sent && rec.Message.Type == protocol.MsgStdout:
+			stdout = string(rec.Message.Payload) == "captured"
+		case rec.Direction == capture.Sent && rec.Message.Type == protocol.MsgExitCode:
+			exitCode = true
+		}
+	}
+	if !stdin || !stdout || !exitCode {
+		t.Fatalf("capture is missing messages: stdin %v, stdout %v, exit code %v", stdin, stdout, exitCode)
+	}
+}
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -9,27 +10,191 @@ import (
 	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
 )
 
+// maxChunk is the largest payload sent in one frame. Larger messages are
+// split into MsgFragment frames, so that a ping or stderr line waits for at
+// most one chunk of a large read to go out, not all of it.
+const maxChunk = 64 * 1024
+
+// priority orders the frames waiting to be written. Lower values go first.
+type priority int
+
+const (
+	priorityControl priority = iota
+	priorityStderr           // and progress reports
+	priorityFileIO           // file I/O responses
+	priorityBulk             // stdin, stdout and file I/O requests
+	numPriorities
+)
+
+func priorityOf(msgType uint8) priority {
+	switch {
+	case msgType == protocol.MsgStderr, msgType == protocol.MsgProgress:
+		return priorityStderr
+	case protocol.IsFileIOResponse(msgType):
+		return priorityFileIO
+	case msgType == protocol.MsgStdin, msgType == protocol.MsgStdout, protocol.IsFileIORequest(msgType):
+		return priorityBulk
+	default:
+		return priorityControl
+	}
+}
+
+// scheduler hands out turns to write a frame, highest priority first.
+// Messages of the same priority go out whole and in order, so that their
+// fragments are never mixed, but a message of a higher priority can go out
+// between two fragments of a lower one.
+type scheduler struct {
+	messages [numPriorities]sync.Mutex // held while a message of that priority is sent
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	busy    bool
+	waiting [numPriorities]int
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire waits for the turn to write a frame of priority p.
+func (s *scheduler) acquire(p priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting[p]++
+	for s.busy || s.ahead(p) {
+		s.changed.Wait()
+	}
+	s.waiting[p]--
+	s.busy = true
+}
+
+// ahead reports whether a frame of a higher priority than p is waiting.
+// Must hold mu.
+func (s *scheduler) ahead(p priority) bool {
+	for q := range p {
+		if s.waiting[q] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scheduler) release() {
+	s.mu.Lock()
+	s.busy = false
+	s.changed.Broadcast()
+	s.mu.Unlock()
+}
+
+// send passes the message to frame one frame at a time, each in its turn,
+// splitting it if it is larger than maxChunk.
+func (s *scheduler) send(msgType uint8, payload []byte, frame func(msgType uint8, payload []byte) error) error {
+	p := priorityOf(msgType)
+	s.messages[p].Lock()
+	defer s.messages[p].Unlock()
+
+	for len(payload) > maxChunk {
+		fragment := &protocol.FragmentMessage{Type: msgType, Data: payload[:maxChunk]}
+		s.acquire(p)
+		err := frame(protocol.MsgFragment, fragment.Encode())
+		s.release()
+		if err != nil {
+			return err
+		}
+		payload = payload[maxChunk:]
+	}
+	s.acquire(p)
+	defer s.release()
+	return frame(msgType, payload)
+}
+
+// assembler puts messages split into fragments back together.
+type assembler struct {
+	partial map[uint8][]byte
+}
+
+// add takes the next message read. It returns the message once complete,
+// or nil for a fragment.
+func (a *assembler) add(msg *protocol.Message) (*protocol.Message, error) {
+	if msg.Type == protocol.MsgFragment {
+		fragment, err := protocol.DecodeFragmentMessage(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if a.partial == nil {
+			a.partial = make(map[uint8][]byte)
+		}
+		data := append(a.partial[fragment.Type], fragment.Data...)
+		if len(data) > protocol.MaxPayload {
+			return nil, fmt.Errorf("fragmented message too large: %d bytes", len(data))
+		}
+		a.partial[fragment.Type] = data
+		return nil, nil
+	}
+	if data, ok := a.partial[msg.Type]; ok {
+		delete(a.partial, msg.Type)
+		msg = &protocol.Message{Type: msg.Type, Payload: append(data, msg.Payload...)}
+	}
+	return msg, nil
+}
+
 // Writer is a thread-safe protocol message writer. Multiple goroutines can
-// call WriteMessage concurrently without interleaving.
+// call WriteMessage concurrently; when they do, control messages go out
+// first, then stderr, file I/O responses, and bulk data, and large
+// messages are split so that they do not hold up the others. Reader puts
+// them back together.
 type Writer struct {
-	mu       sync.Mutex
+	sched    *scheduler
 	w        io.Writer
 	lastSend atomic.Int64 // unix nano of last write
+	written  atomic.Uint64
 }
 
 func NewWriter(w io.Writer) *Writer {
-	sw := &Writer{w: w}
+	sw := &Writer{sched: newScheduler(), w: w}
 	sw.lastSend.Store(time.Now().UnixNano())
 	return sw
 }
 
 func (sw *Writer) WriteMessage(msgType uint8, payload []byte) error {
-	sw.mu.Lock()
-	defer sw.mu.Unlock()
-	sw.lastSend.Store(time.Now().UnixNano())
-	return protocol.WriteMessageTo(sw.w, msgType, payload)
+	return sw.sched.send(msgType, payload, func(msgType uint8, payload []byte) error {
+		sw.lastSend.Store(time.Now().UnixNano())
+		sw.written.Add(uint64(5 + len(payload)))
+		return protocol.WriteMessageTo(sw.w, msgType, payload)
+	})
+}
+
+// BytesWritten returns the total number of bytes written, including
+// message headers.
+func (sw *Writer) BytesWritten() uint64 {
+	return sw.written.Load()
 }
 
 func (sw *Writer) LastSendTime() time.Time {
 	return time.Unix(0, sw.lastSend.Load())
 }
+
+// Reader reads the messages written by a Writer.
+type Reader struct {
+	r         io.Reader
+	assembler assembler
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadMessage returns the next message, whole.
+func (sr *Reader) ReadMessage() (*protocol.Message, error) {
+	for {
+		msg, err := protocol.ReadMessageFrom(sr.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg, err = sr.assembler.add(msg); msg != nil || err != nil {
+			return msg, err
+		}
+	}
+}
@@ -2,7 +2,9 @@ package session
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -190,7 +192,7 @@ func TestWriteMessageWithLargePayload(t *testing.T) {
 		t.Fatalf("WriteMessage with 1MB payload returned error: %v", err)
 	}
 
-	msg, err := protocol.ReadMessageFrom(&buf)
+	msg, err := NewReader(&buf).ReadMessage()
 	if err != nil {
 		t.Fatalf("ReadMessageFrom returned error: %v", err)
 	}
@@ -203,6 +205,66 @@ func TestWriteMessageWithLargePayload(t *testing.T) {
 	}
 }
 
+func TestWriteMessageSplitsLargePayload(t *testing.T) {
+	payload := bytes.Repeat([]byte{7}, 2*maxChunk+10)
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).WriteMessage(protocol.MsgReadOk, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []uint8
+	var sizes []int
+	for buf.Len() > 0 {
+		msg, err := protocol.ReadMessageFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msg.Type)
+		sizes = append(sizes, len(msg.Payload))
+	}
+	wantTypes := []uint8{protocol.MsgFragment, protocol.MsgFragment, protocol.MsgReadOk}
+	wantSizes := []int{1 + maxChunk, 1 + maxChunk, 10}
+	if !bytes.Equal(types, wantTypes) || fmt.Sprint(sizes) != fmt.Sprint(wantSizes) {
+		t.Fatalf("frames %x of %v bytes, want %x of %v", types, sizes, wantTypes, wantSizes)
+	}
+}
+
+func TestWriteMessageControlOvertakesBulk(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	sw := NewWriter(clientConn)
+
+	go sw.WriteMessage(protocol.MsgStdout, make([]byte, 4*maxChunk))
+
+	// While the first chunk is being written, a ping and stderr line queue
+	// up behind it
+	var header [5]byte
+	if _, err := io.ReadFull(serverConn, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	go sw.WriteMessage(protocol.MsgStderr, []byte("progress"))
+	time.Sleep(20 * time.Millisecond)
+	go sw.WriteMessage(protocol.MsgPing, nil)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := io.CopyN(io.Discard, serverConn, int64(binary.BigEndian.Uint32(header[1:]))); err != nil {
+		t.Fatal(err)
+	}
+
+	var order []uint8
+	for range 5 {
+		msg, err := protocol.ReadMessageFrom(serverConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, msg.Type)
+	}
+	want := []uint8{protocol.MsgPing, protocol.MsgStderr, protocol.MsgFragment, protocol.MsgFragment, protocol.MsgStdout}
+	if !bytes.Equal(order, want) {
+		t.Fatalf("frames after the first chunk: %x, want %x", order, want)
+	}
+}
+
 func TestWriteMessageWriteError(t *testing.T) {
 	errBroken := errors.New("broken pipe")
 	sw := NewWriter(&failWriter{err: errBroken})
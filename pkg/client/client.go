@@ -0,0 +1,142 @@
+// Package client runs programs on an ffmpeg-over-ip server from a Go
+// program, as the ffmpeg-over-ip-client binary does for the applications
+// that invoke it. The program runs on the server, reads and writes files
+// through the caller's FS, and its output goes to the caller's writers.
+//
+//	code, err := client.Run(ctx, client.Options{
+//		Servers:    []client.Server{{Address: "192.168.1.100:5050"}},
+//		AuthSecret: secret,
+//		Program:    "ffmpeg",
+//		Args:       []string{"-i", "/media/in.mkv", "/media/out.mp4"},
+//		Stderr:     os.Stderr,
+//	})
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/failover"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/filehandler"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// Exit codes for timeouts before a job starts, outside the range ffmpeg
+// itself uses, so callers can tell them apart from encoding failures.
+const (
+	ExitConnectTimeout   = 110
+	ExitHandshakeTimeout = 111
+	ExitResponseTimeout  = 112
+)
+
+const (
+	// KeepaliveInterval is how long a connection to a server may be idle
+	// before the client pings it.
+	KeepaliveInterval = 30 * time.Second
+	// KeepaliveTimeout is how long the client waits to hear from a server
+	// before it counts the connection as lost.
+	KeepaliveTimeout = 150 * time.Second
+)
+
+// Server is a server to run jobs on. Lower priorities are tried first;
+// among servers of equal priority, higher weights are more likely to be
+// tried first.
+type Server = failover.Server
+
+// FS is the filesystem the program's file operations run against. Paths
+// are as the program on the server uses them. Errors that wrap a
+// syscall.Errno or one of the io/fs errors reach the program as the
+// matching errno.
+type FS = filehandler.FS
+
+// File is a file opened by an FS. *os.File implements it.
+type File = filehandler.File
+
+// LocalFS returns the local filesystem, with relative paths resolved
+// against dir, or against the working directory if dir is "".
+func LocalFS(dir string) FS {
+	return filehandler.OSFS(dir)
+}
+
+// Options describe a job for Run.
+type Options struct {
+	// Servers are tried in turn until one takes the job. Addresses are
+	// "host:port" or "unix:" and a socket path.
+	Servers    []Server
+	AuthSecret string
+
+	// Program names the program in the server's registry, such as
+	// "ffmpeg" or "ffprobe", and Args are its arguments.
+	Program string
+	Args    []string
+	// Env is "NAME=value" entries for the program's environment. The
+	// server drops those its envAllowlist does not allow.
+	Env []string
+	// Profile picks one of the server's profiles; "" for none.
+	Profile string
+
+	// Stdin is the program's standard input; nil for none. Stdout and
+	// Stderr get its output; nil discards it. Stderr also gets the reason
+	// the server gives for stopping the program, if it does.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// FS serves the program's file operations; nil for LocalFS("").
+	FS FS
+
+	// ConnectTimeout bounds connecting to a server, HandshakeTimeout
+	// sending it the command, and FirstResponseTimeout the wait for its
+	// first message after that, or between the pings of a server whose job
+	// waits to start. Zero waits as long as the OS does.
+	ConnectTimeout       time.Duration
+	HandshakeTimeout     time.Duration
+	FirstResponseTimeout time.Duration
+
+	// Dial connects to a server; nil for a new connection to the address.
+	Dial func(ctx context.Context, address string) (net.Conn, error)
+	// FailureCache is a file that records servers that recently failed,
+	// shared by all clients that use it, so that later jobs try them
+	// last; "" for none.
+	FailureCache string
+
+	// Progress, if set, is called with each progress report of a server
+	// that sends them.
+	Progress func(fields map[string]string)
+	// Capture, if set, gets a capture of the job's traffic, as read by
+	// ffoip-dump and the -inspect flag of the server.
+	Capture io.Writer
+	// Fallback, if set, runs the job when no server takes it, and returns
+	// what Run does. err is a *StartError. stdin is Stdin itself if
+	// nothing was read from it yet, and otherwise a reader that replays
+	// what was read for the servers that failed before the rest of it.
+	Fallback func(ctx context.Context, stdin io.Reader, err error) (int, error)
+
+	// Logger logs what happens to the job; nil for the standard logger.
+	Logger *log.Logger
+}
+
+// Run runs a job and returns the program's exit code. It returns an error
+// if the job did not run to its end on a server: a *StartError if no
+// server took it, a *ServerError if the server refused or stopped it, and
+// a *ConnectionError if the connection broke for good. The exit code is
+// then the one the ffmpeg-over-ip-client binary exits with: a
+// TimeoutError's Code, or 1.
+//
+// Cancelling ctx asks the server to stop the program, as Ctrl-C does for
+// ffmpeg, and Run returns the exit code it reports. If the server does not
+// report one within a few seconds, or ctx is cancelled before a server
+// takes the job, Run returns ctx's error.
+func Run(ctx context.Context, opts Options) (int, error) {
+	if opts.Program == "" || len(opts.Program) > protocol.MaxProgramLength {
+		return 1, fmt.Errorf("program name must be 1 to %d bytes: %q", protocol.MaxProgramLength, opts.Program)
+	}
+	if len(opts.Servers) == 0 {
+		return 1, errors.New("no servers")
+	}
+	return newJob(ctx, opts).run()
+}
@@ -0,0 +1,330 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+const testSecret = "test-secret"
+
+// fakeServer is the server end of one job's connection.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+	cmd  *protocol.CommandMessage
+	msgs chan *protocol.Message // what the client sends after the command
+}
+
+// serve returns a Dial that connects to a fake server, which checks the
+// command and then runs script.
+func serve(t *testing.T, script func(s *fakeServer)) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			msg, err := protocol.ReadMessageFrom(serverConn)
+			if err != nil || msg.Type != protocol.MsgCommand {
+				t.Errorf("first message = %v, %v; want a command", msg, err)
+				return
+			}
+			cmd, err := protocol.DecodeCommandMessage(msg.Payload)
+			if err != nil {
+				t.Errorf("DecodeCommandMessage: %v", err)
+				return
+			}
+			if !auth.Verify(testSecret, protocol.CurrentVersion, cmd.Nonce, cmd.Signature, cmd.Program, cmd.Args, cmd.Env, cmd.Profile) {
+				t.Errorf("command signature does not verify")
+				return
+			}
+			s := &fakeServer{t: t, conn: serverConn, cmd: cmd, msgs: make(chan *protocol.Message, 256)}
+			go func() {
+				defer close(s.msgs)
+				for {
+					msg, err := protocol.ReadMessageFrom(serverConn)
+					if err != nil {
+						return
+					}
+					s.msgs <- msg
+				}
+			}()
+			script(s)
+		}()
+		return clientConn, nil
+	}
+}
+
+func (s *fakeServer) send(msgType uint8, payload []byte) {
+	if err := protocol.WriteMessageTo(s.conn, msgType, payload); err != nil {
+		s.t.Errorf("send 0x%02x: %v", msgType, err)
+	}
+}
+
+// expect returns the next message of type msgType the client sends.
+func (s *fakeServer) expect(msgType uint8) *protocol.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-s.msgs:
+			if !ok {
+				s.t.Errorf("connection closed waiting for 0x%02x", msgType)
+				return &protocol.Message{}
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			s.t.Errorf("timed out waiting for 0x%02x", msgType)
+			return &protocol.Message{}
+		}
+	}
+}
+
+func (s *fakeServer) exit(code uint32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, code)
+	s.send(protocol.MsgExitCode, payload)
+}
+
+func testOptions(dial func(context.Context, string) (net.Conn, error)) Options {
+	return Options{
+		Servers:    []Server{{Address: "test"}},
+		AuthSecret: testSecret,
+		Program:    "ffmpeg",
+		Dial:       dial,
+		Logger:     log.New(io.Discard, "", 0),
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("file contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions(serve(t, func(s *fakeServer) {
+		if s.cmd.Program != "ffmpeg" || strings.Join(s.cmd.Args, " ") != "-i in.txt" || strings.Join(s.cmd.Env, " ") != "TZ=UTC" {
+			t.Errorf("command = %+v", s.cmd)
+		}
+		if data := s.expect(protocol.MsgStdin).Payload; string(data) != "input" {
+			t.Errorf("stdin = %q", data)
+		}
+		s.expect(protocol.MsgStdinClose)
+
+		s.send(protocol.MsgOpen, (&protocol.OpenRequest{RequestID: 1, FileID: 1, Flags: protocol.FioORDONLY, Path: "in.txt"}).Encode())
+		s.expect(protocol.MsgOpenOk)
+		s.send(protocol.MsgRead, (&protocol.ReadRequest{RequestID: 2, FileID: 1, NBytes: 100}).Encode())
+		resp, err := protocol.DecodeReadOkResponse(s.expect(protocol.MsgReadOk).Payload)
+		if err != nil || string(resp.Data) != "file contents" {
+			t.Errorf("read = %+v, %v", resp, err)
+		}
+
+		s.send(protocol.MsgStdout, []byte("out"))
+		s.send(protocol.MsgStderr, []byte("err"))
+		s.send(protocol.MsgProgress, (&protocol.ProgressMessage{Fields: []protocol.ProgressField{{Key: "frame", Value: "10"}}}).Encode())
+		s.exit(3)
+	}))
+	opts.Args = []string{"-i", "in.txt"}
+	opts.Env = []string{"TZ=UTC"}
+	opts.Stdin = strings.NewReader("input")
+	var stdout, stderr bytes.Buffer
+	opts.Stdout, opts.Stderr = &stdout, &stderr
+	opts.FS = LocalFS(dir)
+	var progress []map[string]string
+	opts.Progress = func(fields map[string]string) { progress = append(progress, fields) }
+
+	code, err := Run(context.Background(), opts)
+	if code != 3 || err != nil {
+		t.Fatalf("Run = %d, %v; want 3, nil", code, err)
+	}
+	if stdout.String() != "out" || stderr.String() != "err" {
+		t.Errorf("stdout = %q, stderr = %q", stdout.String(), stderr.String())
+	}
+	if len(progress) != 1 || progress[0]["frame"] != "10" {
+		t.Errorf("progress = %v", progress)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	opts := testOptions(serve(t, func(s *fakeServer) {
+		s.send(protocol.MsgSession, (&protocol.SessionMessage{}).Encode())
+		s.expect(protocol.MsgCancel)
+		s.exit(255)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	code, err := Run(ctx, opts)
+	if code != 255 || err != nil {
+		t.Fatalf("Run = %d, %v; want the exit code the server reports", code, err)
+	}
+}
+
+func TestRunCancelWhileStarting(t *testing.T) {
+	// The server never responds
+	opts := testOptions(serve(t, func(s *fakeServer) {
+		for range s.msgs {
+		}
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if _, err := Run(ctx, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRunServerError(t *testing.T) {
+	opts := testOptions(serve(t, func(s *fakeServer) {
+		s.send(protocol.MsgStderr, []byte("before"))
+		s.send(protocol.MsgError, []byte("authentication failed"))
+	}))
+	var stderr bytes.Buffer
+	opts.Stderr = &stderr
+
+	code, err := Run(context.Background(), opts)
+	var serverErr *ServerError
+	if code != 1 || !errors.As(err, &serverErr) || serverErr.Message != "authentication failed" {
+		t.Fatalf("Run = %d, %v; want 1 and a ServerError", code, err)
+	}
+	if stderr.String() != "before" {
+		t.Errorf("output before the error = %q", stderr.String())
+	}
+}
+
+func TestRunConnectionLost(t *testing.T) {
+	opts := testOptions(serve(t, func(s *fakeServer) {
+		s.send(protocol.MsgStdout, []byte("partial"))
+	}))
+
+	code, err := Run(context.Background(), opts)
+	var connErr *ConnectionError
+	if code != 1 || !errors.As(err, &connErr) {
+		t.Fatalf("Run = %d, %v; want 1 and a ConnectionError", code, err)
+	}
+}
+
+func TestRunPingsWhileStarting(t *testing.T) {
+	// The first server holds the job longer than the first response
+	// timeout, pinging meanwhile, then starts draining before it runs it
+	queued := serve(t, func(s *fakeServer) {
+		for range 3 {
+			time.Sleep(60 * time.Millisecond)
+			s.send(protocol.MsgPing, nil)
+		}
+		s.send(protocol.MsgError, []byte(protocol.ErrServerDraining))
+	})
+	running := serve(t, func(s *fakeServer) {
+		s.send(protocol.MsgSession, (&protocol.SessionMessage{}).Encode())
+		s.send(protocol.MsgStdout, []byte("out"))
+		s.exit(0)
+	})
+	opts := testOptions(func(ctx context.Context, address string) (net.Conn, error) {
+		if address == "a" {
+			return queued(ctx, address)
+		}
+		return running(ctx, address)
+	})
+	opts.Servers = []Server{{Address: "a", Priority: 1}, {Address: "b", Priority: 2}}
+	opts.FirstResponseTimeout = 100 * time.Millisecond
+	var stdout bytes.Buffer
+	opts.Stdout = &stdout
+
+	if code, err := Run(context.Background(), opts); code != 0 || err != nil || stdout.String() != "out" {
+		t.Fatalf("Run = %d, %v with stdout %q; want the job run on the second server", code, err, stdout.String())
+	}
+}
+
+// timeout is a net.Error for a timed out dial.
+type timeout struct{}
+
+func (timeout) Error() string   { return "i/o timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+func TestRunStartError(t *testing.T) {
+	var tried []string
+	opts := testOptions(func(ctx context.Context, address string) (net.Conn, error) {
+		tried = append(tried, address)
+		return nil, timeout{}
+	})
+	opts.Servers = []Server{{Address: "b", Priority: 2}, {Address: "a", Priority: 1}}
+	opts.ConnectTimeout = time.Second
+
+	code, err := Run(context.Background(), opts)
+	var startErr *StartError
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &startErr) || !errors.As(err, &timeoutErr) {
+		t.Fatalf("Run error = %v; want a StartError for a TimeoutError", err)
+	}
+	if code != ExitConnectTimeout {
+		t.Errorf("code = %d, want %d", code, ExitConnectTimeout)
+	}
+	if strings.Join(tried, ",") != "a,b" || strings.Join(startErr.Servers, ",") != "a,b" {
+		t.Errorf("tried %v, error lists %v; want a then b", tried, startErr.Servers)
+	}
+}
+
+func TestRunFallback(t *testing.T) {
+	opts := testOptions(func(ctx context.Context, address string) (net.Conn, error) {
+		return nil, errors.New("refused")
+	})
+	opts.Stdin = strings.NewReader("input")
+	opts.Fallback = func(ctx context.Context, stdin io.Reader, err error) (int, error) {
+		if stdin != opts.Stdin {
+			t.Errorf("fallback did not get the untouched stdin")
+		}
+		var startErr *StartError
+		if !errors.As(err, &startErr) {
+			t.Errorf("fallback error = %v, want a StartError", err)
+		}
+		return 7, nil
+	}
+
+	if code, err := Run(context.Background(), opts); code != 7 || err != nil {
+		t.Fatalf("Run = %d, %v; want what the fallback returned", code, err)
+	}
+}
+
+func TestRunFallbackReplaysStdin(t *testing.T) {
+	// The server reads stdin, then goes away before the job starts
+	opts := testOptions(serve(t, func(s *fakeServer) {
+		s.expect(protocol.MsgStdinClose)
+	}))
+	opts.Stdin = strings.NewReader("input")
+	opts.Fallback = func(ctx context.Context, stdin io.Reader, err error) (int, error) {
+		data, readErr := io.ReadAll(stdin)
+		if string(data) != "input" || readErr != nil {
+			t.Errorf("fallback stdin = %q, %v; want the replayed input", data, readErr)
+		}
+		return 0, nil
+	}
+
+	if code, err := Run(context.Background(), opts); code != 0 || err != nil {
+		t.Fatalf("Run = %d, %v", code, err)
+	}
+}
+
+func TestRunRejectsOptions(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"no program": {Servers: []Server{{Address: "a"}}},
+		"long name":  {Servers: []Server{{Address: "a"}}, Program: strings.Repeat("x", protocol.MaxProgramLength+1)},
+		"no servers": {Program: "ffmpeg"},
+	} {
+		if _, err := Run(context.Background(), opts); err == nil {
+			t.Errorf("%s: Run succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/failover"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// connect sends the command to the first server that takes it
+// and returns the link to it, and the server's first message unless that
+// was the MsgSession that confirms the job started.
+//
+// A server counts as failed, and the next one is tried, if it cannot be
+// reached, or if it goes away or reports that it is draining before it
+// sends anything else. Nothing has reached the client's files or output at
+// that point, so running the job elsewhere is safe. Any other error,
+// including failed authentication, is left for the caller to report.
+//
+// If every server fails, or the job is cancelled while it starts, connect
+// returns a *StartError.
+func (j *job) connect(command []byte, stdin *stdinForwarder) (*session.Link, *protocol.Message, error) {
+	servers := failover.Order(j.opts.Servers, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+	var cache *failover.Cache
+	if j.opts.FailureCache != "" {
+		cache = failover.NewCache(j.opts.FailureCache, failover.DefaultFailedTTL)
+		servers = cache.Demote(servers)
+	}
+
+	startErr := &StartError{}
+	for _, server := range servers {
+		startErr.Servers = append(startErr.Servers, server.Address)
+		link, first, err := j.try(server.Address, command, stdin)
+		if err != nil {
+			startErr.Err = err
+			if j.ctx.Err() != nil {
+				break
+			}
+			j.log.Printf("server %s failed: %v", server.Address, err)
+			if cache != nil {
+				cache.MarkFailed(server.Address)
+			}
+			continue
+		}
+		if cache != nil {
+			cache.MarkOK(server.Address)
+		}
+		return link, first, nil
+	}
+	return nil, nil, startErr
+}
+
+// try runs the command on one server, returning an error if the job should
+// move on to the next.
+func (j *job) try(address string, command []byte, stdin *stdinForwarder) (*session.Link, *protocol.Message, error) {
+	opts := &j.opts
+	conn, err := j.dial(j.ctx, address)
+	if err != nil {
+		return nil, nil, asTimeout(err, "connecting", opts.ConnectTimeout, ExitConnectTimeout)
+	}
+	// A job cancelled before it starts gives up on the server
+	stop := context.AfterFunc(j.ctx, func() { conn.Close() })
+	defer stop()
+
+	// The handshake is sending the command, and any stdin to replay
+	if j.capture != nil {
+		j.capture.Record(capture.Sent, protocol.MsgCommand, command)
+	}
+	setDeadline(conn.SetWriteDeadline, opts.HandshakeTimeout)
+	if err := protocol.WriteMessageTo(conn, protocol.MsgCommand, command); err != nil {
+		conn.Close()
+		return nil, nil, asTimeout(fmt.Errorf("failed to send command: %w", err), "sending the command", opts.HandshakeTimeout, ExitHandshakeTimeout)
+	}
+	// Messages are kept from the start, in case the server offers to
+	// resume the session
+	link := session.NewLink(conn)
+	if j.capture != nil {
+		link.SetCapture(j.capture)
+	}
+	stdin.attach(serverSink{link}, session.NewCredit(protocol.StdioWindow))
+	conn.SetWriteDeadline(time.Time{})
+
+	// The server pings idle connections, so a first response is due within
+	// its keepalive interval even if the program prints nothing. It also
+	// pings while the job waits to start, which restarts the wait.
+	var msg *protocol.Message
+	for {
+		setDeadline(conn.SetReadDeadline, opts.FirstResponseTimeout)
+		msg, err = protocol.ReadMessageFrom(conn)
+		if err == nil && j.capture != nil {
+			j.capture.Record(capture.Received, msg.Type, msg.Payload)
+		}
+		if err != nil || msg.Type != protocol.MsgPing {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	err = asTimeout(err, "waiting for the first response", opts.FirstResponseTimeout, ExitResponseTimeout)
+	if err == nil && msg.Type == protocol.MsgError && string(msg.Payload) == protocol.ErrServerDraining {
+		err = fmt.Errorf("%s", protocol.ErrServerDraining)
+	}
+	if err != nil {
+		// Close first so a stdin write blocked on this server returns
+		link.Close()
+		stdin.detach()
+		return nil, nil, err
+	}
+	stdin.commit()
+
+	if msg.Type != protocol.MsgSession {
+		link.DisableResume()
+		return link, msg, nil
+	}
+	started, err := protocol.DecodeSessionMessage(msg.Payload)
+	if err != nil || started.GracePeriod == 0 {
+		link.DisableResume()
+		return link, nil, nil
+	}
+	r := &resumer{job: j, address: address, token: started.Token, link: link}
+	link.EnableResume(started.GracePeriod, r.reconnect)
+	return link, nil, nil
+}
+
+// setDeadline sets a connection deadline timeout from now, or none if
+// timeout is zero.
+func setDeadline(set func(time.Time) error, timeout time.Duration) {
+	if timeout > 0 {
+		set(time.Now().Add(timeout))
+	}
+}
+
+// stdinSink is where the job's stdin goes: a server, or the fallback.
+type stdinSink interface {
+	write(data []byte)
+	close()
+}
+
+type serverSink struct{ w *session.Link }
+
+func (s serverSink) write(data []byte) { s.w.WriteMessage(protocol.MsgStdin, data) }
+func (s serverSink) close()            { s.w.WriteMessage(protocol.MsgStdinClose, nil) }
+
+type pipeSink struct{ w io.WriteCloser }
+
+func (s pipeSink) write(data []byte) { s.w.Write(data) }
+func (s pipeSink) close()            { s.w.Close() }
+
+// stdinForwarder sends the job's stdin to the server. It starts reading
+// when the first server is attached, and until a server has taken the job,
+// it keeps what it sent so it can be replayed to the next server.
+//
+// It reads no more than the server's credit allows. No credit comes back
+// before the server has taken the job, so what is kept for replaying is
+// at most protocol.StdioWindow.
+type stdinForwarder struct {
+	r         io.Reader
+	mu        sync.Mutex
+	sink      stdinSink
+	credit    *session.Credit // nil when the sink takes any amount
+	started   bool
+	sent      []byte
+	closed    bool
+	committed bool
+}
+
+func (f *stdinForwarder) run() {
+	buf := make([]byte, 32*1024)
+	for {
+		f.mu.Lock()
+		credit := f.credit
+		f.mu.Unlock()
+		limit := len(buf)
+		if credit != nil {
+			limit = credit.Take(len(buf))
+		}
+		n, err := f.r.Read(buf[:limit])
+		f.mu.Lock()
+		if credit != nil && credit == f.credit {
+			credit.Add(limit - n)
+		} else if f.credit != nil {
+			// Read for a sink that is gone, and now sent to this one
+			f.credit.Add(-n)
+		}
+		if n > 0 {
+			if !f.committed {
+				f.sent = append(f.sent, buf[:n]...)
+			}
+			if f.sink != nil {
+				f.sink.write(buf[:n])
+			}
+		}
+		if err != nil {
+			f.closed = true
+			if f.sink != nil {
+				f.sink.close()
+			}
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+	}
+}
+
+// attach starts forwarding to sink, first replaying what was sent to a
+// previous server. credit limits what is sent to sink, or is nil if sink
+// takes any amount.
+func (f *stdinForwarder) attach(sink stdinSink, credit *session.Credit) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if credit != nil {
+		credit.Add(-len(f.sent))
+	}
+	for data := f.sent; len(data) > 0; {
+		n := min(len(data), 32*1024)
+		sink.write(data[:n])
+		data = data[n:]
+	}
+	if f.closed {
+		sink.close()
+	}
+	f.sink = sink
+	f.credit = credit
+	if !f.started {
+		f.started = true
+		go f.run()
+	}
+}
+
+// detach stops forwarding to the current server.
+func (f *stdinForwarder) detach() {
+	f.mu.Lock()
+	if f.credit != nil {
+		// A read waiting for this server's credit goes ahead, to be sent to
+		// the next
+		f.credit.Close()
+	}
+	f.sink = nil
+	f.credit = nil
+	f.mu.Unlock()
+}
+
+// addCredit lets the forwarder send n more bytes to the current server.
+func (f *stdinForwarder) addCredit(n int) {
+	f.mu.Lock()
+	if f.credit != nil {
+		f.credit.Add(n)
+	}
+	f.mu.Unlock()
+}
+
+// untouched reports whether stdin has not been read from at all.
+func (f *stdinForwarder) untouched() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.started
+}
+
+// commit drops the replay buffer once a server has taken the job.
+func (f *stdinForwarder) commit() {
+	f.mu.Lock()
+	f.committed = true
+	f.sent = nil
+	f.mu.Unlock()
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// StartError is a job that no server took. Err is why the last server
+// failed.
+type StartError struct {
+	Servers []string // the addresses tried, in order
+	Err     error
+}
+
+func (e *StartError) Error() string {
+	if len(e.Servers) == 1 {
+		return fmt.Sprintf("failed to start the job on %s: %v", e.Servers[0], e.Err)
+	}
+	return fmt.Sprintf("failed to start the job on any of %d servers, last error: %v", len(e.Servers), e.Err)
+}
+
+func (e *StartError) Unwrap() error { return e.Err }
+
+// TimeoutError is a server that did not respond in time at one step of
+// starting a job.
+type TimeoutError struct {
+	Step    string // what timed out, such as "connecting"
+	Timeout time.Duration
+	Code    int // the exit code for it, such as ExitConnectTimeout
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out %s after %v", e.Step, e.Timeout)
+}
+
+// asTimeout returns a TimeoutError if err is a timeout, and err otherwise.
+func asTimeout(err error, step string, timeout time.Duration, code int) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Step: step, Timeout: timeout, Code: code}
+	}
+	return err
+}
+
+// ServerError is an error the server reported instead of running the
+// program, such as failed authentication or an unknown program, or while
+// it ran.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// ConnectionError is a connection to the server that broke while the job
+// ran and could not be resumed. The program's exit code is unknown.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	if errors.Is(e.Err, io.EOF) {
+		return "server closed connection"
+	}
+	return fmt.Sprintf("read error: %v", e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error { return e.Err }
+
+// exitCode is the exit code for a job that failed with err.
+func exitCode(err error) int {
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return 1
+}
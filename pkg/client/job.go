@@ -0,0 +1,305 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/failover"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/filehandler"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// cancelTimeout is how long a cancelled job waits for the server to report
+// the program's exit code.
+const cancelTimeout = 5 * time.Second
+
+// job is one run of a program.
+type job struct {
+	ctx    context.Context
+	opts   Options
+	log    *log.Logger
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	fs     FS
+
+	// capture records the job's messages; nil when not recording
+	capture *capture.Writer
+}
+
+func newJob(ctx context.Context, opts Options) *job {
+	j := &job{
+		ctx:    ctx,
+		opts:   opts,
+		log:    opts.Logger,
+		stdin:  opts.Stdin,
+		stdout: opts.Stdout,
+		stderr: opts.Stderr,
+		fs:     opts.FS,
+	}
+	if j.log == nil {
+		j.log = log.Default()
+	}
+	if j.stdin == nil {
+		j.stdin = strings.NewReader("")
+	}
+	if j.stdout == nil {
+		j.stdout = io.Discard
+	}
+	if j.stderr == nil {
+		j.stderr = io.Discard
+	}
+	if j.fs == nil {
+		j.fs = LocalFS("")
+	}
+	return j
+}
+
+// dial connects to the server at address.
+func (j *job) dial(ctx context.Context, address string) (net.Conn, error) {
+	if j.opts.Dial != nil {
+		return j.opts.Dial(ctx, address)
+	}
+	return failover.Dial(ctx, address, j.opts.ConnectTimeout)
+}
+
+// run runs the job and returns its exit code.
+func (j *job) run() (int, error) {
+	// Generate nonce
+	var nonce [protocol.NonceLength]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return 1, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// Sign and send command
+	opts := &j.opts
+	sig := auth.Sign(opts.AuthSecret, protocol.CurrentVersion, nonce, opts.Program, opts.Args, opts.Env, opts.Profile)
+	cmd := &protocol.CommandMessage{
+		Nonce:     nonce,
+		Signature: sig,
+		Program:   opts.Program,
+		Args:      opts.Args,
+		Env:       opts.Env,
+		Profile:   opts.Profile,
+	}
+
+	if opts.Capture != nil {
+		w, err := capture.NewWriter(opts.Capture, capture.SideClient)
+		if err != nil {
+			j.log.Printf("failed to start capture: %v", err)
+		} else {
+			j.capture = w
+			defer func() {
+				if err := w.Close(); err != nil {
+					j.log.Printf("failed to write capture: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Connect to the first server that takes the job, which also starts
+	// forwarding stdin
+	stdin := &stdinForwarder{r: j.stdin}
+	link, first, err := j.connect(cmd.Encode(), stdin)
+	if err != nil {
+		if j.ctx.Err() != nil {
+			return 1, j.ctx.Err()
+		}
+		if opts.Fallback == nil {
+			return exitCode(err), err
+		}
+		if stdin.untouched() {
+			return opts.Fallback(j.ctx, j.stdin, err)
+		}
+		// Replaying may block until the fallback reads, so it happens in
+		// the background
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			stdin.attach(pipeSink{pw}, nil)
+			stdin.commit()
+		}()
+		return opts.Fallback(j.ctx, pr, err)
+	}
+	defer link.Close()
+
+	// done is closed when the job ends, exited once the exit code is in
+	done := make(chan struct{})
+	defer close(done)
+	exited := make(chan struct{})
+
+	// Cancel (Ctrl-C)
+	go func() {
+		select {
+		case <-j.ctx.Done():
+		case <-done:
+			return
+		}
+		link.WriteMessage(protocol.MsgCancel, nil)
+
+		// Wait for exit code with timeout
+		select {
+		case <-exited:
+		case <-done:
+		case <-time.After(cancelTimeout):
+			link.Abort(j.ctx.Err())
+		}
+	}()
+
+	// Keepalive
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			if time.Since(link.LastSendTime()) >= KeepaliveInterval {
+				link.WriteMessage(protocol.MsgPing, nil)
+			}
+			if time.Since(link.LastReceiveTime()) < KeepaliveTimeout {
+				continue
+			}
+			if link.Resumable() {
+				// Reconnect, unless already reconnecting
+				if link.Drop(errors.New("server keepalive timeout")) {
+					j.log.Printf("server keepalive timeout")
+				}
+				continue
+			}
+			link.Abort(errors.New("server keepalive timeout"))
+			return
+		}
+	}()
+
+	// Output and file I/O each go through a queue of their own, so a slow
+	// stdout or file does not hold up the rest. Output is credited back to
+	// the server once written.
+	credited := func(w io.Writer, channel uint8) func(*protocol.Message) {
+		return func(msg *protocol.Message) {
+			if msg.Type == protocol.MsgExitReason {
+				// Queued with stderr to keep its place in the output
+				if reason, err := protocol.DecodeExitReasonMessage(msg.Payload); err == nil {
+					fmt.Fprintf(w, "ffmpeg-over-ip: %s\n", reason.Message)
+				}
+				return
+			}
+			w.Write(msg.Payload)
+			credit := &protocol.CreditMessage{Channel: channel, Bytes: uint32(len(msg.Payload))}
+			link.WriteMessage(protocol.MsgCredit, credit.Encode())
+		}
+	}
+	stdout := session.NewQueue(credited(j.stdout, protocol.MsgStdout))
+	stderr := session.NewQueue(credited(j.stderr, protocol.MsgStderr))
+	progress := session.NewQueue(j.progress)
+	// All output received is written before the job ends
+	defer func() {
+		stdout.Close()
+		stderr.Close()
+		progress.Close()
+		<-stdout.Done()
+		<-stderr.Done()
+		<-progress.Done()
+	}()
+
+	handler := filehandler.NewHandlerFS(j.fs)
+	fio := session.NewQueue(func(msg *protocol.Message) {
+		respType, respPayload, err := handler.HandleMessage(msg.Type, msg.Payload)
+		if err != nil {
+			j.log.Printf("file handler error: %v", err)
+			return
+		}
+		link.WriteMessage(respType, respPayload)
+	})
+	defer func() {
+		fio.Abort()
+		<-fio.Done()
+		handler.CloseAll()
+	}()
+
+	// Message loop, starting with the message connect read
+	for {
+		msg := first
+		first = nil
+		if msg == nil {
+			var err error
+			msg, err = link.ReadMessage()
+			if err != nil {
+				if j.ctx.Err() != nil {
+					// Cancelled, and no exit code came in time
+					return 1, j.ctx.Err()
+				}
+				return 1, &ConnectionError{Err: err}
+			}
+		}
+
+		switch {
+		case protocol.IsFileIORequest(msg.Type):
+			fio.Push(msg)
+
+		case msg.Type == protocol.MsgStdout:
+			stdout.Push(msg)
+
+		case msg.Type == protocol.MsgStderr, msg.Type == protocol.MsgExitReason:
+			stderr.Push(msg)
+
+		case msg.Type == protocol.MsgProgress:
+			progress.Push(msg)
+
+		case msg.Type == protocol.MsgCredit:
+			if credit, err := protocol.DecodeCreditMessage(msg.Payload); err == nil && credit.Channel == protocol.MsgStdin {
+				stdin.addCredit(int(credit.Bytes))
+			}
+
+		case msg.Type == protocol.MsgExitCode:
+			close(exited)
+			// Let a resumable session on the server end without waiting
+			link.Ack()
+			return int(binary.BigEndian.Uint32(msg.Payload)), nil
+
+		case msg.Type == protocol.MsgError:
+			// Reported after the output that came before it, which the
+			// deferred queue shutdown writes first
+			return 1, &ServerError{Message: string(msg.Payload)}
+
+		case msg.Type == protocol.MsgPing:
+			link.WriteMessage(protocol.MsgPong, msg.Payload)
+
+		case msg.Type == protocol.MsgPong:
+			// keepalive response, nothing to do (the link noted the time)
+
+		default:
+			j.log.Printf("unknown message type 0x%02x, ignoring", msg.Type)
+		}
+	}
+}
+
+// progress passes the report in a MsgProgress to Options.Progress.
+func (j *job) progress(msg *protocol.Message) {
+	if j.opts.Progress == nil {
+		return
+	}
+	report, err := protocol.DecodeProgressMessage(msg.Payload)
+	if err != nil {
+		j.log.Printf("invalid progress report: %v", err)
+		return
+	}
+	fields := make(map[string]string, len(report.Fields))
+	for _, f := range report.Fields {
+		fields[f.Key] = f.Value
+	}
+	j.opts.Progress(fields)
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// resumeRetryInterval is how long the client waits between attempts to
+// resume a session.
+const resumeRetryInterval = time.Second
+
+// resumer reconnects a session to its server after the connection breaks,
+// until the server's grace period ends and the link closes.
+type resumer struct {
+	job     *job
+	address string
+	token   [protocol.TokenLength]byte
+	link    *session.Link
+
+	// mu keeps reconnects one at a time and protects attempt, which
+	// increases with every resume request
+	mu      sync.Mutex
+	attempt uint32
+}
+
+// rejectedError is a resume the server refused, which retrying will not
+// change.
+type rejectedError struct{ reason string }
+
+func (e *rejectedError) Error() string { return e.reason }
+
+func (r *resumer) reconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job.log.Printf("connection to %s lost, resuming the session", r.address)
+	for !r.link.Closed() {
+		r.attempt++
+		err := r.resume()
+		if err == nil {
+			r.job.log.Printf("resumed the session on %s", r.address)
+			return
+		}
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			r.link.Abort(fmt.Errorf("server refused to resume the session: %v", err))
+			return
+		}
+		r.job.log.Printf("failed to resume the session on %s: %v", r.address, err)
+		time.Sleep(resumeRetryInterval)
+	}
+}
+
+// resume asks the server to continue the session on a new connection.
+func (r *resumer) resume() error {
+	// Not given up when the job is cancelled, so that the cancel can still
+	// reach the server
+	conn, err := r.job.dial(context.WithoutCancel(r.job.ctx), r.address)
+	if err != nil {
+		return err
+	}
+	received := r.link.Received()
+	req := &protocol.ResumeMessage{Token: r.token, Attempt: r.attempt, Received: received}
+	req.Signature = auth.SignResume(r.job.opts.AuthSecret, protocol.CurrentVersion, r.token, r.attempt, received)
+
+	payload := req.Encode()
+	if r.job.capture != nil {
+		r.job.capture.Record(capture.Sent, protocol.MsgResume, payload)
+	}
+	setDeadline(conn.SetDeadline, r.job.opts.HandshakeTimeout)
+	err = protocol.WriteMessageTo(conn, protocol.MsgResume, payload)
+	var reply *protocol.Message
+	if err == nil {
+		reply, err = protocol.ReadMessageFrom(conn)
+	}
+	conn.SetDeadline(time.Time{})
+	if err == nil && r.job.capture != nil {
+		r.job.capture.Record(capture.Received, reply.Type, reply.Payload)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	switch reply.Type {
+	case protocol.MsgResumeOk:
+		peerReceived, err := protocol.DecodeCount(reply.Payload)
+		if err == nil {
+			_, err = r.link.Attach(conn, peerReceived)
+		}
+		if err != nil {
+			conn.Close()
+			return &rejectedError{err.Error()}
+		}
+		return nil
+	case protocol.MsgError:
+		conn.Close()
+		return &rejectedError{string(reply.Payload)}
+	default:
+		conn.Close()
+		return fmt.Errorf("unexpected reply 0x%02x", reply.Type)
+	}
+}
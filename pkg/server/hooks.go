@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// AuthRequest is a client asking to run a job, to resume a session whose
+// connection broke, or to open a multiplexed connection for jobs, each of
+// which is authenticated on its own.
+type AuthRequest struct {
+	RemoteAddr net.Addr
+	// Command is the job the client asks to run; nil when it resumes a
+	// session or opens a multiplexed connection.
+	Command *Command
+
+	verify func(secret string) bool
+}
+
+// Verify reports whether the request is signed with secret.
+func (r *AuthRequest) Verify(secret string) bool {
+	return r.verify(secret)
+}
+
+// Authenticator decides which clients a server accepts.
+type Authenticator interface {
+	// Authenticate returns nil to accept req. The client is only told
+	// that authentication failed; the error is logged.
+	Authenticate(req *AuthRequest) error
+}
+
+// Command is a job as the client sent it.
+type Command struct {
+	// Program is the name the client was invoked as, such as "ffmpeg".
+	Program string
+	Args    []string
+	Env     []string
+	Profile string
+}
+
+// Job is how a command runs, once the config has resolved its program and
+// profile and applied its rewrites, default arguments and envAllowlist.
+type Job struct {
+	Command    *Command
+	RemoteAddr net.Addr
+
+	// Program is the program in the registry the job runs, such as
+	// "ffmpeg", and Path its binary.
+	Program string
+	Path    string
+	Args    []string
+	// Env is "NAME=value" entries added to the server's environment.
+	Env []string
+
+	// Config is the config the job runs under, whose limits, sandbox and
+	// progress settings LocalExecutor applies.
+	Config *Config
+	// Fallback is set on the rerun of a failed job with the config's
+	// fallback rewrites applied to Args.
+	Fallback bool
+}
+
+// CommandPolicy reviews jobs before they run.
+type CommandPolicy interface {
+	// Apply is called with a job as the config would run it, and may
+	// change it. An error refuses the job, and its message is sent to
+	// the client.
+	Apply(job *Job) error
+}
+
+// Process is the running program of a job. Its output and file I/O are
+// relayed to the client: Loopback is the connection of the program's fio
+// layer.
+type Process = session.Process
+
+// Executor starts the programs of jobs. It is where jobs can be queued or
+// sent elsewhere.
+type Executor interface {
+	// Start starts job's program. It may block until the job's turn comes;
+	// the client is pinged meanwhile so it keeps waiting. Cancelling ctx,
+	// which happens when the server shuts down, when the client goes away
+	// before Start returns, or once the session has ended, should stop it.
+	Start(ctx context.Context, job *Job) (Process, error)
+}
+
+// LocalExecutor runs jobs as child processes of the server, with the
+// limits, sandbox and progress reports their config sets.
+type LocalExecutor struct{}
+
+// Start implements Executor.
+func (LocalExecutor) Start(ctx context.Context, job *Job) (Process, error) {
+	proc := newProcess(job)
+	if err := proc.Start(ctx); err != nil {
+		return nil, err
+	}
+	return proc, nil
+}
+
+// SessionInfo describes a running session to the session callbacks.
+type SessionInfo struct {
+	// ID identifies the session in the admin API.
+	ID        string
+	Job       *Job
+	StartTime time.Time
+}
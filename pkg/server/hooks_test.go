@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+// runCommand sends payload as a command to srv and returns what the server
+// replies.
+func runCommand(t *testing.T, srv *Server, payload []byte) (stdout string, exitCode int, errMsg string) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go srv.ServeConn(context.Background(), serverConn)
+
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	ch := make(chan []*protocol.Message, 1)
+	go func() { ch <- readAllMessages(clientConn) }()
+	var msgs []*protocol.Message
+	select {
+	case msgs = <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for response messages")
+	}
+
+	exitCode = -1
+	for _, msg := range msgs {
+		switch msg.Type {
+		case protocol.MsgStdout:
+			stdout += string(msg.Payload)
+		case protocol.MsgExitCode:
+			exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+		case protocol.MsgError:
+			errMsg = string(msg.Payload)
+		}
+	}
+	return stdout, exitCode, errMsg
+}
+
+type authFunc func(req *AuthRequest) error
+
+func (f authFunc) Authenticate(req *AuthRequest) error { return f(req) }
+
+type policyFunc func(job *Job) error
+
+func (f policyFunc) Apply(job *Job) error { return f(job) }
+
+type executorFunc func(ctx context.Context, job *Job) (Process, error)
+
+func (f executorFunc) Start(ctx context.Context, job *Job) (Process, error) { return f(ctx, job) }
+
+func TestAuthenticator(t *testing.T) {
+	// Either of two secrets, as while rotating them
+	srv := mustNew(&Config{AuthSecret: "unused"}, Options{
+		FFmpegPath: "/bin/sh",
+		Authenticator: authFunc(func(req *AuthRequest) error {
+			if req.Command == nil || req.Command.Program != protocol.ProgramFFmpeg || req.RemoteAddr == nil {
+				t.Errorf("request = %+v", req)
+			}
+			if req.Verify("old") || req.Verify("new") {
+				return nil
+			}
+			return errors.New("unknown secret")
+		}),
+	})
+
+	for _, tt := range []struct {
+		secret string
+		want   string
+	}{
+		{"old", "ok\n"},
+		{"new", "ok\n"},
+		{"unused", ""},
+	} {
+		stdout, _, errMsg := runCommand(t, srv, makeCommandPayload(tt.secret, protocol.ProgramFFmpeg, []string{"-c", "echo ok"}))
+		if stdout != tt.want {
+			t.Errorf("%s: stdout = %q, want %q", tt.secret, stdout, tt.want)
+		}
+		if tt.want == "" && errMsg != "authentication failed" {
+			t.Errorf("%s: error = %q, want authentication failed", tt.secret, errMsg)
+		}
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	srv := mustNew(&Config{AuthSecret: "secret"}, Options{
+		FFmpegPath:  "/bin/sh",
+		FFprobePath: "/bin/sh",
+		Policy: policyFunc(func(job *Job) error {
+			if job.Program == protocol.ProgramFFprobe {
+				return errors.New("ffprobe is not allowed here")
+			}
+			job.Args = append(job.Args, "policy")
+			return nil
+		}),
+	})
+
+	stdout, code, _ := runCommand(t, srv, makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "echo $0"}))
+	if stdout != "policy\n" || code != 0 {
+		t.Errorf("stdout = %q, exit code %d; want the policy's argument", stdout, code)
+	}
+	_, _, errMsg := runCommand(t, srv, makeCommandPayload("secret", protocol.ProgramFFprobe, []string{"-c", "echo $0"}))
+	if errMsg != "ffprobe is not allowed here" {
+		t.Errorf("error = %q, want the policy's", errMsg)
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	var jobs []*Job
+	cfg := &Config{AuthSecret: "secret", EnvAllowlist: []string{"TZ"}}
+	srv := mustNew(cfg, Options{
+		FFmpegPath: "/bin/sh",
+		Executor: executorFunc(func(ctx context.Context, job *Job) (Process, error) {
+			jobs = append(jobs, job)
+			if len(jobs) > 1 {
+				return nil, errors.New("no free slot")
+			}
+			return LocalExecutor{}.Start(ctx, job)
+		}),
+	})
+
+	payload := makeCommandPayloadEnv("secret", "ffmpeg-remote", []string{"-c", "echo $TZ"}, []string{"TZ=UTC", "HOME=/root"})
+	if stdout, _, _ := runCommand(t, srv, payload); stdout != "UTC\n" {
+		t.Errorf("stdout = %q, want the job's output", stdout)
+	}
+	job := jobs[0]
+	if job.Program != protocol.ProgramFFmpeg || job.Path != "/bin/sh" || job.Command.Program != "ffmpeg-remote" || job.Config != cfg {
+		t.Errorf("job = %+v", job)
+	}
+	if !slices.Equal(job.Env, []string{"TZ=UTC"}) {
+		t.Errorf("job env = %v, want only what envAllowlist allows", job.Env)
+	}
+
+	if _, _, errMsg := runCommand(t, srv, payload); !strings.Contains(errMsg, "no free slot") {
+		t.Errorf("error = %q, want the executor's", errMsg)
+	}
+}
+
+func TestExecutorQueues(t *testing.T) {
+	// The job waits for a slot for longer than the ping interval
+	srv := mustNew(&Config{AuthSecret: "secret"}, Options{
+		FFmpegPath: "/bin/sh",
+		Executor: executorFunc(func(ctx context.Context, job *Job) (Process, error) {
+			time.Sleep(startPingInterval * 5 / 2)
+			return LocalExecutor{}.Start(ctx, job)
+		}),
+	})
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go srv.ServeConn(context.Background(), serverConn)
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "echo ok"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	var types []uint8
+	for _, msg := range readAllMessages(clientConn) {
+		types = append(types, msg.Type)
+	}
+	if len(types) < 3 || types[0] != protocol.MsgPing || types[1] != protocol.MsgPing || types[2] != protocol.MsgSession {
+		t.Errorf("message types = %v, want pings while the job waits, then MsgSession", types)
+	}
+}
+
+func TestExecutorCancelledWhenClientLeaves(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := mustNew(&Config{AuthSecret: "secret"}, Options{
+		FFmpegPath: "/bin/sh",
+		Executor: executorFunc(func(ctx context.Context, job *Job) (Process, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}),
+	})
+
+	clientConn, serverConn := net.Pipe()
+	go srv.ServeConn(context.Background(), serverConn)
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "echo ok"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	clientConn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * startPingInterval):
+		t.Fatal("job still waiting to start after its client left")
+	}
+}
+
+func TestSessionCallbacks(t *testing.T) {
+	var srv *Server
+	var started *SessionInfo
+	ended := make(chan int, 1)
+	srv = mustNew(&Config{AuthSecret: "secret"}, Options{
+		FFmpegPath: "/bin/sh",
+		OnSessionStart: func(info *SessionInfo) {
+			started = info
+			if info.ID == "" || srv.Sessions() != 1 {
+				t.Errorf("started session %+v with %d running", info, srv.Sessions())
+			}
+		},
+		OnSessionEnd: func(info *SessionInfo, exitCode int, err error) {
+			if info != started || err != nil {
+				t.Errorf("ended session %+v, %v; want the one that started", info, err)
+			}
+			ended <- exitCode
+		},
+	})
+
+	runCommand(t, srv, makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "exit 3"}))
+	select {
+	case code := <-ended:
+		if code != 3 {
+			t.Errorf("OnSessionEnd exit code = %d, want 3", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSessionEnd was not called")
+	}
+	if started == nil || started.Job.Program != protocol.ProgramFFmpeg {
+		t.Errorf("OnSessionStart got %+v", started)
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/admin"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/rewrite"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// runJob runs an authenticated command on conn until it exits. command is
+// the raw command message, for captures.
+func (srv *Server) runJob(ctx context.Context, cfg *Config, conn net.Conn, cmd *Command, command []byte) {
+	job, errMsg := srv.newJob(cfg, conn.RemoteAddr(), cmd)
+	if job == nil {
+		sendError(conn, errMsg)
+		return
+	}
+	if srv.opts.Policy != nil {
+		if err := srv.opts.Policy.Apply(job); err != nil {
+			sendError(conn, err.Error())
+			log.Printf("policy refused %s %v (from %s): %v", job.Program, job.Args, conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	if cfg.Debug {
+		log.Printf("[debug] original args: %v", cmd.Args)
+		log.Printf("[debug] rewritten args: %v", job.Args)
+		if len(job.Env) > 0 {
+			log.Printf("[debug] env: %v", job.Env)
+		}
+	}
+	if cmd.Profile != "" {
+		log.Printf("running %s %v with profile %q (from %s)", filepath.Base(job.Path), job.Args, cmd.Profile, conn.RemoteAddr())
+	} else {
+		log.Printf("running %s %v (from %s)", filepath.Base(job.Path), job.Args, conn.RemoteAddr())
+	}
+
+	// Start process. An executor that queues the job may hold it for a
+	// while, so the client is pinged meanwhile, and the job cancelled if
+	// the client has gone.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopPings := pingUntilStarted(conn, cancel)
+	proc, err := srv.opts.Executor.Start(ctx, job)
+	stopPings()
+	if err != nil {
+		sendError(conn, fmt.Sprintf("failed to start process: %v", err))
+		return
+	}
+
+	// Run session
+	sess := session.NewSession(conn, proc)
+	var captureDir string
+	if cfg.Capture != nil {
+		captureDir = cfg.Capture.Dir
+	}
+	info := &SessionInfo{Job: job, StartTime: time.Now()}
+	// A drain that began while the job was starting has not waited for it,
+	// so the job must not run
+	info.ID, err = srv.sessions.TryAdd(&admin.Entry{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Program:    filepath.Base(job.Path),
+		Args:       job.Args,
+		StartTime:  info.StartTime,
+		Proc:       sess,
+		Session:    sess,
+		CaptureDir: captureDir,
+	})
+	if err != nil {
+		proc.Terminate()
+		sendError(conn, protocol.ErrServerDraining)
+		return
+	}
+	defer srv.sessions.Unregister(info.ID)
+	started, unregister := srv.register(cfg, sess, info)
+	defer unregister()
+	if cfg.Capture != nil && cfg.Capture.All {
+		captureSession(sess, captureDir, job.Program, command, started.Encode())
+	}
+	// Tell the client the job started, and how to resume it if the
+	// connection breaks. Only pings are sent before this.
+	protocol.WriteMessageTo(conn, protocol.MsgSession, started.Encode())
+	limits := cfg.Limits[job.Program]
+	sess.SetTimeouts(session.Timeouts{
+		MaxRuntime:   time.Duration(limits.MaxRuntime),
+		StallTimeout: time.Duration(limits.StallTimeout),
+	})
+	if fallback := srv.fallback(ctx, job); fallback != nil {
+		sess.SetFallback(fallback)
+	}
+	if srv.opts.OnSessionStart != nil {
+		srv.opts.OnSessionStart(info)
+	}
+
+	exitCode, err := sess.Run(ctx)
+	if err != nil {
+		log.Printf("session error: %v", err)
+	}
+
+	log.Printf("process exited with code %d (from %s)", exitCode, conn.RemoteAddr())
+	if srv.opts.OnSessionEnd != nil {
+		srv.opts.OnSessionEnd(info, exitCode, err)
+	}
+}
+
+// pingUntilStarted pings conn every startPingInterval until the returned
+// function is called, and calls cancel if a ping fails. The function
+// returns once no ping is being sent.
+func pingUntilStarted(conn net.Conn, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(startPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := protocol.WriteMessageTo(conn, protocol.MsgPing, nil); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// newJob resolves cmd to the job the config runs for it. If the config
+// does not allow it, newJob returns nil and the error for the client.
+func (srv *Server) newJob(cfg *Config, remoteAddr net.Addr, cmd *Command) (*Job, string) {
+	// Determine binary path
+	programName, ok := resolveProgram(cfg, cmd.Program)
+	if !ok {
+		return nil, fmt.Sprintf("unknown program: %q", cmd.Program)
+	}
+	var profile config.ProfileConfig
+	if cmd.Profile != "" {
+		if profile, ok = cfg.Profiles[cmd.Profile]; !ok {
+			return nil, fmt.Sprintf("unknown profile: %q", cmd.Profile)
+		}
+	}
+
+	// Apply rewrites, then add the program's default arguments
+	args := rewrite.Apply(cfg.Rewrites, programName, cmd.Args)
+	args = rewrite.Apply(profile.Rewrites, programName, args)
+	if defaults := cfg.Programs[programName].Args; len(defaults) > 0 {
+		args = append(slices.Clone(defaults), args...)
+	}
+	return &Job{
+		Command:    cmd,
+		RemoteAddr: remoteAddr,
+		Program:    programName,
+		Path:       srv.programPath(cfg, &profile, programName),
+		Args:       args,
+		// The profile's env comes last so it wins over the client's
+		Env:    append(allowedEnv(cfg, cmd.Env), profile.Env...),
+		Config: cfg,
+	}, ""
+}
+
+// captureSession records sess to a new file in dir from its start,
+// including the command and the reply that started it, which are
+// exchanged before the session runs.
+func captureSession(sess *session.Session, dir, programName string, command, started []byte) {
+	w, path, err := capture.CreateIn(dir, programName, capture.SideServer)
+	if err != nil {
+		log.Printf("failed to create capture: %v", err)
+		return
+	}
+	w.Record(capture.Received, protocol.MsgCommand, command)
+	w.Record(capture.Sent, protocol.MsgSession, started)
+	sess.SetCapture(w, path)
+	log.Printf("recording session to %s", path)
+}
+
+// resolveProgram maps the program name a client asked for to a program in
+// the registry. Names that are not registered fall back to ffprobe or
+// ffmpeg if they contain one of those, so clients installed under names
+// like "ffmpeg-over-ip-client" or "ffprobe-remote" keep working.
+func resolveProgram(cfg *Config, name string) (string, bool) {
+	if _, ok := cfg.Programs[name]; ok || slices.Contains(config.BuiltinPrograms, name) {
+		return name, true
+	}
+	for _, builtin := range []string{protocol.ProgramFFprobe, protocol.ProgramFFmpeg} {
+		if strings.Contains(name, builtin) {
+			return builtin, true
+		}
+	}
+	return "", false
+}
+
+// programPath returns the binary to run for a registered program, taking
+// ffmpeg and ffprobe from the job's profile if it replaces them.
+func (srv *Server) programPath(cfg *Config, profile *config.ProfileConfig, programName string) string {
+	switch {
+	case programName == protocol.ProgramFFmpeg && profile.Path != "":
+		return profile.Path
+	case programName == protocol.ProgramFFprobe && profile.FFprobePath != "":
+		return profile.FFprobePath
+	}
+	if path := cfg.Programs[programName].Path; path != "" {
+		return path
+	}
+	if programName == protocol.ProgramFFprobe {
+		return srv.opts.FFprobePath
+	}
+	return srv.opts.FFmpegPath
+}
+
+// fallback returns the session fallback for a job, or nil if none is
+// configured or the fallback rewrites would not change its arguments.
+func (srv *Server) fallback(ctx context.Context, job *Job) *session.Fallback {
+	cfg := job.Config
+	if cfg.Fallback == nil {
+		return nil
+	}
+	fallbackArgs := rewrite.Apply(cfg.Fallback.Rewrites, job.Program, job.Args)
+	if slices.Equal(fallbackArgs, job.Args) {
+		return nil
+	}
+	rerun := *job
+	rerun.Args = fallbackArgs
+	rerun.Fallback = true
+	return &session.Fallback{
+		Patterns: cfg.Fallback.Patterns,
+		Start: func() (session.Process, error) {
+			if cfg.Debug {
+				log.Printf("[debug] fallback args: %v", fallbackArgs)
+			}
+			log.Printf("falling back to %s %v (from %s)", filepath.Base(rerun.Path), fallbackArgs, rerun.RemoteAddr)
+			return srv.opts.Executor.Start(ctx, &rerun)
+		},
+	}
+}
+
+// newProcess creates the process for a job, with the client's environment
+// and the configured limits, sandbox and progress reports.
+func newProcess(job *Job) *process.Process {
+	cfg := job.Config
+	proc := process.NewProcess(job.Path, job.Args)
+	proc.SetEnv(job.Env)
+	proc.SetLimits(processLimits(cfg.Limits[job.Program]))
+	if cfg.Programs[job.Program].Progress && !slices.Contains(job.Args, "-progress") {
+		// Unless the job reports progress itself
+		proc.EnableProgress()
+	}
+	if sb := cfg.Sandbox; sb != nil {
+		proc.SetSandbox(&process.Sandbox{
+			UID:     sb.UID,
+			GID:     sb.GID,
+			Groups:  sb.Groups,
+			Devices: sb.Devices,
+			Paths:   sb.Paths,
+			Network: sb.Network,
+		})
+	}
+	return proc
+}
+
+// allowedEnv returns the entries of a client's environment that the config
+// allows it to set. Others are dropped, and logged in debug mode.
+func allowedEnv(cfg *Config, env []string) []string {
+	var allowed []string
+	for _, kv := range env {
+		name, _, ok := strings.Cut(kv, "=")
+		if ok && config.EnvAllowed(cfg.EnvAllowlist, name) {
+			allowed = append(allowed, kv)
+		} else if cfg.Debug {
+			log.Printf("[debug] ignoring environment variable %q: not in envAllowlist", name)
+		}
+	}
+	return allowed
+}
+
+// processLimits converts configured limits to the form process.Process
+// applies.
+func processLimits(l config.ProgramLimits) process.Limits {
+	limits := process.Limits{
+		AddressSpace: uint64(l.AddressSpace),
+		OpenFiles:    l.OpenFiles,
+		CPUTime:      time.Duration(l.CPUTime),
+		Nice:         l.Nice,
+	}
+	if l.IOPriority != nil {
+		classes := map[string]process.IOClass{
+			"realtime":    process.IOClassRealtime,
+			"best-effort": process.IOClassBestEffort,
+			"idle":        process.IOClassIdle,
+		}
+		limits.IOPriority = &process.IOPriority{Class: classes[l.IOPriority.Class], Level: l.IOPriority.Level}
+	}
+	if l.Cgroup != nil {
+		limits.Cgroup = &process.Cgroup{
+			Parent:    l.Cgroup.Parent,
+			MemoryMax: uint64(l.Cgroup.Memory),
+			CPUs:      l.Cgroup.CPUs,
+		}
+	}
+	return limits
+}
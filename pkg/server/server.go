@@ -0,0 +1,436 @@
+// Package server runs ffmpeg-over-ip jobs for clients, as the
+// ffmpeg-over-ip-server binary does, inside a Go program. Hooks replace how
+// clients are authenticated, how their commands become jobs, and how jobs
+// are run, and report when sessions start and end.
+//
+// LocalExecutor applies a config's limits and sandbox by re-executing the
+// program as a launch helper, so HelperMain must be the first call in
+// main of any program that uses it; New fails otherwise.
+//
+//	server.HelperMain()
+//	cfg, err := server.LoadConfig("/etc/ffmpeg-over-ip.server.jsonc")
+//	...
+//	srv, err := server.New(cfg, server.Options{
+//		FFmpegPath:  "/opt/ffmpeg/bin/ffmpeg",
+//		FFprobePath: "/opt/ffmpeg/bin/ffprobe",
+//		Executor:    scheduler, // runs each job when a slot is free
+//	})
+//	err = srv.Serve(ctx, listener)
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/admin"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/mux"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/rewrite"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/session"
+)
+
+// A multiplexed connection is pinged when idle for muxKeepaliveInterval,
+// and closed when nothing arrives on it for muxKeepaliveTimeout.
+const (
+	muxKeepaliveInterval = 30 * time.Second
+	muxKeepaliveTimeout  = 150 * time.Second
+)
+
+// startPingInterval is how often a client is pinged while the executor
+// has not started its job, so it does not time out waiting for the first
+// response.
+const startPingInterval = time.Second
+
+// Config is the server config, as read from a server config file. Its
+// Address, Admin and Log settings are for the ffmpeg-over-ip-server binary
+// and not used by a Server. A config built in Go should start from
+// DefaultConfig, as files do.
+type Config = config.ServerConfig
+
+// The types of Config's fields, as documented for the server config file.
+type (
+	AdminConfig    = config.AdminConfig
+	FallbackConfig = config.FallbackConfig
+	CaptureConfig  = config.CaptureConfig
+	ProgramConfig  = config.ProgramConfig
+	ProfileConfig  = config.ProfileConfig
+	ProgramLimits  = config.ProgramLimits
+	IOPriority     = config.IOPriority
+	CgroupConfig   = config.CgroupConfig
+	SandboxConfig  = config.SandboxConfig
+	Duration       = config.Duration
+	ByteSize       = config.ByteSize
+	LogValue       = config.LogValue
+)
+
+// RewriteRule is one of the argument rewrites of Config and its profiles
+// and fallback. A rule built in Go, other than with RewritePair, must be
+// compiled with its Compile method before the server uses it.
+type RewriteRule = rewrite.Rule
+
+// RewritePair returns a rule that replaces every occurrence of from in
+// every argument with to.
+func RewritePair(from, to string) RewriteRule {
+	return rewrite.Pair(from, to)
+}
+
+// DefaultConfig returns the settings a config has before its file is
+// applied: the default limits, drain timeout, resume grace period and
+// envAllowlist.
+func DefaultConfig() *Config {
+	return config.DefaultServerConfig()
+}
+
+// LoadConfig reads the server config at path, or, if path is "", from the
+// first of the default locations that exists.
+func LoadConfig(path string) (*Config, error) {
+	return config.LoadServerConfig(path)
+}
+
+// ParseConfig parses and validates the contents of a server config file.
+func ParseConfig(data []byte) (*Config, error) {
+	return config.ParseServerConfig(data)
+}
+
+// HelperMain runs the launch helper when the program was re-executed as
+// one, to apply a job's limits and sandbox before exec'ing its binary, and
+// otherwise returns immediately. It must be called first thing in main.
+func HelperMain() {
+	process.HelperMain()
+}
+
+// ErrNoHelper is returned by New for a server that runs jobs with
+// LocalExecutor in a program that has not called HelperMain, and reported
+// for jobs with limits or a sandbox that such a program starts.
+var ErrNoHelper = process.ErrNoHelper
+
+// Options are the hooks of a Server. The zero value runs jobs as the
+// ffmpeg-over-ip-server binary does.
+type Options struct {
+	// FFmpegPath and FFprobePath are the binaries for ffmpeg and ffprobe
+	// jobs, unless the config's programs or the job's profile name others.
+	FFmpegPath  string
+	FFprobePath string
+
+	// Authenticator accepts or refuses clients; nil checks their
+	// signatures against the config's authSecret.
+	Authenticator Authenticator
+	// Policy reviews each job before it runs; nil runs jobs as the config
+	// describes them.
+	Policy CommandPolicy
+	// Executor starts the programs of jobs; nil for LocalExecutor.
+	Executor Executor
+
+	// OnSessionStart, if set, is called when a job has started, and
+	// OnSessionEnd once it has ended and the client has its exit code or
+	// is gone. OnSessionResume is called when a client continues a session
+	// on a new connection. They are called on the session's goroutine, so
+	// they should return quickly.
+	OnSessionStart  func(info *SessionInfo)
+	OnSessionEnd    func(info *SessionInfo, exitCode int, err error)
+	OnSessionResume func(info *SessionInfo)
+}
+
+// Server runs the jobs of clients that connect to it. Its methods are safe
+// for concurrent use.
+type Server struct {
+	// cfg is replaced wholesale by SetConfig; each connection uses the
+	// snapshot it loaded when it started.
+	cfg      atomic.Pointer[Config]
+	opts     Options
+	sessions *admin.Registry
+
+	// resumable holds the sessions a client can resume, by token
+	resumableMu sync.Mutex
+	resumable   map[[protocol.TokenLength]byte]*resumableSession
+}
+
+// resumableSession is a session a client can resume, with what
+// OnSessionResume is told about it.
+type resumableSession struct {
+	sess *session.Session
+	info *SessionInfo
+}
+
+// New returns a server that runs jobs as cfg describes. It returns
+// ErrNoHelper if jobs run with LocalExecutor and HelperMain has not been
+// called.
+func New(cfg *Config, opts Options) (*Server, error) {
+	if opts.Executor == nil {
+		opts.Executor = LocalExecutor{}
+	}
+	if _, local := opts.Executor.(LocalExecutor); local && !process.HelperInstalled() {
+		return nil, ErrNoHelper
+	}
+	srv := &Server{
+		opts:      opts,
+		sessions:  admin.NewRegistry(),
+		resumable: make(map[[protocol.TokenLength]byte]*resumableSession),
+	}
+	srv.cfg.Store(cfg)
+	return srv, nil
+}
+
+// Config returns the config new connections use.
+func (srv *Server) Config() *Config {
+	return srv.cfg.Load()
+}
+
+// SetConfig replaces the config for connections accepted from now on.
+// Connections already open keep the one they started with.
+func (srv *Server) SetConfig(cfg *Config) {
+	srv.cfg.Store(cfg)
+}
+
+// Serve accepts connections on l and serves each with ServeConn until ctx
+// is cancelled, or l fails for good. Once ctx is cancelled, it returns nil
+// after the caller closes l.
+func (srv *Server) Serve(ctx context.Context, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil // shutting down
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("accept error: %v", err)
+			continue
+		}
+
+		go srv.ServeConn(ctx, conn)
+	}
+}
+
+// ServeConn serves one client connection, and closes it once the client's
+// job or multiplexed connection is done. Cancelling ctx stops the jobs on
+// it.
+func (srv *Server) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	cfg := srv.cfg.Load()
+
+	// Read command message
+	msg, err := protocol.ReadMessageFrom(conn)
+	if err != nil {
+		log.Printf("failed to read command: %v", err)
+		return
+	}
+	if msg.Type == protocol.MsgResume {
+		srv.resume(ctx, cfg, conn, msg.Payload)
+		return
+	}
+	if msg.Type == protocol.MsgMux {
+		srv.serveMux(ctx, cfg, conn, msg.Payload)
+		return
+	}
+	if msg.Type != protocol.MsgCommand {
+		sendError(conn, fmt.Sprintf("expected command message (0x%02x), got 0x%02x", protocol.MsgCommand, msg.Type))
+		return
+	}
+
+	// Decode command
+	cmd, err := protocol.DecodeCommandMessage(msg.Payload)
+	if err != nil {
+		sendError(conn, fmt.Sprintf("invalid command: %v", err))
+		return
+	}
+
+	// Verify HMAC
+	command := &Command{Program: cmd.Program, Args: cmd.Args, Env: cmd.Env, Profile: cmd.Profile}
+	if !srv.authenticate(cfg, &AuthRequest{
+		RemoteAddr: conn.RemoteAddr(),
+		Command:    command,
+		verify: func(secret string) bool {
+			return auth.Verify(secret, protocol.CurrentVersion, cmd.Nonce, cmd.Signature, cmd.Program, cmd.Args, cmd.Env, cmd.Profile)
+		},
+	}) {
+		sendError(conn, "authentication failed")
+		log.Printf("auth failed from %s", conn.RemoteAddr())
+		return
+	}
+	if srv.sessions.Draining() {
+		sendError(conn, protocol.ErrServerDraining)
+		return
+	}
+
+	srv.runJob(ctx, cfg, conn, command, msg.Payload)
+}
+
+// authenticate reports whether the client that sent req may go on.
+func (srv *Server) authenticate(cfg *Config, req *AuthRequest) bool {
+	if srv.opts.Authenticator == nil {
+		return req.Verify(cfg.AuthSecret)
+	}
+	if err := srv.opts.Authenticator.Authenticate(req); err != nil {
+		log.Printf("authenticator refused %s: %v", req.RemoteAddr, err)
+		return false
+	}
+	return true
+}
+
+// resume continues a session on a new connection from its client, and
+// returns once the session stops using the connection.
+func (srv *Server) resume(ctx context.Context, cfg *Config, conn net.Conn, payload []byte) {
+	req, err := protocol.DecodeResumeMessage(payload)
+	if err != nil {
+		sendError(conn, fmt.Sprintf("invalid resume: %v", err))
+		return
+	}
+	if !srv.authenticate(cfg, &AuthRequest{
+		RemoteAddr: conn.RemoteAddr(),
+		verify: func(secret string) bool {
+			return auth.VerifyResume(secret, protocol.CurrentVersion, req.Token, req.Attempt, req.Received, req.Signature)
+		},
+	}) {
+		sendError(conn, "authentication failed")
+		log.Printf("resume auth failed from %s", conn.RemoteAddr())
+		return
+	}
+
+	srv.resumableMu.Lock()
+	r := srv.resumable[req.Token]
+	srv.resumableMu.Unlock()
+	if r == nil {
+		sendError(conn, protocol.ErrUnknownSession)
+		return
+	}
+	done, err := r.sess.Resume(conn, req.Attempt, req.Received)
+	if err != nil {
+		sendError(conn, fmt.Sprintf("cannot resume: %v", err))
+		return
+	}
+	log.Printf("session resumed (from %s)", conn.RemoteAddr())
+	if srv.opts.OnSessionResume != nil {
+		srv.opts.OnSessionResume(r.info)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// serveMux runs the jobs of a multiplexed connection, each on a stream of
+// its own that is handled like a separate connection, and returns once the
+// connection closes.
+func (srv *Server) serveMux(ctx context.Context, cfg *Config, conn net.Conn, payload []byte) {
+	if _, nested := conn.(*mux.Stream); nested {
+		// Multiplexed connections cannot be nested
+		sendError(conn, protocol.ErrNoMux)
+		return
+	}
+	req, err := protocol.DecodeMuxMessage(payload)
+	if err != nil {
+		sendError(conn, fmt.Sprintf("invalid multiplex request: %v", err))
+		return
+	}
+	if !srv.authenticate(cfg, &AuthRequest{
+		RemoteAddr: conn.RemoteAddr(),
+		verify: func(secret string) bool {
+			return auth.VerifyMux(secret, protocol.CurrentVersion, req.Nonce, req.Signature)
+		},
+	}) {
+		sendError(conn, "authentication failed")
+		log.Printf("multiplex auth failed from %s", conn.RemoteAddr())
+		return
+	}
+	if srv.sessions.Draining() {
+		sendError(conn, protocol.ErrServerDraining)
+		return
+	}
+	if err := protocol.WriteMessageTo(conn, protocol.MsgMuxOk, nil); err != nil {
+		return
+	}
+
+	m := mux.Server(conn)
+	defer m.Close()
+	go m.Keepalive(muxKeepaliveInterval, muxKeepaliveTimeout)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.Close()
+		case <-m.Done():
+		}
+	}()
+	log.Printf("multiplexed connection from %s", conn.RemoteAddr())
+
+	for {
+		stream, err := m.Accept()
+		if err != nil {
+			log.Printf("multiplexed connection from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		go srv.ServeConn(ctx, stream)
+	}
+}
+
+// register makes a started session resumable, if its config allows, and
+// returns the message that tells the client so. unregister undoes it once
+// the session ends.
+func (srv *Server) register(cfg *Config, sess *session.Session, info *SessionInfo) (started *protocol.SessionMessage, unregister func()) {
+	started = &protocol.SessionMessage{GracePeriod: max(time.Duration(cfg.ResumeGracePeriod), 0)}
+	if started.GracePeriod == 0 {
+		return started, func() {}
+	}
+	rand.Read(started.Token[:])
+	sess.EnableResume(started.GracePeriod)
+	srv.resumableMu.Lock()
+	srv.resumable[started.Token] = &resumableSession{sess: sess, info: info}
+	srv.resumableMu.Unlock()
+	return started, func() {
+		srv.resumableMu.Lock()
+		delete(srv.resumable, started.Token)
+		srv.resumableMu.Unlock()
+	}
+}
+
+// Drain stops the server from accepting new jobs and waits for running
+// sessions to finish. Sessions still running after timeout are terminated,
+// and Drain returns once they have exited.
+func (srv *Server) Drain(timeout time.Duration) {
+	srv.sessions.Drain()
+	log.Printf("draining %d session(s), deadline %v", srv.sessions.Len(), timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.sessions.WaitIdle(ctx); err != nil {
+		log.Printf("drain deadline passed, terminating %d session(s)", srv.sessions.Len())
+		srv.sessions.TerminateAll()
+		srv.sessions.WaitIdle(context.Background())
+	}
+	log.Printf("drain complete")
+}
+
+// TerminateAll terminates every running session.
+func (srv *Server) TerminateAll() {
+	srv.sessions.TerminateAll()
+}
+
+// Sessions returns how many sessions are running.
+func (srv *Server) Sessions() int {
+	return srv.sessions.Len()
+}
+
+// AdminHandler returns the admin API for the server's sessions, which
+// requires secret. A drain request through it calls drain, which should
+// call Drain and shut down.
+func (srv *Server) AdminHandler(secret string, drain func()) http.Handler {
+	return admin.NewHandler(srv.sessions, secret, drain)
+}
+
+func sendError(conn net.Conn, msg string) {
+	protocol.WriteMessageTo(conn, protocol.MsgError, []byte(msg))
+}
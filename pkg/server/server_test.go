@@ -0,0 +1,1208 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steelbrain/ffmpeg-over-ip/internal/auth"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/capture"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/config"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/mux"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/process"
+	"github.com/steelbrain/ffmpeg-over-ip/internal/protocol"
+)
+
+func TestMain(m *testing.M) {
+	// Jobs with resource limits re-execute the test binary as the launch
+	// helper, except where TestNewWithoutHelper runs it without one
+	if os.Getenv("SERVER_TEST_WITHOUT_HELPER") == "" {
+		HelperMain()
+	}
+	os.Exit(m.Run())
+}
+
+func TestSendError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errMsg := "something went wrong"
+
+	// Write error from server side in a goroutine to avoid blocking
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendError(server, errMsg)
+	}()
+
+	// Read the message from the client side
+	msg, err := protocol.ReadMessageFrom(client)
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	<-done
+
+	if msg.Type != protocol.MsgError {
+		t.Errorf("message type = 0x%02x, want 0x%02x (MsgError)", msg.Type, protocol.MsgError)
+	}
+
+	if string(msg.Payload) != errMsg {
+		t.Errorf("payload = %q, want %q", string(msg.Payload), errMsg)
+	}
+}
+
+func TestSendErrorEmptyMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendError(server, "")
+	}()
+
+	msg, err := protocol.ReadMessageFrom(client)
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	<-done
+
+	if msg.Type != protocol.MsgError {
+		t.Errorf("message type = 0x%02x, want 0x%02x (MsgError)", msg.Type, protocol.MsgError)
+	}
+
+	if len(msg.Payload) != 0 {
+		t.Errorf("payload length = %d, want 0", len(msg.Payload))
+	}
+}
+
+// readAllMessages reads protocol messages from r until the exit code, EOF
+// or error.
+func readAllMessages(r io.Reader) []*protocol.Message {
+	var msgs []*protocol.Message
+	for {
+		msg, err := protocol.ReadMessageFrom(r)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+		if msg.Type == protocol.MsgExitCode {
+			break
+		}
+	}
+	return msgs
+}
+
+// makeCommandPayload creates a properly encoded CommandMessage payload.
+func makeCommandPayload(secret string, program string, args []string) []byte {
+	return makeCommandPayloadEnv(secret, program, args, nil)
+}
+
+// makeCommandPayloadEnv is makeCommandPayload with environment entries.
+func makeCommandPayloadEnv(secret string, program string, args, env []string) []byte {
+	return makeCommandPayloadProfile(secret, program, args, env, "")
+}
+
+// makeCommandPayloadProfile is makeCommandPayloadEnv with a profile.
+func makeCommandPayloadProfile(secret string, program string, args, env []string, profile string) []byte {
+	nonce := [protocol.NonceLength]byte{1, 2, 3}
+	sig := auth.Sign(secret, protocol.CurrentVersion, nonce, program, args, env, profile)
+	cmd := &protocol.CommandMessage{
+		Nonce:     nonce,
+		Signature: sig,
+		Program:   program,
+		Args:      args,
+		Env:       env,
+		Profile:   profile,
+	}
+	return cmd.Encode()
+}
+
+func TestServeConnBadFirstMessage(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx := context.Background()
+	cfg := &config.ServerConfig{AuthSecret: "test-secret"}
+
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(ctx, serverConn)
+
+	// Send a MsgPing instead of MsgCommand
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgPing, nil); err != nil {
+		t.Fatalf("failed to write ping: %v", err)
+	}
+
+	msgs := readAllMessages(clientConn)
+	if len(msgs) == 0 {
+		t.Fatal("expected at least one response message, got none")
+	}
+
+	msg := msgs[0]
+	if msg.Type != protocol.MsgError {
+		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	}
+	if !strings.Contains(string(msg.Payload), "expected command") {
+		t.Errorf("error message %q does not contain %q", string(msg.Payload), "expected command")
+	}
+}
+
+func TestServeConnInvalidCommand(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx := context.Background()
+	cfg := &config.ServerConfig{AuthSecret: "test-secret"}
+
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(ctx, serverConn)
+
+	// Send a MsgCommand with a 1-byte payload (too short to decode)
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, []byte{0x01}); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	msgs := readAllMessages(clientConn)
+	if len(msgs) == 0 {
+		t.Fatal("expected at least one response message, got none")
+	}
+
+	msg := msgs[0]
+	if msg.Type != protocol.MsgError {
+		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	}
+	if !strings.Contains(string(msg.Payload), "invalid command") {
+		t.Errorf("error message %q does not contain %q", string(msg.Payload), "invalid command")
+	}
+}
+
+func TestServeConnAuthFailure(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx := context.Background()
+	cfg := &config.ServerConfig{AuthSecret: "correct-secret"}
+
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(ctx, serverConn)
+
+	// Sign with wrong secret
+	payload := makeCommandPayload("wrong-secret", protocol.ProgramFFmpeg, []string{"-version"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	msgs := readAllMessages(clientConn)
+	if len(msgs) == 0 {
+		t.Fatal("expected at least one response message, got none")
+	}
+
+	msg := msgs[0]
+	if msg.Type != protocol.MsgError {
+		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	}
+	if !strings.Contains(string(msg.Payload), "authentication failed") {
+		t.Errorf("error message %q does not contain %q", string(msg.Payload), "authentication failed")
+	}
+}
+
+func TestServeConnUnknownProgram(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx := context.Background()
+	secret := "test-secret"
+	cfg := &config.ServerConfig{AuthSecret: secret}
+
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(ctx, serverConn)
+
+	// Sign with correct secret but a program that is not registered
+	payload := makeCommandPayload(secret, "x264", []string{"-version"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	msgs := readAllMessages(clientConn)
+	if len(msgs) == 0 {
+		t.Fatal("expected at least one response message, got none")
+	}
+
+	msg := msgs[0]
+	if msg.Type != protocol.MsgError {
+		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	}
+	if !strings.Contains(string(msg.Payload), "unknown program") {
+		t.Errorf("error message %q does not contain %q", string(msg.Payload), "unknown program")
+	}
+}
+
+func TestServeConnSuccess(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx := context.Background()
+	secret := "test-secret"
+	cfg := &config.ServerConfig{AuthSecret: secret}
+
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(ctx, serverConn)
+
+	// Send a valid command that runs "echo -version" (echo will just print "-version")
+	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"-version"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	// Read all messages with a timeout
+	type result struct {
+		msgs []*protocol.Message
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ch <- result{msgs: readAllMessages(clientConn)}
+	}()
+
+	var msgs []*protocol.Message
+	select {
+	case r := <-ch:
+		msgs = r.msgs
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for response messages")
+	}
+
+	if len(msgs) == 0 {
+		t.Fatal("expected at least one response message, got none")
+	}
+
+	// We should see at least stdout output and an exit code
+	var gotStdout bool
+	var gotExitCode bool
+	var exitCode int
+
+	for _, msg := range msgs {
+		switch msg.Type {
+		case protocol.MsgStdout:
+			gotStdout = true
+			if !strings.Contains(string(msg.Payload), "-version") {
+				t.Errorf("stdout %q does not contain %q", string(msg.Payload), "-version")
+			}
+		case protocol.MsgExitCode:
+			gotExitCode = true
+			if len(msg.Payload) >= 4 {
+				exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+			}
+		}
+	}
+
+	if !gotStdout {
+		t.Error("expected MsgStdout in response, got none")
+	}
+	if !gotExitCode {
+		t.Error("expected MsgExitCode in response, got none")
+	}
+	if gotExitCode && exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", exitCode)
+	}
+}
+
+func TestServeConnProcessNotFound(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx := context.Background()
+	secret := "test-secret"
+	cfg := &config.ServerConfig{AuthSecret: secret}
+
+	// Use a nonexistent binary path
+	go testServer(cfg, "/nonexistent/binary/ffmpeg", "/nonexistent/binary/ffprobe").ServeConn(ctx, serverConn)
+
+	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"-version"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	// Read all messages with a timeout
+	type result struct {
+		msgs []*protocol.Message
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ch <- result{msgs: readAllMessages(clientConn)}
+	}()
+
+	var msgs []*protocol.Message
+	select {
+	case r := <-ch:
+		msgs = r.msgs
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for response messages")
+	}
+
+	if len(msgs) == 0 {
+		t.Fatal("expected at least one response message, got none")
+	}
+
+	msg := msgs[0]
+	if msg.Type != protocol.MsgError {
+		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msg.Type)
+	}
+}
+
+func TestServeConnDraining(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	secret := "test-secret"
+	srv := testServer(&config.ServerConfig{AuthSecret: secret}, "/bin/echo", "/bin/echo")
+	srv.sessions.Drain()
+
+	go srv.ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"-version"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	msgs := readAllMessages(clientConn)
+	if len(msgs) != 1 {
+		t.Fatalf("expected exactly one message, got %d", len(msgs))
+	}
+	if msgs[0].Type != protocol.MsgError {
+		t.Fatalf("expected MsgError (0x%02x), got 0x%02x", protocol.MsgError, msgs[0].Type)
+	}
+	if string(msgs[0].Payload) != protocol.ErrServerDraining {
+		t.Errorf("error message = %q, want %q", string(msgs[0].Payload), protocol.ErrServerDraining)
+	}
+
+	// Only authenticated clients learn that the server is draining
+	if _, _, errMsg := runCommand(t, srv, makeCommandPayload("wrong", protocol.ProgramFFmpeg, []string{"-version"})); errMsg != "authentication failed" {
+		t.Errorf("unauthenticated error = %q, want authentication failed", errMsg)
+	}
+}
+
+func TestDrainWaitsForSessions(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	secret := "test-secret"
+	srv := testServer(&config.ServerConfig{AuthSecret: secret}, "/bin/sh", "/bin/sh")
+
+	go srv.ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"-c", "sleep 0.5; echo finished"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	msgsCh := make(chan []*protocol.Message, 1)
+	go func() { msgsCh <- readAllMessages(clientConn) }()
+
+	// Wait for the session to register
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.sessions.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	srv.Drain(30 * time.Second)
+	if srv.sessions.Len() != 0 {
+		t.Fatalf("drain returned with %d session(s) running", srv.sessions.Len())
+	}
+
+	msgs := <-msgsCh
+	var stdout string
+	exitCode := -1
+	for _, msg := range msgs {
+		switch msg.Type {
+		case protocol.MsgStdout:
+			stdout += string(msg.Payload)
+		case protocol.MsgExitCode:
+			exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+		}
+	}
+	if !strings.Contains(stdout, "finished") {
+		t.Errorf("stdout = %q, want job to run to completion", stdout)
+	}
+	if exitCode != 0 {
+		t.Errorf("exit code = %d, want 0", exitCode)
+	}
+}
+
+func TestDrainWhileJobStarts(t *testing.T) {
+	// The job has passed the draining check and is starting when the drain
+	// begins, and finds no sessions to wait for
+	marker := filepath.Join(t.TempDir(), "ran")
+	starting := make(chan struct{})
+	drained := make(chan struct{})
+	srv := mustNew(&config.ServerConfig{AuthSecret: "secret"}, Options{
+		FFmpegPath: "/bin/sh",
+		Executor: executorFunc(func(ctx context.Context, job *Job) (Process, error) {
+			close(starting)
+			<-drained
+			return LocalExecutor{}.Start(ctx, job)
+		}),
+	})
+	go func() {
+		<-starting
+		srv.Drain(time.Second)
+		close(drained)
+	}()
+
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "sleep 0.3; touch " + marker})
+	_, exitCode, errMsg := runCommand(t, srv, payload)
+	if errMsg != protocol.ErrServerDraining || exitCode != -1 {
+		t.Errorf("error = %q, exit code %d; want the job refused as draining", errMsg, exitCode)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the job ran after the drain completed")
+	}
+}
+
+func TestDrainTerminatesAfterDeadline(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	secret := "test-secret"
+	srv := testServer(&config.ServerConfig{AuthSecret: secret}, "/bin/sleep", "/bin/sleep")
+
+	go srv.ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayload(secret, protocol.ProgramFFmpeg, []string{"3600"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	msgsCh := make(chan []*protocol.Message, 1)
+	go func() { msgsCh <- readAllMessages(clientConn) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.sessions.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.Drain(100 * time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("drain did not return after deadline")
+	}
+
+	exitCode := -1
+	for _, msg := range <-msgsCh {
+		if msg.Type == protocol.MsgExitCode {
+			exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+		}
+	}
+	if exitCode != 128+15 {
+		t.Errorf("exit code = %d, want %d (SIGTERM)", exitCode, 128+15)
+	}
+}
+
+// testServer returns a server with the default hooks that runs ffmpeg and
+// ffprobe jobs with the given binaries.
+func testServer(cfg *Config, ffmpegPath, ffprobePath string) *Server {
+	return mustNew(cfg, Options{FFmpegPath: ffmpegPath, FFprobePath: ffprobePath})
+}
+
+// mustNew is New for tests, where it cannot fail: TestMain calls
+// HelperMain.
+func mustNew(cfg *Config, opts Options) *Server {
+	srv, err := New(cfg, opts)
+	if err != nil {
+		panic(err)
+	}
+	return srv
+}
+
+func writeConfig(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewWithoutHelper(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the launch helper is only used on Linux")
+	}
+	if os.Getenv("SERVER_TEST_WITHOUT_HELPER") != "" {
+		if _, err := New(&Config{}, Options{}); !errors.Is(err, ErrNoHelper) {
+			t.Errorf("New error = %v, want ErrNoHelper", err)
+		}
+		// Other executors may not need the helper
+		if _, err := New(&Config{}, Options{Executor: executorFunc(nil)}); err != nil {
+			t.Errorf("New with an executor of its own: %v", err)
+		}
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestNewWithoutHelper$")
+	cmd.Env = append(os.Environ(), "SERVER_TEST_WITHOUT_HELPER=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("without HelperMain: %v\n%s", err, out)
+	}
+}
+
+func TestSetConfigAppliesToNewConnections(t *testing.T) {
+	srv := testServer(&Config{AuthSecret: "old-secret"}, "/bin/echo", "/bin/echo")
+	srv.SetConfig(&Config{AuthSecret: "new-secret"})
+
+	for _, tt := range []struct {
+		secret   string
+		wantAuth bool
+	}{
+		{"old-secret", false},
+		{"new-secret", true},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go srv.ServeConn(context.Background(), serverConn)
+
+		payload := makeCommandPayload(tt.secret, protocol.ProgramFFmpeg, []string{"-version"})
+		if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+			t.Fatalf("failed to write command: %v", err)
+		}
+		msgs := readAllMessages(clientConn)
+		clientConn.Close()
+		if len(msgs) == 0 {
+			t.Fatalf("%s: no response", tt.secret)
+		}
+		authFailed := msgs[0].Type == protocol.MsgError && strings.Contains(string(msgs[0].Payload), "authentication failed")
+		if authFailed == tt.wantAuth {
+			t.Errorf("%s: authFailed = %v, want %v", tt.secret, authFailed, !tt.wantAuth)
+		}
+	}
+}
+
+func TestServeConnFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.jsonc")
+	writeConfig(t, path, `{
+		"address": "127.0.0.1:5050",
+		"authSecret": "secret",
+		"fallback": {
+			"patterns": ["No NVENC capable devices"],
+			"rewrites": [{"match": "^h264_nvenc$", "replace": "libx264"}]
+		}
+	}`)
+	cfg, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+
+	// Stands in for ffmpeg: fails with the NVENC error unless the encoder
+	// argument has been rewritten
+	script := `if [ "$0" = h264_nvenc ]; then echo "No NVENC capable devices found" >&2; exit 1; fi; echo "encoded with $0"`
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", script, "h264_nvenc"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	var stdout string
+	exitCode := -1
+	for _, msg := range readAllMessages(clientConn) {
+		switch msg.Type {
+		case protocol.MsgStdout:
+			stdout += string(msg.Payload)
+		case protocol.MsgExitCode:
+			exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+		}
+	}
+	if exitCode != 0 {
+		t.Errorf("exit code = %d, want 0", exitCode)
+	}
+	if stdout != "encoded with libx264\n" {
+		t.Errorf("stdout = %q, want %q", stdout, "encoded with libx264\n")
+	}
+}
+
+func TestServeConnConfigBuiltInGo(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AuthSecret = "secret"
+	encoder := "libx264"
+	rule := RewriteRule{Match: "^h264_nvenc$", Replace: &encoder}
+	if err := rule.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Rewrites = []RewriteRule{rule, RewritePair("slow", "fast")}
+	cfg.Limits["ffmpeg"] = ProgramLimits{MaxRuntime: Duration(10 * time.Second)}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", `echo "$0 $1"`, "h264_nvenc", "slow"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	var stdout string
+	for _, msg := range readAllMessages(clientConn) {
+		if msg.Type == protocol.MsgStdout {
+			stdout += string(msg.Payload)
+		}
+	}
+	if stdout != "libx264 fast\n" {
+		t.Errorf("stdout = %q, want %q", stdout, "libx264 fast\n")
+	}
+}
+
+func TestServeConnLimits(t *testing.T) {
+	cfg := &config.ServerConfig{
+		AuthSecret: "secret",
+		Limits: map[string]config.ProgramLimits{
+			"ffmpeg":  {MaxRuntime: config.Duration(200 * time.Millisecond)},
+			"ffprobe": {},
+		},
+	}
+	srv := testServer(cfg, "/bin/sh", "/bin/sh")
+
+	for _, tt := range []struct {
+		program    string
+		wantReason bool
+	}{
+		{protocol.ProgramFFmpeg, true},
+		{protocol.ProgramFFprobe, false},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go srv.ServeConn(context.Background(), serverConn)
+
+		payload := makeCommandPayload("secret", tt.program, []string{"-c", "exec sleep 1"})
+		if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+			t.Fatalf("failed to write command: %v", err)
+		}
+		var reason *protocol.ExitReasonMessage
+		for _, msg := range readAllMessages(clientConn) {
+			if msg.Type == protocol.MsgExitReason {
+				reason, _ = protocol.DecodeExitReasonMessage(msg.Payload)
+			}
+		}
+		clientConn.Close()
+
+		if tt.wantReason && (reason == nil || reason.Reason != protocol.ExitReasonTimeout) {
+			t.Errorf("program 0x%02x: exit reason = %+v, want timeout", tt.program, reason)
+		}
+		if !tt.wantReason && reason != nil {
+			t.Errorf("program 0x%02x: unexpected exit reason %+v", tt.program, reason)
+		}
+	}
+}
+
+func TestServeConnResourceLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only enforced on linux")
+	}
+	nice := 5
+	cfg := &config.ServerConfig{
+		AuthSecret: "secret",
+		Limits: map[string]config.ProgramLimits{
+			"ffmpeg": {OpenFiles: 100, Nice: &nice},
+		},
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "ulimit -n; cut -d' ' -f19 /proc/self/stat"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	var stdout string
+	for _, msg := range readAllMessages(clientConn) {
+		if msg.Type == protocol.MsgStdout {
+			stdout += string(msg.Payload)
+		}
+	}
+	if stdout != "100\n5\n" {
+		t.Errorf("stdout = %q, want open files 100 and nice 5", stdout)
+	}
+}
+
+func TestServeConnSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("sandbox requires root on linux")
+	}
+	cfg := &config.ServerConfig{
+		AuthSecret: "secret",
+		Sandbox:    &config.SandboxConfig{UID: 65534, GID: 65534, Paths: []string{"/bin", "/usr/bin"}},
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "id -u; test -e /etc/passwd || echo hidden"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	var stdout string
+	for _, msg := range readAllMessages(clientConn) {
+		if msg.Type == protocol.MsgStdout {
+			stdout += string(msg.Payload)
+		}
+	}
+	if stdout != "65534\nhidden\n" {
+		t.Errorf("stdout = %q, want uid 65534 and /etc hidden", stdout)
+	}
+}
+
+func TestServeConnEnv(t *testing.T) {
+	cfg := &config.ServerConfig{AuthSecret: "secret", EnvAllowlist: []string{"TZ", "LC_*"}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+
+	args := []string{"-c", `echo "$TZ|$LC_ALL|$LD_PRELOAD"`}
+	env := []string{"TZ=Europe/Berlin", "LC_ALL=de_DE.UTF-8", "LD_PRELOAD=/tmp/evil.so"}
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, makeCommandPayloadEnv("secret", protocol.ProgramFFmpeg, args, env)); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	var stdout string
+	for _, msg := range readAllMessages(clientConn) {
+		if msg.Type == protocol.MsgStdout {
+			stdout += string(msg.Payload)
+		}
+	}
+	if stdout != "Europe/Berlin|de_DE.UTF-8|\n" {
+		t.Errorf("stdout = %q, want allowed variables only", stdout)
+	}
+}
+
+func TestServeConnEnvServerVariables(t *testing.T) {
+	// An allowlist that matches everything, as an embedder could set without
+	// the config file's checks
+	cfg := &config.ServerConfig{AuthSecret: "secret", EnvAllowlist: []string{"*"}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+
+	args := []string{"-c", `echo "$TZ|${FFOIP_FD-unset}|${FFMPEG_OVER_IP_SERVER_AUTH_SECRET-unset}"`}
+	env := []string{"TZ=UTC", "FFOIP_FD=0", "FFMPEG_OVER_IP_SERVER_AUTH_SECRET=x"}
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, makeCommandPayloadEnv("secret", protocol.ProgramFFmpeg, args, env)); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	var stdout string
+	for _, msg := range readAllMessages(clientConn) {
+		if msg.Type == protocol.MsgStdout {
+			stdout += string(msg.Payload)
+		}
+	}
+	if stdout != "UTC|unset|unset\n" {
+		t.Errorf("stdout = %q, want the server's own variables unset", stdout)
+	}
+}
+
+func TestServeConnEnvTampered(t *testing.T) {
+	cfg := &config.ServerConfig{AuthSecret: "secret", EnvAllowlist: []string{"TZ"}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(context.Background(), serverConn)
+
+	// Signed without env, then env added in transit
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"hi"})
+	cmd, _ := protocol.DecodeCommandMessage(payload)
+	cmd.Env = []string{"TZ=UTC"}
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, cmd.Encode()); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	msg, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if msg.Type != protocol.MsgError || string(msg.Payload) != "authentication failed" {
+		t.Errorf("got type 0x%02x %q, want authentication failed", msg.Type, msg.Payload)
+	}
+}
+
+func TestServeConnProgramRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.jsonc")
+	writeConfig(t, path, `{
+		"address": "127.0.0.1:5050",
+		"authSecret": "secret",
+		"programs": {
+			"ffmpeg-av1": {"path": "/bin/echo", "args": ["av1"]},
+			"ffmpeg": {"args": ["-hide_banner"]}
+		},
+		"rewrites": [{"match": "^libx264$", "replace": "libsvtav1", "program": "ffmpeg-av1"}]
+	}`)
+	cfg, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		program string
+		want    string
+	}{
+		{"ffmpeg-av1", "av1 -c:v libsvtav1\n"},
+		{"ffmpeg", "-hide_banner -c:v libx264\n"},
+		{"ffmpeg-over-ip-client", "-hide_banner -c:v libx264\n"},
+		{"ffprobe", "-c:v libx264\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.program, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(context.Background(), serverConn)
+
+			payload := makeCommandPayload("secret", tt.program, []string{"-c:v", "libx264"})
+			if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+				t.Fatalf("failed to write command: %v", err)
+			}
+			var stdout string
+			for _, msg := range readAllMessages(clientConn) {
+				if msg.Type == protocol.MsgStdout {
+					stdout += string(msg.Payload)
+				}
+			}
+			if stdout != tt.want {
+				t.Errorf("stdout = %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeConnProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.jsonc")
+	writeConfig(t, path, `{
+		"address": "127.0.0.1:5050",
+		"authSecret": "secret",
+		"envAllowlist": ["TZ", "PROFILE"],
+		"rewrites": [["libx264", "h264_nvenc"]],
+		"profiles": {
+			"beta": {
+				"path": "/bin/sh",
+				"rewrites": [["h264_nvenc", "h264_qsv"]],
+				"env": ["PROFILE=beta"]
+			}
+		}
+	}`)
+	cfg, err := config.LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-c", `echo "$0 $TZ $PROFILE"`, "libx264"}
+	env := []string{"TZ=UTC", "PROFILE=client"}
+
+	tests := []struct {
+		profile string
+		want    string
+	}{
+		// /bin/echo prints its arguments; the profile's /bin/sh runs them
+		{"", "-c echo \"$0 $TZ $PROFILE\" h264_nvenc\n"},
+		{"beta", "h264_qsv UTC beta\n"},
+	}
+	for _, tt := range tests {
+		t.Run("profile="+tt.profile, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(context.Background(), serverConn)
+
+			payload := makeCommandPayloadProfile("secret", protocol.ProgramFFmpeg, args, env, tt.profile)
+			if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+				t.Fatalf("failed to write command: %v", err)
+			}
+			var stdout string
+			for _, msg := range readAllMessages(clientConn) {
+				if msg.Type == protocol.MsgStdout {
+					stdout += string(msg.Payload)
+				}
+			}
+			if stdout != tt.want {
+				t.Errorf("stdout = %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeConnUnknownProfile(t *testing.T) {
+	cfg := &config.ServerConfig{AuthSecret: "secret"}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go testServer(cfg, "/bin/echo", "/bin/echo").ServeConn(context.Background(), serverConn)
+
+	payload := makeCommandPayloadProfile("secret", protocol.ProgramFFmpeg, []string{"-version"}, nil, "beta")
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	msg, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if msg.Type != protocol.MsgError || !strings.Contains(string(msg.Payload), "unknown profile") {
+		t.Errorf("got type 0x%02x %q, want unknown profile error", msg.Type, msg.Payload)
+	}
+}
+
+// sendResume opens a new connection to srv and asks it to resume a
+// session, returning the connection and the server's reply.
+func sendResume(t *testing.T, srv *Server, secret string, token [protocol.TokenLength]byte, attempt uint32) (net.Conn, *protocol.Message) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go srv.ServeConn(context.Background(), serverConn)
+
+	req := &protocol.ResumeMessage{Token: token, Attempt: attempt}
+	req.Signature = auth.SignResume(secret, protocol.CurrentVersion, token, attempt, 0)
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgResume, req.Encode()); err != nil {
+		t.Fatalf("failed to write resume: %v", err)
+	}
+	reply, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read resume reply: %v", err)
+	}
+	return clientConn, reply
+}
+
+func TestServeConnResume(t *testing.T) {
+	cfg := &config.ServerConfig{AuthSecret: "secret", ResumeGracePeriod: config.Duration(10 * time.Second)}
+	srv := testServer(cfg, "/bin/sh", "/bin/sh")
+
+	clientConn, serverConn := net.Pipe()
+	go srv.ServeConn(context.Background(), serverConn)
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", `read line; echo "got $line"`})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	msg, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil || msg.Type != protocol.MsgSession {
+		t.Fatalf("expected MsgSession, got %v, %v", msg, err)
+	}
+	started, err := protocol.DecodeSessionMessage(msg.Payload)
+	if err != nil || started.GracePeriod != 10*time.Second {
+		t.Fatalf("session message %+v, %v", started, err)
+	}
+
+	// The connection breaks while the job waits for input
+	clientConn.Close()
+
+	if _, reply := sendResume(t, srv, "wrong", started.Token, 1); reply.Type != protocol.MsgError || string(reply.Payload) != "authentication failed" {
+		t.Errorf("resume with wrong secret: got 0x%02x %q", reply.Type, reply.Payload)
+	}
+	if _, reply := sendResume(t, srv, "secret", [protocol.TokenLength]byte{1}, 1); reply.Type != protocol.MsgError || string(reply.Payload) != protocol.ErrUnknownSession {
+		t.Errorf("resume with unknown token: got 0x%02x %q", reply.Type, reply.Payload)
+	}
+
+	conn, reply := sendResume(t, srv, "secret", started.Token, 1)
+	if reply.Type != protocol.MsgResumeOk {
+		t.Fatalf("resume: got 0x%02x %q, want MsgResumeOk", reply.Type, reply.Payload)
+	}
+	if _, reply := sendResume(t, srv, "secret", started.Token, 1); reply.Type != protocol.MsgError || !strings.Contains(string(reply.Payload), "stale resume attempt") {
+		t.Errorf("replayed resume: got 0x%02x %q", reply.Type, reply.Payload)
+	}
+
+	// The job continues on the new connection
+	protocol.WriteMessageTo(conn, protocol.MsgStdin, []byte("hello\n"))
+	protocol.WriteMessageTo(conn, protocol.MsgStdinClose, nil)
+	var stdout string
+	exitCode := -1
+	for _, msg := range readAllMessages(conn) {
+		switch msg.Type {
+		case protocol.MsgStdout:
+			stdout += string(msg.Payload)
+		case protocol.MsgExitCode:
+			exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+		}
+	}
+	if stdout != "got hello\n" || exitCode != 0 {
+		t.Errorf("stdout = %q, exit code = %d; want %q, 0", stdout, exitCode, "got hello\n")
+	}
+}
+
+func TestServeConnResumeDisabled(t *testing.T) {
+	cfg := &config.ServerConfig{AuthSecret: "secret"}
+	srv := testServer(cfg, "/bin/echo", "/bin/echo")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go srv.ServeConn(context.Background(), serverConn)
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-version"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	msgs := readAllMessages(clientConn)
+	if len(msgs) == 0 || msgs[0].Type != protocol.MsgSession {
+		t.Fatal("expected MsgSession first")
+	}
+	started, err := protocol.DecodeSessionMessage(msgs[0].Payload)
+	if err != nil || started.GracePeriod != 0 {
+		t.Errorf("session message %+v, %v; want no grace period", started, err)
+	}
+}
+
+// openMux opens a multiplexed connection to srv.
+func openMux(t *testing.T, srv *Server, secret string) (*mux.Conn, *protocol.Message) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go srv.ServeConn(context.Background(), serverConn)
+
+	req := &protocol.MuxMessage{Nonce: [protocol.NonceLength]byte{4, 5, 6}}
+	req.Signature = auth.SignMux(secret, protocol.CurrentVersion, req.Nonce)
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgMux, req.Encode()); err != nil {
+		t.Fatalf("failed to write multiplex request: %v", err)
+	}
+	reply, err := protocol.ReadMessageFrom(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read multiplex reply: %v", err)
+	}
+	if reply.Type != protocol.MsgMuxOk {
+		return nil, reply
+	}
+	m := mux.Client(clientConn)
+	t.Cleanup(func() { m.Close() })
+	return m, reply
+}
+
+func TestServeConnMux(t *testing.T) {
+	srv := testServer(&config.ServerConfig{AuthSecret: "secret"}, "/bin/sh", "/bin/sh")
+
+	if _, reply := openMux(t, srv, "wrong"); reply.Type != protocol.MsgError || string(reply.Payload) != "authentication failed" {
+		t.Errorf("multiplex with wrong secret: got 0x%02x %q", reply.Type, reply.Payload)
+	}
+
+	m, _ := openMux(t, srv, "secret")
+	if m == nil {
+		t.Fatal("multiplexed connection refused")
+	}
+
+	// Jobs run concurrently, each on its own stream and signed as usual
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := m.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", fmt.Sprintf("sleep 0.2; echo job %d; exit %d", i, i)})
+			if err := protocol.WriteMessageTo(stream, protocol.MsgCommand, payload); err != nil {
+				t.Error(err)
+				return
+			}
+			var stdout string
+			exitCode := -1
+			for _, msg := range readAllMessages(stream) {
+				switch msg.Type {
+				case protocol.MsgStdout:
+					stdout += string(msg.Payload)
+				case protocol.MsgExitCode:
+					exitCode = int(binary.BigEndian.Uint32(msg.Payload))
+				}
+			}
+			if want := fmt.Sprintf("job %d\n", i); stdout != want || exitCode != i {
+				t.Errorf("stream %d: stdout = %q, exit code = %d; want %q, %d", stream.ID(), stdout, exitCode, want, i)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for jobs")
+	}
+
+	// A stream cannot start another multiplexed connection
+	stream, _ := m.Open()
+	req := &protocol.MuxMessage{}
+	req.Signature = auth.SignMux("secret", protocol.CurrentVersion, req.Nonce)
+	protocol.WriteMessageTo(stream, protocol.MsgMux, req.Encode())
+	if reply, err := protocol.ReadMessageFrom(stream); err != nil || reply.Type != protocol.MsgError {
+		t.Errorf("nested multiplex request: got %v, %v; want an error", reply, err)
+	}
+}
+
+func TestProcessLimits(t *testing.T) {
+	nice := -5
+	got := processLimits(config.ProgramLimits{
+		AddressSpace: 1 << 30,
+		CPUTime:      config.Duration(time.Minute),
+		Nice:         &nice,
+		IOPriority:   &config.IOPriority{Class: "idle"},
+		Cgroup:       &config.CgroupConfig{Parent: "/sys/fs/cgroup/ffoip", Memory: 2 << 30, CPUs: 2},
+	})
+	if got.AddressSpace != 1<<30 || got.CPUTime != time.Minute || got.Nice == nil || *got.Nice != -5 {
+		t.Errorf("limits = %+v", got)
+	}
+	if got.IOPriority == nil || got.IOPriority.Class != process.IOClassIdle {
+		t.Errorf("IOPriority = %+v", got.IOPriority)
+	}
+	if got.Cgroup == nil || got.Cgroup.MemoryMax != 2<<30 || got.Cgroup.CPUs != 2 {
+		t.Errorf("Cgroup = %+v", got.Cgroup)
+	}
+}
+
+func TestServeConnCaptureAll(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.ServerConfig{AuthSecret: "secret", Capture: &config.CaptureConfig{Dir: dir, All: true}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		testServer(cfg, "/bin/sh", "/bin/sh").ServeConn(context.Background(), serverConn)
+		close(done)
+	}()
+
+	payload := makeCommandPayload("secret", protocol.ProgramFFmpeg, []string{"-c", "echo captured"})
+	if err := protocol.WriteMessageTo(clientConn, protocol.MsgCommand, payload); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+	readAllMessages(clientConn)
+	<-done
+
+	files, _ := filepath.Glob(filepath.Join(dir, "ffmpeg-*.ffcap"))
+	if len(files) != 1 {
+		t.Fatalf("captures = %v, want one", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var trace strings.Builder
+	if err := capture.Inspect(&trace, f); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"C->S  Command      ffmpeg -c \"echo captured\"",
+		"S->C  Session      not resumable",
+		`S->C  Stdout       9 bytes`,
+		"S->C  ExitCode     code 0",
+	} {
+		if !strings.Contains(trace.String(), want) {
+			t.Errorf("trace is missing %q:\n%s", want, trace.String())
+		}
+	}
+}